@@ -16,23 +16,52 @@ package controller
 
 import (
 	"strings"
+	"sync"
 )
 
-//ConvertToMapStringW removes prefixes in annotation
+// Annotation prefixes of --annotation-prefix in priority order, set when controller starts
+var annotationPrefixes []string
+
+// Annotations using a deprecated prefix, a warning is logged once for each of them
+var deprecatedAnnotations sync.Map
+
+//ConvertToMapStringW removes prefixes in annotation.
+//When the same annotation has several prefixes, the one of --annotation-prefix
+//listed first wins, then annotations without prefix and then other prefixes.
 func ConvertToMapStringW(annotations map[string]string) MapStringW {
 	newAnnotations := make(MapStringW, len(annotations))
+	priorities := make(map[string]int, len(annotations))
 	for name, value := range annotations {
-		newAnnotations[convertAnnotationName(name)] = &StringW{
+		key, priority := convertAnnotationName(name)
+		if current, ok := priorities[key]; ok && current <= priority {
+			continue
+		}
+		priorities[key] = priority
+		newAnnotations[key] = &StringW{
 			Value:  value,
 			Status: ADDED,
 		}
+		if priority > 0 && priority < len(annotationPrefixes) {
+			if _, warned := deprecatedAnnotations.LoadOrStore(name, struct{}{}); !warned {
+				logger.Warningf("annotation '%s' uses deprecated prefix, use '%s/%s' instead", name, annotationPrefixes[0], key)
+			}
+		}
 	}
 	return newAnnotations
 }
 
-func convertAnnotationName(annotation string) string {
+// Return annotation name without prefix and priority of its prefix, lower is preferred
+func convertAnnotationName(annotation string) (name string, priority int) {
 	split := strings.SplitN(annotation, "/", 2)
-	return split[len(split)-1]
+	if len(split) == 1 {
+		return annotation, len(annotationPrefixes)
+	}
+	for i, prefix := range annotationPrefixes {
+		if split[0] == prefix {
+			return split[1], i
+		}
+	}
+	return split[1], len(annotationPrefixes) + 1
 }
 
 //GetValueFromAnnotations returns value by checking in multiple annotatins.
@@ -119,6 +148,74 @@ func GetValueFromAnnotations(annotationName string, annotations ...MapStringW) (
 	return data, nil
 }
 
+// Backend-scoped annotations configure a backend or its servers, they are read on the
+// Service first, then on the Ingress and then on the ConfigMap, so services shared by
+// several ingresses are configured once. Other ingress annotations configure frontends
+// and are only read on Ingress and ConfigMap. blue-green-balance and scale-server-slots
+// are read on Service only (and ConfigMap), they don't depend on ingresses.
+// false: ConfigMap value is not a default of backends, it is set in defaults section or
+// would apply to every backend.
+var backendScopedAnnotations = map[string]bool{
+	"abortonclose":           true,
+	"agent-addr":             true,
+	"agent-check":            true,
+	"agent-inter":            true,
+	"agent-port":             true,
+	"backend-config-snippet": false,
+	"backend-maxqueue":       false,
+	"check":                  true,
+	"check-http":             true,
+	"check-interval":         true,
+	"compression-algo":       false,
+	"compression-types":      false,
+	"cookie-domain":          true,
+	"cookie-dynamic":         true,
+	"cookie-httponly":        true,
+	"cookie-indirect":        true,
+	"cookie-maxidle":         true,
+	"cookie-maxlife":         true,
+	"cookie-nocache":         true,
+	"cookie-persistence":     true,
+	"cookie-postonly":        true,
+	"cookie-preserve":        true,
+	"cookie-secure":          true,
+	"cookie-type":            true,
+	"errorfiles":             false,
+	"forwarded-for":          true,
+	"http-connection-mode":   false,
+	"load-balance":           true,
+	"mirror-percent":         false,
+	"no-endpoints-page":      true,
+	"option-redispatch":      true,
+	"path-rewrite":           true,
+	"pod-maxconn":            false,
+	"request-mirror":         false,
+	"retries":                true,
+	"retry-on":               true,
+	"scale-from-zero":        true,
+	"scale-from-zero-target": false,
+	"send-proxy-protocol":    true,
+	"server-ssl":             true,
+	"set-host":               true,
+	"slowstart":              true,
+	"ssl-passthrough":        true,
+	"timeout-check":          true,
+	"timeout-queue":          true,
+}
+
+// Return value of an annotation for the backend of service, with Service > Ingress > ConfigMap
+// precedence for backend-scoped annotations and Ingress > ConfigMap for other ones.
+func (c *HAProxyController) backendAnnotation(name string, ingress *Ingress, service *Service) (data *StringW, err error) {
+	configMap, ok := backendScopedAnnotations[name]
+	if !ok {
+		return GetValueFromAnnotations(name, ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	}
+	if !configMap {
+		return GetValueFromAnnotations(name, service.Annotations, ingress.Annotations)
+	}
+	return GetValueFromAnnotations(name, service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
+}
+
 func SetDefaultAnnotation(annotation, value string) {
 	defaultAnnotationValues[annotation] = &StringW{
 		Value:  value,
@@ -127,25 +224,61 @@ func SetDefaultAnnotation(annotation, value string) {
 }
 
 var defaultAnnotationValues = MapStringW{
+	"blacklist-status-code":   &StringW{Value: "403"},
 	"check":                   &StringW{Value: "true"},
+	"conn-limit-size":         &StringW{Value: "100k"},
+	"conn-rate-period":        &StringW{Value: "1s"},
 	"cookie-indirect":         &StringW{Value: "true"},
 	"cookie-nocache":          &StringW{Value: "true"},
 	"cookie-type":             &StringW{Value: "insert"},
+	"cors-allow-methods":      &StringW{Value: "GET,POST,PUT,DELETE,PATCH,OPTIONS"},
+	"cors-allow-origin":       &StringW{Value: "*"},
+	"cors-enable":             &StringW{Value: "false"},
+	"dontlog-normal":          &StringW{Value: "false"},
+	"dontlognull":             &StringW{Value: "true"},
 	"forwarded-for":           &StringW{Value: "true"},
+	"forwarded-header":        &StringW{Value: "false"},
+	"forwarded-port":          &StringW{Value: "false"},
+	"forwarded-proto":         &StringW{Value: "true"},
+	"healthz-bind-port":       &StringW{Value: "1043"},
+	"hsts":                    &StringW{Value: "false"},
+	"hsts-include-subdomains": &StringW{Value: "false"},
+	"hsts-max-age":            &StringW{Value: "31536000"},
+	"hsts-preload":            &StringW{Value: "false"},
+	"http2":                   &StringW{Value: "true"},
 	"load-balance":            &StringW{Value: "roundrobin"},
 	"log-format":              &StringW{Value: "%ci:%cp [%tr] %ft %b/%s %TR/%Tw/%Tc/%Tr/%Ta %ST %B %CC %CS %tsc %ac/%fc/%bc/%sc/%rc %sq/%bq %hr %hs \"%HM %[var(txn.base)] %HV\""},
-	"rate-limit-size":         &StringW{Value: "100k"},
+	"log-stdout":              &StringW{Value: "false"},
+	"mirror-agent":            &StringW{Value: "127.0.0.1:12345"},
+	"mirror-percent":          &StringW{Value: "100"},
+	"modsecurity-enabled":     &StringW{Value: "false"},
+	"no-endpoints-page":       &StringW{Value: "true"},
+	"ocsp-stapling":           &StringW{Value: "false"},
+	"rate-limit-key":          &StringW{Value: "src"},
 	"rate-limit-period":       &StringW{Value: "1s"},
-	"ssl-redirect-code":       &StringW{Value: "302"},
-	"ssl-passthrough":         &StringW{Value: "false"},
+	"rate-limit-size":         &StringW{Value: "100k"},
+	"rate-limit-status-code":  &StringW{Value: "403"},
+	"response-capture-len":    &StringW{Value: "128"},
+	"scale-server-slots":      &StringW{Value: "42"},
 	"server-ssl":              &StringW{Value: "false"},
-	"servers-increment":       &StringW{Value: "42"},
+	"session-affinity":        &StringW{Value: "stick-table"},
+	"ssl-ciphers":             &StringW{Value: "ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-AES256-GCM-SHA384:DHE-RSA-AES128-GCM-SHA256:DHE-DSS-AES128-GCM-SHA256:kEDH+AESGCM:ECDHE-RSA-AES128-SHA256:ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES256-SHA384:ECDHE-ECDSA-AES256-SHA384:ECDHE-RSA-AES256-SHA:ECDHE-ECDSA-AES256-SHA:DHE-RSA-AES128-SHA256:DHE-RSA-AES128-SHA:DHE-DSS-AES128-SHA256:DHE-RSA-AES256-SHA256:DHE-DSS-AES256-SHA:DHE-RSA-AES256-SHA:!aNULL:!eNULL:!EXPORT:!DES:!RC4:!3DES:!MD5:!PSK"},
+	"ssl-options":             &StringW{Value: "no-sslv3 no-tls-tickets no-tlsv10"},
+	"ssl-passthrough":         &StringW{Value: "false"},
+	"ssl-redirect-code":       &StringW{Value: "302"},
+	"stats-enable":            &StringW{Value: "true"},
+	"stats-port":              &StringW{Value: "1024"},
+	"stats-uri":               &StringW{Value: "/"},
 	"syslog-server":           &StringW{Value: "address:127.0.0.1, facility: local0, level: notice"},
-	"timeout-http-request":    &StringW{Value: "5s"},
-	"timeout-connect":         &StringW{Value: "5s"},
 	"timeout-client":          &StringW{Value: "50s"},
+	"timeout-connect":         &StringW{Value: "5s"},
+	"timeout-http-keep-alive": &StringW{Value: "1m"},
+	"timeout-http-request":    &StringW{Value: "5s"},
 	"timeout-queue":           &StringW{Value: "5s"},
 	"timeout-server":          &StringW{Value: "50s"},
 	"timeout-tunnel":          &StringW{Value: "1h"},
-	"timeout-http-keep-alive": &StringW{Value: "1m"},
+	"unique-id":               &StringW{Value: "false"},
+	"unique-id-format":        &StringW{Value: "%{+X}o %ci:%cp_%fi:%fp_%Ts_%rt:%pid"},
+	"unique-id-header":        &StringW{Value: "X-Request-ID"},
+	"unique-id-preserve":      &StringW{Value: "false"},
 }
@@ -0,0 +1,64 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import "testing"
+
+func TestConvertToMapStringWPrefixPriority(t *testing.T) {
+	prefixes := annotationPrefixes
+	annotationPrefixes = []string{"haproxy.org", "haproxy.com", "ingress.kubernetes.io"}
+	defer func() { annotationPrefixes = prefixes }()
+
+	for _, test := range []struct {
+		annotations map[string]string
+		expected    string
+	}{
+		{map[string]string{"haproxy.org/timeout-server": "1s", "haproxy.com/timeout-server": "2s"}, "1s"},
+		{map[string]string{"ingress.kubernetes.io/timeout-server": "3s", "haproxy.com/timeout-server": "2s"}, "2s"},
+		{map[string]string{"ingress.kubernetes.io/timeout-server": "3s", "timeout-server": "4s"}, "3s"},
+		{map[string]string{"timeout-server": "4s", "example.com/timeout-server": "5s"}, "4s"},
+		{map[string]string{"example.com/timeout-server": "5s"}, "5s"},
+		{map[string]string{
+			"example.com/timeout-server":           "5s",
+			"timeout-server":                       "4s",
+			"ingress.kubernetes.io/timeout-server": "3s",
+			"haproxy.com/timeout-server":           "2s",
+			"haproxy.org/timeout-server":           "1s",
+		}, "1s"},
+	} {
+		// map iteration order is random, the result must not depend on it
+		for i := 0; i < 20; i++ {
+			result := ConvertToMapStringW(test.annotations)
+			if len(result) != 1 || result["timeout-server"] == nil || result["timeout-server"].Value != test.expected {
+				t.Fatalf("%v: expected timeout-server %s, got %v", test.annotations, test.expected, result)
+			}
+		}
+	}
+}
+
+func TestConvertToMapStringWPrefixOrder(t *testing.T) {
+	prefixes := annotationPrefixes
+	defer func() { annotationPrefixes = prefixes }()
+	annotations := map[string]string{"haproxy.org/maxconn": "100", "haproxy.com/maxconn": "200"}
+
+	annotationPrefixes = []string{"haproxy.com", "haproxy.org"}
+	if value := ConvertToMapStringW(annotations)["maxconn"].Value; value != "200" {
+		t.Errorf("haproxy.com configured first: expected 200, got %s", value)
+	}
+	annotationPrefixes = []string{"haproxy.org", "haproxy.com"}
+	if value := ConvertToMapStringW(annotations)["maxconn"].Value; value != "100" {
+		t.Errorf("haproxy.org configured first: expected 100, got %s", value)
+	}
+}
@@ -1,6 +1,10 @@
 package controller
 
 import (
+	"strings"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/types"
 	"github.com/haproxytech/models"
 )
 
@@ -11,10 +15,14 @@ func (c *HAProxyController) apiStartTransaction() error {
 		version = 1
 	}
 	//log.Println("Config version:", version)
+	c.ActiveTransactionHasChanges = false
 	transaction, err := c.NativeAPI.Configuration.StartTransaction(version)
+	if err != nil {
+		c.ActiveTransaction = ""
+		return err
+	}
 	c.ActiveTransaction = transaction.ID
-	c.ActiveTransactionHasChanges = false
-	return err
+	return nil
 }
 
 func (c *HAProxyController) apiCommitTransaction() error {
@@ -28,7 +36,12 @@ func (c *HAProxyController) apiCommitTransaction() error {
 	return err
 }
 
+// Transaction neither committed nor failed is deleted, so its ID is never reused.
+// Committed or failed ones are already deleted and the error is ignored.
 func (c *HAProxyController) apiDisposeTransaction() {
+	if c.ActiveTransaction != "" {
+		c.NativeAPI.Configuration.DeleteTransaction(c.ActiveTransaction) //nolint errcheck
+	}
 	c.ActiveTransaction = ""
 	c.ActiveTransactionHasChanges = false
 }
@@ -79,6 +92,11 @@ func (c *HAProxyController) backendServerCreate(backendName string, data models.
 	return c.NativeAPI.Configuration.CreateServer(backendName, &data, c.ActiveTransaction, 0)
 }
 
+func (c *HAProxyController) backendServerGet(backendName, serverName string) (*models.Server, error) {
+	_, server, err := c.NativeAPI.Configuration.GetServer(serverName, backendName, c.ActiveTransaction)
+	return server, err
+}
+
 func (c *HAProxyController) backendServerEdit(backendName string, data models.Server) error {
 	c.ActiveTransactionHasChanges = true
 	return c.NativeAPI.Configuration.EditServer(data.Name, backendName, &data, c.ActiveTransaction, 0)
@@ -195,3 +213,25 @@ func (c *HAProxyController) frontendTCPRequestRuleCreate(frontend string, rule m
 	c.ActiveTransactionHasChanges = true
 	return c.NativeAPI.Configuration.CreateTCPRequestRule("frontend", frontend, &rule, c.ActiveTransaction, 0)
 }
+
+// Replace lines starting with prefix in a configuration section by the given ones.
+// Used for directives not handled by config-parser, kept as unprocessed data.
+func (c *HAProxyController) unprocessedSet(section parser.Section, sectionName, prefix string, values []string) error {
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return err
+	}
+	lines := []types.UnProcessed{}
+	if data, errGet := config.Get(section, sectionName, ""); errGet == nil {
+		for _, line := range data.([]types.UnProcessed) {
+			if !strings.HasPrefix(line.Value, prefix) {
+				lines = append(lines, line)
+			}
+		}
+	}
+	for _, value := range values {
+		lines = append(lines, types.UnProcessed{Value: value})
+	}
+	c.ActiveTransactionHasChanges = true
+	return config.Set(section, sectionName, "", lines)
+}
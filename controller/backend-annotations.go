@@ -16,9 +16,16 @@ package controller
 
 import (
 	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/common"
+	"github.com/haproxytech/config-parser/v2/params"
+	"github.com/haproxytech/config-parser/v2/types"
 	"github.com/haproxytech/kubernetes-ingress/controller/haproxy"
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
 	"github.com/haproxytech/models"
@@ -30,7 +37,7 @@ func (c *HAProxyController) handleSSLPassthrough(ingress *Ingress, service *Serv
 		return false
 	}
 	updateBackendSwitching = false
-	annSSLPassthrough, _ := GetValueFromAnnotations("ssl-passthrough", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	annSSLPassthrough, _ := c.backendAnnotation("ssl-passthrough", ingress, service)
 	status := annSSLPassthrough.Status
 	if status == EMPTY {
 		status = path.Status
@@ -63,15 +70,30 @@ func (c *HAProxyController) handleBackendAnnotations(ingress *Ingress, service *
 	backend := haproxy.Backend(*backendModel)
 	backendAnnotations := make(map[string]*StringW, 8)
 
-	backendAnnotations["abortonclose"], _ = GetValueFromAnnotations("abortonclose", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	backendAnnotations["cookie-persistence"], _ = GetValueFromAnnotations("cookie-persistence", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	backendAnnotations["load-balance"], _ = GetValueFromAnnotations("load-balance", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	backendAnnotations["timeout-check"], _ = GetValueFromAnnotations("timeout-check", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	backendAnnotations["abortonclose"], _ = c.backendAnnotation("abortonclose", ingress, service)
+	backendAnnotations["cookie-persistence"], _ = c.backendAnnotation("cookie-persistence", ingress, service)
+	backendAnnotations["load-balance"], _ = c.backendAnnotation("load-balance", ingress, service)
+	backendAnnotations["option-redispatch"], _ = c.backendAnnotation("option-redispatch", ingress, service)
+	backendAnnotations["retries"], _ = c.backendAnnotation("retries", ingress, service)
+	backendAnnotations["retry-on"], _ = c.backendAnnotation("retry-on", ingress, service)
+	backendAnnotations["timeout-check"], _ = c.backendAnnotation("timeout-check", ingress, service)
+	backendAnnotations["timeout-queue"], _ = c.backendAnnotation("timeout-queue", ingress, service)
 	if backend.Mode == "http" {
-		backendAnnotations["check-http"], _ = GetValueFromAnnotations("check-http", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-		backendAnnotations["forwarded-for"], _ = GetValueFromAnnotations("forwarded-for", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-		backendAnnotations["path-rewrite"], _ = GetValueFromAnnotations("path-rewrite", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-		backendAnnotations["set-host"], _ = GetValueFromAnnotations("set-host", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
+		// ConfigMap values are set in defaults section
+		backendAnnotations["auth-url"], _ = GetValueFromAnnotations("auth-url", ingress.Annotations)
+		backendAnnotations["auth-headers"], _ = GetValueFromAnnotations("auth-headers", ingress.Annotations)
+		backendAnnotations["compression-algo"], _ = c.backendAnnotation("compression-algo", ingress, service)
+		backendAnnotations["compression-types"], _ = c.backendAnnotation("compression-types", ingress, service)
+		backendAnnotations["http-connection-mode"], _ = c.backendAnnotation("http-connection-mode", ingress, service)
+		backendAnnotations["check-http"], _ = c.backendAnnotation("check-http", ingress, service)
+		backendAnnotations["errorfiles"], _ = c.backendAnnotation("errorfiles", ingress, service)
+		backendAnnotations["forwarded-for"], _ = c.backendAnnotation("forwarded-for", ingress, service)
+		backendAnnotations["path-rewrite"], _ = c.backendAnnotation("path-rewrite", ingress, service)
+		backendAnnotations["set-host"], _ = c.backendAnnotation("set-host", ingress, service)
+	}
+	// Error files are written again when the referenced configmap changed
+	if ann := backendAnnotations["errorfiles"]; ann != nil && ann.Status == EMPTY && c.errorFilesChanged(ann.Value) {
+		backendAnnotations["errorfiles"] = &StringW{Value: ann.Value, Status: MODIFIED}
 	}
 
 	// The DELETED status of an annotation is handled explicitly
@@ -88,6 +110,9 @@ func (c *HAProxyController) handleBackendAnnotations(ingress *Ingress, service *
 					continue
 				}
 				activeAnnotations = true
+			case "auth-url", "auth-headers":
+				c.backendAuth(backend.Name, ingress)
+				activeAnnotations = true
 			case "check-http":
 				if v.Status == DELETED && !newBackend {
 					backend.Httpchk = nil
@@ -96,6 +121,16 @@ func (c *HAProxyController) handleBackendAnnotations(ingress *Ingress, service *
 					continue
 				}
 				activeAnnotations = true
+			case "compression-algo", "compression-types":
+				value := v.Value
+				if v.Status == DELETED && !newBackend {
+					value = ""
+				}
+				if err := c.sectionCompression(parser.Backends, backend.Name, k, value); err != nil {
+					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
+					continue
+				}
+				activeAnnotations = true
 			case "cookie-persistence":
 				if v.Status == DELETED && !newBackend {
 					backend.Cookie = nil
@@ -107,18 +142,71 @@ func (c *HAProxyController) handleBackendAnnotations(ingress *Ingress, service *
 					}
 				}
 				activeAnnotations = true
+			case "errorfiles":
+				lines := []string{}
+				if v.Status != DELETED {
+					// Each backend has its own directory, codes can differ from the ones of defaults section
+					errorFiles, err := c.writeErrorFiles(v.Value, filepath.Join(HAProxyErrDir, backend.Name))
+					if err != nil {
+						utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
+					}
+					for _, errorFile := range errorFiles {
+						lines = append(lines, fmt.Sprintf("errorfile %s %s", errorFile.Code, errorFile.File))
+					}
+				}
+				if err := c.unprocessedSet(parser.Backends, backend.Name, "errorfile", lines); err != nil {
+					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
+					continue
+				}
+				activeAnnotations = true
 			case "forwarded-for":
 				if err := backend.UpdateForwardfor(v.Value); err != nil {
 					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
 					continue
 				}
 				activeAnnotations = true
+			case "http-connection-mode":
+				value := v.Value
+				if v.Status == DELETED && !newBackend {
+					value = ""
+				}
+				if err := c.sectionConnectionMode(parser.Backends, backend.Name, value); err != nil {
+					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
+					continue
+				}
+				activeAnnotations = true
 			case "load-balance":
 				if err := backend.UpdateBalance(v.Value); err != nil {
 					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
 					continue
 				}
 				activeAnnotations = true
+			case "option-redispatch":
+				if v.Status == DELETED && !newBackend {
+					backend.Redispatch = nil
+				} else if err := backend.UpdateRedispatch(v.Value); err != nil {
+					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
+					continue
+				}
+				activeAnnotations = true
+			case "retries":
+				if v.Status == DELETED && !newBackend {
+					backend.Retries = nil
+				} else if err := backend.UpdateRetries(v.Value); err != nil {
+					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
+					continue
+				}
+				activeAnnotations = true
+			case "retry-on":
+				value := v.Value
+				if v.Status == DELETED && !newBackend {
+					value = ""
+				}
+				if err := c.backendRetryOn(backend.Name, value); err != nil {
+					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
+					continue
+				}
+				activeAnnotations = true
 			case "path-rewrite":
 				httpReqs := c.getBackendHTTPReqs(backend.Name)
 				delete(httpReqs.rules, PATH_REWRITE)
@@ -150,9 +238,14 @@ func (c *HAProxyController) handleBackendAnnotations(ingress *Ingress, service *
 				activeAnnotations = true
 				c.cfg.BackendHTTPRules[backend.Name] = httpReqs
 			case "set-host":
+				// "preserve" keeps the Host header of the client
+				if v.Status != DELETED && strings.ContainsAny(v.Value, " \t") {
+					utils.LogErr(fmt.Errorf("%s annotation: incorrect host '%s'", k, v.Value))
+					continue
+				}
 				httpReqs := c.getBackendHTTPReqs(backend.Name)
 				delete(httpReqs.rules, SET_HOST)
-				if v.Status != DELETED || newBackend {
+				if (v.Status != DELETED || newBackend) && v.Value != "preserve" && v.Value != "" {
 					httpRule := models.HTTPRequestRule{
 						Index:     utils.PtrInt64(0),
 						Type:      "set-header",
@@ -172,6 +265,12 @@ func (c *HAProxyController) handleBackendAnnotations(ingress *Ingress, service *
 					continue
 				}
 				activeAnnotations = true
+			case "timeout-queue":
+				if err := backend.UpdateQueueTimeout(v.Value); err != nil {
+					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
+					continue
+				}
+				activeAnnotations = true
 			}
 		}
 	}
@@ -185,12 +284,16 @@ func (c *HAProxyController) handleServerAnnotations(ingress *Ingress, service *S
 	activeAnnotations = false
 	server := haproxy.Server(*serverModel)
 
-	serverAnnotations := make(map[string]*StringW, 5)
-	serverAnnotations["cookie-persistence"], _ = GetValueFromAnnotations("cookie-persistence", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	serverAnnotations["check"], _ = GetValueFromAnnotations("check", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	serverAnnotations["check-interval"], _ = GetValueFromAnnotations("check-interval", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	serverAnnotations["pod-maxconn"], _ = GetValueFromAnnotations("pod-maxconn", service.Annotations)
-	serverAnnotations["server-ssl"], _ = GetValueFromAnnotations("server-ssl", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	serverAnnotations := make(map[string]*StringW, 6)
+	serverAnnotations["cookie-persistence"], _ = c.backendAnnotation("cookie-persistence", ingress, service)
+	serverAnnotations["check"], _ = c.backendAnnotation("check", ingress, service)
+	serverAnnotations["check-interval"], _ = c.backendAnnotation("check-interval", ingress, service)
+	serverAnnotations["backend-maxqueue"], _ = c.backendAnnotation("backend-maxqueue", ingress, service)
+	serverAnnotations["pod-maxconn"], _ = c.backendAnnotation("pod-maxconn", ingress, service)
+	serverAnnotations["server-ssl"], _ = c.backendAnnotation("server-ssl", ingress, service)
+	serverAnnotations["send-proxy-protocol"], _ = c.backendAnnotation("send-proxy-protocol", ingress, service)
+	serverAnnotations["slowstart"], _ = c.backendAnnotation("slowstart", ingress, service)
+	activeAnnotations = c.handleAgentCheck(ingress, service, &server)
 
 	// The DELETED status of an annotation is handled explicitly
 	// only when there is no default annotation value.
@@ -229,12 +332,40 @@ func (c *HAProxyController) handleServerAnnotations(ingress *Ingress, service *S
 					continue
 				}
 				activeAnnotations = true
+			case "send-proxy-protocol":
+				value := v.Value
+				if v.Status == DELETED {
+					value = ""
+				}
+				if err := server.UpdateSendProxy(value); err != nil {
+					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
+					continue
+				}
+				activeAnnotations = true
 			case "server-ssl":
 				if err := server.UpdateServerSsl(v.Value); err != nil {
 					utils.LogErr(fmt.Errorf("%s annotation: %s", k, err))
 					continue
 				}
 				activeAnnotations = true
+			case "backend-maxqueue":
+				// Parameter is set by handleEndpointIP, see serverMaxqueue
+				if v.Status != DELETED {
+					if maxqueue, err := strconv.ParseInt(v.Value, 10, 64); err != nil || maxqueue < 0 {
+						utils.LogErr(fmt.Errorf("%s annotation: incorrect value '%s'", k, v.Value))
+						continue
+					}
+				}
+				activeAnnotations = true
+			case "slowstart":
+				// Parameter is set by handleEndpointIP, see serverSlowstart
+				if v.Status != DELETED {
+					if _, err := utils.ParseTime(v.Value); err != nil {
+						utils.LogErr(fmt.Errorf("%s annotation: incorrect duration '%s'", k, v.Value))
+						continue
+					}
+				}
+				activeAnnotations = true
 			}
 		}
 	}
@@ -242,21 +373,186 @@ func (c *HAProxyController) handleServerAnnotations(ingress *Ingress, service *S
 	return activeAnnotations
 }
 
+// agent-check annotations are applied to every server, including the provisioned ones
+// filled through runtime API, their changes require a reload.
+func (c *HAProxyController) handleAgentCheck(ingress *Ingress, service *Service, server *haproxy.Server) (activeAnnotations bool) {
+	annAgent, _ := c.backendAnnotation("agent-check", ingress, service)
+	annPort, _ := c.backendAnnotation("agent-port", ingress, service)
+	annInter, _ := c.backendAnnotation("agent-inter", ingress, service)
+	annAddr, _ := c.backendAnnotation("agent-addr", ingress, service)
+	for _, ann := range []*StringW{annAgent, annPort, annInter, annAddr} {
+		if ann != nil && ann.Status != EMPTY {
+			activeAnnotations = true
+		}
+	}
+	// Errors are only logged when annotations change
+	logErr := func(err error) {
+		if activeAnnotations {
+			utils.LogErr(err)
+		}
+	}
+	if annAgent == nil || annAgent.Status == DELETED {
+		return activeAnnotations
+	}
+	enabled, err := utils.GetBoolValue(annAgent.Value, "agent-check")
+	if err != nil || !enabled {
+		logErr(err)
+		return activeAnnotations
+	}
+	if annPort == nil || annPort.Status == DELETED {
+		logErr(fmt.Errorf("agent-check annotation: agent-port annotation is required"))
+		return activeAnnotations
+	}
+	port, err := c.agentPort(service, annPort.Value)
+	if err != nil {
+		logErr(fmt.Errorf("agent-port annotation: %s", err))
+		return activeAnnotations
+	}
+	server.AgentCheck = "enabled"
+	server.AgentPort = &port
+	if annInter != nil && annInter.Status != DELETED {
+		if server.AgentInter, err = utils.ParseTime(annInter.Value); err != nil {
+			logErr(fmt.Errorf("agent-inter annotation: %s", err))
+		}
+	}
+	if annAddr != nil && annAddr.Status != DELETED {
+		server.AgentAddr = annAddr.Value
+	}
+	return activeAnnotations
+}
+
+// Port of agent-port annotation, a name is looked up in endpoints ports of the service and
+// in container ports of its pods. Servers share the same agent port, like they share other
+// parameters, so that provisioned servers are ready to be filled through runtime API.
+func (c *HAProxyController) agentPort(service *Service, value string) (int64, error) {
+	if port, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if port < 1 || port > 65535 {
+			return 0, fmt.Errorf("incorrect port '%s'", value)
+		}
+		return port, nil
+	}
+	namespace, ok := c.cfg.Namespace[service.Namespace]
+	if !ok {
+		return 0, fmt.Errorf("namespace '%s' does not exist", service.Namespace)
+	}
+	if endpoints, ok := namespace.Endpoints[service.Name]; ok {
+		for _, ip := range *endpoints.Addresses {
+			if port, ok := ip.Ports[value]; ok {
+				return port, nil
+			}
+			if pod, ok := namespace.Pods[ip.Name]; ok {
+				if port, ok := pod.Ports[value]; ok {
+					return port, nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no port named '%s' in pods of service '%s'", value, service.Name)
+}
+
+// slowstart annotation: servers leaving maintenance, like the ones of new pods filling
+// server slots through runtime API, get their weight progressively during this period.
+// Return value of slowstart parameter in milliseconds, empty without a valid annotation.
+func (c *HAProxyController) serverSlowstart(ingress *Ingress, service *Service) string {
+	annSlowstart, _ := c.backendAnnotation("slowstart", ingress, service)
+	if annSlowstart == nil || annSlowstart.Status == DELETED {
+		return ""
+	}
+	slowstart, err := utils.ParseTime(annSlowstart.Value)
+	if err != nil || *slowstart <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(*slowstart, 10)
+}
+
+// backend-maxqueue annotation: maximum number of requests queued for each server
+// once its maxconn is reached, see pod-maxconn. Return value of maxqueue parameter,
+// empty without a valid annotation or with 0 which removes the limit.
+func (c *HAProxyController) serverMaxqueue(ingress *Ingress, service *Service) string {
+	annMaxqueue, _ := c.backendAnnotation("backend-maxqueue", ingress, service)
+	if annMaxqueue == nil || annMaxqueue.Status == DELETED {
+		return ""
+	}
+	maxqueue, err := strconv.ParseInt(annMaxqueue.Value, 10, 64)
+	if err != nil || maxqueue <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(maxqueue, 10)
+}
+
+// Set parameter of a server line the server model does not have, empty value removes it.
+// It has to be set again after each server edition as client-native rewrites the line.
+func (c *HAProxyController) backendServerParam(backendName, serverName, name, value string) error {
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return err
+	}
+	data, err := config.Get(parser.Backends, backendName, "server")
+	if err != nil {
+		return err
+	}
+	for i, server := range data.([]types.Server) {
+		if server.Name != serverName {
+			continue
+		}
+		current := ""
+		serverParams := []params.ServerOption{}
+		for _, param := range server.Params {
+			if option, ok := param.(*params.ServerOptionValue); ok && option.Name == name {
+				current = option.Value
+				continue
+			}
+			serverParams = append(serverParams, param)
+		}
+		if current == value {
+			return nil
+		}
+		if value != "" {
+			serverParams = append(serverParams, &params.ServerOptionValue{Name: name, Value: value})
+		}
+		server.Params = serverParams
+		c.ActiveTransactionHasChanges = true
+		return config.Set(parser.Backends, backendName, "server", &server, i)
+	}
+	return fmt.Errorf("server '%s' of backend '%s' does not exist", serverName, backendName)
+}
+
+// Rename server of backend, its parameters are kept
+func (c *HAProxyController) backendServerRename(backendName, serverName, newName string) error {
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return err
+	}
+	data, err := config.Get(parser.Backends, backendName, "server")
+	if err != nil {
+		return err
+	}
+	for i, server := range data.([]types.Server) {
+		if server.Name != serverName {
+			continue
+		}
+		server.Name = newName
+		c.ActiveTransactionHasChanges = true
+		return config.Set(parser.Backends, backendName, "server", &server, i)
+	}
+	return fmt.Errorf("server '%s' of backend '%s' does not exist", serverName, backendName)
+}
+
 func (c *HAProxyController) handleCookieAnnotations(ingress *Ingress, service *Service) models.Cookie {
 
 	cookieAnnotations := make(map[string]*StringW, 11)
-	cookieAnnotations["cookie-persistence"], _ = GetValueFromAnnotations("cookie-persistence", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-domain"], _ = GetValueFromAnnotations("cookie-domain", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-dynamic"], _ = GetValueFromAnnotations("cookie-dynamic", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-httponly"], _ = GetValueFromAnnotations("cookie-httponly", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-indirect"], _ = GetValueFromAnnotations("cookie-indirect", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-maxidle"], _ = GetValueFromAnnotations("cookie-maxidle", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-maxlife"], _ = GetValueFromAnnotations("cookie-maxlife", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-nocache"], _ = GetValueFromAnnotations("cookie-nocache", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-postonly"], _ = GetValueFromAnnotations("cookie-postonly", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-preserve"], _ = GetValueFromAnnotations("cookie-preserve", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-secure"], _ = GetValueFromAnnotations("cookie-secure", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	cookieAnnotations["cookie-type"], _ = GetValueFromAnnotations("cookie-type", service.Annotations, ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	cookieAnnotations["cookie-persistence"], _ = c.backendAnnotation("cookie-persistence", ingress, service)
+	cookieAnnotations["cookie-domain"], _ = c.backendAnnotation("cookie-domain", ingress, service)
+	cookieAnnotations["cookie-dynamic"], _ = c.backendAnnotation("cookie-dynamic", ingress, service)
+	cookieAnnotations["cookie-httponly"], _ = c.backendAnnotation("cookie-httponly", ingress, service)
+	cookieAnnotations["cookie-indirect"], _ = c.backendAnnotation("cookie-indirect", ingress, service)
+	cookieAnnotations["cookie-maxidle"], _ = c.backendAnnotation("cookie-maxidle", ingress, service)
+	cookieAnnotations["cookie-maxlife"], _ = c.backendAnnotation("cookie-maxlife", ingress, service)
+	cookieAnnotations["cookie-nocache"], _ = c.backendAnnotation("cookie-nocache", ingress, service)
+	cookieAnnotations["cookie-postonly"], _ = c.backendAnnotation("cookie-postonly", ingress, service)
+	cookieAnnotations["cookie-preserve"], _ = c.backendAnnotation("cookie-preserve", ingress, service)
+	cookieAnnotations["cookie-secure"], _ = c.backendAnnotation("cookie-secure", ingress, service)
+	cookieAnnotations["cookie-type"], _ = c.backendAnnotation("cookie-type", ingress, service)
 	cookie := models.Cookie{}
 	for k, v := range cookieAnnotations {
 		if v == nil {
@@ -314,6 +610,132 @@ func (c *HAProxyController) handleCookieAnnotations(ingress *Ingress, service *S
 	return cookie
 }
 
+// Set "compression algo" or "compression type" in a section, empty value removes it.
+func (c *HAProxyController) sectionCompression(section parser.Section, sectionName, annotation, value string) error {
+	values := strings.Fields(strings.Replace(value, ",", " ", -1))
+	prefix := "compression type"
+	if annotation == "compression-algo" {
+		prefix = "compression algo"
+		for _, algo := range values {
+			switch algo {
+			case "identity", "gzip", "deflate", "raw-deflate":
+			default:
+				return fmt.Errorf("unknown algorithm '%s'", algo)
+			}
+		}
+	}
+	lines := []string{}
+	if len(values) > 0 {
+		lines = append(lines, prefix+" "+strings.Join(values, " "))
+	}
+	return c.unprocessedSet(section, sectionName, prefix, lines)
+}
+
+// Set HTTP connection mode option of a section, removing the other modes.
+// Empty value removes all of them.
+func (c *HAProxyController) sectionConnectionMode(section parser.Section, sectionName, mode string) error {
+	modes := []string{"http-keep-alive", "http-server-close", "httpclose"}
+	valid := mode == ""
+	for _, m := range modes {
+		valid = valid || m == mode
+	}
+	if !valid {
+		return fmt.Errorf("unknown mode '%s'", mode)
+	}
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return err
+	}
+	for _, m := range modes {
+		var data common.ParserData
+		if m == mode {
+			data = &types.SimpleOption{}
+		}
+		if err := config.Set(section, sectionName, "option "+m, data); err != nil {
+			return err
+		}
+	}
+	c.ActiveTransactionHasChanges = true
+	return nil
+}
+
+// Keywords accepted by retry-on
+var retryOnKeywords = map[string]struct{}{
+	"none": {}, "conn-failure": {}, "empty-response": {}, "junk-response": {},
+	"response-timeout": {}, "0rtt-rejected": {}, "all-retryable-errors": {},
+	"404": {}, "408": {}, "425": {}, "500": {}, "501": {}, "502": {}, "503": {}, "504": {},
+}
+
+// Set retry-on in backend. Config parser does not handle retry-on
+// so the line is managed as unprocessed data, empty value removes it.
+func (c *HAProxyController) backendRetryOn(backendName, value string) error {
+	keywords := strings.Fields(strings.Replace(value, ",", " ", -1))
+	if len(keywords) > 0 && !haproxyVersionAtLeast(2, 0) {
+		return fmt.Errorf("requires HAProxy 2.0 or later, running %d.%d", HAProxyVersion[0], HAProxyVersion[1])
+	}
+	for _, keyword := range keywords {
+		if _, ok := retryOnKeywords[keyword]; !ok {
+			return fmt.Errorf("unknown keyword '%s'", keyword)
+		}
+	}
+	lines := []string{}
+	if len(keywords) > 0 {
+		lines = append(lines, "retry-on "+strings.Join(keywords, " "))
+	}
+	return c.unprocessedSet(parser.Backends, backendName, "retry-on", lines)
+}
+
+// Deny requests and copy auth-headers according to the result of the auth-request
+// Lua action, rules only match requests which went through it (see handleAuth).
+func (c *HAProxyController) backendAuth(backendName string, ingress *Ingress) {
+	httpReqs := c.getBackendHTTPReqs(backendName)
+	for rule := range httpReqs.rules {
+		if strings.HasPrefix(string(rule), string(AUTH)) {
+			delete(httpReqs.rules, rule)
+		}
+	}
+	annAuthURL, _ := GetValueFromAnnotations("auth-url", ingress.Annotations)
+	if annAuthURL != nil && annAuthURL.Status != DELETED {
+		httpReqs.rules[AUTH] = models.HTTPRequestRule{
+			Index:    utils.PtrInt64(0),
+			Type:     "auth",
+			Cond:     "if",
+			CondTest: "{ var(txn.auth_response) -m str denied }",
+		}
+		annAuthHeaders, _ := GetValueFromAnnotations("auth-headers", ingress.Annotations)
+		if annAuthHeaders != nil && annAuthHeaders.Status != DELETED {
+			for _, header := range strings.Split(annAuthHeaders.Value, ",") {
+				header = strings.TrimSpace(header)
+				if header == "" {
+					continue
+				}
+				// Header is overwritten even if missing in auth response so clients can't forge it
+				httpReqs.rules[Rule(fmt.Sprintf("%s-%s", AUTH, header))] = models.HTTPRequestRule{
+					Index:     utils.PtrInt64(0),
+					Type:      "set-header",
+					HdrName:   header,
+					HdrFormat: fmt.Sprintf("%%[var(%s)]", authHeaderVar(header)),
+					Cond:      "if",
+					CondTest:  "{ var(txn.auth_response) -m str ok }",
+				}
+			}
+		}
+	}
+	httpReqs.modified = true
+	c.cfg.BackendHTTPRules[backendName] = httpReqs
+}
+
+// Name of the variable holding an auth response header, same as var_name in auth-request Lua script
+func authHeaderVar(header string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(header))
+	return "req.auth_response_header." + name
+}
+
 func (c *HAProxyController) getBackendHTTPReqs(backend string) BackendHTTPReqs {
 	httpReqs, ok := c.cfg.BackendHTTPRules[backend]
 	if !ok {
@@ -325,3 +747,169 @@ func (c *HAProxyController) getBackendHTTPReqs(backend string) BackendHTTPReqs {
 	}
 	return httpReqs
 }
+
+// Services with ClientIP session affinity get client address stickiness: a stick table of
+// client addresses expiring after affinity timeout, or "balance source" with session-affinity
+// annotation. Stick table entries outlive servers changes, unlike balance source hashing.
+func (c *HAProxyController) handleSessionAffinity(ingress *Ingress, service *Service, backend *models.Backend) (backendModified, reload bool) {
+	annAffinity, _ := GetValueFromAnnotations("session-affinity", c.cfg.ConfigMap.Annotations)
+	mode := annAffinity.Value
+	if mode != "stick-table" && mode != "balance-source" {
+		if annAffinity.Status != EMPTY {
+			utils.LogErr(fmt.Errorf("session-affinity annotation: incorrect value '%s'", mode))
+		}
+		mode = "stick-table"
+	}
+	if service.ClientIPAffinity == 0 {
+		mode = ""
+	}
+
+	var stickTable *models.BackendStickTable
+	stick := []types.Stick{}
+	if mode == "stick-table" {
+		stickTable = &models.BackendStickTable{
+			Type:   "ip",
+			Size:   utils.PtrInt64(100000),
+			Expire: utils.PtrInt64(service.ClientIPAffinity * 1000),
+		}
+		stick = append(stick, types.Stick{Type: "on", Pattern: "src"})
+	}
+	if (backend.StickTable == nil) != (stickTable == nil) || (stickTable != nil && !reflect.DeepEqual(*backend.StickTable, *stickTable)) {
+		backend.StickTable = stickTable
+		backendModified = true
+	}
+
+	// load-balance annotation applies again when balance source is no longer used
+	balance := ""
+	if backend.Balance != nil && backend.Balance.Algorithm != nil {
+		balance = *backend.Balance.Algorithm
+	}
+	if mode == "balance-source" && balance != "source" {
+		backend.Balance = &models.Balance{Algorithm: utils.PtrString("source")}
+		backendModified = true
+	} else if mode != "balance-source" && balance == "source" {
+		annBalance, _ := c.backendAnnotation("load-balance", ingress, service)
+		if annBalance.Value != "source" {
+			b := haproxy.Backend(*backend)
+			if err := b.UpdateBalance(annBalance.Value); err != nil {
+				utils.LogErr(fmt.Errorf("load-balance annotation: %s", err))
+			} else {
+				*backend = models.Backend(b)
+				backendModified = true
+			}
+		}
+	}
+
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		utils.LogErr(err)
+		return backendModified, false
+	}
+	current := []types.Stick{}
+	if data, errGet := config.Get(parser.Backends, backend.Name, "stick"); errGet == nil {
+		current = data.([]types.Stick)
+	}
+	if !reflect.DeepEqual(current, stick) {
+		if len(stick) > 0 {
+			logger.Infof("Backend %s: client IP affinity with %ds timeout (%s)", backend.Name, service.ClientIPAffinity, mode)
+		}
+		utils.LogErr(config.Set(parser.Backends, backend.Name, "stick", stick))
+		c.ActiveTransactionHasChanges = true
+		reload = true
+	}
+	return backendModified, reload
+}
+
+type blueGreenShare struct {
+	label string
+	value string
+	share int64
+}
+
+// blue-green-balance is a comma separated list of label=value=share, the traffic share
+// of each label is relative to the sum of all shares.
+func parseBlueGreenBalance(value string) (shares []blueGreenShare, err error) {
+	total := int64(0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, "=")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid '%s', expected label=value=share", item)
+		}
+		share, errParse := strconv.ParseInt(parts[2], 10, 64)
+		if errParse != nil || share < 0 {
+			return nil, fmt.Errorf("invalid share in '%s'", item)
+		}
+		shares = append(shares, blueGreenShare{label: parts[0], value: parts[1], share: share})
+		total += share
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no traffic share in '%s'", value)
+	}
+	return shares, nil
+}
+
+// Weights of servers of a service with blue-green-balance annotation by server name.
+// Share of a label is split between ready pods having it and weights are scaled so the
+// highest one is 256, pods matching none of the labels get no traffic. Returns nil when
+// servers keep their weight.
+func (c *HAProxyController) blueGreenWeights(namespace *Namespace, service *Service, endpoints *Endpoints) map[string]int64 {
+	annBalance, _ := GetValueFromAnnotations("blue-green-balance", service.Annotations)
+	if annBalance == nil {
+		return nil
+	}
+	weights := make(map[string]int64, len(*endpoints.Addresses))
+	if annBalance.Status == DELETED {
+		for _, ip := range *endpoints.Addresses {
+			weights[ip.HAProxyName] = 128
+		}
+		return weights
+	}
+	shares, err := parseBlueGreenBalance(annBalance.Value)
+	if err != nil {
+		utils.LogErr(fmt.Errorf("blue-green-balance annotation: %s", err))
+		return nil
+	}
+	members := make([][]string, len(shares))
+	for _, ip := range *endpoints.Addresses {
+		weights[ip.HAProxyName] = 0
+		if ip.Disabled || ip.Status == DELETED {
+			continue
+		}
+		pod, ok := namespace.Pods[ip.Name]
+		if !ok {
+			continue
+		}
+		for i, s := range shares {
+			if value, ok := pod.Labels[s.label]; ok && value == s.value {
+				members[i] = append(members[i], ip.HAProxyName)
+				break
+			}
+		}
+	}
+	maxShare := 0.0
+	for i, s := range shares {
+		if len(members[i]) > 0 {
+			maxShare = math.Max(maxShare, float64(s.share)/float64(len(members[i])))
+		}
+	}
+	if maxShare == 0 {
+		return weights
+	}
+	for i, s := range shares {
+		if s.share == 0 || len(members[i]) == 0 {
+			continue
+		}
+		weight := int64(math.Round(256 * float64(s.share) / float64(len(members[i])) / maxShare))
+		if weight < 1 {
+			weight = 1
+		}
+		for _, name := range members[i] {
+			weights[name] = weight
+		}
+	}
+	return weights
+}
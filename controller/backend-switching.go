@@ -16,9 +16,10 @@ package controller
 
 import (
 	"fmt"
-	"log"
 	"sort"
+	"strings"
 
+	"github.com/haproxytech/kubernetes-ingress/controller/haproxy"
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
 	"github.com/haproxytech/models"
 )
@@ -26,10 +27,15 @@ import (
 type UseBackendRules map[string]UseBackendRule
 
 type UseBackendRule struct {
-	Host      string
-	Path      string
-	Backend   string
-	Namespace string
+	Host          string
+	Path          string
+	Backend       string
+	Namespace     string
+	CanaryBackend string
+	CanaryWeight  int64
+	// Backend of requests matching HeaderCond, see route-by-header annotation
+	HeaderBackend string
+	HeaderCond    string
 }
 
 func (c *HAProxyController) addUseBackendRule(key string, rule UseBackendRule, frontends ...string) {
@@ -61,6 +67,12 @@ func (c *HAProxyController) refreshBackendSwitching() (reload bool) {
 	for rateLimitTable := range rateLimitTables {
 		activeBackends[rateLimitTable] = struct{}{}
 	}
+	for _, authRequest := range c.cfg.FrontendAuthRequests {
+		activeBackends[authRequest.Backend] = struct{}{}
+	}
+	// Agent backends are removed by refreshRequestMirrors and refreshModSecurity
+	activeBackends[mirrorAgentBackend] = struct{}{}
+	activeBackends[modsecAgentBackend] = struct{}{}
 	for _, frontend := range frontends {
 		activeBackends[frontend.DefaultBackend] = struct{}{}
 		useBackendRules, ok := c.cfg.BackendSwitchingRules[frontend.Name]
@@ -70,6 +82,12 @@ func (c *HAProxyController) refreshBackendSwitching() (reload bool) {
 		sortedKeys := []string{}
 		for key, rule := range useBackendRules {
 			activeBackends[rule.Backend] = struct{}{}
+			if rule.CanaryBackend != "" {
+				activeBackends[rule.CanaryBackend] = struct{}{}
+			}
+			if rule.HeaderBackend != "" {
+				activeBackends[rule.HeaderBackend] = struct{}{}
+			}
 			sortedKeys = append(sortedKeys, key)
 		}
 		if _, ok := c.cfg.BackendSwitchingStatus[frontend.Name]; !ok {
@@ -77,44 +95,72 @@ func (c *HAProxyController) refreshBackendSwitching() (reload bool) {
 			// of the frontend were not updated
 			continue
 		}
-		// host/path are part of use_backend keys, so sorting keys will
-		// result in sorted use_backend rules where the longest path will match first.
+		// use_backend rules are sorted so exact hosts match first, then wildcard
+		// hosts (longest suffix first) and finally rules without host.
+		// For the same host the longest path will match first.
 		// Example:
 		// use_backend service-abc if { req.hdr(host) -i example } { path_beg /a/b/c }
 		// use_backend service-ab  if { req.hdr(host) -i example } { path_beg /a/b }
-		// use_backend service-a   if { req.hdr(host) -i example } { path_beg /a }
-		sort.Strings(sortedKeys)
+		// use_backend service-w   if { req.hdr(host) -m reg -i ^[^.]+\.example$ } { path_beg /a }
+		// use_backend service-a   if { path_beg /a }
+		sortUseBackendKeys(sortedKeys, useBackendRules)
 		c.backendSwitchingRuleDeleteAll(frontend.Name)
+		var index int64
 		for _, key := range sortedKeys {
 			rule := useBackendRules[key]
 			var condTest string
 			switch frontend.Mode {
 			case "http":
-				if rule.Host != "" {
-					//TODO: provide option to do strict host matching
-					condTest = fmt.Sprintf("{ req.hdr(host),field(1,:) -i %s } ", rule.Host)
-				}
-				if rule.Path != "" {
-					condTest = fmt.Sprintf("%s{ path_beg %s }", condTest, rule.Path)
-				}
+				condTest = hostPathACL(rule.Host, rule.Path)
 				if condTest == "" {
-					log.Printf("both Host and Path are empty for frontend %v with backend %v, SKIP\n", frontend, rule.Backend)
+					logger.Warningf("both Host and Path are empty for frontend %v with backend %v, SKIP\n", frontend, rule.Backend)
 					continue
 				}
 			case "tcp":
 				if rule.Host == "" {
-					log.Println(fmt.Sprintf("Empty SNI for backend %s, SKIP", rule.Backend))
+					logger.Warningf("Empty SNI for backend %s, SKIP", rule.Backend)
 					continue
 				}
-				condTest = fmt.Sprintf("{ req_ssl_sni -i %s } ", rule.Host)
+				if isWildcardHost(rule.Host) {
+					condTest = fmt.Sprintf("{ req_ssl_sni -m reg -i %s } ", haproxy.HostPattern(rule.Host))
+				} else {
+					condTest = fmt.Sprintf("{ req_ssl_sni -i %s } ", rule.Host)
+				}
+			}
+			// Header routing rule is evaluated first, requests matching it skip canary
+			if rule.HeaderBackend != "" && frontend.Mode == "http" {
+				err := c.backendSwitchingRuleCreate(frontend.Name, models.BackendSwitchingRule{
+					Cond:     "if",
+					CondTest: strings.TrimSpace(fmt.Sprintf("%s %s", rule.HeaderCond, strings.TrimSpace(condTest))),
+					Name:     rule.HeaderBackend,
+					Index:    utils.PtrInt64(index),
+				})
+				utils.PanicErr(err)
+				index++
+			}
+			// Canary rule is evaluated before the primary one and catches a percentage of the traffic
+			if rule.CanaryBackend != "" && rule.CanaryWeight > 0 {
+				canaryCondTest := condTest
+				if rule.CanaryWeight < 100 {
+					canaryCondTest = strings.TrimSpace(fmt.Sprintf("%s { rand(100) lt %d }", strings.TrimSpace(condTest), rule.CanaryWeight))
+				}
+				err := c.backendSwitchingRuleCreate(frontend.Name, models.BackendSwitchingRule{
+					Cond:     "if",
+					CondTest: canaryCondTest,
+					Name:     rule.CanaryBackend,
+					Index:    utils.PtrInt64(index),
+				})
+				utils.PanicErr(err)
+				index++
 			}
 			err := c.backendSwitchingRuleCreate(frontend.Name, models.BackendSwitchingRule{
 				Cond:     "if",
 				CondTest: condTest,
 				Name:     rule.Backend,
-				Index:    utils.PtrInt64(0),
+				Index:    utils.PtrInt64(index),
 			})
 			utils.PanicErr(err)
+			index++
 		}
 		reload = true
 		delete(c.cfg.BackendSwitchingStatus, frontend.Name)
@@ -123,6 +169,56 @@ func (c *HAProxyController) refreshBackendSwitching() (reload bool) {
 	return reload
 }
 
+// Return ACL matching requests of host and path prefix, empty when both are empty
+func hostPathACL(host, path string) string {
+	var condTest string
+	if isWildcardHost(host) {
+		condTest = fmt.Sprintf("{ req.hdr(host),field(1,:) -m reg -i %s } ", haproxy.HostPattern(host))
+	} else if host != "" {
+		//TODO: provide option to do strict host matching
+		condTest = fmt.Sprintf("{ req.hdr(host),field(1,:) -i %s } ", host)
+	}
+	if path != "" {
+		condTest = fmt.Sprintf("%s{ path_beg %s }", condTest, path)
+	}
+	return condTest
+}
+
+func isWildcardHost(host string) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// Sort use_backend keys by host specificity (exact, wildcard, empty),
+// then by path length so longest path matches first.
+func sortUseBackendKeys(keys []string, rules UseBackendRules) {
+	hostRank := func(host string) int {
+		switch {
+		case host == "":
+			return 2
+		case isWildcardHost(host):
+			return 1
+		default:
+			return 0
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := rules[keys[i]], rules[keys[j]]
+		if rankA, rankB := hostRank(a.Host), hostRank(b.Host); rankA != rankB {
+			return rankA < rankB
+		}
+		if len(a.Host) != len(b.Host) {
+			return len(a.Host) > len(b.Host)
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		if len(a.Path) != len(b.Path) {
+			return len(a.Path) > len(b.Path)
+		}
+		return keys[i] < keys[j]
+	})
+}
+
 // Remove unused backends
 func (c *HAProxyController) clearBackends(activeBackends map[string]struct{}) (reload bool) {
 	allBackends, err := c.backendsGet()
@@ -137,6 +233,16 @@ func (c *HAProxyController) clearBackends(activeBackends map[string]struct{}) (r
 			reload = true
 		}
 	}
+	// Servers of endpoints are no longer updated in deleted backends
+	for _, namespace := range c.cfg.Namespace {
+		for _, endpoints := range namespace.Endpoints {
+			for backendName := range endpoints.Backends {
+				if _, ok := activeBackends[backendName]; !ok {
+					delete(endpoints.Backends, backendName)
+				}
+			}
+		}
+	}
 	return reload
 }
 
@@ -0,0 +1,302 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/params"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+// bindAddress is an address HTTP, HTTPS and TCP services frontends listen on
+type bindAddress struct {
+	address string
+	v4v6    bool
+	v6only  bool
+}
+
+// Return addresses of --bind-address of enabled families, or wildcard addresses of enabled families
+func parseBindAddresses(osArgs utils.OSArgs) ([]bindAddress, error) {
+	ipv4 := osArgs.BindIPv4 == "true"
+	ipv6 := osArgs.BindIPv6 == "true"
+	addresses := []bindAddress{}
+	if len(osArgs.BindAddress) == 0 {
+		if ipv4 {
+			addresses = append(addresses, bindAddress{address: "0.0.0.0"})
+		}
+		if ipv6 {
+			addresses = append(addresses, bindAddress{address: "::", v4v6: ipv4, v6only: !ipv4})
+		}
+	}
+	for _, address := range osArgs.BindAddress {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("incorrect bind address '%s'", address)
+		}
+		switch {
+		case ip.To4() != nil:
+			if ipv4 {
+				addresses = append(addresses, bindAddress{address: address})
+			}
+		case ipv6:
+			addresses = append(addresses, bindAddress{address: address, v6only: ip.IsUnspecified() && !ipv4})
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("no bind address left, check --bind-ipv4, --bind-ipv6 and --bind-address")
+	}
+	return addresses, nil
+}
+
+// Return port of a bind line path, IPv6 addresses contain colons so port is after the last one
+func bindPort(path string) (port int64, ok bool) {
+	i := strings.LastIndex(path, ":")
+	if i < 0 {
+		return 0, false
+	}
+	port, err := strconv.ParseInt(path[i+1:], 10, 64)
+	return port, err == nil
+}
+
+func (c *HAProxyController) frontendBindsRaw(frontend string) []types.Bind {
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return nil
+	}
+	data, err := config.Get(parser.Frontends, frontend, "bind")
+	if err != nil {
+		return nil
+	}
+	binds, _ := data.([]types.Bind)
+	return binds
+}
+
+// Parameters of bind line that are set on all binds of a frontend (ssl, crt, alpn, accept-proxy...)
+func bindSharedParams(bind types.Bind) []params.BindOption {
+	shared := []params.BindOption{}
+	for _, param := range bind.Params {
+		switch bindParamName(param) {
+		case "name", "v4v6", "v6only":
+		default:
+			shared = append(shared, param)
+		}
+	}
+	return shared
+}
+
+func bindParamName(param params.BindOption) string {
+	switch p := param.(type) {
+	case *params.BindOptionWord:
+		return p.Name
+	case *params.BindOptionDoubleWord:
+		return p.Name
+	case *params.BindOptionValue:
+		return p.Name
+	}
+	return ""
+}
+
+func bindString(bind types.Bind) string {
+	return bind.Path + " " + bindParamsString(bind.Params)
+}
+
+// Order of crt parameters matters, first loaded certificate is the default one
+func bindParamsString(bindParams []params.BindOption) string {
+	parts := make([]string, 0, len(bindParams))
+	crts := []string{}
+	for _, param := range bindParams {
+		if bindParamName(param) == "crt" {
+			crts = append(crts, param.String())
+			continue
+		}
+		parts = append(parts, param.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(append(parts, crts...), " ")
+}
+
+func isSSLParam(param params.BindOption) bool {
+	name := bindParamName(param)
+	_, sslWord := sslBindOptionWords[name]
+	_, sslValue := sslBindOptionValues[name]
+	return sslWord || sslValue || name == "ssl" || name == "crt" || name == "alpn"
+}
+
+// Make frontend listen on port of every bind address, with shared parameters on each bind line.
+// Binds are written with the config parser, client-native models can't hold
+// IPv6 addresses other than "::" nor the v6only option
+func (c *HAProxyController) frontendBindsSet(frontend string, port int64, shared []params.BindOption) (reload bool, err error) {
+	binds := make([]types.Bind, 0, len(c.bindAddresses))
+	for i, address := range c.bindAddresses {
+		if port == 0 {
+			break
+		}
+		bind := types.Bind{
+			Path:   fmt.Sprintf("%s:%d", address.address, port),
+			Params: []params.BindOption{&params.BindOptionValue{Name: "name", Value: fmt.Sprintf("bind_%d", i+1)}},
+		}
+		if address.v4v6 {
+			bind.Params = append(bind.Params, &params.BindOptionWord{Name: "v4v6"})
+		}
+		if address.v6only {
+			bind.Params = append(bind.Params, &params.BindOptionWord{Name: "v6only"})
+		}
+		bind.Params = append(bind.Params, shared...)
+		binds = append(binds, bind)
+	}
+	current := c.frontendBindsRaw(frontend)
+	if len(current) == len(binds) {
+		equal := true
+		for i := range binds {
+			if bindString(current[i]) != bindString(binds[i]) {
+				equal = false
+				break
+			}
+		}
+		if equal {
+			return false, nil
+		}
+	}
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return false, err
+	}
+	c.ActiveTransactionHasChanges = true
+	return true, config.Set(parser.Frontends, frontend, "bind", binds)
+}
+
+// Replace ssl parameters of every bind of frontend, other parameters are kept
+func (c *HAProxyController) frontendBindsSSLSet(frontend string, ssl []params.BindOption) error {
+	binds := c.frontendBindsRaw(frontend)
+	for i, bind := range binds {
+		bindParams := []params.BindOption{}
+		for _, param := range bind.Params {
+			if !isSSLParam(param) {
+				bindParams = append(bindParams, param)
+			}
+		}
+		binds[i].Params = append(bindParams, ssl...)
+	}
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return err
+	}
+	c.ActiveTransactionHasChanges = true
+	return config.Set(parser.Frontends, frontend, "bind", binds)
+}
+
+// Return port of HTTP or HTTPS frontend from http-bind-port or https-bind-port annotation,
+// defaultPort of --http-bind-port or --https-bind-port is used when it is incorrect
+func (c *HAProxyController) frontendPort(annotation string, defaultPort int) int64 {
+	ann, _ := GetValueFromAnnotations(annotation, c.cfg.ConfigMap.Annotations)
+	if ann == nil {
+		return int64(defaultPort)
+	}
+	port, err := strconv.ParseInt(ann.Value, 10, 64)
+	if err != nil || port < 0 || port > 65535 {
+		utils.LogErr(fmt.Errorf("%s annotation: incorrect value '%s'", annotation, ann.Value))
+		return int64(defaultPort)
+	}
+	return port
+}
+
+func (c *HAProxyController) httpPort() int64 {
+	return c.frontendPort("http-bind-port", c.osArgs.HTTPBindPort)
+}
+
+func (c *HAProxyController) httpsPort() int64 {
+	return c.frontendPort("https-bind-port", c.osArgs.HTTPSBindPort)
+}
+
+// Frontends without port have no bind and are disabled
+func (c *HAProxyController) frontendDisabledSet(frontend string, disabled bool) (reload bool) {
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	current := false
+	if data, errGet := config.Get(parser.Frontends, frontend, ""); errGet == nil {
+		for _, line := range data.([]types.UnProcessed) {
+			if line.Value == "disabled" {
+				current = true
+			}
+		}
+	}
+	if current == disabled {
+		return false
+	}
+	values := []string{}
+	if disabled {
+		logger.Infof("Disabling frontend '%s'", frontend)
+		values = append(values, "disabled")
+	} else {
+		logger.Infof("Enabling frontend '%s'", frontend)
+	}
+	utils.LogErr(c.unprocessedSet(parser.Frontends, frontend, "disabled", values))
+	return true
+}
+
+// Update binds of HTTP, HTTPS and SSL passthrough frontends to bind addresses, HTTP/HTTPS
+// ports and accept-proxy of proxy-protocol annotation, binds of TCP services frontends are
+// set by handleTCPServices
+func (c *HAProxyController) handleBinds() (reload bool) {
+	frontends, err := c.frontendsGet()
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	httpPort := c.httpPort()
+	httpsPort := c.httpsPort()
+	for _, frontend := range frontends {
+		var port int64
+		var shared []params.BindOption
+		switch {
+		case frontend.Name == FrontendHTTP:
+			port = httpPort
+		case frontend.Name == FrontendSSL:
+			port = httpsPort
+		case frontend.Name == FrontendHTTPS:
+			if c.cfg.SSLPassthrough {
+				continue
+			}
+			port = httpsPort
+			if c.cfg.HTTPS {
+				shared = c.httpsBindParams()
+			}
+		default:
+			continue
+		}
+		if c.proxyProtocol(frontend.Name).acceptProxy {
+			shared = append(shared, &params.BindOptionWord{Name: "accept-proxy"})
+		}
+		r, errBinds := c.frontendBindsSet(frontend.Name, port, shared)
+		utils.LogErr(errBinds)
+		if r {
+			logger.Debugf("binds of frontend '%s' updated", frontend.Name)
+		}
+		r = c.frontendDisabledSet(frontend.Name, port == 0) || r
+		reload = reload || r
+	}
+	return reload
+}
@@ -0,0 +1,309 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/common"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+// Name of the section config snippets of frontends and backends are parsed in
+const snippetSection = "snippet"
+
+// Sections can't be declared in config snippets
+var snippetSections = map[string]struct{}{
+	"global": {}, "defaults": {}, "frontend": {}, "backend": {}, "listen": {},
+	"resolvers": {}, "userlist": {}, "peers": {}, "mailers": {}, "cache": {}, "program": {},
+}
+
+// Directives managed by the controller can't be set in config snippets
+var snippetForbidden = map[parser.Section]map[string]struct{}{
+	parser.Global:    {"daemon": {}, "master-worker": {}, "pidfile": {}},
+	parser.Frontends: {"mode": {}, "bind": {}},
+	parser.Backends:  {"mode": {}, "server": {}},
+}
+
+// Directive of a config snippet, data is what config parser holds for attribute
+type snippetDirective struct {
+	attribute string
+	data      common.ParserData
+}
+
+// Config snippet of a section, directives are applied on top of the ones set by the controller
+type configSnippet struct {
+	value      string
+	directives []snippetDirective
+	applied    []snippetDirective
+}
+
+// Parse config snippet of a section with config parser. Directives config parser
+// does not know or can't parse are rejected when allowUnknown is false, otherwise
+// they are kept as they are and checked with HAProxy configuration before commit.
+func parseConfigSnippet(section parser.Section, value string, allowUnknown bool) ([]snippetDirective, error) {
+	lines := []string{}
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		_, isSection := snippetSections[fields[0]]
+		_, forbidden := snippetForbidden[section][fields[0]]
+		if isSection || forbidden {
+			return nil, fmt.Errorf("'%s' can't be set in config snippets", fields[0])
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	header, sectionName := fmt.Sprintf("%s %s", section, snippetSection), snippetSection
+	if section == parser.Global {
+		header, sectionName = "global", parser.GlobalSectionName
+	}
+	p := parser.Parser{}
+	if err := p.ParseData(header + "\n" + strings.Join(lines, "\n")); err != nil {
+		return nil, err
+	}
+	directives := []snippetDirective{}
+	for _, attrParser := range p.Parsers[section][sectionName].Parsers {
+		data, err := attrParser.Get(false)
+		if err != nil {
+			continue
+		}
+		switch d := data.(type) {
+		case *types.Section:
+			continue
+		case []types.UnProcessed:
+			if len(d) == 0 {
+				continue
+			}
+			if !allowUnknown {
+				return nil, fmt.Errorf("unknown or incorrect directive '%s'", d[0].Value)
+			}
+		}
+		directives = append(directives, snippetDirective{
+			attribute: attrParser.GetParserName(),
+			data:      data,
+		})
+	}
+	return directives, nil
+}
+
+// Update snippet from annotation value, previous snippet is kept when value is incorrect
+func (snippet *configSnippet) update(section parser.Section, value string, allowUnknown bool) error {
+	if value == snippet.value {
+		return nil
+	}
+	directives, err := parseConfigSnippet(section, value, allowUnknown)
+	if err != nil {
+		return err
+	}
+	snippet.value = value
+	snippet.directives = directives
+	return nil
+}
+
+// Apply directives of snippet to section when they changed or the controller
+// changed or removed them (for example with http-request rules), directives of
+// previously applied snippet are removed first so changed snippets are replaced
+func (c *HAProxyController) snippetApply(section parser.Section, sectionName string, snippet *configSnippet) (reload bool) {
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return false
+	}
+	if reflect.DeepEqual(snippet.applied, snippet.directives) && snippetApplied(config, section, sectionName, snippet.directives) {
+		return false
+	}
+	logger.Debugf("applying config snippet of %s '%s'", section, sectionName)
+	err = snippetDirectivesRemove(config, section, sectionName, snippet.applied)
+	if err == nil {
+		err = snippetDirectivesAdd(config, section, sectionName, snippet.directives)
+	}
+	if err != nil {
+		utils.LogErr(fmt.Errorf("config snippet of %s '%s': %s", section, sectionName, err))
+	}
+	c.ActiveTransactionHasChanges = true
+	return true
+}
+
+// global-config-snippet and frontend-config-snippet ConfigMap annotations,
+// global snippet is applied at once and frontends one by refreshConfigSnippets
+func (c *HAProxyController) handleConfigSnippets() (reload bool) {
+	for _, name := range []string{"global-config-snippet", "frontend-config-snippet"} {
+		ann, _ := GetValueFromAnnotations(name, c.cfg.ConfigMap.Annotations)
+		value := ""
+		if ann != nil && ann.Status != DELETED {
+			value = ann.Value
+		}
+		snippet, section := &c.cfg.GlobalSnippet, parser.Global
+		if name == "frontend-config-snippet" {
+			snippet, section = &c.cfg.FrontendSnippet, parser.Frontends
+		}
+		if err := snippet.update(section, value, true); err != nil {
+			utils.LogErr(fmt.Errorf("%s annotation: %s", name, err))
+		}
+	}
+	reload = c.snippetApply(parser.Global, parser.GlobalSectionName, &c.cfg.GlobalSnippet)
+	c.cfg.GlobalSnippet.applied = c.cfg.GlobalSnippet.directives
+	return reload
+}
+
+// backend-config-snippet annotation of service or ingress, it is applied by refreshConfigSnippets
+func (c *HAProxyController) handleBackendConfigSnippet(ingress *Ingress, service *Service, backendName string) {
+	annSnippet, _ := c.backendAnnotation("backend-config-snippet", ingress, service)
+	value := ""
+	if annSnippet != nil && annSnippet.Status != DELETED {
+		value = annSnippet.Value
+	}
+	if value != "" && c.osArgs.DisableConfigSnippets {
+		utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation,
+			fmt.Errorf("backend-config-snippet annotation of backend '%s': config snippets are disabled by --disable-config-snippets", backendName)))
+		value = ""
+	}
+	snippet, ok := c.cfg.BackendSnippets[backendName]
+	if !ok {
+		if value == "" {
+			return
+		}
+		snippet = &configSnippet{}
+		c.cfg.BackendSnippets[backendName] = snippet
+	}
+	if err := snippet.update(parser.Backends, value, false); err != nil {
+		utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation,
+			fmt.Errorf("backend-config-snippet annotation of backend '%s': %s", backendName, err)))
+	}
+}
+
+// Apply config snippets of HTTP and HTTPS frontends and of backends,
+// once the controller has refreshed their rules
+func (c *HAProxyController) refreshConfigSnippets() (reload bool) {
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		if _, err := c.frontendGet(frontend); err == nil {
+			reload = c.snippetApply(parser.Frontends, frontend, &c.cfg.FrontendSnippet) || reload
+		}
+	}
+	c.cfg.FrontendSnippet.applied = c.cfg.FrontendSnippet.directives
+	for backendName, snippet := range c.cfg.BackendSnippets {
+		if _, err := c.backendGet(backendName); err != nil {
+			delete(c.cfg.BackendSnippets, backendName)
+			continue
+		}
+		reload = c.snippetApply(parser.Backends, backendName, snippet) || reload
+		snippet.applied = snippet.directives
+		if len(snippet.directives) == 0 {
+			delete(c.cfg.BackendSnippets, backendName)
+		}
+	}
+	return reload
+}
+
+// Return true if all directives are set in section
+func snippetApplied(config *parser.Parser, section parser.Section, sectionName string, directives []snippetDirective) bool {
+	for _, directive := range directives {
+		current, err := config.Get(section, sectionName, directive.attribute)
+		if err != nil {
+			return false
+		}
+		data := reflect.ValueOf(directive.data)
+		if data.Kind() != reflect.Slice {
+			if !reflect.DeepEqual(current, directive.data) {
+				return false
+			}
+			continue
+		}
+		for i := 0; i < data.Len(); i++ {
+			if !sliceContains(reflect.ValueOf(current), data.Index(i)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func snippetDirectivesRemove(config *parser.Parser, section parser.Section, sectionName string, directives []snippetDirective) error {
+	for _, directive := range directives {
+		current, err := config.Get(section, sectionName, directive.attribute)
+		if err != nil {
+			continue
+		}
+		data := reflect.ValueOf(directive.data)
+		if data.Kind() != reflect.Slice {
+			if reflect.DeepEqual(current, directive.data) {
+				if err = config.Set(section, sectionName, directive.attribute, nil); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		currentValue := reflect.ValueOf(current)
+		kept := reflect.MakeSlice(currentValue.Type(), 0, currentValue.Len())
+		for i := 0; i < currentValue.Len(); i++ {
+			if !sliceContains(data, currentValue.Index(i)) {
+				kept = reflect.Append(kept, currentValue.Index(i))
+			}
+		}
+		var value common.ParserData
+		if kept.Len() > 0 {
+			value = kept.Interface()
+		}
+		if err = config.Set(section, sectionName, directive.attribute, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Directives holding several values (acl, http-request...) are added after the ones
+// of the controller, others replace them. Config parser writes directives in a fixed
+// order, unknown ones at the end of the section, so syncs don't reorder them.
+func snippetDirectivesAdd(config *parser.Parser, section parser.Section, sectionName string, directives []snippetDirective) error {
+	for _, directive := range directives {
+		value := directive.data
+		data := reflect.ValueOf(directive.data)
+		if data.Kind() == reflect.Slice {
+			merged := reflect.MakeSlice(data.Type(), 0, data.Len())
+			if current, err := config.Get(section, sectionName, directive.attribute); err == nil {
+				currentValue := reflect.ValueOf(current)
+				if currentValue.Type() != data.Type() {
+					return errors.New("unexpected data of " + directive.attribute)
+				}
+				merged = reflect.AppendSlice(merged, currentValue)
+			}
+			for i := 0; i < data.Len(); i++ {
+				if !sliceContains(merged, data.Index(i)) {
+					merged = reflect.Append(merged, data.Index(i))
+				}
+			}
+			value = merged.Interface()
+		}
+		if err := config.Set(section, sectionName, directive.attribute, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sliceContains(slice, item reflect.Value) bool {
+	for i := 0; i < slice.Len(); i++ {
+		if reflect.DeepEqual(slice.Index(i).Interface(), item.Interface()) {
+			return true
+		}
+	}
+	return false
+}
@@ -15,11 +15,13 @@
 package controller
 
 import (
+	"net"
 	"strings"
 
 	"github.com/haproxytech/kubernetes-ingress/controller/haproxy"
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
 	"github.com/haproxytech/models"
+	corev1 "k8s.io/api/core/v1"
 )
 
 //Configuration represents k8s state
@@ -33,6 +35,8 @@ type Configuration struct {
 	Namespace              map[string]*Namespace
 	NamespacesAccess       NamespacesWatch
 	IngressClass           string
+	IngressClasses         map[string]*IngressClass
+	EmptyIngressClass      bool
 	ConfigMap              *ConfigMap
 	ConfigMapTCPServices   *ConfigMap
 	PublishService         *Service
@@ -41,11 +45,32 @@ type Configuration struct {
 	FrontendHTTPRspRules   map[Rule]FrontendHTTPRsps
 	FrontendTCPRules       map[Rule]FrontendTCPReqs
 	FrontendRulesStatus    map[Mode]Status
+	FrontendAuthRequests   map[uint64]AuthRequest
+	FrontendHTTPReturns    map[uint64]string
+	SourcePatternFiles     map[string]struct{}
+	CookieCaptures         []cookieCapture
+	SNIBlacklist           map[string]struct{}
 	BackendSwitchingRules  map[string]UseBackendRules
 	BackendSwitchingStatus map[string]struct{}
 	BackendHTTPRules       map[string]BackendHTTPReqs
+	BackendSnippets        map[string]*configSnippet
+	BackendMirrors         map[string]*requestMirror
+	SPOEFiles              map[string]string
+	ScaleFromZero          map[string]scaleFromZeroTarget
+	ModSecurityAgents      []string
+	MaxconnCommands        []string
+	GlobalSnippet          configSnippet
+	FrontendSnippet        configSnippet
+	ProxyProtocol          map[string]proxyProtocol
+	ForwardedHeaders       forwardedHeaders
+	UniqueID               uniqueID
+	LogSampling            logSampling
 	HTTPS                  bool
 	SSLPassthrough         bool
+	HTTPSOptions           string
+	HTTPSBindParams        string
+	DefaultCertificate     string
+	DefaultCertMissing     bool
 }
 
 func (c *Configuration) IsRelevantNamespace(namespace string) bool {
@@ -60,6 +85,32 @@ func (c *Configuration) IsRelevantNamespace(namespace string) bool {
 	return !ok
 }
 
+//IsRelevantIngress returns true if ingressClassName or ingress.class annotation of the ingress matches controller ones
+func (c *Configuration) IsRelevantIngress(ingress *Ingress) bool {
+	if ingress.Class != "" {
+		ingressClass, ok := c.IngressClasses[ingress.Class]
+		return ok && ingressClass.Controller == IngressClassController
+	}
+	ingressClass := ""
+	if annIngressClass, ok := ingress.Annotations["ingress.class"]; ok {
+		ingressClass = annIngressClass.Value
+	}
+	if ingressClass == "" && (c.EmptyIngressClass || c.isDefaultIngressClass()) {
+		return true
+	}
+	return ingressClass == c.IngressClass
+}
+
+// Returns true if one of controller IngressClasses is the default one of the cluster
+func (c *Configuration) isDefaultIngressClass() bool {
+	for _, ingressClass := range c.IngressClasses {
+		if ingressClass.Default && ingressClass.Controller == IngressClassController {
+			return true
+		}
+	}
+	return false
+}
+
 //Init itialize configuration
 func (c *Configuration) Init(osArgs utils.OSArgs, mapDir string) {
 
@@ -77,6 +128,8 @@ func (c *Configuration) Init(osArgs utils.OSArgs, mapDir string) {
 	}
 
 	c.IngressClass = osArgs.IngressClass
+	c.EmptyIngressClass = osArgs.EmptyIngressClass
+	c.IngressClasses = make(map[string]*IngressClass)
 
 	parts := strings.Split(osArgs.PublishService, "/")
 	if len(parts) == 2 {
@@ -84,32 +137,55 @@ func (c *Configuration) Init(osArgs utils.OSArgs, mapDir string) {
 			Namespace: parts[0],
 			Name:      parts[1],
 			Status:    EMPTY,
-			Addresses: []string{},
+			Addresses: []corev1.LoadBalancerIngress{},
+		}
+	}
+	// Static addresses are handled like the ones of a publish service which never changes,
+	// all ingresses get them on first sync and previous addresses are replaced.
+	if len(osArgs.PublishAddress) > 0 {
+		c.PublishService = &Service{
+			Status:    MODIFIED,
+			Addresses: []corev1.LoadBalancerIngress{},
+		}
+		for _, address := range osArgs.PublishAddress {
+			if net.ParseIP(address) != nil {
+				c.PublishService.Addresses = append(c.PublishService.Addresses, corev1.LoadBalancerIngress{IP: address})
+			} else {
+				c.PublishService.Addresses = append(c.PublishService.Addresses, corev1.LoadBalancerIngress{Hostname: address})
+			}
 		}
 	}
 
 	c.Namespace = make(map[string]*Namespace)
 
 	c.FrontendHTTPReqRules = make(map[Rule]FrontendHTTPReqs)
-	for _, rule := range []Rule{BLACKLIST, SSL_REDIRECT, RATE_LIMIT, REQUEST_CAPTURE, REQUEST_SET_HEADER, WHITELIST} {
+	for _, rule := range []Rule{ACCESS_LOG, APP_ROOT, BLACKLIST, CONN_LIMIT, CORS, METHODS, SSL_REDIRECT, RATE_LIMIT, REDIRECT, REQUEST_CAPTURE, REQUEST_DEL_HEADER, REQUEST_MAX_BODY_SIZE, REQUEST_SET_HEADER, WAF, WHITELIST} {
 		c.FrontendHTTPReqRules[rule] = make(map[uint64]models.HTTPRequestRule)
 	}
 	c.FrontendHTTPRspRules = make(map[Rule]FrontendHTTPRsps)
-	for _, rule := range []Rule{RESPONSE_SET_HEADER} {
+	for _, rule := range []Rule{CORS, HSTS, RESPONSE_CAPTURE, RESPONSE_DEL_HEADER, RESPONSE_SET_HEADER} {
 		c.FrontendHTTPRspRules[rule] = make(map[uint64]models.HTTPResponseRule)
 	}
 	c.FrontendTCPRules = make(map[Rule]FrontendTCPReqs)
-	for _, rule := range []Rule{BLACKLIST, REQUEST_CAPTURE, PROXY_PROTOCOL, WHITELIST} {
+	for _, rule := range []Rule{BLACKLIST, CONN_LIMIT, REQUEST_CAPTURE, PROXY_PROTOCOL, WHITELIST} {
 		c.FrontendTCPRules[rule] = make(map[uint64]models.TCPRequestRule)
 	}
 	c.FrontendRulesStatus = map[Mode]Status{
 		HTTP: EMPTY,
 		TCP:  EMPTY,
 	}
+	c.FrontendAuthRequests = make(map[uint64]AuthRequest)
+	c.FrontendHTTPReturns = make(map[uint64]string)
+	c.SourcePatternFiles = make(map[string]struct{})
+	c.SNIBlacklist = make(map[string]struct{})
 	c.MapFiles = haproxy.NewMapFiles(mapDir)
 
-	sslRedirectEnabled = make(map[string]struct{})
+	sslRedirectEnabled = make(map[string]uint64)
 	rateLimitTables = make(map[string]rateLimitTable)
+	responseCaptures = responseCaptureSlots{
+		ids:       make(map[string]int64),
+		requested: make(map[string]int64),
+	}
 
 	c.BackendSwitchingRules = make(map[string]UseBackendRules)
 	c.BackendSwitchingStatus = make(map[string]struct{})
@@ -117,6 +193,10 @@ func (c *Configuration) Init(osArgs utils.OSArgs, mapDir string) {
 		c.BackendSwitchingRules[frontend] = UseBackendRules{}
 	}
 	c.BackendHTTPRules = make(map[string]BackendHTTPReqs)
+	c.BackendSnippets = make(map[string]*configSnippet)
+	c.BackendMirrors = make(map[string]*requestMirror)
+	c.SPOEFiles = make(map[string]string)
+	c.ScaleFromZero = make(map[string]scaleFromZeroTarget)
 }
 
 //GetNamespace returns Namespace. Creates one if not existing
@@ -132,13 +212,16 @@ func (c *Configuration) GetNamespace(name string) *Namespace {
 //NewNamespace returns new initialized Namespace
 func (c *Configuration) NewNamespace(name string) *Namespace {
 	newNamespace := &Namespace{
-		Name:      name,
-		Relevant:  c.IsRelevantNamespace(name),
-		Endpoints: make(map[string]*Endpoints),
-		Services:  make(map[string]*Service),
-		Ingresses: make(map[string]*Ingress),
-		Secret:    make(map[string]*Secret),
-		Status:    ADDED,
+		Name:             name,
+		Relevant:         c.IsRelevantNamespace(name),
+		Endpoints:        make(map[string]*Endpoints),
+		Services:         make(map[string]*Service),
+		Ingresses:        make(map[string]*Ingress),
+		IgnoredIngresses: make(map[string]*Ingress),
+		Secret:           make(map[string]*Secret),
+		ConfigMaps:       make(map[string]*ConfigMap),
+		Pods:             make(map[string]*Pod),
+		Status:           ADDED,
 	}
 	c.Namespace[name] = newNamespace
 	return newNamespace
@@ -225,6 +308,14 @@ func (c *Configuration) Clean() {
 				data.Status = EMPTY
 			}
 		}
+		for _, data := range namespace.ConfigMaps {
+			switch data.Status {
+			case DELETED:
+				delete(namespace.ConfigMaps, data.Name)
+			default:
+				data.Status = EMPTY
+			}
+		}
 	}
 	c.ConfigMap.Annotations.Clean()
 	switch c.ConfigMap.Status {
@@ -249,9 +340,15 @@ func (c *Configuration) Clean() {
 	for rule := range c.FrontendHTTPRspRules {
 		c.FrontendHTTPRspRules[rule] = make(map[uint64]models.HTTPResponseRule)
 	}
+	responseCaptures.requested = make(map[string]int64)
 	for rule := range c.FrontendTCPRules {
 		c.FrontendTCPRules[rule] = make(map[uint64]models.TCPRequestRule)
 	}
+	c.FrontendAuthRequests = make(map[uint64]AuthRequest)
+	c.FrontendHTTPReturns = make(map[uint64]string)
+	c.SourcePatternFiles = make(map[string]struct{})
+	c.CookieCaptures = nil
+	c.SNIBlacklist = make(map[string]struct{})
 	c.FrontendRulesStatus[HTTP] = EMPTY
 	c.FrontendRulesStatus[TCP] = EMPTY
 	defaultAnnotationValues.Clean()
@@ -15,16 +15,17 @@
 package controller
 
 import (
-	"bufio"
 	"context"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	clientnative "github.com/haproxytech/client-native"
 	"github.com/haproxytech/client-native/configuration"
@@ -34,6 +35,16 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 )
 
+// Loggers of controller components
+var (
+	logger        = utils.GetLogger("controller")
+	k8sLogger     = utils.GetLogger("k8s")
+	haproxyLogger = utils.GetLogger("haproxy")
+)
+
+// Maximum duration of events processing stop and ingresses status cleanup on shutdown
+const shutdownStatusTimeout = 10 * time.Second
+
 // HAProxyController is ingress controller
 type HAProxyController struct {
 	k8s                         *K8s
@@ -45,6 +56,31 @@ type HAProxyController struct {
 	HAProxyCfgDir               string
 	eventChan                   chan SyncDataEvent
 	serverlessPods              map[string]int
+	leader                      int32
+	leaderResync                int32
+	health                      healthState
+	metrics                     controllerMetrics
+	testResult                  chan error
+	testDone                    bool
+	commitFailures              int
+	syncFailures                int
+	reloadPending               bool
+	reloadReasons               map[reloadReason]struct{}
+	secretIndex                 map[string]struct{}
+	forceFullSync               bool
+	resyncPending               int32
+	lastReload                  time.Time
+	bindAddresses               []bindAddress
+	ocspEnabled                 int32
+	syslogRelay                 *syslogRelay
+	statsFilter                 map[string]struct{}
+	statsPods                   atomic.Value
+	scaleFromZeroTargets        atomic.Value
+}
+
+// Return true if HAProxy binary version is at least major.minor
+func haproxyVersionAtLeast(major, minor int) bool {
+	return HAProxyVersion[0] > major || (HAProxyVersion[0] == major && HAProxyVersion[1] >= minor)
 }
 
 // Return Parser of current configuration (for config-parser usage)
@@ -55,38 +91,131 @@ func (c *HAProxyController) ActiveConfiguration() (*parser.Parser, error) {
 	return c.NativeAPI.Configuration.GetParser(c.ActiveTransaction)
 }
 
+// Time haproxyService("start") waits for HAProxy master to write its pid file
+const haproxyStartTimeout = 5 * time.Second
+
 // Rreturn HAProxy master process if it exists.
+// Pid file with invalid content, or with the pid of a process which is not HAProxy
+// (pid reused after a node crash), is removed and HAProxy is considered not running.
 func (c *HAProxyController) HAProxyProcess() (*os.Process, error) {
-	file, err := os.Open(HAProxyPIDFile)
+	return haproxyProcess()
+}
+
+func haproxyProcess() (*os.Process, error) {
+	content, err := ioutil.ReadFile(HAProxyPIDFile)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	scanner.Scan()
-	pid, err := strconv.Atoi(scanner.Text())
-	if err != nil {
-		return nil, err
+	pid, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0]))
+	if err != nil || pid <= 0 {
+		// HAProxy may be writing it
+		if info, errStat := os.Stat(HAProxyPIDFile); errStat == nil && time.Since(info.ModTime()) > haproxyStartTimeout {
+			utils.LogErr(removeStalePIDFile(fmt.Sprintf("invalid content '%s'", strings.TrimSpace(string(content)))))
+		}
+		return nil, fmt.Errorf("haproxy pid file %s: invalid content", HAProxyPIDFile)
 	}
 	process, err := os.FindProcess(pid)
 	if err != nil {
 		return nil, err
 	}
-	err = process.Signal(syscall.Signal(0))
-	return process, err
+	if err = process.Signal(syscall.Signal(0)); err != nil {
+		utils.LogErr(removeStalePIDFile(fmt.Sprintf("process %d not running", pid)))
+		return nil, err
+	}
+	if !isHAProxyProcess(pid) {
+		utils.LogErr(removeStalePIDFile(fmt.Sprintf("process %d is not haproxy", pid)))
+		return nil, fmt.Errorf("haproxy pid file %s: process %d is not haproxy", HAProxyPIDFile, pid)
+	}
+	return process, nil
+}
+
+func removeStalePIDFile(reason string) error {
+	haproxyLogger.Warningf("removing stale pid file %s: %s", HAProxyPIDFile, reason)
+	if err := os.Remove(HAProxyPIDFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
-// Start initialize and run HAProxyController
-func (c *HAProxyController) Start(ctx context.Context, osArgs utils.OSArgs) {
+// Name of HAProxy processes in /proc/<pid>/comm
+var haproxyProcessName = "haproxy"
+
+// Check name of the process in /proc, processes can't be checked without /proc
+func isHAProxyProcess(pid int) bool {
+	if _, err := os.Stat("/proc/self"); err != nil {
+		return true
+	}
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(string(comm)), haproxyProcessName)
+}
+
+// Wait for HAProxy started by cmd to write its pid file, so that a reload right
+// after start signals it instead of starting another master.
+// In daemon mode the started process forks the master and exits: it is reaped here
+// and the pid file holds the pid of the forked master, not the one of cmd.
+func (c *HAProxyController) waitHAProxyStart(cmd *exec.Cmd, started time.Time) error {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	return waitHAProxyPIDFile(started, exited, haproxyStartTimeout)
+}
+
+// Wait for a pid file written after started with the pid of a running HAProxy process.
+// exited receives the exit status of the started process, an error means HAProxy failed to start.
+func waitHAProxyPIDFile(started time.Time, exited <-chan error, timeout time.Duration) error {
+	// pid file modification time may have a one second precision
+	started = started.Truncate(time.Second)
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if info, err := os.Stat(HAProxyPIDFile); err == nil && !info.ModTime().Before(started) {
+			if _, err = haproxyProcess(); err == nil {
+				return nil
+			}
+		}
+		select {
+		case err := <-exited:
+			if err != nil {
+				return fmt.Errorf("haproxy exited: %s", err)
+			}
+			// daemon mode, master forked
+			exited = nil
+		case <-deadline:
+			return fmt.Errorf("haproxy pid file %s not written %s after start", HAProxyPIDFile, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start initialize and run HAProxyController.
+// It returns when ctx is done or, in test mode with an output directory, after the first sync.
+func (c *HAProxyController) Start(ctx context.Context, osArgs utils.OSArgs) (err error) {
 
 	c.osArgs = osArgs
+	if c.bindAddresses, err = parseBindAddresses(osArgs); err != nil {
+		logger.Fatalf("Incorrect bind addresses: %s", err)
+	}
+	for _, port := range []int{osArgs.HTTPBindPort, osArgs.HTTPSBindPort} {
+		if port < 0 || port > 65535 {
+			logger.Fatalf("Incorrect frontend port %d", port)
+		}
+	}
+	annotationPrefixes = osArgs.AnnotationPrefix
+	SetDefaultAnnotation("http-bind-port", strconv.Itoa(osArgs.HTTPBindPort))
+	SetDefaultAnnotation("https-bind-port", strconv.Itoa(osArgs.HTTPSBindPort))
 
 	c.haproxyInitialize()
 
 	var k8s *K8s
-	var err error
 
-	if osArgs.OutOfCluster {
+	if osArgs.Test && osArgs.TestInput != "" {
+		k8s, err = GetTestKubernetesClient(osArgs.TestInput, osArgs.ConfigMap)
+	} else if osArgs.OutOfCluster {
 		kubeconfig := filepath.Join(utils.HomeDir(), ".kube", "config")
 		if osArgs.KubeConfig != "" {
 			kubeconfig = osArgs.KubeConfig
@@ -102,15 +231,72 @@ func (c *HAProxyController) Start(ctx context.Context, osArgs utils.OSArgs) {
 
 	x := k8s.API.Discovery()
 	if k8sVersion, err := x.ServerVersion(); err != nil {
-		log.Fatalf("Unable to get Kubernetes version: %v\n", err)
+		logger.Fatalf("Unable to get Kubernetes version: %v\n", err)
 	} else {
-		log.Printf("Running on Kubernetes version: %s %s", k8sVersion.String(), k8sVersion.Platform)
+		logger.Infof("Running on Kubernetes version: %s %s", k8sVersion.String(), k8sVersion.Platform)
+	}
+	k8s.SetIngressAPIVersion()
+	k8s.SetEndpointSliceAPI()
+	k8s.InitEventRecorder()
+	logger.Infof("Watching Ingress API version: %s", k8s.IngressAPIVersion)
+	if k8s.EndpointSliceAPI {
+		logger.Infof("Watching EndpointSlices (%s)", endpointSliceGroupVersion)
 	}
 
 	c.serverlessPods = map[string]int{}
 	c.eventChan = make(chan SyncDataEvent, watch.DefaultChanSize*6)
+	// Leadership is kept until ingresses status is cleaned on shutdown,
+	// a new leader pushes a resync to eventChan
+	leaderCtx, leaderCancel := context.WithCancel(context.Background())
+	defer leaderCancel()
+	c.runLeaderElection(leaderCtx)
+	c.testResult = make(chan error, 1)
+	c.runHealthz()
+	c.runMetrics()
+	c.runPprof()
+	c.runOCSPUpdater()
+	c.runScaleFromZeroMonitor()
 	go c.monitorChanges()
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+	case err = <-c.testResult:
+		return err
+	}
+
+	// SyncData stops processing events once ingresses status is cleaned
+	done := make(chan struct{})
+	timeout := time.After(shutdownStatusTimeout)
+	select {
+	case c.eventChan <- SyncDataEvent{SyncType: SHUTDOWN, Data: done}:
+		select {
+		case <-done:
+		case <-timeout:
+			logger.Warning("Timeout while waiting for events processing to stop")
+		}
+	case <-timeout:
+		logger.Warning("Timeout while waiting for events processing to stop")
+	}
+	c.haproxyShutdown()
+	return nil
+}
+
+// Remove publish service addresses from status of handled ingresses.
+// Called from SyncData so ingresses are not modified meanwhile.
+func (c *HAProxyController) removeIngressesStatus() {
+	logger.Info("Removing publish service addresses from ingresses status")
+	for _, namespace := range c.cfg.Namespace {
+		if !namespace.Relevant {
+			continue
+		}
+		for _, ingress := range namespace.Ingresses {
+			if ingress.Status == DELETED {
+				continue
+			}
+			utils.LogErr(c.k8s.RemoveIngressStatus(ingress, c.cfg.PublishService))
+		}
+	}
+	// Status is not written anymore by this replica
+	atomic.StoreInt32(&c.leader, 0)
 }
 
 // Sync HAProxy configuration
@@ -126,35 +312,40 @@ func (c *HAProxyController) updateHAProxy() error {
 		c.apiDisposeTransaction()
 	}()
 
-	reload, restart := c.handleGlobalAnnotations()
+	restart, reload := c.handleGlobalAnnotations()
+	reload = c.reloadRequired(ReloadServerState, "", c.handleServerState()) || reload
 
 	r, err := c.handleDefaultService()
 	utils.LogErr(err)
-	reload = reload || r
+	reload = c.reloadRequired(ReloadDefaultService, "", r) || reload
 
 	usedCerts := map[string]struct{}{}
-
+	var managedIngresses, handledIngresses int64
+	// Backends of unchanged ingresses are kept as they are
+	fullSync := c.forceFullSync || c.fullSyncRequired()
+	c.forceFullSync = false
+
+	updateStatus := c.cfg.PublishService != nil && c.isLeader()
+	if updateStatus && c.leaderResyncRequired() {
+		// New leader: status of all ingresses is written
+		c.cfg.PublishService.Status = MODIFIED
+	}
+	ingressSSLOptions := map[string][]string{}
+	c.cfg.ModSecurityAgents = c.modsecAgents()
 	for _, namespace := range c.cfg.Namespace {
 		if !namespace.Relevant {
 			continue
 		}
 		for _, ingress := range namespace.Ingresses {
-			if c.cfg.PublishService != nil && ingress.Status != DELETED {
+			if updateStatus && (ingress.Status != DELETED || ingress.ClassChanged) {
 				utils.LogErr(c.k8s.UpdateIngressStatus(ingress, c.cfg.PublishService))
 			}
-			// handle Default Backend
-			if ingress.DefaultBackend != nil {
-				r, err = c.handlePath(namespace, ingress, &IngressRule{}, ingress.DefaultBackend)
-				utils.LogErr(err)
-				reload = reload || r
+			if ingress.Status != DELETED {
+				managedIngresses++
 			}
-			// handle Ingress rules
-			for _, rule := range ingress.Rules {
-				for _, path := range rule.Paths {
-					r, err = c.handlePath(namespace, ingress, rule, path)
-					reload = reload || r
-					utils.LogErr(err)
-				}
+			if fullSync || c.ingressChanged(namespace, ingress) {
+				handledIngresses++
+				reload = c.handleIngressBackends(namespace, ingress) || reload
 			}
 			//handle certs
 			ingressSecrets := map[string]struct{}{}
@@ -162,69 +353,248 @@ func (c *HAProxyController) updateHAProxy() error {
 				if _, ok := ingressSecrets[tls.SecretName.Value]; !ok {
 					ingressSecrets[tls.SecretName.Value] = struct{}{}
 					r = c.handleTLSSecret(*ingress, *tls, usedCerts)
-					reload = reload || r
+					reload = c.reloadRequired(ReloadCerts, "tls secret "+tls.SecretName.Value+" of ingress "+ingress.Namespace+"/"+ingress.Name, r) || reload
 				}
 			}
 
-			utils.LogErr(c.handleRateLimiting(ingress))
-			utils.LogErr(c.handleRequestCapture(ingress))
-			utils.LogErr(c.handleRequestSetHdr(ingress))
-			utils.LogErr(c.handleResponseSetHdr(ingress))
-			utils.LogErr(c.handleBlacklisting(ingress))
-			utils.LogErr(c.handleWhitelisting(ingress))
-			utils.LogErr(c.handleHTTPRedirect(ingress))
+			r, err = c.handleAuth(namespace, ingress)
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, err))
+			reload = c.reloadRequired(ReloadAuth, "ingress "+ingress.Namespace+"/"+ingress.Name, r) || reload
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleIngressSSLOptions(ingress, ingressSSLOptions)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleConnLimiting(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleRateLimiting(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleRequestCapture(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleCaptureCookie(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleRequestMaxBodySize(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleRequestSetHdr(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleResponseCapture(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleResponseSetHdr(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleRequestDelHdr(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleResponseDelHdr(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleBlacklisting(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleCORS(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleWhitelisting(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleRequestHeaderAccess(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleAllowedMethods(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleAccessLog(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleHTTPRedirect(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleRedirect(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleAppRoot(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleWAF(ingress)))
+			utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation, c.handleHSTS(ingress)))
 		}
 	}
 
 	utils.LogErr(c.handleProxyProtocol())
+	utils.LogErr(c.handleForwardedHeaders())
+	reload = c.reloadRequired(ReloadUniqueID, "", c.handleUniqueID()) || reload
+	utils.LogErr(c.handleGlobalConnLimiting())
+	utils.LogErr(c.handleDisallowedMethods())
 
 	r = c.handleDefaultCertificate(usedCerts)
-	reload = reload || r
+	reload = c.reloadRequired(ReloadCerts, "default certificate", r) || reload
 
-	r = c.handleHTTPS(usedCerts)
-	reload = reload || r
+	// SSL passthrough frontend checks SNI blacklist, see handleHTTPS
+	reload = c.reloadRequired(ReloadSNIBlacklist, "", c.handleSNIBlacklist()) || reload
 
-	reload = c.FrontendHTTPReqsRefresh() || reload
+	r = c.handleHTTPS(usedCerts, httpsBindSSLOptions(ingressSSLOptions))
+	reload = c.reloadRequired(ReloadHTTPS, "", r) || reload
 
-	reload = c.FrontendHTTPRspsRefresh() || reload
+	reload = c.reloadRequired(ReloadOCSP, "ocsp-stapling annotation", c.handleOCSPStapling()) || reload
 
-	reload = c.FrontendTCPreqsRefresh() || reload
+	r = c.reloadRequired(ReloadFrontendRules, "http-request rules", c.FrontendHTTPReqsRefresh())
+	r = c.reloadRequired(ReloadFrontendRules, "http-response rules", c.FrontendHTTPRspsRefresh()) || r
+	r = c.reloadRequired(ReloadFrontendRules, "tcp-request rules", c.FrontendTCPreqsRefresh()) || r
+	if r {
+		c.traceFrontendRules(FrontendHTTP, FrontendHTTPS, FrontendSSL)
+	}
+	reload = reload || r
 
-	reload = c.BackendHTTPReqsRefresh() || reload
+	reload = c.reloadRequired(ReloadBackendRules, "", c.BackendHTTPReqsRefresh()) || reload
 
-	r, err = c.cfg.MapFiles.Refresh()
+	mapFiles, err := c.cfg.MapFiles.Refresh()
 	utils.LogErr(err)
-	reload = reload || r
+	reload = c.reloadRequired(ReloadMapRefresh, strings.Join(mapFiles, ", "), len(mapFiles) > 0) || reload
 
-	r, err = c.handleTCPServices()
+	r, err = c.handleTCPServices(usedCerts)
 	utils.LogErr(err)
-	reload = reload || r
+	reload = c.reloadRequired(ReloadTCPServices, "", r) || reload
+
+	reload = c.reloadRequired(ReloadBinds, "", c.handleBinds()) || reload
 
 	r = c.refreshBackendSwitching()
-	reload = reload || r
+	reload = c.reloadRequired(ReloadBackendSwitching, "", r) || reload
+
+	reload = c.reloadRequired(ReloadConfigSnippets, "", c.refreshConfigSnippets()) || reload
+
+	reload = c.reloadRequired(ReloadRequestMirrors, "", c.refreshRequestMirrors()) || reload
+
+	reload = c.reloadRequired(ReloadModSecurity, "", c.refreshModSecurity()) || reload
+
+	c.refreshScaleFromZero()
+	reload = c.reloadRequired(ReloadLuaScripts, "", c.refreshLuaLoad()) || reload
+
+	if backends, errBackends := c.backendsGet(); errBackends == nil {
+		atomic.StoreInt64(&c.metrics.managedBackends, int64(len(backends)))
+	}
+	atomic.StoreInt64(&c.metrics.managedIngresses, managedIngresses)
+	logger.Debugf("backends of %d/%d ingresses handled (full sync: %t)", handledIngresses, managedIngresses, fullSync)
+
+	usedErrorFiles := c.usedErrorFiles()
+	var renamedServers map[*EndpointIP]string
+	if restart || c.reloadDue(reload) {
+		renamedServers = c.renameReusedServers()
+	}
 
 	err = c.apiCommitTransaction()
 	if err != nil {
 		utils.LogErr(err)
+		c.logCommitError(err)
+		c.recordSyncFailure(err)
+		c.configCommitFailed(err)
+		restoreServerNames(renamedServers)
+		// SPOE configuration files are set again by the full sync
+		c.cfg.SPOEFiles = make(map[string]string)
+		c.cfg.MaxconnCommands = nil
+		// Changes of the transaction are computed again by a full sync, retried by SyncData
+		c.forceFullSync = true
+		// Changes of the transaction requiring a reload were not committed
+		if !c.reloadPending {
+			c.reloadReasons = nil
+		}
 		return err
 	}
+	c.configCommitted()
+	// certificates are only removed once configuration not using them is committed
+	r, err = c.cleanCertDir(usedCerts)
+	utils.LogErr(err)
+	reload = c.reloadRequired(ReloadCerts, "removed certificates", r) || reload
+	// same for error files of errorfiles annotations and pattern files of source lists
+	cleanErrorFiles(usedErrorFiles)
+	utils.LogErr(c.sourcePatternFilesClean())
+	c.writeSPOEFiles()
+	// maxconn of the running process is only changed once the configuration is committed
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "maxconn annotation", c.runtimeMaxconn()) || reload
 	c.cfg.Clean()
 	if restart {
+		// Restarts are not rate limited and include pending reload
 		if err := c.haproxyService("restart"); err != nil {
 			utils.LogErr(err)
 		} else {
-			log.Println("HAProxy restarted")
+			c.reloadPending = false
+			c.reloadReasons = nil
+			c.lastReload = time.Now()
+			haproxyLogger.Info("HAProxy restarted")
 		}
 		return nil
 	}
-	if reload {
-		if err := c.haproxyService("reload"); err != nil {
+	c.reloadHAProxy(reload)
+	return nil
+}
+
+// Handle backends of default backend and paths of ingress
+func (c *HAProxyController) handleIngressBackends(namespace *Namespace, ingress *Ingress) (reload bool) {
+	// handle Default Backend
+	if ingress.DefaultBackend != nil {
+		r, err := c.handlePath(namespace, ingress, &IngressRule{}, ingress.DefaultBackend)
+		utils.LogErr(err)
+		reload = c.reloadRequired(ReloadBackend, "default backend of ingress "+ingress.Namespace+"/"+ingress.Name, r) || reload
+	}
+	// handle Ingress rules
+	for _, rule := range ingress.Rules {
+		for _, path := range rule.Paths {
+			r, err := c.handlePath(namespace, ingress, rule, path)
+			reload = c.reloadRequired(ReloadBackend, "path "+rule.Host+path.Path+" of ingress "+ingress.Namespace+"/"+ingress.Name, r) || reload
 			utils.LogErr(err)
-		} else {
-			log.Println("HAProxy reloaded")
 		}
 	}
-	return nil
+	return reload
+}
+
+// Return true if reloadHAProxy reloads HAProxy now
+func (c *HAProxyController) reloadDue(reload bool) bool {
+	return (reload || c.reloadPending) && time.Since(c.lastReload) >= c.osArgs.ReloadInterval
+}
+
+// Reload HAProxy at most once per --reload-interval, reloads required meanwhile
+// are coalesced in a pending one done by a later sync.
+func (c *HAProxyController) reloadHAProxy(reload bool) {
+	if !reload && !c.reloadPending {
+		return
+	}
+	if since := time.Since(c.lastReload); since < c.osArgs.ReloadInterval {
+		if reload {
+			atomic.AddUint64(&c.metrics.reloadsRateLimited, 1)
+		}
+		if !c.reloadPending {
+			haproxyLogger.Infof("HAProxy reload deferred for %s (--reload-interval)", (c.osArgs.ReloadInterval - since).Round(time.Millisecond))
+		}
+		c.reloadPending = true
+		return
+	}
+	c.reloadPending = false
+	if err := c.haproxyService("reload"); err != nil {
+		utils.LogErr(err)
+	} else {
+		c.lastReload = time.Now()
+		reasons := c.takeReloadReasons()
+		c.metrics.reloadDone(reasons)
+		haproxyLogger.Infof("HAProxy reloaded (%s)", strings.Join(reasons, ", "))
+	}
+}
+
+func restartRequired(handler string, restart bool) bool {
+	if restart {
+		logger.Debugf("restart required by %s", handler)
+	}
+	return restart
+}
+
+// Log at trace level the rules of refreshed frontends
+func (c *HAProxyController) traceFrontendRules(frontends ...string) {
+	if !utils.LogLevelEnabled(utils.LogLevelTrace) {
+		return
+	}
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return
+	}
+	lines := strings.Split(config.String(), "\n")
+	for _, frontend := range frontends {
+		inSection := false
+		for _, line := range lines {
+			if !strings.HasPrefix(line, " ") {
+				inSection = strings.TrimSpace(line) == "frontend "+frontend
+				continue
+			}
+			line = strings.TrimSpace(line)
+			if inSection && (strings.HasPrefix(line, "http-request") || strings.HasPrefix(line, "http-response") || strings.HasPrefix(line, "tcp-request")) {
+				logger.Tracef("frontend %s: %s", frontend, line)
+			}
+		}
+	}
+}
+
+// Record failed transaction on ingresses modified since last sync,
+// or on controller pod when no ingress was modified.
+func (c *HAProxyController) recordSyncFailure(err error) {
+	message := fmt.Sprintf("HAProxy configuration update failed: %s", err)
+	touched := false
+	for _, namespace := range c.cfg.Namespace {
+		if !namespace.Relevant {
+			continue
+		}
+		for _, ingress := range namespace.Ingresses {
+			if ingress.Status == EMPTY || ingress.Status == DELETED {
+				continue
+			}
+			c.k8s.IngressEvent(ingress, ReasonSyncFailed, message)
+			touched = true
+		}
+	}
+	if !touched {
+		c.k8s.PodEvent(ReasonSyncFailed, message)
+	}
 }
 
 //HAProxyInitialize runs HAProxy for the first time so native client can have access to it
@@ -235,6 +605,9 @@ func (c *HAProxyController) haproxyInitialize() {
 	if HAProxyPIDFile == "" {
 		HAProxyPIDFile = "/var/run/haproxy.pid"
 	}
+	if HAProxySocket == "" {
+		HAProxySocket = "/var/run/haproxy-runtime-api.sock"
+	}
 	if _, err := os.Stat(HAProxyCFG); err != nil {
 		utils.PanicErr(err)
 	}
@@ -244,48 +617,61 @@ func (c *HAProxyController) haproxyInitialize() {
 	if HAProxyMapDir == "" {
 		HAProxyMapDir = filepath.Join(c.HAProxyCfgDir, "maps")
 	}
+	if HAProxyErrDir == "" {
+		HAProxyErrDir = filepath.Join(c.HAProxyCfgDir, "errors")
+	}
+	if HAProxyLuaDir == "" {
+		HAProxyLuaDir = filepath.Join(c.HAProxyCfgDir, "lua")
+	}
 	if HAProxyStateDir == "" {
 		HAProxyStateDir = "/var/state/haproxy/"
 	}
-	for _, d := range []string{HAProxyCertDir, HAProxyMapDir, HAProxyStateDir} {
+	for _, d := range []string{HAProxyCertDir, HAProxyMapDir, HAProxyErrDir, HAProxyLuaDir, HAProxyStateDir} {
 		err := os.MkdirAll(d, 0755)
 		if err != nil {
 			utils.PanicErr(err)
 		}
 	}
+	utils.PanicErr(writeLuaScripts())
 
-	cmd := exec.Command("sh", "-c", "haproxy -v")
+	cmd := exec.Command("sh", "-c", "haproxy -vv")
 	haproxyInfo, err := cmd.Output()
 	if err == nil {
-		log.Println("Running with ", strings.ReplaceAll(string(haproxyInfo), "\n", ""))
+		info := string(haproxyInfo)
+		haproxyLogger.Info("Running with ", strings.SplitN(info, "\n", 2)[0])
+		if i := strings.Index(info, "version "); i >= 0 {
+			_, err = fmt.Sscanf(info[i+len("version "):], "%d.%d", &HAProxyVersion[0], &HAProxyVersion[1])
+			utils.LogErr(err)
+		}
+		HAProxyALPN = haproxyVersionAtLeast(1, 8) && alpnSupported(info)
+		if !HAProxyALPN {
+			haproxyLogger.Warning("HAProxy built without ALPN support, HTTP/2 is disabled")
+		}
 	} else {
-		log.Println(err)
+		haproxyLogger.Error(err)
 	}
 
-	log.Println("Starting HAProxy with", HAProxyCFG)
+	haproxyLogger.Info("Starting HAProxy with", HAProxyCFG)
 	utils.PanicErr(c.haproxyService("start"))
 
 	hostname, err := os.Hostname()
 	utils.LogErr(err)
-	log.Println("Running on", hostname)
+	haproxyLogger.Info("Running on", hostname)
 
 	runtimeClient := runtime.Client{}
 	err = runtimeClient.InitWithSockets(map[int]string{
-		0: "/var/run/haproxy-runtime-api.sock",
+		0: HAProxySocket,
 	})
 	if err != nil {
 		utils.PanicErr(err)
 	}
 
 	confClient := configuration.Client{}
-	err = confClient.Init(configuration.ClientParams{
-		ConfigurationFile:      HAProxyCFG,
-		PersistentTransactions: false,
-		Haproxy:                "haproxy",
-	})
+	err = confClient.Init(c.configurationParams())
 	if err != nil {
 		utils.PanicErr(err)
 	}
+	utils.LogErr(copyFile(HAProxyCFG, lastGoodCFG()))
 
 	c.NativeAPI = &clientnative.HAProxyClient{
 		Configuration: &confClient,
@@ -298,8 +684,13 @@ func (c *HAProxyController) haproxyInitialize() {
 
 // Handle HAProxy daemon via Master process
 func (c *HAProxyController) haproxyService(action string) (err error) {
+	defer func() {
+		if err == nil {
+			c.metrics.haproxyAction(action)
+		}
+	}()
 	if c.osArgs.Test {
-		log.Println("HAProxy would be reload" + action + "ed now")
+		haproxyLogger.Info("HAProxy would be reload" + action + "ed now")
 		return nil
 	}
 
@@ -317,7 +708,11 @@ func (c *HAProxyController) haproxyService(action string) (err error) {
 		cmd = exec.Command("haproxy", "-W", "-f", HAProxyCFG, "-p", HAProxyPIDFile)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		return cmd.Start()
+		started := time.Now()
+		if err = cmd.Start(); err != nil {
+			return err
+		}
+		return c.waitHAProxyStart(cmd, started)
 	case "stop":
 		if processErr != nil {
 			utils.LogErr(fmt.Errorf("haproxy  already stopped"))
@@ -341,35 +736,12 @@ func (c *HAProxyController) haproxyService(action string) (err error) {
 		cmd = exec.Command("haproxy", "-W", "-f", HAProxyCFG, "-p", HAProxyPIDFile, "-sf", pid)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		return cmd.Start()
+		started := time.Now()
+		if err = cmd.Start(); err != nil {
+			return err
+		}
+		return c.waitHAProxyStart(cmd, started)
 	default:
 		return fmt.Errorf("unkown command '%s'", action)
 	}
 }
-
-// Saves HAProxy servers state so it is retrieved after reload.
-func (c *HAProxyController) saveServerState() error {
-	result, err := c.NativeAPI.Runtime.ExecuteRaw("show servers state")
-	if err != nil {
-		return err
-	}
-	var f *os.File
-	if f, err = os.Create(HAProxyStateDir + "global"); err != nil {
-		log.Println(err)
-		return err
-	}
-	defer f.Close()
-	if _, err = f.Write([]byte(result[0])); err != nil {
-		log.Println(err)
-		return err
-	}
-	if err = f.Sync(); err != nil {
-		log.Println(err)
-		return err
-	}
-	if err = f.Close(); err != nil {
-		log.Println(err)
-		return err
-	}
-	return nil
-}
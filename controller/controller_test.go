@@ -0,0 +1,214 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	clientnative "github.com/haproxytech/client-native"
+	"github.com/haproxytech/client-native/configuration"
+	"github.com/haproxytech/client-native/runtime"
+)
+
+// Controller without HAProxy, runtime API commands are not sent
+func testController() *HAProxyController {
+	c := &HAProxyController{
+		NativeAPI: &clientnative.HAProxyClient{Runtime: &runtime.Client{}},
+	}
+	c.cfg.Namespace = map[string]*Namespace{}
+	c.cfg.ConfigMap = &ConfigMap{Annotations: MapStringW{}}
+	c.cfg.ScaleFromZero = map[string]scaleFromZeroTarget{}
+	return c
+}
+
+// Controller with an active transaction of configuration cfg, HAProxy is not run
+// to validate it
+func testControllerConfig(t testing.TB, cfg string) (*HAProxyController, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "haproxy-cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "haproxy.cfg")
+	if err = ioutil.WriteFile(file, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := testController()
+	client := &configuration.Client{}
+	err = client.Init(configuration.ClientParams{
+		ConfigurationFile: file,
+		TransactionDir:    filepath.Join(dir, "transactions"),
+		Haproxy:           "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.NativeAPI.Configuration = client
+	if err = c.apiStartTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// Use a pid file in a temporary directory and consider the test binary as HAProxy
+func setupPIDFile(t *testing.T) func() {
+	t.Helper()
+	if _, err := os.Stat("/proc/self/comm"); err != nil {
+		t.Skip("/proc is required")
+	}
+	dir, err := ioutil.TempDir("", "haproxy-pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comm, err := ioutil.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidFile, processName := HAProxyPIDFile, haproxyProcessName
+	HAProxyPIDFile = filepath.Join(dir, "haproxy.pid")
+	haproxyProcessName = strings.TrimSpace(string(comm))
+	return func() {
+		HAProxyPIDFile, haproxyProcessName = pidFile, processName
+		os.RemoveAll(dir)
+	}
+}
+
+func writePIDFile(t *testing.T, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(HAProxyPIDFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pidFileExists() bool {
+	_, err := os.Stat(HAProxyPIDFile)
+	return err == nil
+}
+
+// Pid of a process which already exited
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("can't run true: %s", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestHAProxyProcess(t *testing.T) {
+	defer setupPIDFile(t)()
+	c := &HAProxyController{}
+
+	if _, err := c.HAProxyProcess(); !os.IsNotExist(err) {
+		t.Errorf("missing pid file: expected not exist error, got %v", err)
+	}
+
+	writePIDFile(t, strconv.Itoa(os.Getpid())+"\n")
+	process, err := c.HAProxyProcess()
+	if err != nil || process.Pid != os.Getpid() {
+		t.Errorf("running process: expected pid %d, got %v, %v", os.Getpid(), process, err)
+	}
+
+	writePIDFile(t, strconv.Itoa(exitedPID(t)))
+	if _, err = c.HAProxyProcess(); err == nil {
+		t.Error("stale pid: expected error")
+	}
+	if pidFileExists() {
+		t.Error("stale pid: pid file not removed")
+	}
+
+	haproxyProcessName = "haproxy"
+	writePIDFile(t, strconv.Itoa(os.Getpid()))
+	if _, err = c.HAProxyProcess(); err == nil {
+		t.Error("pid of another program: expected error")
+	}
+	if pidFileExists() {
+		t.Error("pid of another program: pid file not removed")
+	}
+}
+
+func TestHAProxyProcessInvalidContent(t *testing.T) {
+	defer setupPIDFile(t)()
+	c := &HAProxyController{}
+
+	// HAProxy may be writing it
+	writePIDFile(t, "")
+	if _, err := c.HAProxyProcess(); err == nil {
+		t.Error("empty pid file: expected error")
+	}
+	if !pidFileExists() {
+		t.Error("pid file being written removed")
+	}
+
+	old := time.Now().Add(-2 * haproxyStartTimeout)
+	if err := os.Chtimes(HAProxyPIDFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.HAProxyProcess(); err == nil {
+		t.Error("old empty pid file: expected error")
+	}
+	if pidFileExists() {
+		t.Error("old empty pid file not removed")
+	}
+}
+
+func TestWaitHAProxyPIDFile(t *testing.T) {
+	defer setupPIDFile(t)()
+	pid := strconv.Itoa(os.Getpid())
+
+	// not yet written when HAProxy daemon parent exits
+	exited := make(chan error, 1)
+	exited <- nil
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		_ = ioutil.WriteFile(HAProxyPIDFile, []byte(pid), 0644)
+	}()
+	if err := waitHAProxyPIDFile(time.Now(), exited, haproxyStartTimeout); err != nil {
+		t.Errorf("pid file written after start: %s", err)
+	}
+
+	// never written
+	os.Remove(HAProxyPIDFile)
+	if err := waitHAProxyPIDFile(time.Now(), make(chan error), 300*time.Millisecond); err == nil {
+		t.Error("missing pid file: expected timeout")
+	}
+
+	// pid file of the previous master
+	writePIDFile(t, pid)
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(HAProxyPIDFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitHAProxyPIDFile(time.Now(), make(chan error), 300*time.Millisecond); err == nil {
+		t.Error("pid file older than start: expected timeout")
+	}
+
+	// HAProxy fails to start
+	exited = make(chan error, 1)
+	exited <- errors.New("exit status 1")
+	if err := waitHAProxyPIDFile(time.Now().Add(time.Minute), exited, haproxyStartTimeout); err == nil {
+		t.Error("haproxy exited with error: expected error")
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EndpointSlices are not known to the client library in use, they are watched with the dynamic client
+var endpointSliceGroupVersion = schema.GroupVersion{Group: "discovery.k8s.io", Version: "v1beta1"}
+
+const (
+	endpointSliceServiceLabel = "kubernetes.io/service-name"
+	endpointSliceServiceIndex = "service"
+)
+
+// SetEndpointSliceAPI makes the controller watch EndpointSlices instead of Endpoints if they are served.
+func (k *K8s) SetEndpointSliceAPI() {
+	resources, err := k.API.Discovery().ServerResourcesForGroupVersion(endpointSliceGroupVersion.String())
+	if err != nil {
+		return
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == "endpointslices" {
+			k.EndpointSliceAPI = true
+		}
+	}
+}
+
+func endpointSliceService(obj interface{}) (namespace, service string, ok bool) {
+	if deleted, isDeleted := obj.(cache.DeletedFinalStateUnknown); isDeleted {
+		obj = deleted.Obj
+	}
+	data, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return "", "", false
+	}
+	service = data.GetLabels()[endpointSliceServiceLabel]
+	return data.GetNamespace(), service, service != ""
+}
+
+// Slices of a service are merged into one Endpoints sent to channel on each change of one of them,
+// Endpoints are deleted with the last slice of the service.
+func (k *K8s) eventsEndpointSlices(channel chan *Endpoints, stop chan struct{}) {
+	// Last Endpoints sent by service, handlers are called sequentially
+	sent := map[string]*Endpoints{}
+	handle := func(obj interface{}) {
+		namespace, service, ok := endpointSliceService(obj)
+		if !ok {
+			return
+		}
+		item, err := k.endpointsFromSlices(namespace, service)
+		if err == ErrIgnored {
+			return
+		}
+		key := namespace + "/" + service
+		if item.Status == DELETED {
+			if _, ok := sent[key]; !ok {
+				return
+			}
+			delete(sent, key)
+		} else if item.Equal(sent[key]) {
+			return
+		} else {
+			sent[key] = item
+		}
+		k8sLogger.Debugf("%s %s: %s \n", ENDPOINTS, item.Status, item.Service)
+		channel <- item
+	}
+	indexer, controller := cache.NewIndexerInformer(
+		k.dynamicListWatch(endpointSliceGroupVersion.WithResource("endpointslices")),
+		&unstructured.Unstructured{},
+		1*time.Second, //Duration is int64
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    handle,
+			DeleteFunc: handle,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if unchangedResourceVersion(oldObj, newObj) {
+					return
+				}
+				// Slice can be moved to another service
+				if namespace, service, ok := endpointSliceService(oldObj); ok {
+					if newNamespace, newService, _ := endpointSliceService(newObj); newNamespace != namespace || newService != service {
+						handle(oldObj)
+					}
+				}
+				handle(newObj)
+			},
+		},
+		cache.Indexers{endpointSliceServiceIndex: func(obj interface{}) ([]string, error) {
+			if namespace, service, ok := endpointSliceService(obj); ok {
+				return []string{namespace + "/" + service}, nil
+			}
+			return []string{}, nil
+		}},
+	)
+	k.endpointSlices = indexer
+	go controller.Run(stop)
+}
+
+// Merge EndpointSlices of service into Endpoints, only ready endpoints are kept.
+// Addresses are deduplicated by pod, a pod can be in two slices while they are updated.
+func (k *K8s) endpointsFromSlices(namespace, service string) (*Endpoints, error) {
+	if ignoredEndpoints(namespace, service) {
+		return nil, ErrIgnored
+	}
+	item := &Endpoints{
+		Namespace: namespace,
+		Service:   StringW{Value: service},
+		Ports:     &EndpointPorts{},
+		Addresses: &EndpointIPs{},
+		NotReady:  map[string]struct{}{},
+		Status:    ADDED,
+	}
+	slices, err := k.endpointSlices.ByIndex(endpointSliceServiceIndex, namespace+"/"+service)
+	if err != nil {
+		return nil, err
+	}
+	if len(slices) == 0 {
+		item.Status = DELETED
+		return item, nil
+	}
+	knownPorts := map[EndpointPort]struct{}{}
+	for _, obj := range slices {
+		slice := obj.(*unstructured.Unstructured)
+		if addressType, _, _ := unstructured.NestedString(slice.Object, "addressType"); addressType != "IPv4" && addressType != "IPv6" {
+			continue
+		}
+		ports := map[string]int64{}
+		slicePorts, _, _ := unstructured.NestedSlice(slice.Object, "ports")
+		for _, p := range slicePorts {
+			data, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			port := EndpointPort{Status: ADDED}
+			port.Name, _, _ = unstructured.NestedString(data, "name")
+			port.Protocol, _, _ = unstructured.NestedString(data, "protocol")
+			port.Port, _, _ = unstructured.NestedInt64(data, "port")
+			ports[port.Name] = port.Port
+			if _, ok := knownPorts[port]; !ok {
+				knownPorts[port] = struct{}{}
+				*item.Ports = append(*item.Ports, &EndpointPort{Name: port.Name, Protocol: port.Protocol, Port: port.Port, Status: ADDED})
+			}
+		}
+		endpoints, _, _ := unstructured.NestedSlice(slice.Object, "endpoints")
+		for _, e := range endpoints {
+			data, ok := e.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			addresses, _, _ := unstructured.NestedStringSlice(data, "addresses")
+			if len(addresses) == 0 {
+				continue
+			}
+			// Unknown readiness is considered ready
+			if ready, found, _ := unstructured.NestedBool(data, "conditions", "ready"); found && !ready {
+				item.NotReady[addresses[0]] = struct{}{}
+				continue
+			}
+			eip := &EndpointIP{
+				IP:     addresses[0],
+				Ports:  ports,
+				Status: ADDED,
+			}
+			key := addresses[0]
+			if uid, found, _ := unstructured.NestedString(data, "targetRef", "uid"); found {
+				eip.Name, _, _ = unstructured.NestedString(data, "targetRef", "name")
+				key = uid
+			} else if hostname, _, _ := unstructured.NestedString(data, "hostname"); hostname != "" {
+				key = fmt.Sprintf("%s%s", addresses[0], hostname)
+			}
+			(*item.Addresses)[key] = eip
+		}
+	}
+	return item, nil
+}
+
+// Return Endpoints of informer store, merged from EndpointSlices when they are watched
+func (k *K8s) storedEndpoints() (items []*Endpoints, ok bool) {
+	if k.endpointSlices != nil {
+		for _, service := range k.endpointSlices.ListIndexFuncValues(endpointSliceServiceIndex) {
+			namespace, name, err := cache.SplitMetaNamespaceKey(service)
+			if err != nil {
+				continue
+			}
+			if item, errSlices := k.endpointsFromSlices(namespace, name); errSlices == nil && item.Status != DELETED {
+				items = append(items, item)
+			}
+		}
+		return items, true
+	}
+	store, ok := k.stores[ENDPOINTS]
+	if !ok {
+		return nil, false
+	}
+	for _, obj := range store.List() {
+		if item, err := k.convertToEndpoints(obj, ADDED); err == nil {
+			items = append(items, item)
+		}
+	}
+	return items, true
+}
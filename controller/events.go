@@ -16,10 +16,14 @@ package controller
 
 import (
 	"fmt"
-	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	corev1 "k8s.io/api/core/v1"
 )
 
 func (c *HAProxyController) eventNamespace(ns *Namespace, data *Namespace) (updateRequired bool) {
@@ -33,14 +37,13 @@ func (c *HAProxyController) eventNamespace(ns *Namespace, data *Namespace) (upda
 			delete(c.cfg.Namespace, data.Name)
 			updateRequired = true
 		} else {
-			log.Println("Namespace not registered with controller, cannot delete !", data.Name)
+			logger.Warning("Namespace not registered with controller, cannot delete !", data.Name)
 		}
 	}
 	return updateRequired
 }
 
 func (c *HAProxyController) eventIngress(ns *Namespace, data *Ingress) (updateRequired bool) {
-	ingressClass := ""
 	updateRequired = false
 	switch data.Status {
 	case MODIFIED:
@@ -50,12 +53,13 @@ func (c *HAProxyController) eventIngress(ns *Namespace, data *Ingress) (updateRe
 			newIngress.Status = ADDED
 			return c.eventIngress(ns, newIngress)
 		}
-		if annIngressClass, ok := data.Annotations["ingress.class"]; ok {
-			ingressClass = annIngressClass.Value
-		}
-		if ingressClass != c.cfg.IngressClass {
+		if !c.cfg.IsRelevantIngress(data) {
+			// ingress class changed, ingress is released and its status cleaned
+			oldIngress.ClassChanged = true
 			newIngress.Status = DELETED
-			return c.eventIngress(ns, newIngress)
+			updateRequired = c.eventIngress(ns, newIngress)
+			ns.IgnoredIngresses[data.Name] = data
+			return updateRequired
 		}
 		if oldIngress.Equal(data) {
 			return false
@@ -157,12 +161,12 @@ func (c *HAProxyController) eventIngress(ns *Namespace, data *Ingress) (updateRe
 		//log.Println("Ingress modified", data.Name, "\n", diffStr)
 		updateRequired = true
 	case ADDED:
-		if annIngressClass, ok := data.Annotations["ingress.class"]; ok {
-			ingressClass = annIngressClass.Value
-		}
-		if ingressClass != c.cfg.IngressClass {
+		if !c.cfg.IsRelevantIngress(data) {
+			// kept in case ingress classes change
+			ns.IgnoredIngresses[data.Name] = data
 			return false
 		}
+		delete(ns.IgnoredIngresses, data.Name)
 		if old, ok := ns.Ingresses[data.Name]; ok {
 			data.Status = old.Status
 			if !old.Equal(data) {
@@ -190,6 +194,10 @@ func (c *HAProxyController) eventIngress(ns *Namespace, data *Ingress) (updateRe
 		//log.Println("Ingress added", data.Name)
 		updateRequired = true
 	case DELETED:
+		if _, ok := ns.IgnoredIngresses[data.Name]; ok {
+			delete(ns.IgnoredIngresses, data.Name)
+			return false
+		}
 		ingress, ok := ns.Ingresses[data.Name]
 		if ok {
 			ingress.Status = DELETED
@@ -206,12 +214,80 @@ func (c *HAProxyController) eventIngress(ns *Namespace, data *Ingress) (updateRe
 			//log.Println("Ingress deleted", data.Name)
 			updateRequired = true
 		} else {
-			log.Println("Ingress not registered with controller, cannot delete !", data.Name)
+			logger.Warning("Ingress not registered with controller, cannot delete !", data.Name)
 		}
 	}
 	return updateRequired
 }
 
+// Ingresses are released or picked up when IngressClasses handled by the controller change
+func (c *HAProxyController) eventIngressClass(data *IngressClass) (updateRequired bool) {
+	switch data.Status {
+	case ADDED, MODIFIED:
+		c.cfg.IngressClasses[data.Name] = data
+	case DELETED:
+		delete(c.cfg.IngressClasses, data.Name)
+	}
+	for _, ns := range c.cfg.Namespace {
+		for _, ingress := range ns.Ingresses {
+			if ingress.Status != DELETED && !c.cfg.IsRelevantIngress(ingress) {
+				// Released ingress is cleaned up, a copy is kept
+				ignored := copyIngress(ingress)
+				ingress.ClassChanged = true
+				updateRequired = c.eventIngress(ns, &Ingress{Name: ingress.Name, Status: DELETED}) || updateRequired
+				ns.IgnoredIngresses[ingress.Name] = ignored
+			}
+		}
+		for _, ingress := range ns.IgnoredIngresses {
+			if c.cfg.IsRelevantIngress(ingress) {
+				ingress.Status = ADDED
+				updateRequired = c.eventIngress(ns, ingress) || updateRequired
+			}
+		}
+	}
+	return updateRequired
+}
+
+// copyIngress returns a copy of ingress data without statuses
+func copyIngress(ingress *Ingress) *Ingress {
+	newIngress := &Ingress{
+		Namespace:   ingress.Namespace,
+		Name:        ingress.Name,
+		UID:         ingress.UID,
+		Class:       ingress.Class,
+		Annotations: make(MapStringW, len(ingress.Annotations)),
+		Rules:       make(map[string]*IngressRule, len(ingress.Rules)),
+		TLS:         make(map[string]*IngressTLS, len(ingress.TLS)),
+	}
+	for name, ann := range ingress.Annotations {
+		newIngress.Annotations[name] = &StringW{Value: ann.Value}
+	}
+	for host, rule := range ingress.Rules {
+		newRule := &IngressRule{
+			Host:  rule.Host,
+			Paths: make(map[string]*IngressPath, len(rule.Paths)),
+		}
+		for name, path := range rule.Paths {
+			newPath := *path
+			newPath.Status = EMPTY
+			newRule.Paths[name] = &newPath
+		}
+		newIngress.Rules[host] = newRule
+	}
+	for host, tls := range ingress.TLS {
+		newIngress.TLS[host] = &IngressTLS{
+			Host:       tls.Host,
+			SecretName: StringW{Value: tls.SecretName.Value},
+		}
+	}
+	if ingress.DefaultBackend != nil {
+		defaultBackend := *ingress.DefaultBackend
+		defaultBackend.Status = EMPTY
+		newIngress.DefaultBackend = &defaultBackend
+	}
+	return newIngress
+}
+
 func (c *HAProxyController) eventEndpoints(ns *Namespace, data *Endpoints) (updateRequired bool) {
 	updateRequired = false
 	switch data.Status {
@@ -219,13 +295,13 @@ func (c *HAProxyController) eventEndpoints(ns *Namespace, data *Endpoints) (upda
 		newEndpoints := data
 		oldEndpoints, ok := ns.Endpoints[data.Service.Value]
 		if !ok {
-			log.Println("Endpoints not registered with controller !", data.Service)
+			logger.Warning("Endpoints not registered with controller !", data.Service)
 			return updateRequired
 		}
 		if oldEndpoints.Equal(newEndpoints) {
 			return updateRequired
 		}
-		data.BackendName = oldEndpoints.BackendName
+		data.Backends = oldEndpoints.Backends
 		c.setModifiedStatusEndpoints(oldEndpoints, newEndpoints)
 		updateRequired = updateRequired || c.processEndpointIPs(newEndpoints)
 		ns.Endpoints[data.Service.Value] = newEndpoints
@@ -253,7 +329,7 @@ func (c *HAProxyController) eventEndpoints(ns *Namespace, data *Endpoints) (upda
 			//log.Println("Endpoints deleted", data.Service)
 			updateRequired = true
 		} else {
-			log.Println("Endpoints not registered with controller, cannot delete !", oldData.Service)
+			logger.Warning("Endpoints not registered with controller, cannot delete !", oldData.Service)
 		}
 	}
 	return updateRequired
@@ -276,6 +352,10 @@ func (c *HAProxyController) setModifiedStatusEndpoints(oldObj, newObj *Endpoints
 			if adrOld.IP == adrNew.IP {
 				adrNew.HAProxyName = adrOld.HAProxyName
 				adrNew.Status = adrOld.Status
+				// Draining server is ready again
+				if !adrOld.portsEqual(adrNew) || adrOld.Draining {
+					adrNew.Status = MODIFIED
+				}
 				delete(*oldObj.Addresses, oldKey)
 				break
 			}
@@ -284,34 +364,40 @@ func (c *HAProxyController) setModifiedStatusEndpoints(oldObj, newObj *Endpoints
 	}
 	for oldKey, adrOld := range *oldObj.Addresses {
 		if !adrOld.Disabled {
+			// Address of a terminating pod is still not ready, its server is drained
+			if _, ok := newObj.NotReady[adrOld.IP]; ok && c.osArgs.DrainTimeout > 0 && (!adrOld.Draining || time.Now().Before(adrOld.DrainDeadline)) {
+				if !adrOld.Draining {
+					adrOld.Draining = true
+					adrOld.DrainDeadline = time.Now().Add(c.osArgs.DrainTimeout)
+					adrOld.Status = MODIFIED
+					atomic.AddUint64(&c.metrics.serversDrained, 1)
+				}
+				(*newObj.Addresses)[oldKey] = adrOld
+				continue
+			}
 			// it not disabled so it must be now, no longer exists
-			adrOld.IP = "127.0.0.1"
-			adrOld.Disabled = true
-			adrOld.Status = MODIFIED
+			c.releaseServer(adrOld)
 			(*newObj.Addresses)[fmt.Sprintf("SRV_%s", utils.RandomString(5))] = adrOld
 		} else {
-			//try to find one that is added so we can switch them
-			replaced := false
+			//try to find one that is added so we can switch them,
+			//a pod coming back with the same name gets its server back
+			var replacement *EndpointIP
 			for _, adrNew := range *newObj.Addresses {
-				if adrNew.Status == ADDED {
-					replaced = true
-					adrNew.HAProxyName = adrOld.HAProxyName
-					adrNew.Status = MODIFIED
-					break
+				if adrNew.Status == ADDED && (replacement == nil || adrNew.Name == adrOld.HAProxyName) {
+					replacement = adrNew
 				}
 			}
-			if !replaced {
+			if replacement != nil {
+				replacement.HAProxyName = adrOld.HAProxyName
+				replacement.Status = MODIFIED
+			} else {
 				(*newObj.Addresses)[oldKey] = adrOld
 			}
 		}
 
 	}
 
-	annIncrement, _ := GetValueFromAnnotations("servers-increment", c.cfg.ConfigMap.Annotations)
-	incrementSize := int64(128)
-	if increment, err := strconv.ParseInt(annIncrement.Value, 10, 64); err == nil {
-		incrementSize = increment
-	}
+	incrementSize := c.serverSlots(newObj)
 	numDisabled := int64(0)
 	for _, adr := range *newObj.Addresses {
 		if adr.Disabled {
@@ -319,14 +405,16 @@ func (c *HAProxyController) setModifiedStatusEndpoints(oldObj, newObj *Endpoints
 		}
 	}
 
-	if numDisabled > incrementSize {
+	// Released servers stay in maintenance, they are only deleted by whole slots
+	// increments when more than one increment of them is unused
+	if numDisabled >= 2*incrementSize {
 		alreadyDeleted := int64(0)
 		for _, adr := range *newObj.Addresses {
 			if adr.Status == DELETED {
 				alreadyDeleted++
 			}
 		}
-		division := numDisabled / incrementSize
+		division := numDisabled/incrementSize - 1
 		toDisable := division*incrementSize - alreadyDeleted
 		if toDisable == 0 {
 			return
@@ -341,13 +429,103 @@ func (c *HAProxyController) setModifiedStatusEndpoints(oldObj, newObj *Endpoints
 	}
 }
 
+// Server of an address that no longer exists is released: it stays in maintenance
+// until another address uses it.
+func (c *HAProxyController) releaseServer(ip *EndpointIP) {
+	if ip.Draining {
+		logger.Debugf("Server %s of pod '%s' drained", ip.HAProxyName, ip.Name)
+	} else {
+		atomic.AddUint64(&c.metrics.serversRemoved, 1)
+	}
+	ip.IP = "127.0.0.1"
+	ip.Disabled = true
+	ip.Draining = false
+	ip.Status = MODIFIED
+}
+
+// Apply address and state of a server to backends of endpoints through runtime API,
+// returns true if it failed
+func (c *HAProxyController) runtimeServerUpdate(data *Endpoints, ip *EndpointIP) (updateRequired bool) {
+	runtimeClient := c.NativeAPI.Runtime
+	for backendName, portName := range data.Backends {
+		err := runtimeClient.SetServerAddr(backendName, ip.HAProxyName, ip.IP, int(ip.Port(portName, 0)))
+		if err != nil {
+			logger.Error(err)
+			updateRequired = true
+		}
+		err = runtimeClient.SetServerState(backendName, ip.HAProxyName, ip.serverState())
+		if err != nil {
+			logger.Error(err)
+			updateRequired = true
+		} else {
+			atomic.AddUint64(&c.metrics.serverUpdatesRuntime, 1)
+		}
+	}
+	return updateRequired
+}
+
+// Register backend of a path of the service, its servers use endpoint port portName
+func (e *Endpoints) setBackend(backendName, portName string) {
+	if e.Backends == nil {
+		e.Backends = map[string]string{}
+	}
+	e.Backends[backendName] = portName
+}
+
+// Servers still draining after --drain-timeout are released,
+// checked periodically since no event may come for them.
+func (c *HAProxyController) expireDrainingServers() (updateRequired bool) {
+	now := time.Now()
+	for _, namespace := range c.cfg.Namespace {
+		for _, endpoints := range namespace.Endpoints {
+			for _, ip := range *endpoints.Addresses {
+				if !ip.Draining || now.Before(ip.DrainDeadline) {
+					continue
+				}
+				logger.Debugf("Drain timeout of server %s of pod '%s' expired", ip.HAProxyName, ip.Name)
+				c.releaseServer(ip)
+				c.runtimeServerUpdate(endpoints, ip)
+				updateRequired = true
+			}
+		}
+	}
+	return updateRequired
+}
+
+// Number of servers provisioned at once in backend of endpoints service, taken from
+// scale-server-slots annotation of the service or ConfigMap, servers-increment is
+// still accepted in ConfigMap.
+func (c *HAProxyController) serverSlots(endpoints *Endpoints) int64 {
+	annotations := []MapStringW{}
+	if ns, ok := c.cfg.Namespace[endpoints.Namespace]; ok {
+		if service, ok := ns.Services[endpoints.Service.Value]; ok {
+			annotations = append(annotations, service.Annotations)
+		}
+	}
+	annotations = append(annotations, c.cfg.ConfigMap.Annotations)
+	annSlots, _ := GetValueFromAnnotations("scale-server-slots", annotations...)
+	slotsSet := false
+	for _, a := range annotations {
+		if ann, err := a.Get("scale-server-slots"); err == nil && ann.Status != DELETED {
+			slotsSet = true
+		}
+	}
+	if !slotsSet {
+		if annIncrement, err := c.cfg.ConfigMap.Annotations.Get("servers-increment"); err == nil && annIncrement.Status != DELETED {
+			annSlots = annIncrement
+		}
+	}
+	slots, err := strconv.ParseInt(annSlots.Value, 10, 64)
+	if err != nil || slots < 1 {
+		logger.Warningf("Invalid scale-server-slots value '%s', using 42", annSlots.Value)
+		slots = 42
+	}
+	return slots
+}
+
 func (c *HAProxyController) processEndpointIPs(data *Endpoints) (updateRequired bool) {
 	updateRequired = false
-	annIncrement, _ := GetValueFromAnnotations("servers-increment", c.cfg.ConfigMap.Annotations)
-	incrementSize := int64(128)
-	if increment, err := strconv.ParseInt(annIncrement.Value, 10, 64); err == nil {
-		incrementSize = increment
-	}
+	incrementSize := c.serverSlots(data)
 
 	usedNames := map[string]struct{}{}
 	for _, ip := range *data.Addresses {
@@ -360,29 +538,11 @@ func (c *HAProxyController) processEndpointIPs(data *Endpoints) (updateRequired
 		case ADDED:
 			//added on haproxy update
 			ip.Status = ADDED
-			ip.HAProxyName = fmt.Sprintf("SRV_%s", utils.RandomString(5))
-			for _, ok := usedNames[ip.HAProxyName]; ok; {
-				ip.HAProxyName = fmt.Sprintf("SRV_%s", utils.RandomString(5))
-			}
-			usedNames[ip.HAProxyName] = struct{}{}
+			ip.HAProxyName = uniqueServerName(serverName(ip), usedNames)
 			updateRequired = true
 		case MODIFIED:
-			if data.BackendName != "" {
-				runtimeClient := c.NativeAPI.Runtime
-				err := runtimeClient.SetServerAddr(data.BackendName, ip.HAProxyName, ip.IP, 0)
-				if err != nil {
-					log.Println(err)
-					updateRequired = true
-				}
-				status := "ready"
-				if ip.Disabled {
-					status = "maint"
-				}
-				err = runtimeClient.SetServerState(data.BackendName, ip.HAProxyName, status)
-				if err != nil {
-					log.Println(err)
-					updateRequired = true
-				}
+			if len(data.Backends) > 0 {
+				updateRequired = c.runtimeServerUpdate(data, ip) || updateRequired
 			} else {
 				//this is ok since if exists, we edit current data
 				ip.Status = ADDED
@@ -396,7 +556,7 @@ func (c *HAProxyController) processEndpointIPs(data *Endpoints) (updateRequired
 
 	//align new number of backend servers if necessary
 	podsNumber := int64(len(*data.Addresses))
-	if podsNumber%incrementSize == 0 {
+	if podsNumber%incrementSize == 0 && (podsNumber > 0 || !c.scaleFromZeroEndpoints(data)) {
 		return updateRequired
 	}
 	toCreate := int(incrementSize - podsNumber%incrementSize)
@@ -404,11 +564,7 @@ func (c *HAProxyController) processEndpointIPs(data *Endpoints) (updateRequired
 		return updateRequired
 	}
 	for index := 0; index < toCreate; index++ {
-		hAProxyName := fmt.Sprintf("SRV_%s", utils.RandomString(5))
-		for _, ok := usedNames[hAProxyName]; ok; {
-			hAProxyName = fmt.Sprintf("SRV_%s", utils.RandomString(5))
-			usedNames[hAProxyName] = struct{}{}
-		}
+		hAProxyName := uniqueServerName(fmt.Sprintf("SRV_%s", utils.RandomString(5)), usedNames)
 
 		(*data.Addresses)[hAProxyName] = &EndpointIP{
 			IP:          "127.0.0.1",
@@ -421,6 +577,101 @@ func (c *HAProxyController) processEndpointIPs(data *Endpoints) (updateRequired
 	return updateRequired
 }
 
+// Servers are named after their pod, so names don't depend on the order of addresses
+// and survive controller restarts for server state to be restored. Addresses without
+// pod are named after a hash of their IP and ports, servers are shared by backends of
+// all ports of the service.
+func serverName(ip *EndpointIP) string {
+	if ip.Name != "" && validServerName(ip.Name) {
+		return ip.Name
+	}
+	ports := make([]string, 0, len(ip.Ports))
+	for name, port := range ip.Ports {
+		ports = append(ports, fmt.Sprintf("%s:%d", name, port))
+	}
+	sort.Strings(ports)
+	return fmt.Sprintf("SRV_%x", hashStrToUint(ip.IP+" "+strings.Join(ports, " ")))
+}
+
+// Servers reused by another pod keep the name of their slot, runtime API can't rename
+// them. They are renamed after their pod when HAProxy reloads anyway, so that server
+// names match pods again after a rolling update and server state is restored.
+// Previous names of renamed servers are returned, see restoreServerNames.
+func (c *HAProxyController) renameReusedServers() (renamed map[*EndpointIP]string) {
+	renamed = map[*EndpointIP]string{}
+	for _, namespace := range c.cfg.Namespace {
+		for _, endpoints := range namespace.Endpoints {
+			if len(endpoints.Backends) == 0 || endpoints.Status == DELETED {
+				continue
+			}
+			used := map[string]struct{}{}
+			for _, ip := range *endpoints.Addresses {
+				used[ip.HAProxyName] = struct{}{}
+			}
+			for _, ip := range *endpoints.Addresses {
+				if ip.Disabled || ip.Status == DELETED || ip.HAProxyName == "" {
+					continue
+				}
+				name := serverName(ip)
+				if _, ok := used[name]; ok {
+					continue
+				}
+				if !c.backendServersExist(endpoints, ip.HAProxyName) {
+					continue
+				}
+				logger.Debugf("Renaming server %s of pod '%s' to %s", ip.HAProxyName, ip.Name, name)
+				for backendName := range endpoints.Backends {
+					utils.LogErr(c.backendServerRename(backendName, ip.HAProxyName, name))
+				}
+				delete(used, ip.HAProxyName)
+				used[name] = struct{}{}
+				renamed[ip] = ip.HAProxyName
+				ip.HAProxyName = name
+			}
+		}
+	}
+	return renamed
+}
+
+// Servers keep their names when the transaction renaming them is not committed
+func restoreServerNames(renamed map[*EndpointIP]string) {
+	for ip, name := range renamed {
+		ip.HAProxyName = name
+	}
+}
+
+// Return true if server exists in every backend of endpoints
+func (c *HAProxyController) backendServersExist(endpoints *Endpoints, serverName string) bool {
+	for backendName := range endpoints.Backends {
+		if _, err := c.backendServerGet(backendName, serverName); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Characters HAProxy accepts in proxy and server names
+func validServerName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return name, or a random one if it is already used in the backend, and mark it used.
+// Server of a pod restarted with the same name can still be in maintenance.
+func uniqueServerName(name string, used map[string]struct{}) string {
+	for {
+		if _, ok := used[name]; !ok {
+			used[name] = struct{}{}
+			return name
+		}
+		name = fmt.Sprintf("SRV_%s", utils.RandomString(5))
+	}
+}
+
 func (c *HAProxyController) eventService(ns *Namespace, data *Service) (updateRequired bool) {
 	updateRequired = false
 	switch data.Status {
@@ -429,7 +680,7 @@ func (c *HAProxyController) eventService(ns *Namespace, data *Service) (updateRe
 		oldService, ok := ns.Services[data.Name]
 		if !ok {
 			//intentionally do not add it. TODO see if our idea of only watching is ok
-			log.Println("Service not registered with controller !", data.Name)
+			logger.Warning("Service not registered with controller !", data.Name)
 		}
 		if oldService.Equal(newService) {
 			return updateRequired
@@ -454,12 +705,42 @@ func (c *HAProxyController) eventService(ns *Namespace, data *Service) (updateRe
 			service.Annotations.SetStatusState(DELETED)
 			updateRequired = true
 		} else {
-			log.Println("Service not registered with controller, cannot delete !", data.Name)
+			logger.Warning("Service not registered with controller, cannot delete !", data.Name)
 		}
 	}
 	return updateRequired
 }
 
+// Addresses of publish service are written to ingresses status on next update,
+// they replace previous ones so switching between IP and hostname LoadBalancers is handled.
+func (c *HAProxyController) eventPublishService(data *Service) (updateRequired bool) {
+	publishSvc := c.cfg.PublishService
+	if publishSvc == nil {
+		return false
+	}
+	if data.Status == DELETED {
+		publishSvc.Addresses = []corev1.LoadBalancerIngress{}
+		publishSvc.Status = DELETED
+		return true
+	}
+	equal := len(publishSvc.Addresses) == len(data.Addresses)
+	if equal {
+		for i, address := range data.Addresses {
+			if address != publishSvc.Addresses[i] {
+				equal = false
+				break
+			}
+		}
+	}
+	if equal {
+		return false
+	}
+	logger.Infof("Publish service %s/%s addresses changed to %v", data.Namespace, data.Name, data.Addresses)
+	publishSvc.Addresses = data.Addresses
+	publishSvc.Status = MODIFIED
+	return true
+}
+
 func (c *HAProxyController) eventConfigMap(ns *Namespace, data *ConfigMap, chConfigMapReceivedAndProcessed chan bool) (updateRequired bool) {
 	updateRequired = false
 	//TODO refractor this so we remember all configmaps, since we now use more that one
@@ -524,18 +805,44 @@ func (c *HAProxyController) eventConfigMap(ns *Namespace, data *ConfigMap, chCon
 			c.cfg.ConfigMapTCPServices.Status = DELETED
 		}
 	}
+
+	if !configmap && !configmapTCP {
+		// Other configmaps are only relevant when referenced by annotations
+		switch data.Status {
+		case MODIFIED, ADDED:
+			if old, ok := ns.ConfigMaps[data.Name]; ok {
+				if old.Equal(data) {
+					return updateRequired
+				}
+				data.Status = MODIFIED
+			}
+			ns.ConfigMaps[data.Name] = data
+		case DELETED:
+			old, ok := ns.ConfigMaps[data.Name]
+			if !ok {
+				return updateRequired
+			}
+			old.Status = DELETED
+		}
+		updateRequired = c.isErrorFilesConfigMap(ns.Name, data.Name) || c.isSourceListConfigMap(ns.Name, data.Name)
+	}
 	return updateRequired
 }
+
+// Only secrets referenced by ingresses, ConfigMap or TCP services are stored, see refreshSecretIndex
 func (c *HAProxyController) eventSecret(ns *Namespace, data *Secret) (updateRequired bool) {
 	updateRequired = false
+	if _, known := ns.Secret[data.Name]; !known && !c.secretReferenced(data.Namespace, data.Name) {
+		return false
+	}
 	switch data.Status {
 	case MODIFIED:
 		newSecret := data
 		oldSecret, ok := ns.Secret[data.Name]
 		if !ok {
-			//intentionally do not add it. TODO see if our idea of only watching is ok
-			log.Println("Secret not registered with controller !", data.Name)
-			return updateRequired
+			// Referenced secret whose creation was missed
+			data.Status = ADDED
+			return c.eventSecret(ns, data)
 		}
 		if oldSecret.Equal(data) {
 			return updateRequired
@@ -553,13 +860,45 @@ func (c *HAProxyController) eventSecret(ns *Namespace, data *Secret) (updateRequ
 		ns.Secret[data.Name] = data
 		updateRequired = true
 	case DELETED:
-		_, ok := ns.Secret[data.Name]
+		secret, ok := ns.Secret[data.Name]
 		if ok {
-			//log.Println("Secret set for deletion", data.Name)
+			secret.Status = DELETED
 			updateRequired = true
 		} else {
-			log.Println("Secret not registered with controller, cannot delete !", data.Name)
+			logger.Warning("Secret not registered with controller, cannot delete !", data.Name)
 		}
 	}
 	return updateRequired
 }
+
+// Pods are only stored for the blue-green-balance annotation, a label change marks the
+// addresses of the pod as modified so weights of their backend are computed again.
+func (c *HAProxyController) eventPod(ns *Namespace, data *Pod) (updateRequired bool) {
+	updateRequired = false
+	switch data.Status {
+	case ADDED, MODIFIED:
+		if old, ok := ns.Pods[data.Name]; ok && old.Equal(data) {
+			return updateRequired
+		}
+		ns.Pods[data.Name] = data
+		for name, endpoints := range ns.Endpoints {
+			service, ok := ns.Services[name]
+			if !ok {
+				continue
+			}
+			if _, err := service.Annotations.Get("blue-green-balance"); err != nil {
+				continue
+			}
+			for _, ip := range *endpoints.Addresses {
+				if ip.Name == data.Name && ip.Status == EMPTY {
+					ip.Status = MODIFIED
+					updateRequired = true
+				}
+			}
+		}
+	case DELETED:
+		// Its addresses are removed from endpoints
+		delete(ns.Pods, data.Name)
+	}
+	return updateRequired
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Endpoints of service "app" with pods serving ports "http" and "admin"
+func testEndpoints(t *testing.T, status Status, pods map[string]string, http, admin int32) *Endpoints {
+	t.Helper()
+	subset := corev1.EndpointSubset{
+		Ports: []corev1.EndpointPort{{Name: "http", Port: http}, {Name: "admin", Port: admin}},
+	}
+	for name, ip := range pods {
+		subset.Addresses = append(subset.Addresses, corev1.EndpointAddress{
+			IP:        ip,
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: name, UID: types.UID("uid-" + name)},
+		})
+	}
+	endpoints, err := (&K8s{}).convertToEndpoints(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Subsets:    []corev1.EndpointSubset{subset},
+	}, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return endpoints
+}
+
+func testService() *Service {
+	return &Service{
+		Namespace: "default",
+		Name:      "app",
+		Ports:     []ServicePort{{Name: "http", Port: 80}, {Name: "admin", Port: 8080}},
+	}
+}
+
+func addressByPod(endpoints *Endpoints, pod string) *EndpointIP {
+	for _, ip := range *endpoints.Addresses {
+		if ip.Name == pod && !ip.Disabled {
+			return ip
+		}
+	}
+	return nil
+}
+
+func TestEventEndpointsModifiedKeepsBackends(t *testing.T) {
+	c := testController()
+	ns := &Namespace{Name: "default", Endpoints: map[string]*Endpoints{}, Services: map[string]*Service{}}
+	c.cfg.Namespace[ns.Name] = ns
+
+	c.eventEndpoints(ns, testEndpoints(t, ADDED, map[string]string{"app-1": "10.0.0.1"}, 8000, 9000))
+	ns.Endpoints["app"].setBackend("default-app-80", "http")
+	ns.Endpoints["app"].setBackend("default-app-8080", "admin")
+
+	c.eventEndpoints(ns, testEndpoints(t, MODIFIED, map[string]string{"app-1": "10.0.0.1", "app-2": "10.0.0.2"}, 8001, 9001))
+	endpoints := ns.Endpoints["app"]
+	expected := map[string]string{"default-app-80": "http", "default-app-8080": "admin"}
+	if len(endpoints.Backends) != len(expected) {
+		t.Fatalf("backends of modified endpoints: expected %v, got %v", expected, endpoints.Backends)
+	}
+	for backend, portName := range expected {
+		if endpoints.Backends[backend] != portName {
+			t.Errorf("backend %s: expected port %s, got '%s'", backend, portName, endpoints.Backends[backend])
+		}
+	}
+	ip := addressByPod(endpoints, "app-1")
+	if ip == nil || ip.HAProxyName != "app-1" {
+		t.Fatalf("server of pod app-1 not kept: %+v", ip)
+	}
+	if ip.Status != MODIFIED {
+		t.Errorf("server of pod app-1 with new ports: expected status MODIFIED, got %s", ip.Status)
+	}
+	if port := ip.Port(endpoints.Backends["default-app-80"], 0); port != 8001 {
+		t.Errorf("port of server app-1 in backend default-app-80: expected 8001, got %d", port)
+	}
+	if port := ip.Port(endpoints.Backends["default-app-8080"], 0); port != 9001 {
+		t.Errorf("port of server app-1 in backend default-app-8080: expected 9001, got %d", port)
+	}
+	if ip = addressByPod(endpoints, "app-2"); ip == nil || ip.HAProxyName == "" {
+		t.Errorf("added pod app-2 without server: %+v", ip)
+	}
+}
+
+func TestSetTargetPortPerPath(t *testing.T) {
+	c := testController()
+	service := testService()
+	endpoints := testEndpoints(t, ADDED, map[string]string{"app-1": "10.0.0.1"}, 8000, 9000)
+	httpPath := &IngressPath{ServiceName: "app", ServicePortInt: 80}
+	adminPath := &IngressPath{ServiceName: "app", ServicePortString: "admin"}
+
+	// Both paths are handled on each sync, ports must not flip between them
+	for i := 0; i < 2; i++ {
+		for _, test := range []struct {
+			path     *IngressPath
+			backend  string
+			portName string
+			port     int64
+		}{
+			{httpPath, "default-app-80", "http", 8000},
+			{adminPath, "default-app-admin", "admin", 9000},
+		} {
+			portName, portChanged, err := c.setTargetPort(test.path, service, endpoints, test.backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if portName != test.portName || test.path.TargetPort != test.port {
+				t.Errorf("backend %s: expected port %s/%d, got %s/%d", test.backend, test.portName, test.port, portName, test.path.TargetPort)
+			}
+			if i > 0 && portChanged {
+				t.Errorf("backend %s: port changed on sync %d", test.backend, i)
+			}
+			endpoints.setBackend(test.backend, portName)
+		}
+	}
+
+	// Pods now expose http on another port
+	endpoints = testEndpoints(t, MODIFIED, map[string]string{"app-1": "10.0.0.1"}, 8001, 9000)
+	endpoints.Backends = map[string]string{"default-app-80": "http", "default-app-admin": "admin"}
+	if _, portChanged, _ := c.setTargetPort(httpPath, service, endpoints, "default-app-80"); !portChanged || httpPath.TargetPort != 8001 {
+		t.Errorf("http port change: expected 8001, got changed=%v port=%d", portChanged, httpPath.TargetPort)
+	}
+	if _, portChanged, _ := c.setTargetPort(adminPath, service, endpoints, "default-app-admin"); portChanged {
+		t.Error("admin port: unexpected change")
+	}
+}
+
+func TestServerName(t *testing.T) {
+	pod := &EndpointIP{IP: "10.0.0.1", Name: "app-1", Ports: map[string]int64{"http": 8000}}
+	if name := serverName(pod); name != "app-1" {
+		t.Errorf("server of pod: expected app-1, got %s", name)
+	}
+	noPod := &EndpointIP{IP: "10.0.0.1", Ports: map[string]int64{"http": 8000, "admin": 9000}}
+	name := serverName(noPod)
+	if name != serverName(&EndpointIP{IP: "10.0.0.1", Ports: map[string]int64{"admin": 9000, "http": 8000}}) {
+		t.Error("server name of address without pod depends on port order")
+	}
+	if name == serverName(&EndpointIP{IP: "10.0.0.2", Ports: noPod.Ports}) {
+		t.Error("addresses without pod share a server name")
+	}
+	invalid := &EndpointIP{IP: "10.0.0.1", Name: "app 1", Ports: noPod.Ports}
+	if serverName(invalid) != name {
+		t.Error("pod name HAProxy can't use: expected hash name")
+	}
+}
+
+func TestUniqueServerName(t *testing.T) {
+	used := map[string]struct{}{"app-1": {}}
+	name := uniqueServerName("app-1", used)
+	if name == "app-1" {
+		t.Error("name already used returned")
+	}
+	if _, ok := used[name]; !ok {
+		t.Errorf("name %s not marked used", name)
+	}
+	if uniqueServerName("app-2", used) != "app-2" {
+		t.Error("unused name not returned")
+	}
+}
+
+func TestRenameReusedServers(t *testing.T) {
+	c, cleanup := testControllerConfig(t, `global
+defaults
+backend default-app-80
+  server app-1 10.0.0.1:8000
+  server SRV_abcde 10.0.0.2:8000 weight 10
+  server SRV_fghij 127.0.0.1:8000 disabled
+`)
+	defer cleanup()
+	ns := &Namespace{Name: "default", Endpoints: map[string]*Endpoints{}}
+	c.cfg.Namespace[ns.Name] = ns
+	reused := &EndpointIP{IP: "10.0.0.2", Name: "app-2", HAProxyName: "SRV_abcde", Ports: map[string]int64{"http": 8000}}
+	free := &EndpointIP{IP: "127.0.0.1", Name: "SRV_fghij", HAProxyName: "SRV_fghij", Disabled: true}
+	ns.Endpoints["app"] = &Endpoints{
+		Namespace: "default",
+		Service:   StringW{Value: "app"},
+		Backends:  map[string]string{"default-app-80": "http"},
+		Addresses: &EndpointIPs{
+			"uid-app-1": {IP: "10.0.0.1", Name: "app-1", HAProxyName: "app-1", Ports: map[string]int64{"http": 8000}},
+			"uid-app-2": reused,
+			"SRV_fghij": free,
+		},
+	}
+
+	renamed := c.renameReusedServers()
+	if len(renamed) != 1 || reused.HAProxyName != "app-2" {
+		t.Fatalf("expected server SRV_abcde renamed to app-2, got %v, %s", renamed, reused.HAProxyName)
+	}
+	server, err := c.backendServerGet("default-app-80", "app-2")
+	if err != nil || server.Address != "10.0.0.2" || server.Weight == nil || *server.Weight != 10 {
+		t.Errorf("renamed server: expected address and weight kept, got %+v, %v", server, err)
+	}
+	if _, err = c.backendServerGet("default-app-80", "SRV_abcde"); err == nil {
+		t.Error("server SRV_abcde still exists")
+	}
+	if free.HAProxyName != "SRV_fghij" {
+		t.Errorf("unused slot renamed to %s", free.HAProxyName)
+	}
+	if renamed = c.renameReusedServers(); len(renamed) != 0 {
+		t.Errorf("servers named after their pods renamed again: %v", renamed)
+	}
+
+	restoreServerNames(map[*EndpointIP]string{reused: "SRV_abcde"})
+	if reused.HAProxyName != "SRV_abcde" {
+		t.Errorf("name not restored: %s", reused.HAProxyName)
+	}
+}
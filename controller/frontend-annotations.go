@@ -15,14 +15,27 @@
 package controller
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"io/ioutil"
 	"net"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/haproxytech/client-native/misc"
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/common"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/haproxy"
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
 	"github.com/haproxytech/models"
 )
@@ -30,10 +43,154 @@ import (
 const (
 	defaultCaptureLen      = 128
 	defaultSSLRedirectCode = 302
+	defaultDenyStatus      = 403
 )
 
-var sslRedirectEnabled map[string]struct{}
+var sslRedirectEnabled map[string]uint64
 var rateLimitTables map[string]rateLimitTable
+var responseCaptures responseCaptureSlots
+
+// Response captures are referenced by ID in log formats (capture.res.hdr(<id>)),
+// so a sample keeps its slot as long as it's in use.
+type responseCaptureSlots struct {
+	ids  map[string]int64
+	lens []int64
+	// samples of response-capture rules of current sync with their length
+	requested map[string]int64
+}
+
+// Request a capture slot for sample, slots are allocated by allocate
+func (r *responseCaptureSlots) request(sample string, length int64) {
+	if r.requested[sample] < length {
+		r.requested[sample] = length
+	}
+}
+
+// Release slots of samples no longer requested and allocate slots of new ones.
+// Samples are sorted so that IDs don't depend on the order ingresses are handled in.
+func (r *responseCaptureSlots) allocate() {
+	for sample := range r.ids {
+		if _, ok := r.requested[sample]; !ok {
+			delete(r.ids, sample)
+		}
+	}
+	samples := make([]string, 0, len(r.requested))
+	for sample := range r.requested {
+		samples = append(samples, sample)
+	}
+	sort.Strings(samples)
+	for _, sample := range samples {
+		r.get(sample, r.requested[sample])
+	}
+}
+
+// Return the capture slot of sample, allocating the first free one if needed
+func (r *responseCaptureSlots) get(sample string, length int64) int64 {
+	if id, ok := r.ids[sample]; ok {
+		if r.lens[id] < length {
+			r.lens[id] = length
+		}
+		return id
+	}
+	used := make(map[int64]struct{}, len(r.ids))
+	for _, id := range r.ids {
+		used[id] = struct{}{}
+	}
+	var id int64
+	for ; id < int64(len(r.lens)); id++ {
+		if _, ok := used[id]; !ok {
+			break
+		}
+	}
+	if id == int64(len(r.lens)) {
+		r.lens = append(r.lens, length)
+	} else {
+		r.lens[id] = length
+	}
+	r.ids[sample] = id
+	return id
+}
+
+// Handle auth-url annotation: requests for ingress hosts are sent to the auth
+// service by the auth-request Lua action, the auth service gets a backend so
+// its endpoints are tracked. Denial and auth-headers are handled in backends.
+func (c *HAProxyController) handleAuth(namespace *Namespace, ingress *Ingress) (reload bool, err error) {
+	annAuthURL, _ := GetValueFromAnnotations("auth-url", ingress.Annotations)
+	if annAuthURL == nil {
+		return false, nil
+	}
+	status := setStatus(ingress.Status, annAuthURL.Status)
+	if status != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	if status == DELETED {
+		return false, nil
+	}
+	// auth-url format: http://<service>[.<namespace>][:<port>][/<path>]
+	authURL, err := url.Parse(annAuthURL.Value)
+	if err != nil || authURL.Scheme != "http" || authURL.Hostname() == "" {
+		return false, fmt.Errorf("auth-url annotation: incorrect value '%s' in ingress '%s'", annAuthURL.Value, ingress.Name)
+	}
+	authNamespace := namespace
+	parts := strings.Split(authURL.Hostname(), ".")
+	if len(parts) > 1 {
+		if !c.isWatchedNamespace(parts[1]) {
+			return false, fmt.Errorf("auth-url annotation: namespace '%s' is excluded by namespace-whitelist/blacklist", parts[1])
+		}
+		ns, ok := c.cfg.Namespace[parts[1]]
+		if !ok {
+			return false, fmt.Errorf("auth-url annotation: namespace '%s' does not exist", parts[1])
+		}
+		authNamespace = ns
+	}
+	service, ok := authNamespace.Services[parts[0]]
+	if !ok {
+		return false, fmt.Errorf("auth-url annotation: service '%s' does not exist", parts[0])
+	}
+	authPath := &IngressPath{
+		ServiceName:   service.Name,
+		IsAuthService: true,
+		Status:        status,
+	}
+	if port := authURL.Port(); port != "" {
+		authPath.ServicePortInt, _ = strconv.ParseInt(port, 10, 64)
+	} else if len(service.Ports) > 0 {
+		authPath.ServicePortInt = service.Ports[0].Port
+	}
+	// Auth backend does not get the annotations of the ingress it protects
+	authIngress := &Ingress{
+		Namespace:   authNamespace.Name,
+		Name:        ingress.Name,
+		Annotations: MapStringW{},
+		Rules:       map[string]*IngressRule{},
+	}
+	reload, err = c.handlePath(authNamespace, authIngress, &IngressRule{}, authPath)
+	if err != nil {
+		return reload, err
+	}
+
+	uri := authURL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	if authURL.RawQuery != "" {
+		uri += "?" + authURL.RawQuery
+	}
+	mapFiles := c.cfg.MapFiles
+	key := hashStrToUint(fmt.Sprintf("%s-%s-%s", AUTH, ingress.Namespace, ingress.Name))
+	if status != EMPTY {
+		mapFiles.Modified(key)
+	}
+	for hostname := range ingress.Rules {
+		mapFiles.AppendHost(key, hostname)
+	}
+	c.cfg.FrontendAuthRequests[key] = AuthRequest{
+		Backend: getBackendName(authNamespace, service, authPath),
+		Path:    uri,
+		MapFile: path.Join(HAProxyMapDir, strconv.FormatUint(key, 10)) + ".lst",
+	}
+	return reload, nil
+}
 
 func (c *HAProxyController) handleBlacklisting(ingress *Ingress) error {
 	//  Get and validate annotations
@@ -41,19 +198,26 @@ func (c *HAProxyController) handleBlacklisting(ingress *Ingress) error {
 	if annBlacklist == nil {
 		return nil
 	}
-	value := strings.Replace(annBlacklist.Value, ",", " ", -1)
-	for _, address := range strings.Fields(value) {
-		if ip := net.ParseIP(address); ip == nil {
-			if _, _, err := net.ParseCIDR(address); err != nil {
-				return fmt.Errorf("incorrect value for blacklist annotation in ingress '%s'", ingress.Name)
-			}
-		}
+	srcACL, srcModified, err := c.srcACL(annBlacklist.Value)
+	if err != nil {
+		return fmt.Errorf("incorrect value for blacklist annotation in ingress '%s': %s", ingress.Name, err)
+	}
+
+	annStatusCode, _ := GetValueFromAnnotations("blacklist-status-code", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	statusCode := int64(defaultDenyStatus)
+	if _, ok := haproxyStatusCodes[annStatusCode.Value]; ok {
+		statusCode, _ = strconv.ParseInt(annStatusCode.Value, 10, 64)
+	} else {
+		utils.LogErr(fmt.Errorf("blacklist-status-code annotation: unsupported status code '%s' in ingress '%s', using %d", annStatusCode.Value, ingress.Name, defaultDenyStatus))
 	}
 
 	// Update rules
 	status := setStatus(ingress.Status, annBlacklist.Status)
+	if status == EMPTY && (annStatusCode.Status != EMPTY || srcModified) {
+		status = MODIFIED
+	}
 	mapFiles := c.cfg.MapFiles
-	key := hashStrToUint(fmt.Sprintf("%s-%s", BLACKLIST, annBlacklist.Value))
+	key := hashStrToUint(fmt.Sprintf("%s-%s-%d", BLACKLIST, annBlacklist.Value, statusCode))
 	if status != EMPTY {
 		mapFiles.Modified(key)
 		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
@@ -70,16 +234,16 @@ func (c *HAProxyController) handleBlacklisting(ingress *Ingress) error {
 	httpRule := models.HTTPRequestRule{
 		Index:      utils.PtrInt64(0),
 		Type:       "deny",
-		DenyStatus: 403,
+		DenyStatus: statusCode,
 		Cond:       "if",
-		CondTest:   fmt.Sprintf("{ req.hdr(Host) -f %s } { src %s }", mapFile, value),
+		CondTest:   hostACL(mapFile, srcACL),
 	}
 	tcpRule := models.TCPRequestRule{
 		Index:    utils.PtrInt64(0),
 		Type:     "content",
 		Action:   "reject",
 		Cond:     "if",
-		CondTest: fmt.Sprintf("{ req_ssl_sni -f %s } { src %s }", mapFile, value),
+		CondTest: sniACL(mapFile, srcACL),
 	}
 	c.cfg.FrontendHTTPReqRules[BLACKLIST][key] = httpRule
 	c.cfg.FrontendTCPRules[BLACKLIST][key] = tcpRule
@@ -87,48 +251,247 @@ func (c *HAProxyController) handleBlacklisting(ingress *Ingress) error {
 	return nil
 }
 
-func (c *HAProxyController) handleHTTPRedirect(ingress *Ingress) error {
+func (c *HAProxyController) handleCORS(ingress *Ingress) error {
 	//  Get and validate annotations
-	var err error
-	toEnable := false
-	annSSLRedirect, _ := GetValueFromAnnotations("ssl-redirect", ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	annRedirectCode, _ := GetValueFromAnnotations("ssl-redirect-code", ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	_, enabled := sslRedirectEnabled[ingress.Namespace+ingress.Name]
-	if annSSLRedirect == nil {
-		if len(ingress.TLS) > 0 {
-			toEnable = true
-		} else if !enabled {
-			// Nothing to do
-			return nil
+	annotations := map[string]*StringW{}
+	status := EMPTY
+	for _, name := range []string{"cors-enable", "cors-allow-origin", "cors-allow-methods", "cors-allow-headers", "cors-allow-credentials", "cors-max-age"} {
+		ann, _ := GetValueFromAnnotations(name, ingress.Annotations, c.cfg.ConfigMap.Annotations)
+		if ann == nil {
+			continue
 		}
-	} else {
-		switch annSSLRedirect.Status {
-		case DELETED:
-			if len(ingress.TLS) > 0 {
-				toEnable = true
-			}
-		default:
-			if toEnable, err = utils.GetBoolValue(annSSLRedirect.Value, "ssl-redirect"); err != nil {
+		if ann.Status != EMPTY {
+			status = MODIFIED
+		}
+		if ann.Status != DELETED {
+			annotations[name] = ann
+		}
+	}
+	enabled := false
+	if annEnable, ok := annotations["cors-enable"]; ok {
+		var err error
+		if enabled, err = utils.GetBoolValue(annEnable.Value, "cors-enable"); err != nil {
+			return err
+		}
+	}
+	status = setStatus(ingress.Status, status)
+	if status != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	if !enabled || status == DELETED {
+		return nil
+	}
+
+	// Origin of the request is kept in a variable of the ingress since response rules
+	// can't access request headers, it is only set for hosts and paths of the ingress.
+	// Origin can be "*", a list of origins or a regex starting with "^"
+	originVar := fmt.Sprintf("cors_origin_%d", hashStrToUint(fmt.Sprintf("%s-%s-%s", CORS, ingress.Namespace, ingress.Name)))
+	origin := annotations["cors-allow-origin"].Value
+	var originACL string
+	allowOrigin := "*"
+	switch {
+	case origin == "*":
+		originACL = fmt.Sprintf("{ var(txn.%s) -m found }", originVar)
+	case strings.HasPrefix(origin, "^"):
+		originACL = fmt.Sprintf("{ var(txn.%s) -m reg %s }", originVar, origin)
+		allowOrigin = fmt.Sprintf("%%[var(txn.%s)]", originVar)
+	default:
+		originACL = fmt.Sprintf("{ var(txn.%s) -m str %s }", originVar, strings.Join(strings.Fields(strings.Replace(origin, ",", " ", -1)), " "))
+		allowOrigin = fmt.Sprintf("%%[var(txn.%s)]", originVar)
+	}
+	headers := map[string]string{
+		"Access-Control-Allow-Origin": allowOrigin,
+	}
+	if allowOrigin != "*" {
+		headers["Vary"] = "Origin"
+	}
+	for name, hdrName := range map[string]string{
+		"cors-allow-methods":     "Access-Control-Allow-Methods",
+		"cors-allow-headers":     "Access-Control-Allow-Headers",
+		"cors-allow-credentials": "Access-Control-Allow-Credentials",
+		"cors-max-age":           "Access-Control-Max-Age",
+	} {
+		ann, ok := annotations[name]
+		if !ok {
+			continue
+		}
+		// Header values should not contain spaces
+		value := strings.Join(strings.Fields(strings.Replace(ann.Value, ",", " ", -1)), ",")
+		switch name {
+		case "cors-allow-credentials":
+			credentials, err := utils.GetBoolValue(value, name)
+			if err != nil {
 				return err
 			}
+			if !credentials {
+				continue
+			}
+		case "cors-max-age":
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("incorrect value '%s' for cors-max-age annotation in ingress '%s'", value, ingress.Name)
+			}
+		}
+		headers[hdrName] = value
+	}
+
+	// Update rules
+	for _, rule := range ingress.Rules {
+		for _, path := range rule.Paths {
+			acl := hostPathACL(rule.Host, path.Path)
+			if acl == "" {
+				continue
+			}
+			key := hashStrToUint(fmt.Sprintf("%s-%s-%s-%s-%s", CORS, ingress.Namespace, ingress.Name, rule.Host, path.Path))
+			c.cfg.FrontendHTTPReqRules[CORS][key] = models.HTTPRequestRule{
+				Index:    utils.PtrInt64(0),
+				Type:     "set-var",
+				VarName:  originVar,
+				VarScope: "txn",
+				VarExpr:  "req.hdr(origin)",
+				Cond:     "if",
+				CondTest: strings.TrimSpace(acl),
+			}
+		}
+	}
+	hdrNames := make([]string, 0, len(headers))
+	for hdrName := range headers {
+		hdrNames = append(hdrNames, hdrName)
+	}
+	sort.Strings(hdrNames)
+	var preflightHeaders strings.Builder
+	for _, hdrName := range hdrNames {
+		key := hashStrToUint(fmt.Sprintf("%s-%s-%s-%s", CORS, ingress.Namespace, ingress.Name, hdrName))
+		c.cfg.FrontendHTTPRspRules[CORS][key] = models.HTTPResponseRule{
+			Index:     utils.PtrInt64(0),
+			Type:      "set-header",
+			HdrName:   hdrName,
+			HdrFormat: headers[hdrName],
+			Cond:      "if",
+			CondTest:  originACL,
+		}
+		fmt.Fprintf(&preflightHeaders, " hdr %s %s", hdrName, headers[hdrName])
+	}
+	// Preflight requests are answered by HAProxy, http-response rules don't apply to
+	// http-request return so headers are part of it. Older versions forward them.
+	if haproxyVersionAtLeast(2, 2) {
+		key := hashStrToUint(fmt.Sprintf("%s-%s-%s-preflight", CORS, ingress.Namespace, ingress.Name))
+		c.cfg.FrontendHTTPReturns[key] = fmt.Sprintf("http-request return status 204%s if METH_OPTIONS { req.hdr(access-control-request-method) -m found } %s", preflightHeaders.String(), originACL)
+	}
+
+	return nil
+}
+
+func (c *HAProxyController) handleHSTS(ingress *Ingress) error {
+	//  Get and validate annotations
+	annHSTS, _ := GetValueFromAnnotations("hsts", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	annMaxAge, _ := GetValueFromAnnotations("hsts-max-age", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	annSubdomains, _ := GetValueFromAnnotations("hsts-include-subdomains", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	annPreload, _ := GetValueFromAnnotations("hsts-preload", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annHSTS == nil {
+		return nil
+	}
+	status := setStatus(ingress.Status, annHSTS.Status)
+	for _, ann := range []*StringW{annMaxAge, annSubdomains, annPreload} {
+		if ann != nil && ann.Status != EMPTY && status == EMPTY {
+			status = MODIFIED
+		}
+	}
+	if status != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	enabled, err := utils.GetBoolValue(annHSTS.Value, "hsts")
+	if err != nil || !enabled || status == DELETED {
+		return err
+	}
+	maxAge, err := strconv.ParseInt(annMaxAge.Value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("incorrect value '%s' for hsts-max-age annotation in ingress '%s'", annMaxAge.Value, ingress.Name)
+	}
+	value := fmt.Sprintf("max-age=%d", maxAge)
+	if subdomains, _ := utils.GetBoolValue(annSubdomains.Value, "hsts-include-subdomains"); subdomains {
+		value += ";includeSubDomains"
+	}
+	if preload, _ := utils.GetBoolValue(annPreload.Value, "hsts-preload"); preload {
+		value += ";preload"
+	}
+
+	// Update rules
+	// Rule is only applied to HTTPS frontend, plain HTTP traffic is
+	// redirected to HTTPS via ssl-redirect before getting the header
+	mapFiles := c.cfg.MapFiles
+	key := hashStrToUint(fmt.Sprintf("%s-%s", HSTS, value))
+	for hostname := range ingress.Rules {
+		mapFiles.AppendHost(key, hostname)
+	}
+	mapFile := path.Join(HAProxyMapDir, strconv.FormatUint(key, 10)) + ".lst"
+	c.cfg.FrontendHTTPRspRules[HSTS][key] = models.HTTPResponseRule{
+		Index:     utils.PtrInt64(0),
+		Type:      "set-header",
+		HdrName:   "Strict-Transport-Security",
+		HdrFormat: value,
+		Cond:      "if",
+		CondTest:  hostACL(mapFile, "{ ssl_fc }"),
+	}
+
+	return nil
+}
+
+// ssl-redirect, ssl-redirect-code and ssl-redirect-port annotations. Requests of hosts of
+// ingresses with TLS are redirected to HTTPS unless ssl-redirect annotation of ingress is
+// "false", ssl-redirect of ConfigMap only applies to ingresses with TLS. Rules are keyed
+// by code and port, so changing them moves hosts of ingress to another rule.
+func (c *HAProxyController) handleHTTPRedirect(ingress *Ingress) (err error) {
+	//  Get and validate annotations
+	ingressKey := ingress.Namespace + ingress.Name
+	prevKey, enabled := sslRedirectEnabled[ingressKey]
+	toEnable := len(ingress.TLS) > 0
+	annSSLRedirect, _ := GetValueFromAnnotations("ssl-redirect", ingress.Annotations)
+	if annSSLRedirect == nil || annSSLRedirect.Status == DELETED {
+		if annSSLRedirect, _ = GetValueFromAnnotations("ssl-redirect", c.cfg.ConfigMap.Annotations); !toEnable {
+			annSSLRedirect = nil
+		}
+	}
+	if annSSLRedirect != nil && annSSLRedirect.Status != DELETED {
+		if toEnable, err = utils.GetBoolValue(annSSLRedirect.Value, "ssl-redirect"); err != nil {
+			// Keep current redirect
+			toEnable = enabled
 		}
 	}
-	var sslRedirectCode int64
-	if sslRedirectCode, err = strconv.ParseInt(annRedirectCode.Value, 10, 64); err != nil {
+	annRedirectCode, _ := GetValueFromAnnotations("ssl-redirect-code", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	sslRedirectCode, errCode := strconv.ParseInt(annRedirectCode.Value, 10, 64)
+	switch sslRedirectCode {
+	case 301, 302, 303, 307, 308:
+	default:
+		if errCode == nil {
+			errCode = fmt.Errorf("ssl-redirect-code: incorrect value '%s', expected 301, 302, 303, 307 or 308", annRedirectCode.Value)
+		}
 		sslRedirectCode = defaultSSLRedirectCode
 	}
+	// scheme redirect keeps port of Host header, so it is replaced by HTTPS port
+	sslRedirectPort := c.httpsPort()
+	if annRedirectPort, _ := GetValueFromAnnotations("ssl-redirect-port", ingress.Annotations, c.cfg.ConfigMap.Annotations); annRedirectPort != nil && annRedirectPort.Status != DELETED {
+		port, errPort := strconv.ParseInt(annRedirectPort.Value, 10, 64)
+		if errPort != nil || port < 1 || port > 65535 {
+			errCode = fmt.Errorf("ssl-redirect-port: incorrect value '%s'", annRedirectPort.Value)
+		} else {
+			sslRedirectPort = port
+		}
+	}
+	if err == nil {
+		err = errCode
+	}
 
 	// Update Rules
-	key := hashStrToUint(fmt.Sprintf("%s-%d", SSL_REDIRECT, sslRedirectCode))
+	key := hashStrToUint(fmt.Sprintf("%s-%d-%d", SSL_REDIRECT, sslRedirectCode, sslRedirectPort))
 	mapFiles := c.cfg.MapFiles
 	// Disable Redirect
 	if !toEnable {
 		if enabled {
-			delete(sslRedirectEnabled, ingress.Namespace+ingress.Name)
-			mapFiles.Modified(key)
+			delete(sslRedirectEnabled, ingressKey)
+			mapFiles.Modified(prevKey)
 			c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
 		}
-		return nil
+		return err
 	}
 	//Enable Redirect
 	for hostname := range ingress.Rules {
@@ -142,160 +505,1150 @@ func (c *HAProxyController) handleHTTPRedirect(ingress *Ingress) error {
 		RedirValue: "https",
 		RedirType:  "scheme",
 		Cond:       "if",
-		CondTest:   fmt.Sprintf("{ req.hdr(Host) -f %s } !{ ssl_fc }", mapFile),
+		CondTest:   hostACL(mapFile, "!{ ssl_fc }"),
+	}
+	if sslRedirectPort != 443 {
+		httpRule.RedirType = "location"
+		httpRule.RedirValue = fmt.Sprintf("https://%%[req.hdr(host),field(1,:)]:%d%%[capture.req.uri]", sslRedirectPort)
 	}
 	c.cfg.FrontendHTTPReqRules[SSL_REDIRECT][key] = httpRule
 
-	if !enabled {
+	if !enabled || prevKey != key {
+		if enabled {
+			mapFiles.Modified(prevKey)
+		}
 		mapFiles.Modified(key)
 		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
-		sslRedirectEnabled[ingress.Namespace+ingress.Name] = struct{}{}
+		sslRedirectEnabled[ingressKey] = key
+	}
+	return err
+}
+
+// app-root annotation: requests of root path of ingress hosts are redirected to the application path.
+// Rules are created before SSL redirect ones, so HTTP requests are redirected to HTTPS first.
+func (c *HAProxyController) handleAppRoot(ingress *Ingress) error {
+	annAppRoot, _ := GetValueFromAnnotations("app-root", ingress.Annotations)
+	if annAppRoot == nil {
+		return nil
+	}
+	if annAppRoot.Status != EMPTY || ingress.Status != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	if annAppRoot.Status == DELETED || ingress.Status == DELETED {
+		return nil
+	}
+	appRoot := annAppRoot.Value
+	if !strings.HasPrefix(appRoot, "/") || appRoot == "/" || strings.ContainsAny(appRoot, " \t\n") {
+		return fmt.Errorf("app-root annotation: incorrect path '%s'", appRoot)
+	}
+	for _, rule := range ingress.Rules {
+		key := hashStrToUint(fmt.Sprintf("%s-%s-%s-%s", APP_ROOT, ingress.Namespace, ingress.Name, rule.Host))
+		c.cfg.FrontendHTTPReqRules[APP_ROOT][key] = models.HTTPRequestRule{
+			Index:      utils.PtrInt64(0),
+			Type:       "redirect",
+			RedirType:  "location",
+			RedirValue: strings.Replace(appRoot, "%", "%%", -1),
+			RedirCode:  302,
+			Cond:       "if",
+			CondTest:   hostPathACL(rule.Host, "") + "{ path / }",
+		}
 	}
 	return nil
 }
 
-func (c *HAProxyController) handleProxyProtocol() error {
-	//  Get and validate annotations
-	annProxyProtocol, _ := GetValueFromAnnotations("proxy-protocol", c.cfg.ConfigMap.Annotations)
-	if annProxyProtocol == nil {
+// Return URL and code of permanent-redirect or temporal-redirect annotation of ingress,
+// permanent-redirect is used when both are set. changed is true when one of them changed.
+func ingressRedirect(ingress *Ingress) (location string, code int64, changed bool) {
+	for _, redirect := range []struct {
+		annotation string
+		code       int64
+	}{{"permanent-redirect", 301}, {"temporal-redirect", 302}} {
+		ann, _ := GetValueFromAnnotations(redirect.annotation, ingress.Annotations)
+		if ann == nil {
+			continue
+		}
+		if ann.Status != EMPTY {
+			changed = true
+		}
+		if ann.Status != DELETED && location == "" {
+			location, code = ann.Value, redirect.code
+		}
+	}
+	return location, code, changed
+}
+
+// Location of a valid redirect annotation of ingress, and whether query string is kept.
+// Paths of ingress have no backend only when it is valid, see handlePath.
+func ingressRedirectURL(ingress *Ingress) (location string, code int64, keepQuery bool, err error) {
+	location, code, _ = ingressRedirect(ingress)
+	if location == "" {
+		return "", 0, false, nil
+	}
+	annotation := "permanent-redirect"
+	if code == 302 {
+		annotation = "temporal-redirect"
+	}
+	if u, errURL := url.Parse(location); errURL != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(location, " \t\n") {
+		return "", 0, false, fmt.Errorf("%s annotation: incorrect URL '%s'", annotation, location)
+	}
+	annKeepQuery, _ := GetValueFromAnnotations("redirect-keep-query", ingress.Annotations)
+	if annKeepQuery != nil && annKeepQuery.Status != DELETED {
+		if keepQuery, err = utils.GetBoolValue(annKeepQuery.Value, "redirect-keep-query"); err != nil {
+			return "", 0, false, err
+		}
+	}
+	return location, code, keepQuery, nil
+}
+
+// permanent-redirect, temporal-redirect and redirect-keep-query annotations: requests of
+// hosts and paths of ingress are redirected to an URL, paths have no backend, see handlePath.
+func (c *HAProxyController) handleRedirect(ingress *Ingress) error {
+	location, _, changed := ingressRedirect(ingress)
+	annKeepQuery, _ := GetValueFromAnnotations("redirect-keep-query", ingress.Annotations)
+	if changed || (location != "" && ingress.Status != EMPTY) || (annKeepQuery != nil && annKeepQuery.Status != EMPTY) {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	if location == "" || ingress.Status == DELETED {
 		return nil
 	}
-	value := strings.Replace(annProxyProtocol.Value, ",", " ", -1)
-	for _, address := range strings.Fields(value) {
-		if ip := net.ParseIP(address); ip == nil {
-			if _, _, err := net.ParseCIDR(address); err != nil {
-				return fmt.Errorf("incorrect value for proxy-protocol annotation ")
+	location, code, keepQuery, err := ingressRedirectURL(ingress)
+	if err != nil {
+		return err
+	}
+	// Location is a log-format string
+	location = strings.Replace(location, "%", "%%", -1)
+	separator := "?"
+	if strings.Contains(location, "?") {
+		separator = "&"
+	}
+	for _, rule := range ingress.Rules {
+		for _, path := range rule.Paths {
+			acl := hostPathACL(rule.Host, path.Path)
+			if acl == "" {
+				continue
+			}
+			key := hashStrToUint(fmt.Sprintf("%s-%s-%s-%s-%s", REDIRECT, ingress.Namespace, ingress.Name, rule.Host, path.Path))
+			c.cfg.FrontendHTTPReqRules[REDIRECT][key] = models.HTTPRequestRule{
+				Index:      utils.PtrInt64(0),
+				Type:       "redirect",
+				RedirType:  "location",
+				RedirValue: location,
+				RedirCode:  code,
+				Cond:       "if",
+				CondTest:   acl,
+			}
+			if keepQuery {
+				// Query string is everything after the first question mark of the URL
+				c.cfg.FrontendHTTPReqRules[REDIRECT][key+1] = models.HTTPRequestRule{
+					Index:      utils.PtrInt64(0),
+					Type:       "redirect",
+					RedirType:  "location",
+					RedirValue: location + separator + "%[url,field(2,?)]",
+					RedirCode:  code,
+					Cond:       "if",
+					CondTest:   acl + " { url -m sub ? }",
+				}
 			}
 		}
 	}
+	return nil
+}
 
-	// Get Rules status
-	status := annProxyProtocol.Status
+// PROXY protocol setting of a frontend of proxy-protocol annotation, either
+// accept-proxy on its binds or expect-proxy rule for connections from sources
+type proxyProtocol struct {
+	acceptProxy bool
+	sources     []string
+}
 
-	// Update rules
-	// Since this is a Configmap Annotation ONLY, no need to
-	// track ingress hosts in Map file
-	if status != EMPTY {
-		c.cfg.FrontendRulesStatus[TCP] = MODIFIED
-		if status == DELETED {
-			return nil
+// Parse proxy-protocol annotation, a list of IPs and CIDRs enabling PROXY protocol on
+// HTTP and HTTPS frontends, and/or <frontend>=<setting> entries where frontend is
+// http, https or tcp-<port> and setting is on, off or a list of IPs and CIDRs.
+func parseProxyProtocol(value string) (map[string]proxyProtocol, error) {
+	lists := map[string][]string{}
+	frontends := []string{}
+	current := ""
+	for _, field := range strings.Fields(strings.Replace(value, ",", " ", -1)) {
+		if i := strings.Index(field, "="); i >= 0 {
+			current = field[:i]
+			if !validProxyProtocolFrontend(current) {
+				return nil, fmt.Errorf("unknown frontend '%s', expected http, https or tcp-<port>", current)
+			}
+			if _, ok := lists[current]; ok {
+				return nil, fmt.Errorf("frontend '%s' is set more than once", current)
+			}
+			frontends = append(frontends, current)
+			lists[current] = []string{}
+			if field = field[i+1:]; field == "" {
+				continue
+			}
+		}
+		lists[current] = append(lists[current], field)
+	}
+	settings := map[string]proxyProtocol{}
+	if sources, ok := lists[""]; ok {
+		for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+			if _, ok = lists[frontend]; !ok {
+				lists[frontend] = sources
+				frontends = append(frontends, frontend)
+			}
+		}
+	}
+	for _, frontend := range frontends {
+		list := lists[frontend]
+		if len(list) == 1 && (list[0] == "on" || list[0] == "off") {
+			if list[0] == "on" {
+				settings[frontend] = proxyProtocol{acceptProxy: true}
+			}
+			continue
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("missing setting of frontend '%s'", frontend)
 		}
+		sources, err := normalizeSources(list)
+		if err != nil {
+			return nil, err
+		}
+		settings[frontend] = proxyProtocol{sources: sources}
 	}
+	return settings, nil
+}
 
-	tcpRule := models.TCPRequestRule{
+func validProxyProtocolFrontend(frontend string) bool {
+	if frontend == FrontendHTTP || frontend == FrontendHTTPS {
+		return true
+	}
+	if !strings.HasPrefix(frontend, "tcp-") {
+		return false
+	}
+	port, err := strconv.ParseInt(strings.TrimPrefix(frontend, "tcp-"), 10, 64)
+	return err == nil && port > 0 && port <= 65535
+}
+
+// Return IPs and CIDRs as networks sorted by family, address and prefix length,
+// without networks contained in others. Single addresses are kept as IPs.
+func normalizeSources(addresses []string) ([]string, error) {
+	networks := make([]*net.IPNet, 0, len(addresses))
+	for _, address := range addresses {
+		var network *net.IPNet
+		if ip := net.ParseIP(address); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		} else if _, ipNet, err := net.ParseCIDR(address); err == nil {
+			network = ipNet
+		} else {
+			return nil, fmt.Errorf("'%s' is not an IP or CIDR", address)
+		}
+		networks = append(networks, network)
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		if len(networks[i].IP) != len(networks[j].IP) {
+			return len(networks[i].IP) < len(networks[j].IP)
+		}
+		if cmp := bytes.Compare(networks[i].IP, networks[j].IP); cmp != 0 {
+			return cmp < 0
+		}
+		onesI, _ := networks[i].Mask.Size()
+		onesJ, _ := networks[j].Mask.Size()
+		return onesI < onesJ
+	})
+	// A network containing another one is sorted before it
+	sources := []string{}
+	var last *net.IPNet
+	for _, network := range networks {
+		if last != nil && len(last.IP) == len(network.IP) && last.Contains(network.IP) {
+			continue
+		}
+		last = network
+		if ones, bits := network.Mask.Size(); ones == bits {
+			sources = append(sources, network.IP.String())
+		} else {
+			sources = append(sources, network.String())
+		}
+	}
+	return sources, nil
+}
+
+// tcp-request rule reading PROXY protocol header of connections from sources
+func proxyProtocolRule(sources []string) models.TCPRequestRule {
+	return models.TCPRequestRule{
 		Index:    utils.PtrInt64(0),
 		Type:     "connection",
 		Action:   "expect-proxy layer4",
 		Cond:     "if",
-		CondTest: fmt.Sprintf("{ src %s }", value),
+		CondTest: fmt.Sprintf("{ src %s }", strings.Join(sources, " ")),
 	}
-	c.cfg.FrontendTCPRules[PROXY_PROTOCOL][0] = tcpRule
-
-	return nil
 }
 
-func (c *HAProxyController) handleRateLimiting(ingress *Ingress) error {
-	//  Get and validate annotations
-	annRateLimitReq, _ := GetValueFromAnnotations("rate-limit-requests", ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	if annRateLimitReq == nil {
-		return nil
-	}
-	reqsLimit, err := strconv.ParseInt(annRateLimitReq.Value, 10, 64)
-	if err != nil {
-		return err
-	}
-	// Following annotaitons have default values
-	annRateLimitPeriod, _ := GetValueFromAnnotations("rate-limit-period", ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	rateLimitPeriod, err := utils.ParseTime(annRateLimitPeriod.Value)
-	if err != nil {
-		return err
+// Return PROXY protocol setting of HTTP, HTTPS, SSL passthrough or TCP service frontend,
+// SSL passthrough frontend listens on HTTPS port and uses setting of HTTPS frontend
+func (c *HAProxyController) proxyProtocol(frontend string) proxyProtocol {
+	if frontend == FrontendSSL {
+		frontend = FrontendHTTPS
 	}
-	annRateLimitSize, _ := GetValueFromAnnotations("rate-limit-size", ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	rateLimitSize := misc.ParseSize(annRateLimitSize.Value)
+	return c.cfg.ProxyProtocol[frontend]
+}
 
-	// Update rules
-	var status Status
-	if annRateLimitReq.Status != EMPTY {
-		status = setStatus(ingress.Status, annRateLimitReq.Status)
-	} else {
-		status = setStatus(ingress.Status, annRateLimitPeriod.Status)
-	}
-	mapFiles := c.cfg.MapFiles
-	reqsKey := hashStrToUint(fmt.Sprintf("%s-%d-%d", RATE_LIMIT, *rateLimitPeriod, reqsLimit))
-	trackKey := hashStrToUint(fmt.Sprintf("%s-%d", RATE_LIMIT, *rateLimitPeriod))
-	tableName := fmt.Sprintf("RateLimit-%d", *rateLimitPeriod)
-	if status != EMPTY {
-		mapFiles.Modified(reqsKey)
-		mapFiles.Modified(trackKey)
-		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
-		if status == DELETED {
-			delete(rateLimitTables, tableName)
-			return nil
+// proxy-protocol annotation, settings are kept when the annotation is incorrect.
+// expect-proxy rules of HTTP and HTTPS frontends are set by FrontendTCPreqsRefresh,
+// accept-proxy binds by handleBinds, rules and binds of TCP services by handleTCPServices
+func (c *HAProxyController) handleProxyProtocol() (err error) {
+	annProxyProtocol, _ := GetValueFromAnnotations("proxy-protocol", c.cfg.ConfigMap.Annotations)
+	if annProxyProtocol != nil && annProxyProtocol.Status != EMPTY {
+		settings := map[string]proxyProtocol{}
+		if annProxyProtocol.Status != DELETED {
+			settings, err = parseProxyProtocol(annProxyProtocol.Value)
+		}
+		if err != nil {
+			err = fmt.Errorf("incorrect value for proxy-protocol annotation: %s", err)
+		} else {
+			c.cfg.ProxyProtocol = settings
+			// Since this is a Configmap Annotation ONLY, no need to
+			// track ingress hosts in Map file
+			c.cfg.FrontendRulesStatus[TCP] = MODIFIED
 		}
 	}
-	for hostname := range ingress.Rules {
-		mapFiles.AppendHost(reqsKey, hostname)
-		mapFiles.AppendHost(trackKey, hostname)
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		if sources := c.cfg.ProxyProtocol[frontend].sources; len(sources) > 0 {
+			key := hashStrToUint(fmt.Sprintf("%s-%s", PROXY_PROTOCOL, frontend))
+			c.cfg.FrontendTCPRules[PROXY_PROTOCOL][key] = proxyProtocolRule(sources)
+		}
+	}
+	return err
+}
+
+// Forwarded headers settings of ConfigMap, see handleForwardedHeaders
+type forwardedHeaders struct {
+	proto          bool
+	port           bool
+	rfc7239        bool
+	trustedProxies []string
+}
+
+// forwarded-proto, forwarded-port, forwarded-header and trusted-proxies annotations of ConfigMap,
+// settings of incorrect annotations are kept. Headers are set by FrontendHTTPReqsRefresh while
+// X-Forwarded-For is added by option forwardfor of backends, see forwarded-for annotation.
+func (c *HAProxyController) handleForwardedHeaders() error {
+	var errs []string
+	settings := &c.cfg.ForwardedHeaders
+	for _, name := range []string{"forwarded-proto", "forwarded-port", "forwarded-header", "trusted-proxies"} {
+		ann, _ := GetValueFromAnnotations(name, c.cfg.ConfigMap.Annotations)
+		if ann == nil {
+			continue
+		}
+		if ann.Status != EMPTY {
+			c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+		}
+		if name == "trusted-proxies" {
+			value := strings.Fields(strings.Replace(ann.Value, ",", " ", -1))
+			if ann.Status == DELETED {
+				value = nil
+			}
+			trusted, err := normalizeSources(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s annotation: %s", name, err))
+				continue
+			}
+			settings.trustedProxies = trusted
+			continue
+		}
+		enabled, err := utils.GetBoolValue(ann.Value, name)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		switch name {
+		case "forwarded-proto":
+			settings.proto = enabled
+		case "forwarded-port":
+			settings.port = enabled
+		case "forwarded-header":
+			settings.rfc7239 = enabled
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Return http-request rules of forwarded headers of HTTP or HTTPS frontend, in the order
+// they are created, so deletion of headers sent by untrusted clients ends before other rules.
+// Headers set by trusted proxies are kept, Forwarded gets a new element.
+func (c *HAProxyController) forwardedHeadersRules(frontend string) []models.HTTPRequestRule {
+	settings := c.cfg.ForwardedHeaders
+	proto, protoCond := "http", []string{}
+	if frontend == FrontendHTTPS {
+		proto, protoCond = "https", []string{"{ ssl_fc }"}
+	}
+	trusted := ""
+	if len(settings.trustedProxies) > 0 {
+		trusted = fmt.Sprintf("{ src %s }", strings.Join(settings.trustedProxies, " "))
+	}
+	rule := func(ruleType, hdrName, hdrFormat string, cond []string) models.HTTPRequestRule {
+		httpRule := models.HTTPRequestRule{
+			Index:     utils.PtrInt64(0),
+			Type:      ruleType,
+			HdrName:   hdrName,
+			HdrFormat: hdrFormat,
+		}
+		if len(cond) > 0 {
+			httpRule.Cond = "if"
+			httpRule.CondTest = strings.Join(cond, " ")
+		}
+		return httpRule
+	}
+	// Set header unless a trusted proxy did it
+	setCond := func(hdrName string, cond []string) []string {
+		if trusted == "" {
+			return cond
+		}
+		return append(cond, fmt.Sprintf("!{ req.hdr(%s) -m found }", hdrName))
+	}
+	rules := []models.HTTPRequestRule{}
+	headers := []string{"X-Forwarded-For"}
+	if settings.rfc7239 {
+		// Quoted IPv6 address in brackets, RFC 7239 section 6
+		ruleType := "set-header"
+		if trusted != "" {
+			ruleType = "add-header"
+		}
+		ipv4 := "{ src 0.0.0.0/0 }"
+		rules = append(rules,
+			rule(ruleType, "Forwarded", fmt.Sprintf(`for=\"[%%[src]]\";proto=%s`, proto), append(append([]string{}, protoCond...), "!"+ipv4)),
+			rule(ruleType, "Forwarded", fmt.Sprintf("for=%%[src];proto=%s", proto), append(append([]string{}, protoCond...), ipv4)))
+		headers = append(headers, "Forwarded")
+	}
+	if settings.port {
+		rules = append(rules, rule("set-header", "X-Forwarded-Port", "%[dst_port]", setCond("X-Forwarded-Port", nil)))
+		headers = append(headers, "X-Forwarded-Port")
+	}
+	if settings.proto {
+		rules = append(rules, rule("set-header", "X-Forwarded-Proto", proto, setCond("X-Forwarded-Proto", protoCond)))
+		headers = append(headers, "X-Forwarded-Proto")
+	}
+	if trusted == "" {
+		return rules
+	}
+	for _, hdrName := range headers {
+		rules = append(rules, rule("del-header", hdrName, "", []string{"!" + trusted}))
+	}
+	return rules
+}
+
+// Unique ID settings of ConfigMap, see handleUniqueID
+type uniqueID struct {
+	enabled  bool
+	format   string
+	header   string
+	preserve bool
+}
+
+// unique-id, unique-id-format, unique-id-header and unique-id-preserve annotations of ConfigMap:
+// requests of HTTP and HTTPS frontends get an ID, logged with %ID, sent to backends in a header.
+// The header is added by unique-id-header or, when a request ID sent by clients is preserved, by
+// an http-request rule of FrontendHTTPReqsRefresh. Settings are kept when annotations are incorrect.
+func (c *HAProxyController) handleUniqueID() (reload bool) {
+	annUniqueID, _ := GetValueFromAnnotations("unique-id", c.cfg.ConfigMap.Annotations)
+	annFormat, _ := GetValueFromAnnotations("unique-id-format", c.cfg.ConfigMap.Annotations)
+	annHeader, _ := GetValueFromAnnotations("unique-id-header", c.cfg.ConfigMap.Annotations)
+	annPreserve, _ := GetValueFromAnnotations("unique-id-preserve", c.cfg.ConfigMap.Annotations)
+	settings := uniqueID{}
+	var err error
+	if settings.enabled, err = utils.GetBoolValue(annUniqueID.Value, "unique-id"); err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	if settings.enabled {
+		// Config parser splits lines on spaces
+		settings.format = strings.Join(strings.Fields(annFormat.Value), " ")
+		settings.header = annHeader.Value
+		if settings.preserve, err = utils.GetBoolValue(annPreserve.Value, "unique-id-preserve"); err != nil {
+			utils.LogErr(err)
+			return false
+		}
+		// Format is written between single quotes like log-format
+		if settings.format == "" || strings.ContainsAny(settings.format, "'\n") {
+			utils.LogErr(fmt.Errorf("unique-id-format annotation: incorrect value '%s', single quotes and newlines are not allowed", settings.format))
+			return false
+		}
+		if len(strings.Fields(settings.header)) != 1 {
+			utils.LogErr(fmt.Errorf("unique-id-header annotation: incorrect value '%s', expected a header name", settings.header))
+			return false
+		}
+	} else if annUniqueID.Status != EMPTY {
+		if annLogFormat, _ := GetValueFromAnnotations("log-format", c.cfg.ConfigMap.Annotations); strings.Contains(annLogFormat.Value, "%ID") {
+			logger.Warning("log-format annotation uses %ID but unique-id annotation is disabled, requests are logged without ID")
+		}
+	}
+	if settings != c.cfg.UniqueID {
+		c.cfg.UniqueID = settings
+		// http-request rule of preserved header
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	var format, header common.ParserData
+	if settings.enabled {
+		format = &types.UniqueIDFormat{LogFormat: "'" + settings.format + "'"}
+		if !settings.preserve {
+			header = &types.UniqueIDHeader{Name: settings.header}
+		}
+	}
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		for attribute, data := range map[string]common.ParserData{"unique-id-format": format, "unique-id-header": header} {
+			current, errGet := config.Get(parser.Frontends, frontend, attribute)
+			if errGet != nil {
+				current = nil
+			}
+			if (current == nil && data == nil) || reflect.DeepEqual(current, data) {
+				continue
+			}
+			if err = config.Set(parser.Frontends, frontend, attribute, data); err != nil {
+				utils.LogErr(err)
+				continue
+			}
+			c.ActiveTransactionHasChanges = true
+			reload = true
+		}
+	}
+	return reload
+}
+
+// http-request rule setting request ID header unless clients sent one, see handleUniqueID
+func (c *HAProxyController) uniqueIDRule() *models.HTTPRequestRule {
+	if !c.cfg.UniqueID.enabled || !c.cfg.UniqueID.preserve {
+		return nil
+	}
+	return &models.HTTPRequestRule{
+		Index:     utils.PtrInt64(0),
+		Type:      "set-header",
+		HdrName:   c.cfg.UniqueID.header,
+		HdrFormat: "%[unique-id]",
+		Cond:      "unless",
+		CondTest:  fmt.Sprintf("{ req.hdr(%s) -m found }", c.cfg.UniqueID.header),
+	}
+}
+
+func (c *HAProxyController) handleRateLimiting(ingress *Ingress) error {
+	//  Get and validate annotations
+	annRateLimitReq, _ := GetValueFromAnnotations("rate-limit-requests", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annRateLimitReq == nil {
+		return nil
+	}
+	reqsLimit, err := strconv.ParseInt(annRateLimitReq.Value, 10, 64)
+	if err != nil {
+		return err
+	}
+	// Following annotaitons have default values
+	annRateLimitPeriod, _ := GetValueFromAnnotations("rate-limit-period", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	rateLimitPeriod, err := utils.ParseTime(annRateLimitPeriod.Value)
+	if err != nil {
+		return err
+	}
+	annRateLimitSize, _ := GetValueFromAnnotations("rate-limit-size", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	rateLimitSize := misc.ParseSize(annRateLimitSize.Value)
+	annRateLimitKey, _ := GetValueFromAnnotations("rate-limit-key", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	trackKeyExpr, tableType, err := rateLimitKey(annRateLimitKey.Value)
+	if err != nil {
+		return err
+	}
+	annStatusCode, _ := GetValueFromAnnotations("rate-limit-status-code", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	statusCode := int64(defaultDenyStatus)
+	if _, ok := haproxyStatusCodes[annStatusCode.Value]; ok {
+		statusCode, _ = strconv.ParseInt(annStatusCode.Value, 10, 64)
+	} else {
+		utils.LogErr(fmt.Errorf("rate-limit-status-code annotation: unsupported status code '%s' in ingress '%s', using %d", annStatusCode.Value, ingress.Name, defaultDenyStatus))
+	}
+	headers := ""
+	headersModified := false
+	annHeaders, _ := GetValueFromAnnotations("rate-limit-response-headers", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annHeaders != nil {
+		headersModified = annHeaders.Status != EMPTY
+		if annHeaders.Status != DELETED {
+			if headers, err = rateLimitResponseHeaders(annHeaders.Value, *rateLimitPeriod); err != nil {
+				return fmt.Errorf("incorrect value for rate-limit-response-headers annotation in ingress '%s': %s", ingress.Name, err)
+			}
+		}
+	}
+	if headers != "" && !haproxyVersionAtLeast(2, 2) {
+		utils.LogErr(fmt.Errorf("rate-limit-response-headers annotation of ingress '%s' ignored: requires HAProxy 2.2 or later, running %d.%d", ingress.Name, HAProxyVersion[0], HAProxyVersion[1]))
+		headers = ""
+	}
+	// Exempted sources are neither tracked nor denied
+	exemptCond := ""
+	exemptModified := false
+	annWhitelist, _ := GetValueFromAnnotations("rate-limit-whitelist", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annWhitelist != nil {
+		exemptModified = annWhitelist.Status != EMPTY
+		if annWhitelist.Status != DELETED {
+			acl, modified, errACL := c.rateLimitExemptACL(annWhitelist.Value)
+			if errACL != nil {
+				return fmt.Errorf("incorrect value for rate-limit-whitelist annotation in ingress '%s': %s", ingress.Name, errACL)
+			}
+			exemptCond = " !" + acl
+			exemptModified = exemptModified || modified
+		}
+	}
+
+	// Update rules
+	var status Status
+	if annRateLimitReq.Status != EMPTY {
+		status = setStatus(ingress.Status, annRateLimitReq.Status)
+	} else {
+		status = setStatus(ingress.Status, annRateLimitPeriod.Status)
+	}
+	if status == EMPTY && (annRateLimitSize.Status != EMPTY || annRateLimitKey.Status != EMPTY || annStatusCode.Status != EMPTY || exemptModified || headersModified) {
+		status = MODIFIED
+	}
+	// Each ingress gets its own table so rate limits are isolated between ingresses.
+	// HAProxy only honors the first track-sc0 of a request, so rules are scoped to the
+	// paths requests are routed to: exactly one ingress tracks a request of a shared host.
+	tableName := fmt.Sprintf("RateLimit-%s-%s", ingress.Namespace, ingress.Name)
+	type scope struct{ host, path, acl string }
+	scopes := []scope{}
+	for _, rule := range ingress.Rules {
+		if rule.Host == "" {
+			continue
+		}
+		for _, path := range rule.Paths {
+			acl, modified := c.routedPathACL(rule.Host, path.Path)
+			if modified || rule.Status != EMPTY || path.Status != EMPTY {
+				status = setStatus(status, MODIFIED)
+			}
+			if rule.Status != DELETED && path.Status != DELETED {
+				scopes = append(scopes, scope{rule.Host, path.Path, acl})
+			}
+		}
+	}
+	if status != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+		if status == DELETED {
+			delete(rateLimitTables, tableName)
+			return nil
+		}
 	}
 	rateLimitTables[tableName] = rateLimitTable{
-		size:   rateLimitSize,
-		period: rateLimitPeriod,
+		size:      rateLimitSize,
+		period:    rateLimitPeriod,
+		tableType: tableType,
+		store:     fmt.Sprintf("http_req_rate(%d)", *rateLimitPeriod),
+	}
+	for _, sc := range scopes {
+		trackKey := hashStrToUint(fmt.Sprintf("%s-%s-%s-%s-%s", RATE_LIMIT, tableName, trackKeyExpr, sc.host, sc.path))
+		reqsKey := hashStrToUint(fmt.Sprintf("%s-%s-%d-%d-%d%s-%s-%s", RATE_LIMIT, tableName, *rateLimitPeriod, reqsLimit, statusCode, headers, sc.host, sc.path))
+		c.cfg.FrontendHTTPReqRules[RATE_LIMIT][trackKey] = models.HTTPRequestRule{
+			Index:         utils.PtrInt64(0),
+			Type:          "track-sc0",
+			TrackSc0Key:   trackKeyExpr,
+			TrackSc0Table: tableName,
+			Cond:          "if",
+			CondTest:      sc.acl + exemptCond,
+		}
+		denyCond := fmt.Sprintf("%s { sc0_http_req_rate(%s) gt %d }%s", sc.acl, tableName, reqsLimit, exemptCond)
+		if headers != "" {
+			// deny can't add headers, the response is built with http-request return
+			c.cfg.FrontendHTTPReturns[reqsKey] = fmt.Sprintf("http-request return status %d default-errorfiles%s if %s", statusCode, headers, denyCond)
+			continue
+		}
+		c.cfg.FrontendHTTPReqRules[RATE_LIMIT][reqsKey] = models.HTTPRequestRule{
+			Index:      utils.PtrInt64(1),
+			Type:       "deny",
+			DenyStatus: statusCode,
+			Cond:       "if",
+			CondTest:   denyCond,
+		}
+	}
+	return nil
+}
+
+// Return ACL matching requests of host and path that are routed to that path: longer
+// paths of the same host in other rules are excluded, since use_backend rules of the
+// longest path match first, see sortUseBackendKeys. modified is true when one of these
+// paths changed since last sync.
+func (c *HAProxyController) routedPathACL(host, path string) (acl string, modified bool) {
+	longerPaths := map[string]struct{}{}
+	for _, ns := range c.cfg.Namespace {
+		if !ns.Relevant {
+			continue
+		}
+		for _, ingress := range ns.Ingresses {
+			rule, ok := ingress.Rules[host]
+			if !ok {
+				continue
+			}
+			for _, p := range rule.Paths {
+				if len(p.Path) <= len(path) || !strings.HasPrefix(p.Path, path) {
+					continue
+				}
+				if ingress.Status != EMPTY || rule.Status != EMPTY || p.Status != EMPTY {
+					modified = true
+				}
+				if ingress.Status != DELETED && rule.Status != DELETED && p.Status != DELETED {
+					longerPaths[p.Path] = struct{}{}
+				}
+			}
+		}
+	}
+	paths := make([]string, 0, len(longerPaths))
+	for p := range longerPaths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	acl = strings.TrimSpace(hostPathACL(host, path))
+	for _, p := range paths {
+		acl += fmt.Sprintf(" !{ path_beg %s }", p)
+	}
+	return acl, modified
+}
+
+// Convert rate-limit-response-headers annotation to hdr arguments of http-request return,
+// one "<Header> <value>" per line. Retry-After without value is the rate limit period.
+func rateLimitResponseHeaders(value string, period int64) (string, error) {
+	var headers strings.Builder
+	for _, line := range strings.Split(value, "\n") {
+		parts := strings.Fields(line)
+		switch {
+		case len(parts) == 0:
+			continue
+		case len(parts) == 1 && strings.EqualFold(parts[0], "Retry-After"):
+			// Retry-After is in seconds, period in milliseconds
+			seconds := (period + 999) / 1000
+			if seconds < 1 {
+				seconds = 1
+			}
+			parts = append(parts, strconv.FormatInt(seconds, 10))
+		case len(parts) != 2:
+			return "", fmt.Errorf("incorrect header '%s', expected <Header> <value>", line)
+		}
+		fmt.Fprintf(&headers, " hdr %s %s", parts[0], parts[1])
+	}
+	return headers.String(), nil
+}
+
+// Inline lists of rate-limit-whitelist longer than this are written to a pattern file
+const rateLimitExemptInlineMax = 8
+
+// Return ACL matching sources exempted from rate limiting, see srcACL.
+// Long inline lists are written to a pattern file named after their content,
+// so that ingresses with the same list share it.
+func (c *HAProxyController) rateLimitExemptACL(value string) (acl string, modified bool, err error) {
+	if _, isRef := parseSourceRef(value); isRef {
+		return c.srcACL(value)
+	}
+	addresses := strings.Fields(strings.Replace(value, ",", " ", -1))
+	if len(addresses) <= rateLimitExemptInlineMax {
+		return c.srcACL(value)
+	}
+	for _, address := range addresses {
+		if !validSource(address) {
+			return "", false, fmt.Errorf("'%s' is not an IP or CIDR", address)
+		}
+	}
+	content := strings.Join(addresses, "\n") + "\n"
+	patternFile := path.Join(HAProxyMapDir, fmt.Sprintf("src-%d.lst", hashStrToUint(content)))
+	if _, errStat := os.Stat(patternFile); errStat != nil {
+		if err = ioutil.WriteFile(patternFile, []byte(content), 0644); err != nil {
+			return "", false, err
+		}
+		modified = true
+	}
+	c.cfg.SourcePatternFiles[patternFile] = struct{}{}
+	return fmt.Sprintf("{ src -f %s }", patternFile), modified, nil
+}
+
+// Remove pattern files of source lists, see srcACL and rateLimitExemptACL, no
+// ingress or TCP service uses anymore. Only called once the configuration is
+// committed, since the running one may still reference them until then.
+func (c *HAProxyController) sourcePatternFilesClean() error {
+	files, err := filepath.Glob(path.Join(HAProxyMapDir, "src-*.lst"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, ok := c.cfg.SourcePatternFiles[file]; ok {
+			continue
+		}
+		if errRemove := os.Remove(file); errRemove != nil && !os.IsNotExist(errRemove) {
+			err = errRemove
+		}
+	}
+	return err
+}
+
+type connLimits struct {
+	table    string
+	connCur  int64
+	connRate int64
+	status   Status
+}
+
+// Get conn-limit and conn-rate-limit values and register the corresponding stick table
+func (c *HAProxyController) getConnLimits(tableName string, annotations ...MapStringW) (limits connLimits, err error) {
+	limits.table = tableName
+	annConnLimit, _ := GetValueFromAnnotations("conn-limit", annotations...)
+	annConnRateLimit, _ := GetValueFromAnnotations("conn-rate-limit", annotations...)
+	// Following annotaitons have default values
+	annConnRatePeriod, _ := GetValueFromAnnotations("conn-rate-period", annotations...)
+	annConnLimitSize, _ := GetValueFromAnnotations("conn-limit-size", c.cfg.ConfigMap.Annotations)
+	for _, ann := range []*StringW{annConnLimit, annConnRateLimit, annConnRatePeriod, annConnLimitSize} {
+		if ann != nil && ann.Status != EMPTY {
+			limits.status = MODIFIED
+		}
+	}
+	if annConnLimit != nil && annConnLimit.Status != DELETED {
+		if limits.connCur, err = strconv.ParseInt(annConnLimit.Value, 10, 64); err != nil {
+			return limits, fmt.Errorf("conn-limit annotation: %s", err)
+		}
+	}
+	if annConnRateLimit != nil && annConnRateLimit.Status != DELETED {
+		if limits.connRate, err = strconv.ParseInt(annConnRateLimit.Value, 10, 64); err != nil {
+			return limits, fmt.Errorf("conn-rate-limit annotation: %s", err)
+		}
+	}
+	if limits.connCur == 0 && limits.connRate == 0 {
+		delete(rateLimitTables, tableName)
+		return limits, nil
+	}
+	period, err := utils.ParseTime(annConnRatePeriod.Value)
+	if err != nil {
+		return limits, fmt.Errorf("conn-rate-period annotation: %s", err)
+	}
+	rateLimitTables[tableName] = rateLimitTable{
+		size:      misc.ParseSize(annConnLimitSize.Value),
+		period:    period,
+		tableType: "ip",
+		store:     fmt.Sprintf("conn_cur,conn_rate(%d)", *period),
+	}
+	return limits, nil
+}
+
+// Handle conn-limit and conn-rate-limit in ConfigMap: connections are
+// tracked and rejected at connection level for all traffic.
+func (c *HAProxyController) handleGlobalConnLimiting() error {
+	limits, err := c.getConnLimits("ConnLimit", c.cfg.ConfigMap.Annotations)
+	if err != nil {
+		return err
+	}
+	if limits.status != EMPTY {
+		// Stick table is refreshed along with HTTP rules
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+		c.cfg.FrontendRulesStatus[TCP] = MODIFIED
+	}
+	if limits.connCur == 0 && limits.connRate == 0 {
+		return nil
+	}
+	c.cfg.FrontendTCPRules[CONN_LIMIT][0] = models.TCPRequestRule{
+		Index:      utils.PtrInt64(0),
+		Type:       "connection",
+		Action:     "track-sc1",
+		TrackKey:   "src",
+		TrackTable: limits.table,
+	}
+	if limits.connCur > 0 {
+		c.cfg.FrontendTCPRules[CONN_LIMIT][1] = models.TCPRequestRule{
+			Index:    utils.PtrInt64(0),
+			Type:     "connection",
+			Action:   "reject",
+			Cond:     "if",
+			CondTest: fmt.Sprintf("{ sc1_conn_cur gt %d }", limits.connCur),
+		}
+	}
+	if limits.connRate > 0 {
+		c.cfg.FrontendTCPRules[CONN_LIMIT][2] = models.TCPRequestRule{
+			Index:    utils.PtrInt64(0),
+			Type:     "connection",
+			Action:   "reject",
+			Cond:     "if",
+			CondTest: fmt.Sprintf("{ sc1_conn_rate gt %d }", limits.connRate),
+		}
+	}
+	return nil
+}
+
+// Handle conn-limit and conn-rate-limit in ingress: Host is not known at
+// connection level so connections are tracked and denied with HTTP rules.
+func (c *HAProxyController) handleConnLimiting(ingress *Ingress) error {
+	tableName := fmt.Sprintf("ConnLimit-%s-%s", ingress.Namespace, ingress.Name)
+	limits, err := c.getConnLimits(tableName, ingress.Annotations)
+	if err != nil {
+		return err
+	}
+	mapFiles := c.cfg.MapFiles
+	trackKey := hashStrToUint(fmt.Sprintf("%s-%s-track", CONN_LIMIT, tableName))
+	denyKey := hashStrToUint(fmt.Sprintf("%s-%s-%d-%d", CONN_LIMIT, tableName, limits.connCur, limits.connRate))
+	status := setStatus(ingress.Status, limits.status)
+	if status != EMPTY {
+		mapFiles.Modified(trackKey)
+		mapFiles.Modified(denyKey)
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+		if status == DELETED {
+			delete(rateLimitTables, tableName)
+			return nil
+		}
+	}
+	if limits.connCur == 0 && limits.connRate == 0 {
+		return nil
+	}
+	for hostname := range ingress.Rules {
+		mapFiles.AppendHost(trackKey, hostname)
+		mapFiles.AppendHost(denyKey, hostname)
+	}
+	trackMapFile := path.Join(HAProxyMapDir, strconv.FormatUint(trackKey, 10)) + ".lst"
+	c.cfg.FrontendHTTPReqRules[CONN_LIMIT][trackKey] = models.HTTPRequestRule{
+		Index:         utils.PtrInt64(0),
+		Type:          "track-sc2",
+		TrackSc2Key:   "src",
+		TrackSc2Table: tableName,
+		Cond:          "if",
+		CondTest:      hostACL(trackMapFile),
+	}
+	denyMapFile := path.Join(HAProxyMapDir, strconv.FormatUint(denyKey, 10)) + ".lst"
+	conds := []string{}
+	if limits.connCur > 0 {
+		conds = append(conds, hostACL(denyMapFile, fmt.Sprintf("{ sc2_conn_cur gt %d }", limits.connCur)))
+	}
+	if limits.connRate > 0 {
+		conds = append(conds, hostACL(denyMapFile, fmt.Sprintf("{ sc2_conn_rate gt %d }", limits.connRate)))
+	}
+	c.cfg.FrontendHTTPReqRules[CONN_LIMIT][denyKey] = models.HTTPRequestRule{
+		Index:      utils.PtrInt64(0),
+		Type:       "deny",
+		DenyStatus: 429,
+		Cond:       "if",
+		CondTest:   strings.Join(conds, " || "),
+	}
+	return nil
+}
+
+// Convert rate-limit-key annotation to a sample expression and a stick table type
+func rateLimitKey(key string) (expr string, tableType string, err error) {
+	switch {
+	case key == "src":
+		return "src", "ip", nil
+	case strings.HasPrefix(key, "hdr(") && strings.HasSuffix(key, ")"):
+		return "req." + key, "string", nil
+	case strings.HasPrefix(key, "cookie(") && strings.HasSuffix(key, ")"):
+		return "req.cook(" + strings.TrimSuffix(strings.TrimPrefix(key, "cookie("), ")") + ")", "string", nil
+	default:
+		return "", "", fmt.Errorf("incorrect value '%s' for rate-limit-key annotation, expected src, hdr(<name>) or cookie(<name>)", key)
+	}
+}
+
+func (c *HAProxyController) handleRequestCapture(ingress *Ingress) error {
+	//  Get and validate annotations
+	annReqCapture, _ := GetValueFromAnnotations("request-capture", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	annCaptureLen, _ := GetValueFromAnnotations("request-capture-len", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annReqCapture == nil {
+		return nil
+	}
+	var captureLen int64
+	var err error
+	if annCaptureLen != nil {
+		captureLen, err = strconv.ParseInt(annCaptureLen.Value, 10, 64)
+		if err != nil {
+			captureLen = defaultCaptureLen
+		}
+		if annCaptureLen.Status == DELETED {
+			captureLen = defaultCaptureLen
+		}
+	} else {
+		captureLen = defaultCaptureLen
+	}
+
+	// Update rules
+	status := setStatus(ingress.Status, annReqCapture.Status)
+	mapFiles := c.cfg.MapFiles
+	for _, sample := range strings.Split(annReqCapture.Value, "\n") {
+		if sample == "" {
+			continue
+		}
+		key := hashStrToUint(fmt.Sprintf("%s-%s-%d", REQUEST_CAPTURE, sample, captureLen))
+		if status != EMPTY {
+			mapFiles.Modified(key)
+			c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+			c.cfg.FrontendRulesStatus[TCP] = MODIFIED
+			if status == DELETED {
+				break
+			}
+		}
+		for hostname := range ingress.Rules {
+			mapFiles.AppendHost(key, hostname)
+		}
+
+		mapFile := path.Join(HAProxyMapDir, strconv.FormatUint(key, 10)) + ".lst"
+		httpRule := models.HTTPRequestRule{
+			Index:         utils.PtrInt64(0),
+			Type:          "capture",
+			CaptureSample: sample,
+			Cond:          "if",
+			CaptureLen:    captureLen,
+			CondTest:      hostACL(mapFile),
+		}
+		tcpRule := models.TCPRequestRule{
+			Index:      utils.PtrInt64(0),
+			Type:       "content",
+			Action:     "capture",
+			CaptureLen: captureLen,
+			Expr:       sample,
+			Cond:       "if",
+			CondTest:   sniACL(mapFile),
+		}
+		c.cfg.FrontendHTTPReqRules[REQUEST_CAPTURE][key] = httpRule
+		c.cfg.FrontendTCPRules[REQUEST_CAPTURE][key] = tcpRule
+	}
+
+	return err
+}
+
+// Cookie requested by capture-cookie annotation of an ingress
+type cookieCapture struct {
+	ingress *Ingress
+	name    string
+	length  int64
+}
+
+// capture-cookie annotation: "<name> [len <length>]", the cookie is logged with %CC and %CS.
+// It does not use a capture slot, so IDs of request and response captures are not affected.
+func (c *HAProxyController) handleCaptureCookie(ingress *Ingress) error {
+	annCookie, _ := GetValueFromAnnotations("capture-cookie", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annCookie == nil {
+		return nil
+	}
+	if setStatus(ingress.Status, annCookie.Status) != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	if annCookie.Status == DELETED || ingress.Status == DELETED {
+		return nil
+	}
+	fields := strings.Fields(annCookie.Value)
+	capture := cookieCapture{ingress: ingress, length: defaultCaptureLen}
+	switch {
+	case len(fields) == 1:
+	case len(fields) == 3 && fields[1] == "len":
+		length, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || length <= 0 {
+			return fmt.Errorf("capture-cookie annotation in ingress '%s': incorrect length '%s'", ingress.Name, fields[2])
+		}
+		capture.length = length
+	default:
+		return fmt.Errorf("capture-cookie annotation in ingress '%s': incorrect value '%s', expected '<name> [len <length>]'", ingress.Name, annCookie.Value)
+	}
+	capture.name = fields[0]
+	c.cfg.CookieCaptures = append(c.cfg.CookieCaptures, capture)
+	return nil
+}
+
+// HAProxy captures one cookie per frontend: the first name in alphabetical order is
+// captured with the longest requested length, other ingresses get a warning event.
+func (c *HAProxyController) captureCookie() string {
+	captures := c.cfg.CookieCaptures
+	if len(captures) == 0 {
+		return ""
+	}
+	sort.Slice(captures, func(i, j int) bool {
+		if captures[i].name != captures[j].name {
+			return captures[i].name < captures[j].name
+		}
+		if captures[i].ingress.Namespace != captures[j].ingress.Namespace {
+			return captures[i].ingress.Namespace < captures[j].ingress.Namespace
+		}
+		return captures[i].ingress.Name < captures[j].ingress.Name
+	})
+	name := captures[0].name
+	var length int64
+	for _, capture := range captures {
+		if capture.name == name {
+			if capture.length > length {
+				length = capture.length
+			}
+			continue
+		}
+		err := fmt.Errorf("capture-cookie annotation in ingress '%s/%s': only one cookie can be captured, '%s' is captured instead of '%s'",
+			capture.ingress.Namespace, capture.ingress.Name, name, capture.name)
+		logger.Warning(c.ingressEventErr(capture.ingress, ReasonInvalidAnnotation, err))
+	}
+	return fmt.Sprintf("%s len %d", name, length)
+}
+
+func (c *HAProxyController) handleRequestMaxBodySize(ingress *Ingress) error {
+	//  Get and validate annotations
+	annMaxBodySize, _ := GetValueFromAnnotations("request-max-body-size", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annMaxBodySize == nil {
+		return nil
+	}
+	var maxBodySize int64
+	if size := misc.ParseSize(annMaxBodySize.Value); size != nil {
+		maxBodySize = *size
+	} else if strings.TrimSpace(annMaxBodySize.Value) != "0" {
+		return fmt.Errorf("incorrect value '%s' for request-max-body-size annotation in ingress '%s'", annMaxBodySize.Value, ingress.Name)
+	}
+
+	// Update rules
+	status := setStatus(ingress.Status, annMaxBodySize.Status)
+	mapFiles := c.cfg.MapFiles
+	key := hashStrToUint(fmt.Sprintf("%s-%d", REQUEST_MAX_BODY_SIZE, maxBodySize))
+	if status != EMPTY {
+		mapFiles.Modified(key)
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+		if status == DELETED {
+			return nil
+		}
+	}
+	// 0 means unlimited
+	if maxBodySize == 0 {
+		return nil
 	}
-	trackMapFile := path.Join(HAProxyMapDir, strconv.FormatUint(trackKey, 10)) + ".lst"
-	httpTrackRule := models.HTTPRequestRule{
-		Index:         utils.PtrInt64(0),
-		Type:          "track-sc0",
-		TrackSc0Key:   "src",
-		TrackSc0Table: tableName,
-		Cond:          "if",
-		CondTest:      fmt.Sprintf("{ req.hdr(Host) -f %s }", trackMapFile),
+	for hostname := range ingress.Rules {
+		mapFiles.AppendHost(key, hostname)
 	}
-	reqsMapFile := path.Join(HAProxyMapDir, strconv.FormatUint(reqsKey, 10)) + ".lst"
-	httpDenyRule := models.HTTPRequestRule{
-		Index:      utils.PtrInt64(1),
+
+	mapFile := path.Join(HAProxyMapDir, strconv.FormatUint(key, 10)) + ".lst"
+	httpRule := models.HTTPRequestRule{
+		Index:      utils.PtrInt64(0),
 		Type:       "deny",
-		DenyStatus: 403,
+		DenyStatus: 413,
 		Cond:       "if",
-		CondTest:   fmt.Sprintf("{ req.hdr(Host) -f %s } { sc0_http_req_rate(%s) gt %d }", reqsMapFile, tableName, reqsLimit),
+		CondTest:   hostACL(mapFile, fmt.Sprintf("{ req.body_size gt %d }", maxBodySize)),
 	}
-	c.cfg.FrontendHTTPReqRules[RATE_LIMIT][trackKey] = httpTrackRule
-	c.cfg.FrontendHTTPReqRules[RATE_LIMIT][reqsKey] = httpDenyRule
+	c.cfg.FrontendHTTPReqRules[REQUEST_MAX_BODY_SIZE][key] = httpRule
+
 	return nil
 }
 
-func (c *HAProxyController) handleRequestCapture(ingress *Ingress) error {
+func (c *HAProxyController) handleResponseCapture(ingress *Ingress) error {
 	//  Get and validate annotations
-	annReqCapture, _ := GetValueFromAnnotations("request-capture", ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	annCaptureLen, _ := GetValueFromAnnotations("request-capture-len", ingress.Annotations, c.cfg.ConfigMap.Annotations)
-	if annReqCapture == nil {
+	annRspCapture, _ := GetValueFromAnnotations("response-capture", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	annCaptureLen, _ := GetValueFromAnnotations("response-capture-len", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annRspCapture == nil {
 		return nil
 	}
-	var captureLen int64
-	var err error
-	if annCaptureLen != nil {
-		captureLen, err = strconv.ParseInt(annCaptureLen.Value, 10, 64)
-		if err != nil {
-			captureLen = defaultCaptureLen
-		}
-		if annCaptureLen.Status == DELETED {
-			captureLen = defaultCaptureLen
-		}
-	} else {
+	captureLen, err := strconv.ParseInt(annCaptureLen.Value, 10, 64)
+	if err != nil || annCaptureLen.Status == DELETED {
 		captureLen = defaultCaptureLen
 	}
 
 	// Update rules
-	status := setStatus(ingress.Status, annReqCapture.Status)
+	status := setStatus(ingress.Status, annRspCapture.Status)
+	if status == EMPTY && annCaptureLen.Status != EMPTY {
+		status = MODIFIED
+	}
 	mapFiles := c.cfg.MapFiles
-	for _, sample := range strings.Split(annReqCapture.Value, "\n") {
+	for _, sample := range strings.Split(annRspCapture.Value, "\n") {
+		sample = strings.TrimSpace(sample)
 		if sample == "" {
 			continue
 		}
-		key := hashStrToUint(fmt.Sprintf("%s-%s-%d", REQUEST_CAPTURE, sample, captureLen))
+		key := hashStrToUint(fmt.Sprintf("%s-%s-%d", RESPONSE_CAPTURE, sample, captureLen))
 		if status != EMPTY {
 			mapFiles.Modified(key)
 			c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
-			c.cfg.FrontendRulesStatus[TCP] = MODIFIED
 			if status == DELETED {
 				break
 			}
@@ -305,25 +1658,61 @@ func (c *HAProxyController) handleRequestCapture(ingress *Ingress) error {
 		}
 
 		mapFile := path.Join(HAProxyMapDir, strconv.FormatUint(key, 10)) + ".lst"
-		httpRule := models.HTTPRequestRule{
+		// CaptureID is set once slots are allocated, see FrontendHTTPRspsRefresh
+		responseCaptures.request(sample, captureLen)
+		httpRule := models.HTTPResponseRule{
 			Index:         utils.PtrInt64(0),
 			Type:          "capture",
 			CaptureSample: sample,
 			Cond:          "if",
-			CaptureLen:    captureLen,
-			CondTest:      fmt.Sprintf("{ req.hdr(Host) -f %s }", mapFile),
+			CondTest:      hostACL(mapFile),
 		}
-		tcpRule := models.TCPRequestRule{
-			Index:      utils.PtrInt64(0),
-			Type:       "content",
-			Action:     "capture",
-			CaptureLen: captureLen,
-			Expr:       sample,
-			Cond:       "if",
-			CondTest:   fmt.Sprintf("{ req_ssl_sni -f %s }", mapFile),
+		c.cfg.FrontendHTTPRspRules[RESPONSE_CAPTURE][key] = httpRule
+	}
+
+	return nil
+}
+
+func (c *HAProxyController) handleRequestDelHdr(ingress *Ingress) error {
+	//  Get and validate annotations
+	annDelHdr, err := GetValueFromAnnotations("request-del-header", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annDelHdr == nil {
+		return nil
+	}
+
+	// Update rules
+	status := setStatus(ingress.Status, annDelHdr.Status)
+	mapFiles := c.cfg.MapFiles
+	for _, param := range strings.Split(annDelHdr.Value, "\n") {
+		hdrName := strings.TrimSpace(param)
+		if hdrName == "" {
+			continue
 		}
-		c.cfg.FrontendHTTPReqRules[REQUEST_CAPTURE][key] = httpRule
-		c.cfg.FrontendTCPRules[REQUEST_CAPTURE][key] = tcpRule
+		if strings.ContainsAny(hdrName, " \t") {
+			utils.LogErr(fmt.Errorf("incorrect value '%s' in request-del-header annotation", param))
+			continue
+		}
+		key := hashStrToUint(fmt.Sprintf("%s-%s", REQUEST_DEL_HEADER, hdrName))
+		if status != EMPTY {
+			mapFiles.Modified(key)
+			c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+			if status == DELETED {
+				break
+			}
+		}
+		for hostname := range ingress.Rules {
+			mapFiles.AppendHost(key, hostname)
+		}
+
+		mapFile := path.Join(HAProxyMapDir, strconv.FormatUint(key, 10)) + ".lst"
+		httpRule := models.HTTPRequestRule{
+			Index:    utils.PtrInt64(0),
+			Type:     "del-header",
+			HdrName:  hdrName,
+			Cond:     "if",
+			CondTest: hostACL(mapFile),
+		}
+		c.cfg.FrontendHTTPReqRules[REQUEST_DEL_HEADER][key] = httpRule
 	}
 
 	return err
@@ -364,7 +1753,7 @@ func (c *HAProxyController) handleRequestSetHdr(ingress *Ingress) error {
 			HdrName:   parts[0],
 			HdrFormat: parts[1],
 			Cond:      "if",
-			CondTest:  fmt.Sprintf("{ req.hdr(Host) -f %s }", mapFile),
+			CondTest:  hostACL(mapFile),
 		}
 		c.cfg.FrontendHTTPReqRules[REQUEST_SET_HEADER][key] = httpRule
 	}
@@ -372,6 +1761,51 @@ func (c *HAProxyController) handleRequestSetHdr(ingress *Ingress) error {
 	return err
 }
 
+func (c *HAProxyController) handleResponseDelHdr(ingress *Ingress) error {
+	//  Get and validate annotations
+	annDelHdr, err := GetValueFromAnnotations("response-del-header", ingress.Annotations, c.cfg.ConfigMap.Annotations)
+	if annDelHdr == nil {
+		return nil
+	}
+
+	// Update rules
+	status := setStatus(ingress.Status, annDelHdr.Status)
+	mapFiles := c.cfg.MapFiles
+	for _, param := range strings.Split(annDelHdr.Value, "\n") {
+		hdrName := strings.TrimSpace(param)
+		if hdrName == "" {
+			continue
+		}
+		if strings.ContainsAny(hdrName, " \t") {
+			utils.LogErr(fmt.Errorf("incorrect value '%s' in response-del-header annotation", param))
+			continue
+		}
+		key := hashStrToUint(fmt.Sprintf("%s-%s", RESPONSE_DEL_HEADER, hdrName))
+		if status != EMPTY {
+			mapFiles.Modified(key)
+			c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+			if status == DELETED {
+				break
+			}
+		}
+		for hostname := range ingress.Rules {
+			mapFiles.AppendHost(key, hostname)
+		}
+
+		mapFile := path.Join(HAProxyMapDir, strconv.FormatUint(key, 10)) + ".lst"
+		httpRule := models.HTTPResponseRule{
+			Index:    utils.PtrInt64(0),
+			Type:     "del-header",
+			HdrName:  hdrName,
+			Cond:     "if",
+			CondTest: hostACL(mapFile),
+		}
+		c.cfg.FrontendHTTPRspRules[RESPONSE_DEL_HEADER][key] = httpRule
+	}
+
+	return err
+}
+
 func (c *HAProxyController) handleResponseSetHdr(ingress *Ingress) error {
 	//  Get and validate annotations
 	annSetHdr, err := GetValueFromAnnotations("response-set-header", ingress.Annotations, c.cfg.ConfigMap.Annotations)
@@ -407,7 +1841,7 @@ func (c *HAProxyController) handleResponseSetHdr(ingress *Ingress) error {
 			HdrName:   parts[0],
 			HdrFormat: parts[1],
 			Cond:      "if",
-			CondTest:  fmt.Sprintf("{ req.hdr(Host) -f %s }", mapFile),
+			CondTest:  hostACL(mapFile),
 		}
 		c.cfg.FrontendHTTPRspRules[RESPONSE_SET_HEADER][key] = httpRule
 	}
@@ -421,17 +1855,16 @@ func (c *HAProxyController) handleWhitelisting(ingress *Ingress) error {
 	if annWhitelist == nil {
 		return nil
 	}
-	value := strings.Replace(annWhitelist.Value, ",", " ", -1)
-	for _, address := range strings.Fields(value) {
-		if ip := net.ParseIP(address); ip == nil {
-			if _, _, err := net.ParseCIDR(address); err != nil {
-				return fmt.Errorf("incorrect value for whitelist annotation in ingress '%s'", ingress.Name)
-			}
-		}
+	srcACL, srcModified, err := c.srcACL(annWhitelist.Value)
+	if err != nil {
+		return fmt.Errorf("incorrect value for whitelist annotation in ingress '%s': %s", ingress.Name, err)
 	}
 
 	// Update rules
 	status := setStatus(ingress.Status, annWhitelist.Status)
+	if status == EMPTY && srcModified {
+		status = MODIFIED
+	}
 	mapFiles := c.cfg.MapFiles
 	key := hashStrToUint(fmt.Sprintf("%s-%s", WHITELIST, annWhitelist.Value))
 	if status != EMPTY {
@@ -452,14 +1885,14 @@ func (c *HAProxyController) handleWhitelisting(ingress *Ingress) error {
 		Type:       "deny",
 		DenyStatus: 403,
 		Cond:       "if",
-		CondTest:   fmt.Sprintf("{ req.hdr(Host) -f %s } !{ src %s }", mapFile, value),
+		CondTest:   hostACL(mapFile, "!"+srcACL),
 	}
 	tcpRule := models.TCPRequestRule{
 		Index:    utils.PtrInt64(0),
 		Type:     "content",
 		Action:   "reject",
 		Cond:     "if",
-		CondTest: fmt.Sprintf("{ req_ssl_sni -f %s } !{ src %s }", mapFile, value),
+		CondTest: sniACL(mapFile, "!"+srcACL),
 	}
 	c.cfg.FrontendHTTPReqRules[WHITELIST][key] = httpRule
 	c.cfg.FrontendTCPRules[WHITELIST][key] = tcpRule
@@ -467,6 +1900,349 @@ func (c *HAProxyController) handleWhitelisting(ingress *Ingress) error {
 	return nil
 }
 
+// Handle request-allow-header and request-deny-header annotations. Allow rule is part of
+// whitelisting rules, so it is evaluated before the deny rule which is part of blacklisting.
+func (c *HAProxyController) handleRequestHeaderAccess(ingress *Ingress) error {
+	var errs []string
+	for _, access := range []struct {
+		annotation string
+		rule       Rule
+		negate     string
+	}{
+		{"request-allow-header", WHITELIST, "!"},
+		{"request-deny-header", BLACKLIST, ""},
+	} {
+		ann, _ := GetValueFromAnnotations(access.annotation, ingress.Annotations, c.cfg.ConfigMap.Annotations)
+		if ann == nil {
+			continue
+		}
+		hdrACL, err := requestHeaderACL(ann.Value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("incorrect value for %s annotation in ingress '%s': %s", access.annotation, ingress.Name, err))
+			continue
+		}
+		status := setStatus(ingress.Status, ann.Status)
+		mapFiles := c.cfg.MapFiles
+		key := hashStrToUint(fmt.Sprintf("%s-%s-%s", access.rule, access.annotation, ann.Value))
+		if status != EMPTY {
+			mapFiles.Modified(key)
+			c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+			if status == DELETED {
+				continue
+			}
+		}
+		for hostname := range ingress.Rules {
+			mapFiles.AppendHost(key, hostname)
+		}
+		mapFile := path.Join(HAProxyMapDir, strconv.FormatUint(key, 10)) + ".lst"
+		c.cfg.FrontendHTTPReqRules[access.rule][key] = models.HTTPRequestRule{
+			Index:      utils.PtrInt64(0),
+			Type:       "deny",
+			DenyStatus: 403,
+			Cond:       "if",
+			CondTest:   hostACL(mapFile, access.negate+hdrACL),
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Match methods of request header annotations, "-m found" takes no pattern
+var headerMatchMethods = map[string]struct{}{
+	"found": {}, "str": {}, "beg": {}, "end": {}, "sub": {}, "reg": {},
+}
+
+// Return ACL of a "<Header>: <value>" annotation. Value is matched as a string
+// unless it starts with a match method, e.g. "-m found" or "-m reg ^prod".
+func requestHeaderACL(value string) (string, error) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return "", fmt.Errorf("'%s', expected <Header>: <value>", value)
+	}
+	name := strings.TrimSpace(value[:i])
+	if !validToken(name) {
+		return "", fmt.Errorf("invalid header name '%s'", name)
+	}
+	patterns := strings.Fields(value[i+1:])
+	method := "str"
+	if len(patterns) > 0 && patterns[0] == "-m" {
+		if len(patterns) < 2 {
+			return "", fmt.Errorf("missing match method in '%s'", value)
+		}
+		method = patterns[1]
+		patterns = patterns[2:]
+		if _, ok := headerMatchMethods[method]; !ok {
+			return "", fmt.Errorf("unsupported match method '%s'", method)
+		}
+	}
+	switch {
+	case method == "found" && len(patterns) > 0:
+		return "", fmt.Errorf("-m found takes no value in '%s'", value)
+	case method != "found" && len(patterns) == 0:
+		return "", fmt.Errorf("missing value of header '%s'", name)
+	}
+	for _, pattern := range patterns {
+		if !validPattern(pattern) {
+			return "", fmt.Errorf("invalid value '%s' of header '%s'", pattern, name)
+		}
+	}
+	acl := fmt.Sprintf("req.hdr(%s) -m %s", name, method)
+	if len(patterns) > 0 {
+		acl += " " + strings.Join(patterns, " ")
+	}
+	return "{ " + acl + " }", nil
+}
+
+// Header names and methods are RFC 7230 tokens, '#' and quote are excluded since
+// they start a comment and a quoted string in HAProxy configuration
+func validToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, r := range token {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("!$%&*+-.^_`|~", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ACL patterns can't contain characters ending the ACL or the line in HAProxy configuration
+func validPattern(pattern string) bool {
+	for _, r := range pattern {
+		if unicode.IsControl(r) || strings.ContainsRune("{}#\"'", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// HTTP methods known by HAProxy method fetch, others are matched as strings
+var haproxyMethods = map[string]struct{}{
+	"OPTIONS": {}, "GET": {}, "HEAD": {}, "POST": {}, "PUT": {}, "DELETE": {}, "TRACE": {}, "CONNECT": {},
+}
+
+// Return ACLs matching a comma separated list of methods, custom ones are
+// matched with "-m str". Known methods are case insensitive.
+func methodsACLs(value string) ([]string, error) {
+	known := []string{}
+	custom := []string{}
+	for _, method := range strings.Split(value, ",") {
+		method = strings.TrimSpace(method)
+		if method == "" {
+			continue
+		}
+		if _, ok := haproxyMethods[strings.ToUpper(method)]; ok {
+			known = append(known, strings.ToUpper(method))
+			continue
+		}
+		if !validToken(method) {
+			return nil, fmt.Errorf("incorrect method '%s'", method)
+		}
+		custom = append(custom, method)
+	}
+	acls := []string{}
+	if len(known) > 0 {
+		acls = append(acls, fmt.Sprintf("{ method %s }", strings.Join(known, " ")))
+	}
+	if len(custom) > 0 {
+		acls = append(acls, fmt.Sprintf("{ method -m str %s }", strings.Join(custom, " ")))
+	}
+	if len(acls) == 0 {
+		return nil, fmt.Errorf("no method in '%s'", value)
+	}
+	return acls, nil
+}
+
+// allowed-methods annotation: requests of other methods to the hosts and paths
+// of the ingress are denied with 405.
+func (c *HAProxyController) handleAllowedMethods(ingress *Ingress) error {
+	annMethods, _ := GetValueFromAnnotations("allowed-methods", ingress.Annotations)
+	if annMethods == nil {
+		return nil
+	}
+	if annMethods.Status != EMPTY || ingress.Status != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	if annMethods.Status == DELETED || ingress.Status == DELETED {
+		return nil
+	}
+	acls, err := methodsACLs(annMethods.Value)
+	if err != nil {
+		return fmt.Errorf("allowed-methods annotation in ingress '%s': %s", ingress.Name, err)
+	}
+	// Request is denied when it matches none of the ACLs
+	methodsCond := "!" + strings.Join(acls, " !")
+	for _, rule := range ingress.Rules {
+		for _, path := range rule.Paths {
+			acl := hostPathACL(rule.Host, path.Path)
+			if acl == "" {
+				continue
+			}
+			key := hashStrToUint(fmt.Sprintf("%s-%s-%s-%s-%s", METHODS, ingress.Namespace, ingress.Name, rule.Host, path.Path))
+			c.cfg.FrontendHTTPReqRules[METHODS][key] = models.HTTPRequestRule{
+				Index:      utils.PtrInt64(0),
+				Type:       "deny",
+				DenyStatus: 405,
+				Cond:       "if",
+				CondTest:   fmt.Sprintf("%s %s", methodsCond, strings.TrimSpace(acl)),
+			}
+		}
+	}
+	return nil
+}
+
+// disallowed-methods ConfigMap annotation: requests of these methods are denied with 405
+// on all hosts.
+func (c *HAProxyController) handleDisallowedMethods() error {
+	annMethods, _ := GetValueFromAnnotations("disallowed-methods", c.cfg.ConfigMap.Annotations)
+	if annMethods == nil {
+		return nil
+	}
+	if annMethods.Status != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	if annMethods.Status == DELETED || strings.TrimSpace(annMethods.Value) == "" {
+		return nil
+	}
+	acls, err := methodsACLs(annMethods.Value)
+	if err != nil {
+		return fmt.Errorf("disallowed-methods annotation: %s", err)
+	}
+	for i, acl := range acls {
+		c.cfg.FrontendHTTPReqRules[METHODS][uint64(i)] = models.HTTPRequestRule{
+			Index:      utils.PtrInt64(0),
+			Type:       "deny",
+			DenyStatus: 405,
+			Cond:       "if",
+			CondTest:   acl,
+		}
+	}
+	return nil
+}
+
+// Return ACL matching source address against a blacklist/whitelist value.
+// Value is either a list of IPs/CIDRs or a reference to a ConfigMap or Secret
+// key holding one IP/CIDR per line: "configmap://<namespace>/<name>/<key>" or
+// "secret://<namespace>/<name>/<key>". Referenced content is written to a pattern
+// file, modified is true when the content of that file changed. Namespace and name
+// can't contain '_', which makes the name of the file unique for each reference.
+func (c *HAProxyController) srcACL(value string) (acl string, modified bool, err error) {
+	ref, isRef := parseSourceRef(value)
+	if !isRef {
+		value = strings.Replace(value, ",", " ", -1)
+		for _, address := range strings.Fields(value) {
+			if !validSource(address) {
+				return "", false, fmt.Errorf("'%s' is not an IP or CIDR", address)
+			}
+		}
+		return fmt.Sprintf("{ src %s }", value), false, nil
+	}
+	var content string
+	ns, ok := c.cfg.Namespace[ref.namespace]
+	switch {
+	case !ok:
+		return "", false, fmt.Errorf("namespace '%s' does not exist", ref.namespace)
+	case ref.kind == "configmap":
+		configMap, ok := ns.ConfigMaps[ref.name]
+		if !ok || configMap.Status == DELETED {
+			return "", false, fmt.Errorf("configmap '%s/%s' does not exist", ref.namespace, ref.name)
+		}
+		data, ok := configMap.Annotations[ref.key]
+		if !ok {
+			return "", false, fmt.Errorf("key '%s' not found in configmap '%s/%s'", ref.key, ref.namespace, ref.name)
+		}
+		content = data.Value
+	default:
+		secret, ok := ns.Secret[ref.name]
+		if !ok || secret.Status == DELETED {
+			return "", false, fmt.Errorf("secret '%s/%s' does not exist", ref.namespace, ref.name)
+		}
+		data, ok := secret.Data[ref.key]
+		if !ok {
+			return "", false, fmt.Errorf("key '%s' not found in secret '%s/%s'", ref.key, ref.namespace, ref.name)
+		}
+		content = string(data)
+	}
+	var buff strings.Builder
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, address := range strings.Fields(strings.Replace(line, ",", " ", -1)) {
+			if !validSource(address) {
+				logger.Warningf("%s: skipping '%s', not an IP or CIDR", value, address)
+				continue
+			}
+			buff.WriteString(address + "\n")
+		}
+	}
+	patternFile := path.Join(HAProxyMapDir, fmt.Sprintf("src-%s_%s_%s_%s.lst", ref.kind, ref.namespace, ref.name, ref.key))
+	if old, errRead := ioutil.ReadFile(patternFile); errRead != nil || string(old) != buff.String() {
+		if err = ioutil.WriteFile(patternFile, []byte(buff.String()), 0644); err != nil {
+			return "", false, err
+		}
+		modified = true
+	}
+	c.cfg.SourcePatternFiles[patternFile] = struct{}{}
+	return fmt.Sprintf("{ src -f %s }", patternFile), modified, nil
+}
+
+type sourceRef struct {
+	kind      string
+	namespace string
+	name      string
+	key       string
+}
+
+func parseSourceRef(value string) (ref sourceRef, ok bool) {
+	for _, kind := range []string{"configmap", "secret"} {
+		if !strings.HasPrefix(value, kind+"://") {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(value, kind+"://"), "/")
+		if len(parts) != 3 {
+			return ref, false
+		}
+		return sourceRef{kind: kind, namespace: parts[0], name: parts[1], key: parts[2]}, true
+	}
+	return ref, false
+}
+
+func validSource(address string) bool {
+	if ip := net.ParseIP(address); ip != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(address)
+	return err == nil
+}
+
+// Return condition matching request Host against hosts of a map file, then conds.
+// Exact hosts are looked up in the map file first, wildcard ones are then matched as
+// regex patterns of its wildcard file, see haproxy.MapFiles.Refresh. ACLs can't be
+// grouped, so conds are repeated on both sides of the ||.
+func hostACL(mapFile string, conds ...string) string {
+	return hostMapCond("req.hdr(Host),field(1,:)", mapFile, conds)
+}
+
+// Return condition matching TLS SNI against hosts of a map file, then conds.
+func sniACL(mapFile string, conds ...string) string {
+	return hostMapCond("req_ssl_sni", mapFile, conds)
+}
+
+func hostMapCond(fetch, mapFile string, conds []string) string {
+	suffix := ""
+	for _, cond := range conds {
+		if cond = strings.TrimSpace(cond); cond != "" {
+			suffix += " " + cond
+		}
+	}
+	return fmt.Sprintf("{ %s,lower -f %s }%s || { %s -m reg -i -f %s }%s", fetch, mapFile, suffix, fetch, haproxy.WildcardMapFile(mapFile), suffix)
+}
+
 func hashStrToUint(s string) uint64 {
 	h := fnv.New64a()
 	_, err := h.Write([]byte(strings.ToLower(s)))
@@ -484,3 +2260,72 @@ func setStatus(ingressStatus, annStatus Status) Status {
 	}
 	return MODIFIED
 }
+
+// access-log annotation: "false" silences logs of requests to the hosts and paths of the ingress
+func (c *HAProxyController) handleAccessLog(ingress *Ingress) error {
+	annAccessLog, _ := GetValueFromAnnotations("access-log", ingress.Annotations)
+	if annAccessLog == nil {
+		return nil
+	}
+	if annAccessLog.Status != EMPTY || ingress.Status != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	if annAccessLog.Status == DELETED || ingress.Status == DELETED {
+		return nil
+	}
+	enabled, err := utils.GetBoolValue(annAccessLog.Value, "access-log")
+	if err != nil || enabled {
+		return err
+	}
+	for _, rule := range ingress.Rules {
+		for _, path := range rule.Paths {
+			acl := hostPathACL(rule.Host, path.Path)
+			if acl == "" {
+				continue
+			}
+			key := hashStrToUint(fmt.Sprintf("%s-%s-%s-%s-%s", ACCESS_LOG, ingress.Namespace, ingress.Name, rule.Host, path.Path))
+			c.cfg.FrontendHTTPReqRules[ACCESS_LOG][key] = models.HTTPRequestRule{
+				Index:    utils.PtrInt64(0),
+				Type:     "set-log-level",
+				LogLevel: "silent",
+				Cond:     "if",
+				CondTest: strings.TrimSpace(acl),
+			}
+		}
+	}
+	return nil
+}
+
+// One of every size successful responses is logged
+type logSampling struct {
+	n    int64
+	size int64
+}
+
+// Parse log-sampling annotation "<n>:<size>", n responses out of size are logged
+func parseLogSampling(value string) (logSampling, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) == 2 {
+		n, errN := strconv.ParseInt(parts[0], 10, 64)
+		size, errSize := strconv.ParseInt(parts[1], 10, 64)
+		if errN == nil && errSize == nil && n > 0 && n <= size {
+			return logSampling{n: n, size: size}, nil
+		}
+	}
+	return logSampling{}, fmt.Errorf("incorrect value '%s', expected <n>:<size> with 0 < n <= size", value)
+}
+
+// Response rule of log-sampling annotation: only n of size responses with a status
+// lower than 400 are logged, errors are always logged. Nil when all responses are logged.
+func (c *HAProxyController) logSamplingRule() *models.HTTPResponseRule {
+	if c.cfg.LogSampling.size == 0 || c.cfg.LogSampling.n == c.cfg.LogSampling.size {
+		return nil
+	}
+	return &models.HTTPResponseRule{
+		Index:    utils.PtrInt64(0),
+		Type:     "set-log-level",
+		LogLevel: "silent",
+		Cond:     "if",
+		CondTest: fmt.Sprintf("{ status lt 400 } { rand(%d) ge %d }", c.cfg.LogSampling.size, c.cfg.LogSampling.n),
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haproxytech/kubernetes-ingress/controller/haproxy"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+func TestRequestHeaderACL(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		acl   string
+	}{
+		{"X-Env: prod", "{ req.hdr(X-Env) -m str prod }"},
+		{"X-Env: prod staging", "{ req.hdr(X-Env) -m str prod staging }"},
+		{"X-Api-Key: -m found", "{ req.hdr(X-Api-Key) -m found }"},
+		{"User-Agent: -m reg ^test-client/", "{ req.hdr(User-Agent) -m reg ^test-client/ }"},
+		// values ending the ACL or the line in HAProxy configuration
+		{"X-Env: prod }", ""},
+		{"X-Env: prod#", ""},
+		{"X-Env: {prod", ""},
+		{`X-Env: "prod"`, ""},
+		{"X-Env: 'prod'", ""},
+		{"X-Env: prod\x00", ""},
+		{"X#Env: prod", ""},
+		{"X'Env: prod", ""},
+		{"X-Env prod", ""},
+		{"X-Env: -m found prod", ""},
+		{"X-Env: -m dir /", ""},
+		{"X-Env:", ""},
+	} {
+		acl, err := requestHeaderACL(test.value)
+		if test.acl == "" {
+			if err == nil {
+				t.Errorf("%q: expected error, got ACL %s", test.value, acl)
+			}
+			continue
+		}
+		if err != nil || acl != test.acl {
+			t.Errorf("%q: expected %s, got %s, %v", test.value, test.acl, acl, err)
+		}
+	}
+}
+
+func TestMethodsACLs(t *testing.T) {
+	acls, err := methodsACLs("get, POST, PURGE")
+	if err != nil || len(acls) != 2 || acls[0] != "{ method GET POST }" || acls[1] != "{ method -m str PURGE }" {
+		t.Errorf("expected known and custom methods ACLs, got %v, %v", acls, err)
+	}
+	for _, value := range []string{"GET, PURGE#", "GET, PUR{GE", "GET, 'PURGE'", ", "} {
+		if acls, err = methodsACLs(value); err == nil {
+			t.Errorf("%q: expected error, got %v", value, acls)
+		}
+	}
+}
+
+func TestResponseCaptureSlots(t *testing.T) {
+	r := responseCaptureSlots{ids: map[string]int64{}, requested: map[string]int64{}}
+	for _, sample := range []string{"res.hdr(c)", "res.hdr(a)", "res.hdr(b)"} {
+		r.request(sample, 64)
+	}
+	r.request("res.hdr(a)", 128)
+	r.allocate()
+	expected := map[string]int64{"res.hdr(a)": 0, "res.hdr(b)": 1, "res.hdr(c)": 2}
+	for sample, id := range expected {
+		if r.ids[sample] != id {
+			t.Errorf("sample %s: expected slot %d, got %d", sample, id, r.ids[sample])
+		}
+	}
+	if len(r.lens) != 3 || r.lens[0] != 128 || r.lens[1] != 64 {
+		t.Errorf("expected slot lengths [128 64 64], got %v", r.lens)
+	}
+
+	// Next sync: b is released, its slot goes to the first new sample
+	r.requested = map[string]int64{"res.hdr(c)": 64, "res.hdr(a)": 128, "res.hdr(e)": 64, "res.hdr(d)": 64}
+	r.allocate()
+	expected = map[string]int64{"res.hdr(a)": 0, "res.hdr(d)": 1, "res.hdr(c)": 2, "res.hdr(e)": 3}
+	for sample, id := range expected {
+		if r.ids[sample] != id {
+			t.Errorf("sample %s: expected slot %d, got %d", sample, id, r.ids[sample])
+		}
+	}
+	if _, ok := r.ids["res.hdr(b)"]; ok {
+		t.Error("slot of released sample kept")
+	}
+}
+
+// Pattern files of long rate-limit-whitelist lists and of source references are
+// removed once no ingress uses them
+func TestSourcePatternFilesClean(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy-maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapDir := HAProxyMapDir
+	HAProxyMapDir = dir
+	defer func() { HAProxyMapDir = mapDir }()
+	c := testController()
+	c.cfg.Init(utils.OSArgs{}, dir)
+	for _, ns := range []string{"a", "a-b"} {
+		c.cfg.NewNamespace(ns).ConfigMaps = map[string]*ConfigMap{
+			"c":   {Annotations: MapStringW{"list": &StringW{Value: "10.0.0.1"}}},
+			"b-c": {Annotations: MapStringW{"list": &StringW{Value: "10.0.0.2"}}},
+		}
+	}
+
+	addresses := []string{}
+	for i := 1; i <= rateLimitExemptInlineMax+1; i++ {
+		addresses = append(addresses, fmt.Sprintf("10.0.0.%d", i))
+	}
+	used := map[string]bool{}
+	for _, value := range []string{strings.Join(addresses, ","), "configmap://a-b/c/list", "configmap://a/b-c/list"} {
+		acl, _, errACL := c.rateLimitExemptACL(value)
+		if errACL != nil {
+			t.Fatal(errACL)
+		}
+		used[strings.TrimSuffix(strings.TrimPrefix(acl, "{ src -f "), " }")] = true
+	}
+	if len(used) != 3 {
+		t.Errorf("expected 3 distinct pattern files, got %v", used)
+	}
+	stale := filepath.Join(dir, "src-1.lst")
+	staleRef := filepath.Join(dir, "src-configmap_default_sources_list.lst")
+	for _, file := range []string{stale, staleRef} {
+		if err = ioutil.WriteFile(file, []byte("10.0.0.1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		used[file] = false
+	}
+	if err = c.sourcePatternFilesClean(); err != nil {
+		t.Fatal(err)
+	}
+	for file, exists := range used {
+		if _, errStat := os.Stat(file); (errStat == nil) != exists {
+			t.Errorf("%s: expected exists %t, got %v", file, exists, errStat)
+		}
+	}
+
+	// Next sync without source list annotations
+	c.cfg.Clean()
+	if err = c.sourcePatternFilesClean(); err != nil {
+		t.Fatal(err)
+	}
+	for file := range used {
+		if _, errStat := os.Stat(file); !os.IsNotExist(errStat) {
+			t.Errorf("%s of removed annotation not removed: %v", file, errStat)
+		}
+	}
+}
+
+// Exact hosts are looked up in the map file before wildcard patterns of its wildcard file
+func TestHostMapFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy-maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maps := haproxy.NewMapFiles(dir)
+	for _, host := range []string{"b.example.com", "*.example.com", "A.example.com"} {
+		maps.AppendHost(1, host)
+	}
+	maps.Modified(1)
+	if _, err = maps.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	mapFile := filepath.Join(dir, "1.lst")
+	for file, expected := range map[string]string{
+		mapFile:                          "a.example.com\nb.example.com\n",
+		haproxy.WildcardMapFile(mapFile): `^[^.]+\.example\.com$` + "\n",
+	} {
+		if content, errRead := ioutil.ReadFile(file); errRead != nil || string(content) != expected {
+			t.Errorf("%s: expected %q, got %q, %v", file, expected, content, errRead)
+		}
+	}
+	expected := fmt.Sprintf("{ req.hdr(Host),field(1,:),lower -f %s } { ssl_fc } || { req.hdr(Host),field(1,:) -m reg -i -f %s } { ssl_fc }", mapFile, haproxy.WildcardMapFile(mapFile))
+	if acl := hostACL(mapFile, "{ ssl_fc }", ""); acl != expected {
+		t.Errorf("expected %s, got %s", expected, acl)
+	}
+
+	// Without hosts both files are removed
+	maps.Clean()
+	maps.Modified(1)
+	if _, err = maps.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{mapFile, haproxy.WildcardMapFile(mapFile)} {
+		if _, errStat := os.Stat(file); !os.IsNotExist(errStat) {
+			t.Errorf("%s not removed: %v", file, errStat)
+		}
+	}
+}
+
+// CORS rules are scoped to hosts and paths of the ingress, preflight requests are
+// answered by HAProxy when http-request return is available
+func TestCORSPreflight(t *testing.T) {
+	version := HAProxyVersion
+	defer func() { HAProxyVersion = version }()
+	rule := &IngressRule{Host: "api.example.com", Paths: map[string]*IngressPath{"/v1": {Path: "/v1"}}}
+	ingress := &Ingress{
+		Namespace: "default",
+		Name:      "api",
+		Status:    ADDED,
+		Annotations: MapStringW{
+			"cors-enable":        &StringW{Value: "true", Status: ADDED},
+			"cors-allow-origin":  &StringW{Value: "https://a.example.com", Status: ADDED},
+			"cors-allow-methods": &StringW{Value: "GET, POST", Status: ADDED},
+		},
+		Rules: map[string]*IngressRule{rule.Host: rule},
+	}
+
+	for _, test := range []struct {
+		version   [2]int
+		preflight bool
+	}{{[2]int{2, 0}, false}, {[2]int{2, 2}, true}} {
+		HAProxyVersion = test.version
+		c := testController()
+		c.cfg.Init(utils.OSArgs{}, "")
+		if err := c.handleCORS(ingress); err != nil {
+			t.Fatal(err)
+		}
+		for _, httpRule := range c.cfg.FrontendHTTPReqRules[CORS] {
+			if httpRule.CondTest != "{ req.hdr(host),field(1,:) -i api.example.com } { path_beg /v1 }" {
+				t.Errorf("origin variable set for %s", httpRule.CondTest)
+			}
+		}
+		if len(c.cfg.FrontendHTTPReqRules[CORS]) != 1 || len(c.cfg.FrontendHTTPRspRules[CORS]) != 3 {
+			t.Errorf("expected 1 request and 3 response rules, got %d and %d", len(c.cfg.FrontendHTTPReqRules[CORS]), len(c.cfg.FrontendHTTPRspRules[CORS]))
+		}
+		if len(c.cfg.FrontendHTTPReturns) != 0 != test.preflight {
+			t.Fatalf("HAProxy %v: expected preflight response %t, got %v", test.version, test.preflight, c.cfg.FrontendHTTPReturns)
+		}
+		for _, line := range c.cfg.FrontendHTTPReturns {
+			for _, expected := range []string{"http-request return status 204 ", " hdr Access-Control-Allow-Methods GET,POST", " if METH_OPTIONS ", "-m str https://a.example.com }"} {
+				if !strings.Contains(line, expected) {
+					t.Errorf("preflight response %q: %q missing", line, expected)
+				}
+			}
+		}
+	}
+}
+
+// Ingresses sharing a host track requests of their own paths only, since HAProxy
+// ignores track-sc0 rules once sc0 is tracked
+func TestRateLimitSharedHost(t *testing.T) {
+	c := testController()
+	c.cfg.Init(utils.OSArgs{}, "")
+	ns := c.cfg.NewNamespace("default")
+	ns.Relevant = true
+	for name, p := range map[string]string{"api": "/api", "api-v2": "/api/v2"} {
+		rule := &IngressRule{Host: "shop.example.com", Paths: map[string]*IngressPath{p: {Path: p}}}
+		ns.Ingresses[name] = &Ingress{
+			Namespace: "default",
+			Name:      name,
+			Status:    ADDED,
+			Annotations: MapStringW{
+				"rate-limit-requests": &StringW{Value: "10", Status: ADDED},
+			},
+			Rules: map[string]*IngressRule{rule.Host: rule},
+		}
+	}
+	for _, ingress := range ns.Ingresses {
+		if err := c.handleRateLimiting(ingress); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		"RateLimit-default-api":    "{ req.hdr(host),field(1,:) -i shop.example.com } { path_beg /api } !{ path_beg /api/v2 }",
+		"RateLimit-default-api-v2": "{ req.hdr(host),field(1,:) -i shop.example.com } { path_beg /api/v2 }",
+	}
+	tracks, denies := 0, 0
+	for _, httpRule := range c.cfg.FrontendHTTPReqRules[RATE_LIMIT] {
+		switch httpRule.Type {
+		case "track-sc0":
+			tracks++
+			if httpRule.CondTest != expected[httpRule.TrackSc0Table] {
+				t.Errorf("track of %s: expected condition %q, got %q", httpRule.TrackSc0Table, expected[httpRule.TrackSc0Table], httpRule.CondTest)
+			}
+		case "deny":
+			denies++
+			matched := false
+			for table, acl := range expected {
+				if httpRule.CondTest == fmt.Sprintf("%s { sc0_http_req_rate(%s) gt 10 }", acl, table) {
+					matched = true
+				}
+			}
+			if !matched {
+				t.Errorf("deny condition %q does not check the table of its own paths", httpRule.CondTest)
+			}
+		}
+	}
+	if tracks != 2 || denies != 2 {
+		t.Errorf("expected 2 track and 2 deny rules, got %d and %d", tracks, denies)
+	}
+}
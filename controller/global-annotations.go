@@ -2,65 +2,257 @@ package controller
 
 import (
 	"fmt"
-	"log"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
 	goruntime "runtime"
+	"sort"
 	"strconv"
 	"strings"
 
 	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/common"
+	stats "github.com/haproxytech/config-parser/v2/parsers/stats/settings"
 	"github.com/haproxytech/config-parser/v2/types"
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	"github.com/haproxytech/models"
 )
 
-// Handle Global and default Annotations
+const statsFrontend = "stats"
+
+// Frontend answering health checks of external load balancers
+const healthzFrontend = "healthz"
+
+// Drain mode hook: health checks fail once proc.maintenance variable is set
+const healthzMonitorFail = "monitor fail if { var(proc.maintenance) -m bool }"
+
+// tune.ssl.default-dh-param of base configuration
+const defaultDHParam = 2048
+
+// Handle Global and default Annotations. Only the options HAProxy reads once when
+// its master process starts require a restart: nbthread, cpu-map and daemon mode
+// (toggled by log-stdout). Other ones are applied with a reload, or with the runtime
+// API and no reload at all for maxconn.
 
 func (c *HAProxyController) handleGlobalAnnotations() (restart bool, reload bool) {
-	reload = false
-	reload = c.handleDefaultLogFormat() ||
-		c.handleDefaultMaxconn() ||
-		c.handleDefaultTimeouts() ||
-		c.handleNbthread()
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "log-format annotation", c.handleDefaultLogFormat())
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "log-tag annotation", c.handleDefaultLogTag()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "log annotations", c.handleDefaultLogOptions()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "maxconn annotation", c.handleDefaultMaxconn()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "timeout annotations", c.handleDefaultTimeouts()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "errorfiles annotation", c.handleErrorFiles()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "compression annotations", c.handleDefaultCompression()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "http-connection-mode annotation", c.handleDefaultConnectionMode()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "stats annotations", c.handleStats()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "healthz-bind-port annotation", c.handleHealthz()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "ssl annotations", c.handleSSLOptions()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "resolvers annotations", c.handleResolvers()) || reload
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "tune annotations", c.handleTune()) || reload
 
-	restart, r := c.handleSyslog()
-	reload = reload || r
+	restart = restartRequired("nbthread annotation", c.handleNbthread())
+	restart = restartRequired("cpu-map annotation", c.handleCPUMap()) || restart
+	r, reloadSyslog := c.handleSyslog()
+	restart = restartRequired("syslog-server annotation", r) || restart
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "syslog-server annotation", reloadSyslog) || reload
+	// Snippet directives are applied on top of the ones of other annotations
+	reload = c.reloadRequired(ReloadGlobalAnnotations, "global-config-snippet annotation", c.handleConfigSnippets()) || reload
 	return restart, reload
 }
 
-func (c *HAProxyController) handleNbthread() bool {
-	reload := false
-	maxProcs := goruntime.GOMAXPROCS(0)
-	numThreads := int64(maxProcs)
+// Return number of threads of nbthread annotation, "auto" is the number of CPUs of the node
+// and higher values are limited to it
+func parseNbthread(value string) (int64, error) {
+	numCPU := int64(goruntime.NumCPU())
+	if value == "auto" {
+		return numCPU, nil
+	}
+	nbthread, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || nbthread < 1 {
+		return 0, fmt.Errorf("incorrect value '%s', expected 'auto' or a positive number", value)
+	}
+	if nbthread > numCPU {
+		logger.Warningf("nbthread annotation: %d threads for %d CPUs, using %d", nbthread, numCPU, numCPU)
+		return numCPU, nil
+	}
+	return nbthread, nil
+}
+
+// Threads are created when HAProxy starts, changing nbthread requires a restart
+func (c *HAProxyController) handleNbthread() (restart bool) {
 	annNbthread, _ := GetValueFromAnnotations("nbthread", c.cfg.ConfigMap.Annotations)
 	if annNbthread == nil || annNbthread.Status == EMPTY {
 		return false
 	}
-	var errParser error
 	config, _ := c.ActiveConfiguration()
-	if numthr, errConv := strconv.Atoi(annNbthread.Value); errConv == nil {
-		if numthr < maxProcs {
-			numThreads = int64(numthr)
+	var current int64
+	if data, err := config.Get(parser.Global, parser.GlobalSectionName, "nbthread"); err == nil {
+		current = data.(*types.Int64C).Value
+	}
+	var err error
+	switch {
+	case annNbthread.Status == DELETED:
+		if current == 0 {
+			return false
 		}
-		if annNbthread.Status == DELETED {
-			errParser = config.Delete(parser.Global, parser.GlobalSectionName, "nbthread")
-			c.ActiveTransactionHasChanges = true
-			reload = true
-		} else if annNbthread.Status != EMPTY {
-			errParser = config.Insert(parser.Global, parser.GlobalSectionName, "nbthread", types.Int64C{
-				Value: numThreads,
+		logger.Info("Removing nbthread")
+		err = config.Set(parser.Global, parser.GlobalSectionName, "nbthread", nil)
+	default:
+		var nbthread int64
+		if nbthread, err = parseNbthread(annNbthread.Value); err != nil {
+			break
+		}
+		if nbthread == current {
+			return false
+		}
+		logger.Infof("Setting nbthread to %d", nbthread)
+		err = config.Set(parser.Global, parser.GlobalSectionName, "nbthread", types.Int64C{
+			Value: nbthread,
+		})
+	}
+	if err != nil {
+		utils.LogErr(fmt.Errorf("nbthread annotation: %s", err))
+		return false
+	}
+	c.ActiveTransactionHasChanges = true
+	return true
+}
+
+var (
+	cpuMapProcessRegexp = regexp.MustCompile(`^(auto:)?(all|odd|even|[0-9]+(-[0-9]+)?)(/(all|odd|even|[0-9]+(-[0-9]+)?))?$`)
+	cpuMapCPUSetRegexp  = regexp.MustCompile(`^[0-9]+(-[0-9]+)?$`)
+)
+
+// cpu-map annotation has one "<process>/<thread> <cpu-set>..." binding per line
+func parseCPUMap(value string) ([]types.CPUMap, error) {
+	cpuMaps := []types.CPUMap{}
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || !cpuMapProcessRegexp.MatchString(fields[0]) {
+			return nil, fmt.Errorf("incorrect cpu-map '%s'", strings.TrimSpace(line))
+		}
+		for _, cpuSet := range fields[1:] {
+			if !cpuMapCPUSetRegexp.MatchString(cpuSet) {
+				return nil, fmt.Errorf("incorrect cpu set '%s' of cpu-map '%s'", cpuSet, strings.TrimSpace(line))
+			}
+		}
+		cpuMaps = append(cpuMaps, types.CPUMap{
+			Process: fields[0],
+			CPUSet:  strings.Join(fields[1:], " "),
+		})
+	}
+	return cpuMaps, nil
+}
+
+// Threads are bound to CPUs when HAProxy starts, changing cpu-map requires a restart
+func (c *HAProxyController) handleCPUMap() (restart bool) {
+	annCPUMap, _ := GetValueFromAnnotations("cpu-map", c.cfg.ConfigMap.Annotations)
+	if annCPUMap == nil || annCPUMap.Status == EMPTY {
+		return false
+	}
+	cpuMaps := []types.CPUMap{}
+	if annCPUMap.Status != DELETED {
+		var err error
+		if cpuMaps, err = parseCPUMap(annCPUMap.Value); err != nil {
+			utils.LogErr(fmt.Errorf("cpu-map annotation: %s", err))
+			return false
+		}
+	}
+	config, _ := c.ActiveConfiguration()
+	current := []types.CPUMap{}
+	if data, err := config.Get(parser.Global, parser.GlobalSectionName, "cpu-map"); err == nil {
+		current = data.([]types.CPUMap)
+	}
+	if cpuMapString(current) == cpuMapString(cpuMaps) {
+		return false
+	}
+	var err error
+	if len(cpuMaps) == 0 {
+		logger.Info("Removing cpu-map")
+		err = config.Set(parser.Global, parser.GlobalSectionName, "cpu-map", nil)
+	} else {
+		logger.Infof("Setting cpu-map to '%s'", cpuMapString(cpuMaps))
+		err = config.Set(parser.Global, parser.GlobalSectionName, "cpu-map", cpuMaps)
+	}
+	if err != nil {
+		utils.LogErr(fmt.Errorf("cpu-map annotation: %s", err))
+		return false
+	}
+	c.ActiveTransactionHasChanges = true
+	return true
+}
+
+func cpuMapString(cpuMaps []types.CPUMap) string {
+	lines := make([]string, len(cpuMaps))
+	for i, cpuMap := range cpuMaps {
+		lines[i] = cpuMap.Process + " " + cpuMap.CPUSet
+	}
+	return strings.Join(lines, ", ")
+}
+
+// tune.ssl.default-dh-param and tune.bufsize annotations, removing them
+// restores values of the base configuration
+func (c *HAProxyController) handleTune() (reload bool) {
+	config, _ := c.ActiveConfiguration()
+	annDHParam, _ := GetValueFromAnnotations("tune.ssl.default-dh-param", c.cfg.ConfigMap.Annotations)
+	if annDHParam != nil && annDHParam.Status != EMPTY {
+		value, err := strconv.ParseInt(annDHParam.Value, 10, 64)
+		switch {
+		case annDHParam.Status == DELETED:
+			value, err = defaultDHParam, nil
+		case err != nil || value < 1024:
+			err = fmt.Errorf("incorrect value '%s', expected a number of bits greater than 1024", annDHParam.Value)
+		}
+		if err == nil {
+			err = config.Set(parser.Global, parser.GlobalSectionName, "tune.ssl.default-dh-param", types.Int64C{
+				Value: value,
 			})
+		}
+		if err != nil {
+			utils.LogErr(fmt.Errorf("tune.ssl.default-dh-param annotation: %s", err))
+		} else {
+			logger.Infof("Setting tune.ssl.default-dh-param to %d", value)
 			c.ActiveTransactionHasChanges = true
 			reload = true
 		}
-		utils.LogErr(errParser)
+	}
+
+	// tune.bufsize is not handled by config parser
+	annBufsize, _ := GetValueFromAnnotations("tune.bufsize", c.cfg.ConfigMap.Annotations)
+	if annBufsize != nil && annBufsize.Status != EMPTY {
+		values := []string{}
+		var err error
+		if annBufsize.Status != DELETED {
+			value, errConv := strconv.ParseInt(annBufsize.Value, 10, 64)
+			if errConv != nil || value < 1 {
+				err = fmt.Errorf("incorrect value '%s', expected a positive number of bytes", annBufsize.Value)
+			}
+			values = append(values, fmt.Sprintf("tune.bufsize %d", value))
+		}
+		if err != nil {
+			utils.LogErr(fmt.Errorf("tune.bufsize annotation: %s", err))
+		} else {
+			utils.LogErr(c.unprocessedSet(parser.Global, parser.GlobalSectionName, "tune.bufsize", values))
+			reload = true
+		}
 	}
 	return reload
 }
 
+// log-stdout annotation replaces syslog-server ones, HAProxy logs to its stdout from 1.9
+// and to a syslog relay of the controller with older versions, see syslogRelay.
 func (c *HAProxyController) handleSyslog() (restart, reload bool) {
 	annSyslogSrv, _ := GetValueFromAnnotations("syslog-server", c.cfg.ConfigMap.Annotations)
-	if annSyslogSrv.Status == EMPTY {
+	annLogStdout, _ := GetValueFromAnnotations("log-stdout", c.cfg.ConfigMap.Annotations)
+	if annSyslogSrv.Status == EMPTY && annLogStdout.Status == EMPTY {
 		return false, false
 	}
+	logStdout, err := utils.GetBoolValue(annLogStdout.Value, "log-stdout")
+	utils.LogErr(err)
 	config, _ := c.ActiveConfiguration()
 	restart = false
 	reload = false
@@ -71,7 +263,21 @@ func (c *HAProxyController) handleSyslog() (restart, reload bool) {
 	}
 	errParser := config.Set(parser.Global, parser.GlobalSectionName, "log", nil)
 	utils.LogErr(errParser)
-	for index, syslogSrv := range strings.Split(annSyslogSrv.Value, "\n") {
+	syslogServers := annSyslogSrv.Value
+	if logStdout {
+		if haproxyVersionAtLeast(1, 9) {
+			syslogServers = "address:stdout, format:raw, facility:local0"
+		} else if c.syslogRelay != nil || c.startSyslogRelay() {
+			host, port, _ := net.SplitHostPort(c.syslogRelay.Address())
+			syslogServers = fmt.Sprintf("address:%s, port:%s, facility:local0", host, port)
+		}
+	}
+	if (!logStdout || haproxyVersionAtLeast(1, 9)) && c.syslogRelay != nil {
+		utils.LogErr(c.syslogRelay.Close())
+		c.syslogRelay = nil
+		logger.Info("syslog relay stopped")
+	}
+	for _, syslogSrv := range strings.Split(syslogServers, "\n") {
 		if syslogSrv == "" {
 			continue
 		}
@@ -110,13 +316,17 @@ func (c *HAProxyController) handleSyslog() (restart, reload bool) {
 				case "level":
 					logData.Level = v
 				case "minlevel":
-					logData.Level = v
+					logData.MinLevel = v
 				default:
 					utils.LogErr(fmt.Errorf("unkown syslog param: %s ", k))
 					continue
 				}
 			}
-			errParser = config.Insert(parser.Global, parser.GlobalSectionName, "log", logData, index)
+			if logData.Facility == "" {
+				utils.LogErr(fmt.Errorf("syslog-server annotation: facility of '%s' is missing", address))
+				continue
+			}
+			errParser = config.Insert(parser.Global, parser.GlobalSectionName, "log", logData)
 			if errParser == nil {
 				c.ActiveTransactionHasChanges = true
 				reload = true
@@ -137,6 +347,17 @@ func (c *HAProxyController) handleSyslog() (restart, reload bool) {
 	return restart, reload
 }
 
+func (c *HAProxyController) startSyslogRelay() bool {
+	relay, err := newSyslogRelay()
+	if err != nil {
+		utils.LogErr(fmt.Errorf("log-stdout annotation: syslog relay: %s", err))
+		return false
+	}
+	c.syslogRelay = relay
+	logger.Infof("HAProxy %d.%d can't log to stdout, relaying its logs received on %s", HAProxyVersion[0], HAProxyVersion[1], relay.Address())
+	return true
+}
+
 func (c *HAProxyController) handleDefaultTimeouts() bool {
 	hasChanges := false
 	hasChanges = c.handleDefaultTimeout("http-request") || hasChanges
@@ -155,7 +376,7 @@ func (c *HAProxyController) handleDefaultTimeouts() bool {
 func (c *HAProxyController) handleDefaultTimeout(timeout string) bool {
 	annTimeout, err := GetValueFromAnnotations(fmt.Sprintf("timeout-%s", timeout), c.cfg.ConfigMap.Annotations)
 	if err != nil {
-		log.Println(err)
+		logger.Error(err)
 		return false
 	}
 	if annTimeout.Status != "" {
@@ -165,65 +386,652 @@ func (c *HAProxyController) handleDefaultTimeout(timeout string) bool {
 			Value: annTimeout.Value,
 		})
 		if err != nil {
-			log.Println(err)
+			logger.Error(err)
 			return false
 		}
-		log.Println(fmt.Sprintf("Setting default timeout-%s to %s", timeout, annTimeout.Value))
+		logger.Infof("Setting default timeout-%s to %s", timeout, annTimeout.Value)
 		c.ActiveTransactionHasChanges = true
 		return true
 	}
 	return false
 }
 
-func (c *HAProxyController) handleDefaultMaxconn() bool {
+// maxconn annotation limits connections of HAProxy process (global section)
+// and of each frontend (defaults section). New values are applied with the runtime
+// API once the configuration is committed, HAProxy is only reloaded when this fails,
+// for example for a value above the one HAProxy started with, or when the annotation
+// is removed.
+func (c *HAProxyController) handleDefaultMaxconn() (reload bool) {
 	annMaxconn, _ := GetValueFromAnnotations("maxconn", c.cfg.ConfigMap.Annotations)
-	if annMaxconn == nil {
+	if annMaxconn == nil || annMaxconn.Status == EMPTY {
 		return false
 	}
-	value, err := strconv.ParseInt(annMaxconn.Value, 10, 64)
+	config, _ := c.ActiveConfiguration()
+	var err error
+	var value int64
+	if annMaxconn.Status == DELETED {
+		logger.Info("Removing maxconn")
+		if err = config.Set(parser.Global, parser.GlobalSectionName, "maxconn", nil); err == nil {
+			err = config.Set(parser.Defaults, parser.DefaultSectionName, "maxconn", nil)
+		}
+	} else {
+		var errConv error
+		value, errConv = strconv.ParseInt(annMaxconn.Value, 10, 64)
+		if errConv != nil || value < 1 {
+			utils.LogErr(fmt.Errorf("maxconn annotation: incorrect value '%s', expected a positive number", annMaxconn.Value))
+			return false
+		}
+		logger.Infof("Setting maxconn to %d", value)
+		maxconn := types.Int64C{Value: value}
+		if err = config.Set(parser.Global, parser.GlobalSectionName, "maxconn", maxconn); err == nil {
+			err = config.Set(parser.Defaults, parser.DefaultSectionName, "maxconn", maxconn)
+		}
+	}
 	if err != nil {
 		utils.LogErr(err)
 		return false
 	}
+	c.ActiveTransactionHasChanges = true
+	if value == 0 {
+		return true
+	}
+	c.cfg.MaxconnCommands = maxconnCommands(config, value)
+	return false
+}
+
+// Runtime commands setting maxconn of HAProxy process and of frontends without their own maxconn
+func maxconnCommands(config *parser.Parser, value int64) []string {
+	commands := []string{fmt.Sprintf("set maxconn global %d", value)}
+	frontends, _ := config.SectionsGet(parser.Frontends)
+	for _, frontend := range frontends {
+		if _, err := config.Get(parser.Frontends, frontend, "maxconn"); err == nil {
+			continue
+		}
+		commands = append(commands, fmt.Sprintf("set maxconn frontend %s %d", frontend, value))
+	}
+	return commands
+}
+
+// Send maxconn commands of the committed configuration. Frontends created by
+// the transaction are unknown to HAProxy and fail, they require a reload anyway.
+func (c *HAProxyController) runtimeMaxconn() (reload bool) {
+	if len(c.cfg.MaxconnCommands) == 0 {
+		return false
+	}
+	err := c.runtimeCommands(c.cfg.MaxconnCommands)
+	c.cfg.MaxconnCommands = nil
+	if err != nil {
+		logger.Debugf("maxconn annotation: runtime update failed, reload required: %s", err)
+		return true
+	}
+	return false
+}
 
+func (c *HAProxyController) handleDefaultLogFormat() bool {
+	annLogFormat, _ := GetValueFromAnnotations("log-format", c.cfg.ConfigMap.Annotations)
+	if annLogFormat.Status == EMPTY {
+		return false
+	}
+	// Value is written between single quotes on one line, other errors
+	// are reported by configuration check before commit
+	if strings.ContainsAny(annLogFormat.Value, "'\n") {
+		utils.LogErr(fmt.Errorf("log-format annotation: incorrect value '%s', single quotes and newlines are not allowed", annLogFormat.Value))
+		return false
+	}
 	config, _ := c.ActiveConfiguration()
-	switch annMaxconn.Status {
-	case EMPTY:
+	err := config.Set(parser.Defaults, parser.DefaultSectionName, "log-format", types.StringC{
+		Value: "'" + annLogFormat.Value + "'",
+	})
+	if err != nil {
+		utils.LogErr(err)
 		return false
-	case DELETED:
-		err = config.Set(parser.Defaults, parser.DefaultSectionName, "maxconn", nil)
+	}
+	c.ActiveTransactionHasChanges = true
+	return true
+}
+
+// dontlognull and dontlog-normal annotations set options of defaults section, log-sampling
+// sets the response rule of HTTP and HTTPS frontends. Removing them restores defaults.
+func (c *HAProxyController) handleDefaultLogOptions() (reload bool) {
+	config, _ := c.ActiveConfiguration()
+	annDontlognull, _ := GetValueFromAnnotations("dontlognull", c.cfg.ConfigMap.Annotations)
+	if annDontlognull != nil && annDontlognull.Status != EMPTY {
+		enabled, err := utils.GetBoolValue(annDontlognull.Value, "dontlognull")
+		if err == nil {
+			var data common.ParserData
+			if enabled {
+				data = &types.SimpleOption{}
+			}
+			err = config.Set(parser.Defaults, parser.DefaultSectionName, "option dontlognull", data)
+		}
 		if err != nil {
-			utils.LogErr(err)
-			return false
+			utils.LogErr(fmt.Errorf("dontlognull annotation: %s", err))
+		} else {
+			logger.Infof("Setting dontlognull to %t", enabled)
+			c.ActiveTransactionHasChanges = true
+			reload = true
+		}
+	}
+
+	// option dontlog-normal is not handled by config parser
+	annDontlogNormal, _ := GetValueFromAnnotations("dontlog-normal", c.cfg.ConfigMap.Annotations)
+	if annDontlogNormal != nil && annDontlogNormal.Status != EMPTY {
+		enabled, err := utils.GetBoolValue(annDontlogNormal.Value, "dontlog-normal")
+		if err == nil {
+			values := []string{}
+			if enabled {
+				values = append(values, "option dontlog-normal")
+			}
+			err = c.unprocessedSet(parser.Defaults, parser.DefaultSectionName, "option dontlog-normal", values)
 		}
-		log.Println("Removing default maxconn")
-	default:
-		err = config.Set(parser.Defaults, parser.DefaultSectionName, "maxconn", types.Int64C{
-			Value: value,
-		})
 		if err != nil {
-			utils.LogErr(err)
-			return false
+			utils.LogErr(fmt.Errorf("dontlog-normal annotation: %s", err))
+		} else {
+			logger.Infof("Setting dontlog-normal to %t", enabled)
+			reload = true
+		}
+	}
+
+	annSampling, _ := GetValueFromAnnotations("log-sampling", c.cfg.ConfigMap.Annotations)
+	if annSampling != nil && annSampling.Status != EMPTY {
+		sampling := logSampling{}
+		var err error
+		if annSampling.Status != DELETED {
+			sampling, err = parseLogSampling(annSampling.Value)
+		}
+		if err != nil {
+			utils.LogErr(fmt.Errorf("log-sampling annotation: %s", err))
+		} else if sampling != c.cfg.LogSampling {
+			c.cfg.LogSampling = sampling
+			c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
 		}
-		log.Println(fmt.Sprintf("Setting default maxconn to %d", value))
+	}
+	return reload
+}
+
+// log-tag annotation sets tag of syslog messages of HTTP and TCP traffic
+func (c *HAProxyController) handleDefaultLogTag() bool {
+	annLogTag, _ := GetValueFromAnnotations("log-tag", c.cfg.ConfigMap.Annotations)
+	if annLogTag == nil || annLogTag.Status == EMPTY {
+		return false
+	}
+	config, _ := c.ActiveConfiguration()
+	var err error
+	switch {
+	case annLogTag.Status == DELETED:
+		logger.Info("Removing default log-tag")
+		err = config.Set(parser.Defaults, parser.DefaultSectionName, "log-tag", nil)
+	case len(strings.Fields(annLogTag.Value)) != 1:
+		err = fmt.Errorf("incorrect value '%s', expected a single word", annLogTag.Value)
+	default:
+		logger.Infof("Setting default log-tag to %s", annLogTag.Value)
+		err = config.Set(parser.Defaults, parser.DefaultSectionName, "log-tag", types.StringC{
+			Value: annLogTag.Value,
+		})
+	}
+	if err != nil {
+		utils.LogErr(fmt.Errorf("log-tag annotation: %s", err))
+		return false
 	}
 	c.ActiveTransactionHasChanges = true
 	return true
 }
 
-func (c *HAProxyController) handleDefaultLogFormat() bool {
-	annLogFormat, _ := GetValueFromAnnotations("log-format", c.cfg.ConfigMap.Annotations)
-	if annLogFormat.Status == EMPTY {
+// Status codes HAProxy is able to generate, used by errorfile and deny_status
+var haproxyStatusCodes = map[string]struct{}{
+	"200": {}, "400": {}, "403": {}, "405": {}, "408": {}, "425": {},
+	"429": {}, "500": {}, "502": {}, "503": {}, "504": {},
+}
+
+func (c *HAProxyController) isErrorFilesConfigMap(namespace, name string) bool {
+	annotations := []MapStringW{c.cfg.ConfigMap.Annotations}
+	for _, ns := range c.cfg.Namespace {
+		for _, ingress := range ns.Ingresses {
+			annotations = append(annotations, ingress.Annotations)
+		}
+		for _, service := range ns.Services {
+			annotations = append(annotations, service.Annotations)
+		}
+	}
+	for _, annotation := range annotations {
+		if annErrorFiles, _ := GetValueFromAnnotations("errorfiles", annotation); annErrorFiles != nil && annErrorFiles.Value == namespace+"/"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if configmap referenced by <namespace>/<configmap> value of errorfiles annotation
+// changed since last sync
+func (c *HAProxyController) errorFilesChanged(value string) bool {
+	configMap := c.errorFilesConfigMap(value)
+	return configMap != nil && configMap.Status != EMPTY
+}
+
+// Return configmap referenced by <namespace>/<configmap> value of errorfiles annotation
+func (c *HAProxyController) errorFilesConfigMap(value string) *ConfigMap {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return nil
+	}
+	ns, ok := c.cfg.Namespace[parts[0]]
+	if !ok {
+		return nil
+	}
+	return ns.ConfigMaps[parts[1]]
+}
+
+// Return true if configmap is used as source list of blacklist or whitelist annotation,
+// or of whitelist of TCP services
+func (c *HAProxyController) isSourceListConfigMap(namespace, name string) bool {
+	annotations := []MapStringW{c.cfg.ConfigMap.Annotations}
+	for _, ns := range c.cfg.Namespace {
+		for _, ingress := range ns.Ingresses {
+			annotations = append(annotations, ingress.Annotations)
+		}
+	}
+	for _, annotation := range annotations {
+		for _, annName := range []string{"blacklist", "whitelist"} {
+			ann, _ := GetValueFromAnnotations(annName, annotation)
+			if ann == nil {
+				continue
+			}
+			if ref, ok := parseSourceRef(ann.Value); ok && ref.kind == "configmap" && ref.namespace == namespace && ref.name == name {
+				return true
+			}
+		}
+	}
+	if c.cfg.ConfigMapTCPServices != nil {
+		for _, entry := range c.cfg.ConfigMapTCPServices.Annotations {
+			svc, err := parseTCPService(entry.Value)
+			if err != nil {
+				continue
+			}
+			if ref, ok := parseSourceRef(svc.whitelist); ok && ref.kind == "configmap" && ref.namespace == namespace && ref.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleErrorFiles writes the content of the configmap referenced by
+// the errorfiles annotation into error files used in defaults section.
+func (c *HAProxyController) handleErrorFiles() bool {
+	annErrorFiles, _ := GetValueFromAnnotations("errorfiles", c.cfg.ConfigMap.Annotations)
+	if annErrorFiles == nil {
+		return false
+	}
+	configMap := c.errorFilesConfigMap(annErrorFiles.Value)
+	if annErrorFiles.Status == EMPTY && (configMap == nil || configMap.Status == EMPTY) {
 		return false
 	}
+
 	config, _ := c.ActiveConfiguration()
-	err := config.Set(parser.Defaults, parser.DefaultSectionName, "log-format", types.StringC{
-		Value: "'" + annLogFormat.Value + "'",
+	errorFiles := []types.ErrorFile{}
+	if annErrorFiles.Status == DELETED {
+		logger.Info("Removing errorfiles")
+	} else {
+		var err error
+		if errorFiles, err = c.writeErrorFiles(annErrorFiles.Value, HAProxyErrDir); err != nil {
+			utils.LogErr(fmt.Errorf("errorfiles annotation: %s", err))
+		}
+	}
+	if err := config.Set(parser.Defaults, parser.DefaultSectionName, "errorfile", errorFiles); err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	c.ActiveTransactionHasChanges = true
+	return true
+}
+
+// Write the content of the configmap referenced by <namespace>/<configmap> value
+// of an errorfiles annotation into <code>.http files of dir.
+func (c *HAProxyController) writeErrorFiles(value, dir string) ([]types.ErrorFile, error) {
+	errorFiles := []types.ErrorFile{}
+	if len(strings.Split(value, "/")) != 2 {
+		return errorFiles, fmt.Errorf("incorrect value '%s', expected <namespace>/<configmap>", value)
+	}
+	configMap := c.errorFilesConfigMap(value)
+	if configMap == nil || configMap.Status == DELETED {
+		return errorFiles, fmt.Errorf("configmap '%s' does not exist", value)
+	}
+	codes := []string{}
+	for code, content := range configMap.Annotations {
+		if content.Status == DELETED {
+			continue
+		}
+		if _, ok := haproxyStatusCodes[code]; !ok {
+			utils.LogErr(fmt.Errorf("errorfiles: unsupported HTTP status code '%s' in configmap '%s'", code, value))
+			continue
+		}
+		codes = append(codes, code)
+	}
+	if len(codes) == 0 {
+		return errorFiles, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errorFiles, err
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		file := filepath.Join(dir, code+".http")
+		if err := ioutil.WriteFile(file, []byte(configMap.Annotations[code].Value), 0644); err != nil {
+			utils.LogErr(err)
+			continue
+		}
+		errorFiles = append(errorFiles, types.ErrorFile{
+			Code: code,
+			File: file,
+		})
+	}
+	return errorFiles, nil
+}
+
+// Return error files referenced by errorfile directives of defaults section and backends
+func (c *HAProxyController) usedErrorFiles() map[string]struct{} {
+	used := map[string]struct{}{}
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return used
+	}
+	if data, errGet := config.Get(parser.Defaults, parser.DefaultSectionName, "errorfile"); errGet == nil {
+		if errorFiles, ok := data.([]types.ErrorFile); ok {
+			for _, errorFile := range errorFiles {
+				used[errorFile.File] = struct{}{}
+			}
+		}
+	}
+	backends, _ := config.SectionsGet(parser.Backends)
+	for _, backend := range backends {
+		data, errGet := config.Get(parser.Backends, backend, "")
+		if errGet != nil {
+			continue
+		}
+		for _, line := range data.([]types.UnProcessed) {
+			if fields := strings.Fields(line.Value); len(fields) == 3 && fields[0] == "errorfile" {
+				used[fields[2]] = struct{}{}
+			}
+		}
+	}
+	return used
+}
+
+var errorFileName = regexp.MustCompile(`^[0-9]{3}\.http$`)
+
+// Remove <code>.http files of errors directory, and of its backend subdirectories,
+// no longer referenced by the committed configuration. Other pages of the directory
+// such as default-404.http or no-endpoints.http are kept.
+func cleanErrorFiles(used map[string]struct{}) {
+	dirs := []string{}
+	err := filepath.Walk(HAProxyErrDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if file != HAProxyErrDir {
+				dirs = append(dirs, file)
+			}
+			return nil
+		}
+		if _, ok := used[file]; ok || !errorFileName.MatchString(info.Name()) {
+			return nil
+		}
+		logger.Debugf("Removing unused error file %s", file)
+		if errRemove := os.Remove(file); errRemove != nil {
+			utils.LogErr(errRemove)
+		}
+		return nil
 	})
 	if err != nil {
 		utils.LogErr(err)
+	}
+	// Empty subdirectories of removed backends, non empty ones fail to be removed
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+}
+
+func (c *HAProxyController) handleDefaultCompression() (reload bool) {
+	for _, name := range []string{"compression-algo", "compression-types"} {
+		ann, _ := GetValueFromAnnotations(name, c.cfg.ConfigMap.Annotations)
+		if ann == nil || ann.Status == EMPTY {
+			continue
+		}
+		value := ann.Value
+		if ann.Status == DELETED {
+			value = ""
+		}
+		if err := c.sectionCompression(parser.Defaults, parser.DefaultSectionName, name, value); err != nil {
+			utils.LogErr(fmt.Errorf("%s annotation: %s", name, err))
+			continue
+		}
+		reload = true
+	}
+	return reload
+}
+
+func (c *HAProxyController) handleDefaultConnectionMode() bool {
+	annMode, _ := GetValueFromAnnotations("http-connection-mode", c.cfg.ConfigMap.Annotations)
+	if annMode == nil || annMode.Status == EMPTY {
+		return false
+	}
+	mode := annMode.Value
+	if annMode.Status == DELETED {
+		// Back to HAProxy default
+		mode = "http-keep-alive"
+	}
+	if err := c.sectionConnectionMode(parser.Defaults, parser.DefaultSectionName, mode); err != nil {
+		utils.LogErr(fmt.Errorf("http-connection-mode annotation: %s", err))
 		return false
 	}
-	c.ActiveTransactionHasChanges = true
 	return true
 }
+
+// Stats frontend is a dedicated listener, it is managed from stats-* annotations
+// of the ConfigMap and compared to current configuration on every sync so that
+// changes of stats-auth secret are also applied.
+func (c *HAProxyController) handleStats() (reload bool) {
+	annEnable, _ := GetValueFromAnnotations("stats-enable", c.cfg.ConfigMap.Annotations)
+	annPort, _ := GetValueFromAnnotations("stats-port", c.cfg.ConfigMap.Annotations)
+	annURI, _ := GetValueFromAnnotations("stats-uri", c.cfg.ConfigMap.Annotations)
+	annAuth, _ := GetValueFromAnnotations("stats-auth", c.cfg.ConfigMap.Annotations)
+
+	_, errFrontend := c.frontendGet(statsFrontend)
+	exists := errFrontend == nil
+	if enabled, err := utils.GetBoolValue(annEnable.Value, "stats-enable"); err != nil || !enabled {
+		utils.LogErr(err)
+		if !exists {
+			return false
+		}
+		logger.Info("Removing stats frontend")
+		utils.LogErr(c.frontendDelete(statsFrontend))
+		return true
+	}
+
+	port, err := strconv.ParseInt(annPort.Value, 10, 64)
+	if err != nil || port < 1 || port > 65535 {
+		utils.LogErr(fmt.Errorf("stats-port annotation: incorrect value '%s'", annPort.Value))
+		return false
+	}
+	if frontend := c.frontendUsingPort(port); frontend != "" && frontend != statsFrontend {
+		utils.LogErr(fmt.Errorf("stats-port annotation: port %d already used by frontend '%s'", port, frontend))
+		return false
+	}
+	statsSettings := []types.StatsSettings{
+		&stats.OneWord{Name: "enable"},
+		&stats.URI{Prefix: annURI.Value},
+	}
+	if annAuth != nil && annAuth.Value != "" {
+		user, password, errAuth := c.statsCredentials(annAuth.Value)
+		if errAuth != nil {
+			utils.LogErr(fmt.Errorf("stats-auth annotation: %s", errAuth))
+			return false
+		}
+		statsSettings = append(statsSettings, &stats.Auth{User: user, Password: password})
+	}
+
+	if !exists {
+		logger.Infof("Creating stats frontend on port %d", port)
+		if err = c.frontendCreate(models.Frontend{
+			Name:       statsFrontend,
+			Mode:       "http",
+			HTTPUseHtx: "enabled",
+		}); err != nil {
+			utils.LogErr(err)
+			return false
+		}
+		utils.LogErr(c.unprocessedSet(parser.Frontends, statsFrontend, "http-request use-service prometheus-exporter",
+			[]string{"http-request use-service prometheus-exporter if { path /metrics }"}))
+		reload = true
+	}
+
+	binds, _ := c.frontendBindsGet(statsFrontend)
+	if len(binds) != 1 || binds[0].Port == nil || *binds[0].Port != port {
+		utils.LogErr(c.frontendBindDeleteAll(statsFrontend))
+		utils.LogErr(c.frontendBindCreate(statsFrontend, models.Bind{
+			Address: "0.0.0.0",
+			Port:    &port,
+			Name:    "bind_1",
+		}))
+		reload = true
+	}
+
+	config, _ := c.ActiveConfiguration()
+	current := []types.StatsSettings{}
+	if data, errGet := config.Get(parser.Frontends, statsFrontend, "stats"); errGet == nil {
+		current = data.([]types.StatsSettings)
+	}
+	// Keep other stats settings (like refresh) of the frontend
+	for _, setting := range current {
+		switch setting.(type) {
+		case *stats.URI, *stats.Auth:
+			continue
+		case *stats.OneWord:
+			if setting.(*stats.OneWord).Name == "enable" {
+				continue
+			}
+		}
+		statsSettings = append(statsSettings, setting)
+	}
+	if statsSettingsString(current) != statsSettingsString(statsSettings) {
+		if err = config.Set(parser.Frontends, statsFrontend, "stats", statsSettings); err != nil {
+			utils.LogErr(err)
+			return reload
+		}
+		c.ActiveTransactionHasChanges = true
+		reload = true
+	}
+	return reload
+}
+
+// Healthz frontend reflects HAProxy liveness to external load balancers, it is part of
+// the base configuration so it answers before any ingress exists. It has no backend,
+// only monitor-uri requests are answered and nothing is routed to tenant services.
+func (c *HAProxyController) handleHealthz() (reload bool) {
+	annPort, _ := GetValueFromAnnotations("healthz-bind-port", c.cfg.ConfigMap.Annotations)
+	port, err := strconv.ParseInt(annPort.Value, 10, 64)
+	if err != nil || port < 1 || port > 65535 {
+		utils.LogErr(fmt.Errorf("healthz-bind-port annotation: incorrect value '%s'", annPort.Value))
+		return false
+	}
+	if port == int64(c.osArgs.HealthzPort) {
+		utils.LogErr(fmt.Errorf("healthz-bind-port annotation: port %d already used by controller --healthz-port", port))
+		return false
+	}
+	if frontend := c.frontendUsingPort(port); frontend != "" && frontend != healthzFrontend {
+		utils.LogErr(fmt.Errorf("healthz-bind-port annotation: port %d already used by frontend '%s'", port, frontend))
+		return false
+	}
+
+	if _, errFrontend := c.frontendGet(healthzFrontend); errFrontend != nil {
+		logger.Infof("Creating healthz frontend on port %d", port)
+		if err = c.frontendCreate(models.Frontend{
+			Name: healthzFrontend,
+			Mode: "http",
+		}); err != nil {
+			utils.LogErr(err)
+			return false
+		}
+		reload = true
+	}
+
+	config, _ := c.ActiveConfiguration()
+	if data, errGet := config.Get(parser.Frontends, healthzFrontend, "monitor-uri"); errGet != nil || data.(*types.StringC).Value != "/healthz" {
+		if err = config.Set(parser.Frontends, healthzFrontend, "monitor-uri", &types.StringC{Value: "/healthz"}); err != nil {
+			utils.LogErr(err)
+			return reload
+		}
+		c.ActiveTransactionHasChanges = true
+		reload = true
+	}
+	found := false
+	if data, errGet := config.Get(parser.Frontends, healthzFrontend, ""); errGet == nil {
+		for _, line := range data.([]types.UnProcessed) {
+			found = found || line.Value == healthzMonitorFail
+		}
+	}
+	if !found {
+		utils.LogErr(c.unprocessedSet(parser.Frontends, healthzFrontend, "monitor fail", []string{healthzMonitorFail}))
+		reload = true
+	}
+
+	binds, _ := c.frontendBindsGet(healthzFrontend)
+	if len(binds) != 1 || binds[0].Port == nil || *binds[0].Port != port {
+		logger.Infof("Binding healthz frontend on port %d", port)
+		utils.LogErr(c.frontendBindDeleteAll(healthzFrontend))
+		utils.LogErr(c.frontendBindCreate(healthzFrontend, models.Bind{
+			Address: "0.0.0.0",
+			Port:    &port,
+			Name:    "bind_1",
+		}))
+		reload = true
+	}
+	return reload
+}
+
+// Return name of the frontend binding port, or empty string
+func (c *HAProxyController) frontendUsingPort(port int64) string {
+	frontends, err := c.frontendsGet()
+	if err != nil {
+		return ""
+	}
+	for _, frontend := range frontends {
+		for _, bind := range c.frontendBindsRaw(frontend.Name) {
+			if p, ok := bindPort(bind.Path); ok && p == port {
+				return frontend.Name
+			}
+		}
+	}
+	return ""
+}
+
+// stats-auth annotation is the <namespace>/<name> of a Secret with username and password keys
+func (c *HAProxyController) statsCredentials(value string) (user, password string, err error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("incorrect value '%s', expected <namespace>/<secret>", value)
+	}
+	ns, ok := c.cfg.Namespace[parts[0]]
+	if !ok {
+		return "", "", fmt.Errorf("namespace '%s' does not exist", parts[0])
+	}
+	secret, ok := ns.Secret[parts[1]]
+	if !ok || secret.Status == DELETED {
+		return "", "", fmt.Errorf("secret '%s' does not exist", value)
+	}
+	user = string(secret.Data["username"])
+	password = string(secret.Data["password"])
+	if user == "" || password == "" || strings.ContainsAny(user+password, ": \t") {
+		return "", "", fmt.Errorf("secret '%s' must have non empty 'username' and 'password' keys without ':' or spaces", value)
+	}
+	return user, password, nil
+}
+
+func statsSettingsString(settings []types.StatsSettings) string {
+	lines := make([]string, len(settings))
+	for i, setting := range settings {
+		lines[i] = setting.String()
+	}
+	return strings.Join(lines, "\n")
+}
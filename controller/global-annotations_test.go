@@ -0,0 +1,182 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/models"
+)
+
+// Each global option changed alone on the configuration shipped with the controller
+// requires either a restart, a reload, or only runtime API commands.
+func TestGlobalAnnotationsChanges(t *testing.T) {
+	cfg, err := ioutil.ReadFile("../fs/etc/haproxy/haproxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := HAProxyVersion
+	HAProxyVersion = [2]int{2, 0}
+	defer func() { HAProxyVersion = version }()
+
+	for _, test := range []struct {
+		annotation string
+		value      string
+		status     Status
+		restart    bool
+		reload     bool
+		runtime    bool
+	}{
+		{"nbthread", "1", ADDED, true, false, false},
+		{"cpu-map", "1/1 0", ADDED, true, false, false},
+		{"log-stdout", "true", ADDED, true, true, false},
+		{"syslog-server", "address:10.0.0.1, facility:local0", MODIFIED, false, true, false},
+		{"maxconn", "1000", ADDED, false, false, true},
+		{"maxconn", "1000", DELETED, false, true, false},
+		{"log-format", "%ci %ST", MODIFIED, false, true, false},
+		{"log-tag", "ingress", ADDED, false, true, false},
+		{"dontlognull", "false", MODIFIED, false, true, false},
+		{"dontlog-normal", "true", MODIFIED, false, true, false},
+		{"timeout-client", "30s", MODIFIED, false, true, false},
+		{"errorfiles", "default/errors", DELETED, false, true, false},
+		{"compression-algo", "gzip", ADDED, false, true, false},
+		{"http-connection-mode", "http-server-close", ADDED, false, true, false},
+		{"stats-port", "1025", MODIFIED, false, true, false},
+		{"healthz-bind-port", "1044", MODIFIED, false, true, false},
+		{"ssl-options", "no-sslv3", MODIFIED, false, true, false},
+		{"ssl-ciphers", "ECDHE-RSA-AES128-GCM-SHA256", MODIFIED, false, true, false},
+		{"dns-resolvers", "dns1 10.0.0.10:53", ADDED, false, true, false},
+		{"tune.bufsize", "32768", ADDED, false, true, false},
+		{"tune.ssl.default-dh-param", "4096", ADDED, false, true, false},
+		{"global-config-snippet", "tune.maxrewrite 2048", ADDED, false, true, false},
+	} {
+		c, cleanup := testControllerConfig(t, string(cfg))
+		c.cfg.ConfigMap.Annotations[test.annotation] = &StringW{Value: test.value, Status: test.status}
+		restart, reload := c.handleGlobalAnnotations()
+		runtime := len(c.cfg.MaxconnCommands) > 0
+		cleanup()
+		if restart != test.restart || reload != test.reload || runtime != test.runtime {
+			t.Errorf("%s %s: expected restart=%t reload=%t runtime=%t, got restart=%t reload=%t runtime=%t",
+				test.annotation, test.status, test.restart, test.reload, test.runtime, restart, reload, runtime)
+		}
+	}
+}
+
+func TestMaxconnCommands(t *testing.T) {
+	c, cleanup := testControllerConfig(t, `global
+defaults
+frontend http
+  bind :80
+frontend stats
+  bind :1024
+  maxconn 10
+`)
+	defer cleanup()
+	c.cfg.ConfigMap.Annotations["maxconn"] = &StringW{Value: "1000", Status: ADDED}
+	if reload := c.handleDefaultMaxconn(); reload {
+		t.Error("maxconn applied with runtime API: unexpected reload")
+	}
+	expected := []string{"set maxconn global 1000", "set maxconn frontend http 1000"}
+	if len(c.cfg.MaxconnCommands) != len(expected) {
+		t.Fatalf("expected commands %v, got %v", expected, c.cfg.MaxconnCommands)
+	}
+	for i, command := range expected {
+		if c.cfg.MaxconnCommands[i] != command {
+			t.Errorf("expected commands %v, got %v", expected, c.cfg.MaxconnCommands)
+		}
+	}
+	// Commands are only sent once the configuration is committed
+	if reload := c.runtimeMaxconn(); reload || c.cfg.MaxconnCommands != nil {
+		t.Errorf("runtime maxconn: expected commands sent without reload, got reload=%t %v", reload, c.cfg.MaxconnCommands)
+	}
+}
+
+// Error files of the errorfiles annotation of an ingress are written in a directory
+// of the backend, and error files no longer referenced are removed.
+func TestBackendErrorFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy-errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	errDir := HAProxyErrDir
+	HAProxyErrDir = dir
+	defer func() { HAProxyErrDir = errDir }()
+
+	c, cleanup := testControllerConfig(t, `global
+defaults
+backend default-app-80
+  mode http
+`)
+	defer cleanup()
+	c.cfg.Namespace["default"] = &Namespace{
+		Name: "default",
+		ConfigMaps: map[string]*ConfigMap{
+			"errors": {Namespace: "default", Name: "errors", Status: ADDED, Annotations: MapStringW{
+				"503": &StringW{Value: "HTTP/1.0 503 Service Unavailable\r\n\r\n", Status: ADDED},
+			}},
+		},
+	}
+	ingress := &Ingress{Namespace: "default", Name: "app", Annotations: MapStringW{
+		"errorfiles": &StringW{Value: "default/errors", Status: ADDED},
+	}}
+	service := &Service{Namespace: "default", Name: "app", Annotations: MapStringW{}}
+	backend := &models.Backend{Name: "default-app-80", Mode: "http"}
+	if !c.handleBackendAnnotations(ingress, service, backend, false) {
+		t.Fatal("errorfiles annotation: expected active annotation")
+	}
+	config, _ := c.ActiveConfiguration()
+	data, err := config.Get(parser.Backends, "default-app-80", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "default-app-80", "503.http")
+	lines := data.([]types.UnProcessed)
+	if len(lines) != 1 || lines[0].Value != "errorfile 503 "+file {
+		t.Errorf("expected 'errorfile 503 %s', got %v", file, lines)
+	}
+
+	// Code removed from the configmap of the defaults section, and pages of the controller
+	stale := filepath.Join(dir, "500.http")
+	for _, f := range []string{stale, filepath.Join(dir, "default-404.http"), filepath.Join(dir, "no-endpoints.http")} {
+		if err = ioutil.WriteFile(f, []byte(""), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanErrorFiles(c.usedErrorFiles())
+	for f, kept := range map[string]bool{
+		file:                                    true,
+		stale:                                   false,
+		filepath.Join(dir, "default-404.http"):  true,
+		filepath.Join(dir, "no-endpoints.http"): true,
+	} {
+		if _, err = os.Stat(f); (err == nil) != kept {
+			t.Errorf("%s: expected kept %t", f, kept)
+		}
+	}
+
+	// Annotation deleted: backend directory is removed
+	ingress.Annotations["errorfiles"].Status = DELETED
+	c.handleBackendAnnotations(ingress, service, backend, false)
+	cleanErrorFiles(c.usedErrorFiles())
+	if _, err = os.Stat(filepath.Dir(file)); !os.IsNotExist(err) {
+		t.Errorf("expected %s removed, got %v", filepath.Dir(file), err)
+	}
+}
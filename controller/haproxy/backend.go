@@ -16,6 +16,7 @@ package haproxy
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
@@ -105,3 +106,36 @@ func (b *Backend) UpdateHttpchk(value string) error {
 	b.Httpchk = val
 	return nil
 }
+
+func (b *Backend) UpdateQueueTimeout(value string) error {
+	val, err := utils.ParseTime(value)
+	if err != nil {
+		return fmt.Errorf("timeout queue: %s", err)
+	}
+	b.QueueTimeout = val
+	return nil
+}
+
+func (b *Backend) UpdateRedispatch(value string) error {
+	enabled, err := utils.GetBoolValue(value, "option-redispatch")
+	if err != nil {
+		return err
+	}
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+	b.Redispatch = &models.Redispatch{
+		Enabled: &state,
+	}
+	return nil
+}
+
+func (b *Backend) UpdateRetries(value string) error {
+	retries, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || retries < 0 {
+		return fmt.Errorf("retries: incorrect value '%s'", value)
+	}
+	b.Retries = &retries
+	return nil
+}
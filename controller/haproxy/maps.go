@@ -15,16 +15,20 @@
 package haproxy
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type Maps interface {
 	AppendHost(key uint64, host string)
 	Clean()
 	Modified(key uint64)
-	Refresh() (reload bool, err error)
+	Refresh() (changed []string, err error)
 }
 
 type mapFiles map[uint64]*mapFile
@@ -77,28 +81,75 @@ func (m mapFiles) Modified(key uint64) {
 	m[key].modified = true
 }
 
-func (m mapFiles) Refresh() (reload bool, err error) {
-	reload = false
+// Refresh writes modified map files, hosts are sorted so the same hosts always give
+// the same content. Exact hosts are written to the map file and wildcard ones, as regex
+// patterns (see HostPattern), to its wildcard file so exact hosts don't pay regex matching.
+// Both files exist as long as the map has hosts. Names of files whose content changed or
+// which were removed because they have no hosts are returned, HAProxy must be reloaded for them.
+func (m mapFiles) Refresh() (changed []string, err error) {
 	for key, mapFile := range m {
-		if mapFile.modified {
-			var f *os.File
-			filename := path.Join(mapDir, strconv.FormatUint(key, 10)) + ".lst"
-			hosts := ""
-			for _, host := range mapFile.hosts {
-				hosts += host + "\n"
+		if !mapFile.modified {
+			continue
+		}
+		filename := path.Join(mapDir, strconv.FormatUint(key, 10)) + ".lst"
+		exact := []string{}
+		wildcard := []string{}
+		for _, host := range mapFile.hosts {
+			if strings.HasPrefix(host, "*.") {
+				wildcard = append(wildcard, HostPattern(host))
+			} else {
+				exact = append(exact, strings.ToLower(host))
+			}
+		}
+		for file, patterns := range map[string][]string{filename: exact, WildcardMapFile(filename): wildcard} {
+			fileChanged, errFile := refreshFile(file, patterns, len(mapFile.hosts) > 0)
+			if errFile != nil {
+				err = errFile
 			}
-			if hosts == "" {
-				err = os.Remove(filename)
-				return reload, err
-			} else if f, err = os.Create(filename); err != nil {
-				return reload, err
+			if fileChanged {
+				changed = append(changed, path.Base(file))
 			}
-			defer f.Close()
-			if _, err = f.WriteString(hosts); err != nil {
-				return reload, err
+		}
+	}
+	sort.Strings(changed)
+	return changed, err
+}
+
+// Write sorted patterns to file, or remove it when it is no longer used
+func refreshFile(file string, patterns []string, used bool) (changed bool, err error) {
+	if !used {
+		if errRemove := os.Remove(file); errRemove != nil {
+			if os.IsNotExist(errRemove) {
+				return false, nil
 			}
-			reload = true
+			return false, errRemove
 		}
+		return true, nil
+	}
+	sort.Strings(patterns)
+	content := ""
+	if len(patterns) > 0 {
+		content = strings.Join(patterns, "\n") + "\n"
+	}
+	if current, errRead := ioutil.ReadFile(file); errRead == nil && string(current) == content {
+		return false, nil
+	}
+	if err = ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WildcardMapFile returns the file holding wildcard hosts of a map file
+func WildcardMapFile(file string) string {
+	return strings.TrimSuffix(file, ".lst") + "-wildcard.lst"
+}
+
+// HostPattern returns the regex used to match a hostname.
+// A leading "*." is converted to a wildcard matching exactly one label.
+func HostPattern(host string) string {
+	if strings.HasPrefix(host, "*.") {
+		return `^[^.]+\.` + regexp.QuoteMeta(strings.TrimPrefix(host, "*.")) + "$"
 	}
-	return reload, nil
+	return "^" + regexp.QuoteMeta(host) + "$"
 }
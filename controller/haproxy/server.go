@@ -15,6 +15,7 @@
 package haproxy
 
 import (
+	"fmt"
 	"strconv"
 
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
@@ -50,6 +51,11 @@ func (s *Server) UpdateMaxconn(value string) error {
 	if err != nil {
 		return err
 	}
+	// 0 means no limit
+	if maxconn == 0 {
+		s.Maxconn = nil
+		return nil
+	}
 	s.Maxconn = &maxconn
 	return nil
 }
@@ -68,3 +74,18 @@ func (s *Server) UpdateServerSsl(value string) error {
 	}
 	return nil
 }
+
+func (s *Server) UpdateSendProxy(value string) error {
+	s.SendProxy = ""
+	s.SendProxyV2 = ""
+	switch value {
+	case "", "disabled":
+	case "proxy", "proxy-v1":
+		s.SendProxy = "enabled"
+	case "proxy-v2":
+		s.SendProxyV2 = "enabled"
+	default:
+		return fmt.Errorf("send-proxy-protocol: unsupported value '%s'", value)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthState is written by SyncData and read by healthz handler
+type healthState struct {
+	mu            sync.Mutex
+	lastEvent     time.Time
+	lastUpdateErr error
+	synced        bool
+	rollbackErr   error
+	// consecutive failed commits, see commitFailuresUnhealthy
+	commitFailures int
+}
+
+func (h *healthState) eventProcessed() {
+	h.mu.Lock()
+	h.lastEvent = time.Now()
+	h.mu.Unlock()
+}
+
+func (h *healthState) updateDone(err error) {
+	h.mu.Lock()
+	h.lastUpdateErr = err
+	if err == nil {
+		h.synced = true
+		h.rollbackErr = nil
+	}
+	h.mu.Unlock()
+}
+
+func (h *healthState) commitDone(failures int) {
+	h.mu.Lock()
+	h.commitFailures = failures
+	h.mu.Unlock()
+}
+
+func (h *healthState) rollbackDone(err error) {
+	h.mu.Lock()
+	h.rollbackErr = err
+	h.mu.Unlock()
+}
+
+// Serve /healthz on --healthz-port, used for both liveness and readiness probes.
+func (c *HAProxyController) runHealthz() {
+	if c.osArgs.HealthzPort == 0 {
+		return
+	}
+	c.health.eventProcessed()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.healthzHandler)
+	go func() {
+		addr := fmt.Sprintf(":%d", c.osArgs.HealthzPort)
+		logger.Infof("Healthz endpoint listening on %s/healthz", addr)
+		logger.Error(http.ListenAndServe(addr, mux))
+	}()
+}
+
+func (c *HAProxyController) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	failures := []string{}
+	if !c.osArgs.Test {
+		if _, err := c.HAProxyProcess(); err != nil {
+			failures = append(failures, fmt.Sprintf("haproxy process: %s", err))
+		}
+	}
+	c.health.mu.Lock()
+	if c.health.lastUpdateErr != nil && !c.health.synced {
+		failures = append(failures, fmt.Sprintf("haproxy configuration: %s", c.health.lastUpdateErr))
+	}
+	if c.health.commitFailures >= commitFailuresUnhealthy {
+		failures = append(failures, fmt.Sprintf("haproxy configuration: %d consecutive commits failed: %s", c.health.commitFailures, c.health.lastUpdateErr))
+	}
+	if c.health.rollbackErr != nil {
+		failures = append(failures, fmt.Sprintf("haproxy configuration: restoring last valid configuration failed: %s", c.health.rollbackErr))
+	}
+	if idle := time.Since(c.health.lastEvent); idle > c.osArgs.HealthzStaleness {
+		failures = append(failures, fmt.Sprintf("event loop: no event processed for %s", idle.Round(time.Second)))
+	}
+	c.health.mu.Unlock()
+
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failures, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -15,21 +15,37 @@
 package controller
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 
+	"github.com/haproxytech/config-parser/v2/params"
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
 	"github.com/haproxytech/models"
 )
 
-func (c *HAProxyController) cleanCertDir(usedCerts map[string]struct{}) error {
+// Abstract socket chaining ssl-passthrough frontend to ssl-offload frontend,
+// it can't collide with ports of frontends
+const sslPassthroughSocket = "abns@https-offload"
+
+// Remove certificates not used by the last committed configuration, HAProxy keeps serving them
+// until reloaded. Files of the configured default certificate are kept even if its secret is missing.
+func (c *HAProxyController) cleanCertDir(usedCerts map[string]struct{}) (removed bool, err error) {
 	files, err := ioutil.ReadDir(HAProxyCertDir)
 	if err != nil {
-		return err
+		return false, err
+	}
+	defaultBundle := ""
+	if secretAnn, _ := GetValueFromAnnotations("ssl-certificate", c.cfg.ConfigMap.Annotations); secretAnn != nil {
+		if secretData := strings.Split(secretAnn.Value, "/"); len(secretData) == 2 {
+			defaultBundle = certificateBundle("0", Secret{Namespace: secretData[0], Name: secretData[1]})
+		}
 	}
 
 	for _, f := range files {
@@ -37,62 +53,137 @@ func (c *HAProxyController) cleanCertDir(usedCerts map[string]struct{}) error {
 			continue
 		}
 		filename := path.Join(HAProxyCertDir, f.Name())
-		_, isOK := usedCerts[filename]
-		if !isOK {
-			os.Remove(filename)
+		// OCSP responses and issuers of used certificates are kept
+		certificate := strings.TrimSuffix(strings.TrimSuffix(filename, ".ocsp"), ".issuer")
+		if _, isOK := usedCerts[certificate]; isOK {
+			continue
 		}
+		if defaultBundle != "" && strings.HasPrefix(filename, defaultBundle+".") {
+			continue
+		}
+		if err = os.Remove(filename); err != nil {
+			utils.LogErr(err)
+			continue
+		}
+		logger.Infof("Removed unused certificate %s", filename)
+		removed = true
 	}
-	return nil
+	return removed, nil
+}
+
+// Return PEM file content of key and certificate
+func certContent(filename string, key, crt []byte) []byte {
+	content := make([]byte, 0, len(key)+len(crt)+1)
+	content = append(content, key...)
+	//Force writing a newline so that parsing does not barf
+	if len(key) > 0 && key[len(key)-1] != byte('\n') {
+		logger.Warning("secret key in", filename, "does not end with \\n, appending it to avoid mangling key and certificate")
+		content = append(content, '\n')
+	}
+	return append(content, crt...)
 }
 
-func (c *HAProxyController) writeCert(filename string, key, crt []byte) error {
+func (c *HAProxyController) writeCert(filename string, content []byte) error {
 	var f *os.File
 	var err error
 	if f, err = os.Create(filename); err != nil {
-		log.Println(err)
+		logger.Error(err)
 		return err
 	}
 	defer f.Close()
-	if _, err = f.Write(key); err != nil {
-		log.Println(err)
-		return err
-	}
-	//Force writing a newline so that parsing does not barf
-	if len(key) > 0 && key[len(key)-1] != byte('\n') {
-		log.Println("Warning: secret key in", filename, "does not end with \\n, appending it to avoid mangling key and certificate")
-		if _, err = f.WriteString("\n"); err != nil {
-			log.Println(err)
-			return err
-		}
-	}
-	if _, err = f.Write(crt); err != nil {
-		log.Println(err)
+	if _, err = f.Write(content); err != nil {
+		logger.Error(err)
 		return err
 	}
 	if err = f.Sync(); err != nil {
-		log.Println(err)
+		logger.Error(err)
 		return err
 	}
 	if err = f.Close(); err != nil {
-		log.Println(err)
+		logger.Error(err)
 		return err
 	}
 	return nil
 }
 
+// Replace certificate loaded by HAProxy with runtime API (HAProxy 2.1 and later),
+// returns false when it must be reloaded instead
+func (c *HAProxyController) certRuntimeUpdate(filename string, content []byte) bool {
+	if c.osArgs.Test || !haproxyVersionAtLeast(2, 1) {
+		return false
+	}
+	// Payload ends with an empty line
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	result, err := c.NativeAPI.Runtime.ExecuteRaw(fmt.Sprintf("set ssl cert %s <<\n%s\n", filename, strings.Join(lines, "\n")))
+	if err != nil || len(result) == 0 || !strings.Contains(result[0], "Transaction") {
+		haproxyLogger.Warningf("Unable to update certificate %s with runtime API, reloading: %v %s", filename, err, strings.Join(result, " "))
+		return false
+	}
+	result, err = c.NativeAPI.Runtime.ExecuteRaw("commit ssl cert " + filename)
+	if err != nil || len(result) == 0 || !strings.Contains(result[0], "Success") {
+		haproxyLogger.Warningf("Unable to commit certificate %s with runtime API, reloading: %v %s", filename, err, strings.Join(result, " "))
+		_, _ = c.NativeAPI.Runtime.ExecuteRaw("abort ssl cert " + filename)
+		return false
+	}
+	haproxyLogger.Infof("Certificate %s updated with runtime API", filename)
+	return true
+}
+
+// Return key type of PEM certificate, HAProxy loads <name>.pem.rsa and <name>.pem.ecdsa
+// files as a bundle and selects the certificate according to ciphers supported by the client
+func certificateKeyType(crt []byte) string {
+	if block, _ := pem.Decode(crt); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil && cert.PublicKeyAlgorithm == x509.ECDSA {
+			return "ecdsa"
+		}
+	}
+	return "rsa"
+}
+
+// Return path of certificate bundle of secret, without key type extension
+func certificateBundle(ingressName string, secret Secret) string {
+	return path.Join(HAProxyCertDir, fmt.Sprintf("%s_%s_%s.pem", ingressName, secret.Namespace, secret.Name))
+}
+
 func (c *HAProxyController) handleSecret(ingress Ingress, secret Secret, writeSecret bool, certs map[string]struct{}) (reload bool) {
 	reload = false
-	for _, k := range []string{"tls", "rsa", "ecdsa"} {
+	bundle := certificateBundle(ingress.Name, secret)
+	written := map[string]struct{}{}
+	for _, k := range []string{"tls", "rsa", "ecdsa", "tls-ecdsa"} {
 		key, keyOk := secret.Data[k+".key"]
 		crt, crtOk := secret.Data[k+".crt"]
 		if keyOk && crtOk {
-			filename := path.Join(HAProxyCertDir, fmt.Sprintf("%s_%s_%s.pem.rsa", ingress.Name, secret.Namespace, secret.Name))
+			filename := bundle + "." + certificateKeyType(crt)
+			if _, ok := written[filename]; ok {
+				if writeSecret {
+					logger.Warningf("secret '%s/%s': ignoring %s.crt, it has the same key type as another certificate", secret.Namespace, secret.Name, k)
+				}
+				continue
+			}
+			written[filename] = struct{}{}
 			if writeSecret {
-				if err := c.writeCert(filename, key, crt); err != nil {
+				content := certContent(filename, key, crt)
+				current, errRead := ioutil.ReadFile(filename)
+				if errRead == nil && bytes.Equal(current, content) {
+					certs[filename] = struct{}{}
+					continue
+				}
+				if err := c.writeCert(filename, content); err != nil {
 					utils.LogErr(err)
 					return false
 				}
-				reload = true
+				// New certificates are only loaded by a reload
+				if errRead == nil && c.certRuntimeUpdate(filename, content) {
+					atomic.AddUint64(&c.metrics.certUpdatesRuntime, 1)
+				} else {
+					atomic.AddUint64(&c.metrics.certUpdatesReload, 1)
+					reload = true
+				}
 			}
 			certs[filename] = struct{}{}
 		}
@@ -100,28 +191,47 @@ func (c *HAProxyController) handleSecret(ingress Ingress, secret Secret, writeSe
 	return reload
 }
 
+// Default certificate is the <namespace>/<name> secret of ssl-certificate annotation or --default-ssl-certificate
 func (c *HAProxyController) handleDefaultCertificate(certs map[string]struct{}) (reload bool) {
+	defaultCert := ""
 	secretAnn, defSecretErr := GetValueFromAnnotations("ssl-certificate", c.cfg.ConfigMap.Annotations)
-	writeSecret := false
-	if defSecretErr == nil {
-		if secretAnn.Status != DELETED && secretAnn.Status != EMPTY {
-			writeSecret = true
-		}
+	if defSecretErr == nil && secretAnn.Status != DELETED && secretAnn.Value != "" {
+		writeSecret := secretAnn.Status != EMPTY
+		var secret *Secret
 		secretData := strings.Split(secretAnn.Value, "/")
-		namespace, namespaceOK := c.cfg.Namespace[secretData[0]]
-		if len(secretData) == 2 && namespaceOK {
-			secret, ok := namespace.Secret[secretData[1]]
-			if ok {
-				if secret.Status != EMPTY && secret.Status != DELETED {
-					writeSecret = true
-				}
-				return c.handleSecret(Ingress{
-					Name: "0",
-				}, *secret, writeSecret, certs)
+		if namespace, namespaceOK := c.cfg.Namespace[secretData[0]]; namespaceOK && len(secretData) == 2 {
+			secret = namespace.Secret[secretData[1]]
+		}
+		if secret == nil || secret.Status == DELETED {
+			if !c.cfg.DefaultCertMissing {
+				err := fmt.Errorf("default certificate secret '%s' does not exist, serving other certificates", secretAnn.Value)
+				utils.LogErr(err)
+				c.k8s.PodEvent(ReasonMissingSecret, err.Error())
+				c.cfg.DefaultCertMissing = true
+			}
+		} else {
+			c.cfg.DefaultCertMissing = false
+			if secret.Status != EMPTY {
+				writeSecret = true
+			}
+			reload = c.handleSecret(Ingress{
+				Name: "0",
+			}, *secret, writeSecret, certs)
+			// crt of a bundle path loads all its key types
+			bundle := certificateBundle("0", *secret)
+			_, rsa := certs[bundle+".rsa"]
+			_, ecdsa := certs[bundle+".ecdsa"]
+			if rsa || ecdsa {
+				defaultCert = bundle
 			}
 		}
 	}
-	return false
+	if defaultCert != c.cfg.DefaultCertificate {
+		logger.Infof("Default certificate: '%s'", defaultCert)
+		c.cfg.DefaultCertificate = defaultCert
+		reload = true
+	}
+	return reload
 }
 
 func (c *HAProxyController) handleTLSSecret(ingress Ingress, tls IngressTLS, certs map[string]struct{}) (reload bool) {
@@ -137,14 +247,16 @@ func (c *HAProxyController) handleTLSSecret(ingress Ingress, tls IngressTLS, cer
 	namespace, namespaceOK := c.cfg.Namespace[namespaceName]
 	if !namespaceOK {
 		if tls.Status != EMPTY {
-			log.Printf("namespace '%s' does not exist, ignoring.", namespaceName)
+			logger.Warningf("namespace '%s' does not exist, ignoring.", namespaceName)
+			c.k8s.IngressEvent(&ingress, ReasonMissingSecret, fmt.Sprintf("namespace '%s' of TLS secret does not exist", namespaceName))
 		}
 		return false
 	}
 	secret, secretOK := namespace.Secret[secretName]
 	if !secretOK {
 		if tls.Status != EMPTY {
-			log.Printf("secret '%s/%s' does not exist, ignoring.", namespaceName, secretName)
+			logger.Warningf("secret '%s/%s' does not exist, ignoring.", namespaceName, secretName)
+			c.k8s.IngressEvent(&ingress, ReasonMissingSecret, fmt.Sprintf("TLS secret '%s/%s' does not exist", namespaceName, secretName))
 		}
 		return false
 	}
@@ -158,65 +270,89 @@ func (c *HAProxyController) handleTLSSecret(ingress Ingress, tls IngressTLS, cer
 	return c.handleSecret(ingress, *secret, writeSecret, certs)
 }
 
-func (c *HAProxyController) handleHTTPS(usedCerts map[string]struct{}) (reload bool) {
-	// ssl-passthrough
-	if len(c.cfg.BackendSwitchingRules[FrontendSSL]) > 0 {
+// Return true if haproxy -vv output shows a TLS library supporting ALPN: LibreSSL or OpenSSL 1.0.2 and later
+func alpnSupported(info string) bool {
+	i := strings.Index(info, "Built with OpenSSL version : ")
+	if i < 0 {
+		return false
+	}
+	library := info[i+len("Built with OpenSSL version : "):]
+	if strings.HasPrefix(library, "LibreSSL") {
+		return true
+	}
+	var major, minor, patch int
+	if _, err := fmt.Sscanf(library, "OpenSSL %d.%d.%d", &major, &minor, &patch); err != nil {
+		return false
+	}
+	return major > 1 || (major == 1 && (minor > 0 || patch >= 2))
+}
+
+// Return true if HTTPS frontend negotiates HTTP/2 with ALPN
+func (c *HAProxyController) http2() bool {
+	annHTTP2, _ := GetValueFromAnnotations("http2", c.cfg.ConfigMap.Annotations)
+	enabled, err := utils.GetBoolValue(annHTTP2.Value, "http2")
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	return enabled && HAProxyALPN
+}
+
+func (c *HAProxyController) handleHTTPS(usedCerts map[string]struct{}, sslOptions string) (reload bool) {
+	// ssl-passthrough, SSL frontend also rejects SNI of sni-blacklist before TLS termination
+	if len(c.cfg.BackendSwitchingRules[FrontendSSL]) > 0 || len(c.cfg.SNIBlacklist) > 0 {
 		if !c.cfg.SSLPassthrough {
 			utils.PanicErr(c.enableSSLPassthrough())
 			c.cfg.SSLPassthrough = true
+			c.cfg.FrontendRulesStatus[TCP] = MODIFIED
 			reload = true
 		}
 	} else if c.cfg.SSLPassthrough {
 		utils.PanicErr(c.disableSSLPassthrough())
 		c.cfg.SSLPassthrough = false
+		c.cfg.FrontendRulesStatus[TCP] = MODIFIED
 		reload = true
 	}
 	// ssl-offload
+	// ssl parameters change with http2, ssl-options and default certificate
+	c.cfg.HTTPSOptions = sslOptions
 	if len(usedCerts) > 0 {
-		if !c.cfg.HTTPS {
-			utils.PanicErr(c.enableSSLOffload(FrontendHTTPS, true))
+		ssl := c.httpsBindParams()
+		if !c.cfg.HTTPS || bindParamsString(ssl) != c.cfg.HTTPSBindParams {
+			utils.PanicErr(c.enableSSLOffload(FrontendHTTPS, ssl))
 			c.cfg.HTTPS = true
+			c.cfg.HTTPSBindParams = bindParamsString(ssl)
 			reload = true
 		}
 	} else if c.cfg.HTTPS {
 		utils.PanicErr(c.disableSSLOffload(FrontendHTTPS))
 		c.cfg.HTTPS = false
+		c.cfg.HTTPSBindParams = ""
 		reload = true
 	}
-	//remove certs that are not needed
-	utils.LogErr(c.cleanCertDir(usedCerts))
-
 	return reload
 }
 
-func (c *HAProxyController) enableSSLOffload(frontendName string, alpn bool) (err error) {
-	binds, _ := c.frontendBindsGet(frontendName)
-	for _, bind := range binds {
-		bind.Ssl = true
-		bind.SslCertificate = HAProxyCertDir
-		if alpn {
-			bind.Alpn = "h2,http/1.1"
-		}
-		err = c.frontendBindEdit(frontendName, *bind)
-	}
-	if err != nil {
-		return err
-	}
-	return err
+// Return ssl parameters of bind lines, default certificate is loaded first so
+// HAProxy serves it to clients without SNI or with an unknown host
+func (c *HAProxyController) sslBindParams(alpn bool) []params.BindOption {
+	ssl := []params.BindOption{&params.BindOptionWord{Name: "ssl"}}
+	if c.cfg.DefaultCertificate != "" {
+		ssl = append(ssl, &params.BindOptionValue{Name: "crt", Value: c.cfg.DefaultCertificate})
+	}
+	ssl = append(ssl, &params.BindOptionValue{Name: "crt", Value: HAProxyCertDir})
+	if alpn {
+		ssl = append(ssl, &params.BindOptionValue{Name: "alpn", Value: "h2,http/1.1"})
+	}
+	return ssl
+}
+
+func (c *HAProxyController) enableSSLOffload(frontendName string, ssl []params.BindOption) (err error) {
+	return c.frontendBindsSSLSet(frontendName, ssl)
 }
 
 func (c *HAProxyController) disableSSLOffload(frontendName string) (err error) {
-	binds, _ := c.frontendBindsGet(frontendName)
-	for _, bind := range binds {
-		bind.Ssl = false
-		bind.SslCertificate = ""
-		bind.Alpn = ""
-		err = c.frontendBindEdit(frontendName, *bind)
-	}
-	if err != nil {
-		return err
-	}
-	return err
+	return c.frontendBindsSSLSet(frontendName, nil)
 }
 
 func (c *HAProxyController) enableSSLPassthrough() (err error) {
@@ -232,18 +368,7 @@ func (c *HAProxyController) enableSSLPassthrough() (err error) {
 	if err != nil {
 		return err
 	}
-	err = c.frontendBindCreate(FrontendSSL, models.Bind{
-		Address: "0.0.0.0:443",
-		Name:    "bind_1",
-	})
-	if err != nil {
-		return err
-	}
-	err = c.frontendBindCreate(FrontendSSL, models.Bind{
-		Address: ":::443",
-		Name:    "bind_2",
-		V4v6:    true,
-	})
+	_, err = c.frontendBindsSet(FrontendSSL, c.httpsPort(), nil)
 	if err != nil {
 		return err
 	}
@@ -285,9 +410,11 @@ func (c *HAProxyController) enableSSLPassthrough() (err error) {
 	if err != nil {
 		return err
 	}
+	// Client address is sent to HTTPS frontend with PROXY protocol
 	err = c.backendServerCreate(backendHTTPS, models.Server{
-		Name:    FrontendHTTPS,
-		Address: "127.0.0.1:8443",
+		Name:        FrontendHTTPS,
+		Address:     sslPassthroughSocket,
+		SendProxyV2: "enabled",
 	})
 	if err != nil {
 		return err
@@ -299,16 +426,15 @@ func (c *HAProxyController) enableSSLPassthrough() (err error) {
 		return err
 	}
 	err = c.frontendBindCreate(FrontendHTTPS, models.Bind{
-		Address: "127.0.0.1:8443",
-		Name:    "bind_1",
+		Address:     sslPassthroughSocket,
+		Name:        "bind_1",
+		AcceptProxy: true,
 	})
 	return err
 }
 
 func (c *HAProxyController) disableSSLPassthrough() (err error) {
-	var ssl bool
-	var sslCertificate string
-	var alpn string
+	var ssl []params.BindOption
 	backendHTTPS := "https"
 	err = c.frontendDelete(FrontendSSL)
 	if err != nil {
@@ -319,31 +445,8 @@ func (c *HAProxyController) disableSSLPassthrough() (err error) {
 		return err
 	}
 	if c.cfg.HTTPS {
-		ssl = true
-		sslCertificate = HAProxyCertDir
-		alpn = "h2,http/1.1"
-	} else {
-		ssl = false
-		sslCertificate = ""
-		alpn = ""
-	}
-	err = c.frontendBindEdit(FrontendHTTPS, models.Bind{
-		Address:        "0.0.0.0:443",
-		Name:           "bind_1",
-		Ssl:            ssl,
-		SslCertificate: sslCertificate,
-		Alpn:           alpn,
-	})
-	if err != nil {
-		return err
+		ssl = c.httpsBindParams()
 	}
-	err = c.frontendBindCreate(FrontendHTTPS, models.Bind{
-		Address:        ":::443",
-		Name:           "bind_2",
-		V4v6:           true,
-		Ssl:            ssl,
-		SslCertificate: sslCertificate,
-		Alpn:           alpn,
-	})
+	_, err = c.frontendBindsSet(FrontendHTTPS, c.httpsPort(), ssl)
 	return err
 }
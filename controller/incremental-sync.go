@@ -0,0 +1,113 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"strings"
+)
+
+// Return true if every ingress has to be handled again. ConfigMap annotations are
+// defaults of ingress and service annotations so they can affect any backend.
+func (c *HAProxyController) fullSyncRequired() bool {
+	if c.cfg.ConfigMap == nil || c.cfg.ConfigMap.Status != EMPTY {
+		return true
+	}
+	return annotationsChanged(c.cfg.ConfigMap.Annotations) || annotationsChanged(defaultAnnotationValues)
+}
+
+// Return true if backends of ingress have to be handled again: ingress, its rules,
+// paths or annotations, or services and endpoints they refer to changed since last sync.
+// Only handlePath is skipped for unchanged ingresses, handlers filling frontend rules
+// still run for all of them since these rules are rebuilt on each sync.
+func (c *HAProxyController) ingressChanged(namespace *Namespace, ingress *Ingress) bool {
+	if ingress.Status != EMPTY || ingress.ClassChanged || annotationsChanged(ingress.Annotations) {
+		return true
+	}
+	services := []string{}
+	if ingress.DefaultBackend != nil {
+		if ingress.DefaultBackend.Status != EMPTY {
+			return true
+		}
+		services = append(services, ingress.DefaultBackend.ServiceName)
+	}
+	for _, rule := range ingress.Rules {
+		if rule.Status != EMPTY {
+			return true
+		}
+		for _, path := range rule.Paths {
+			if path.Status != EMPTY {
+				return true
+			}
+			services = append(services, path.ServiceName)
+		}
+	}
+	for _, name := range []string{"canary-service", "route-service"} {
+		if ann, _ := GetValueFromAnnotations(name, ingress.Annotations); ann != nil {
+			services = append(services, strings.Split(ann.Value, ":")[0])
+		}
+	}
+	for _, name := range services {
+		if serviceChanged(namespace, name) {
+			return true
+		}
+	}
+	// Backend error files are written from a configmap
+	annotations := []MapStringW{ingress.Annotations}
+	for _, name := range services {
+		annotations = append(annotations, namespace.Services[name].Annotations)
+	}
+	for _, annotation := range annotations {
+		if ann, _ := GetValueFromAnnotations("errorfiles", annotation); ann != nil && c.errorFilesChanged(ann.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if service, its annotations or its endpoints changed since last sync.
+// A missing service is considered changed so errors keep being reported.
+func serviceChanged(namespace *Namespace, name string) bool {
+	service, ok := namespace.Services[name]
+	if !ok || service.Status != EMPTY || annotationsChanged(service.Annotations) {
+		return true
+	}
+	endpoints, ok := namespace.Endpoints[name]
+	if !ok {
+		return false
+	}
+	if endpoints.Status != EMPTY {
+		return true
+	}
+	for _, port := range *endpoints.Ports {
+		if port.Status != EMPTY {
+			return true
+		}
+	}
+	for _, ip := range *endpoints.Addresses {
+		if ip.Status != EMPTY {
+			return true
+		}
+	}
+	return false
+}
+
+func annotationsChanged(annotations MapStringW) bool {
+	for _, ann := range annotations {
+		if ann.Status != EMPTY {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	corev1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const benchmarkIngresses = 1000
+
+// Controller with ingresses app-0...app-<count> each routing a host to its own service
+// of two pods. Their backends are created and statuses cleaned as after a first sync.
+func testSyncedIngresses(b *testing.B, count int) (*HAProxyController, *Namespace, func()) {
+	b.Helper()
+	cfg, err := ioutil.ReadFile("../fs/etc/haproxy/haproxy.cfg")
+	if err != nil {
+		b.Fatal(err)
+	}
+	c, cleanup := testControllerConfig(b, string(cfg))
+	mapDir, err := ioutil.TempDir("", "haproxy-maps")
+	if err != nil {
+		b.Fatal(err)
+	}
+	configMap := c.cfg.ConfigMap
+	c.cfg.Init(utils.OSArgs{}, mapDir)
+	c.cfg.ConfigMap = configMap
+	ns := c.cfg.NewNamespace("default")
+	k := &K8s{}
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("app-%d", i)
+		ingress, errIng := k.convertToIngress(&extensions.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: extensions.IngressSpec{Rules: []extensions.IngressRule{{
+				Host: name + ".example.com",
+				IngressRuleValue: extensions.IngressRuleValue{HTTP: &extensions.HTTPIngressRuleValue{
+					Paths: []extensions.HTTPIngressPath{{
+						Path:    "/",
+						Backend: extensions.IngressBackend{ServiceName: name, ServicePort: intstr.FromInt(80)},
+					}},
+				}},
+			}}},
+		}, ADDED)
+		if errIng != nil {
+			b.Fatal(errIng)
+		}
+		ns.Ingresses[name] = ingress
+		ns.Services[name] = &Service{
+			Namespace:   "default",
+			Name:        name,
+			Ports:       []ServicePort{{Name: "http", Port: 80}},
+			Annotations: MapStringW{},
+			Status:      ADDED,
+		}
+		endpoints, errEp := k.convertToEndpoints(&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Subsets: []corev1.EndpointSubset{{
+				Ports: []corev1.EndpointPort{{Name: "http", Port: 8080}},
+				Addresses: []corev1.EndpointAddress{
+					{IP: fmt.Sprintf("10.%d.%d.1", i/256, i%256)},
+					{IP: fmt.Sprintf("10.%d.%d.2", i/256, i%256)},
+				},
+			}},
+		}, ADDED)
+		if errEp != nil {
+			b.Fatal(errEp)
+		}
+		ns.Endpoints[name] = endpoints
+		c.handleIngressBackends(ns, ingress)
+	}
+	if backends, errBackends := c.backendsGet(); errBackends != nil || len(backends) < count {
+		b.Fatalf("expected backends of %d ingresses, got %d, %v", count, len(backends), errBackends)
+	}
+	c.cfg.Clean()
+	return c, ns, func() {
+		cleanup()
+		os.RemoveAll(mapDir)
+	}
+}
+
+// Backends handled by a sync where a single ingress changed
+func benchmarkSync(b *testing.B, fullSync bool) {
+	c, ns, cleanup := testSyncedIngresses(b, benchmarkIngresses)
+	defer cleanup()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ns.Ingresses["app-0"].Status = MODIFIED
+		handled := 0
+		for _, ingress := range ns.Ingresses {
+			if fullSync || c.ingressChanged(ns, ingress) {
+				handled++
+				c.handleIngressBackends(ns, ingress)
+			}
+		}
+		expected := 1
+		if fullSync {
+			expected = benchmarkIngresses
+		}
+		if handled != expected {
+			b.Fatalf("expected %d handled ingresses, got %d", expected, handled)
+		}
+	}
+}
+
+func BenchmarkFullSync(b *testing.B) {
+	benchmarkSync(b, true)
+}
+
+func BenchmarkIncrementalSync(b *testing.B) {
+	benchmarkSync(b, false)
+}
@@ -17,29 +17,66 @@ package controller
 import (
 	"errors"
 	"fmt"
-	"log"
-	"net"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	//networking "k8s.io/api/networking/v1beta1"
 	extensions "k8s.io/api/extensions/v1beta1"
+	networking "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
-const DEBUG_API = false //nolint golint
-
 var ErrIgnored = errors.New("Ignored resource") //nolint golint
 
+// Informers resync every second and deliver updates of objects which did not change,
+// they keep their resourceVersion and don't need to be converted and compared.
+func unchangedResourceVersion(oldObj, newObj interface{}) bool {
+	data1, err := meta.Accessor(oldObj)
+	if err != nil {
+		return false
+	}
+	data2, err := meta.Accessor(newObj)
+	if err != nil {
+		return false
+	}
+	return data1.GetResourceVersion() != "" && data1.GetResourceVersion() == data2.GetResourceVersion()
+}
+
 //K8s is structure with all data required to synchronize with k8s
 type K8s struct {
-	API *kubernetes.Clientset
+	API               kubernetes.Interface
+	Dynamic           dynamic.Interface
+	IngressAPIVersion string
+	IngressClassAPI   bool
+	EndpointSliceAPI  bool
+	Recorder          record.EventRecorder
+	PodRef            *corev1.ObjectReference
+	// Informers stores, replayed on periodic resync
+	stores map[SyncType]cache.Store
+	// Pods are watched by namespace with namespace-whitelist, see EventsPods
+	podStores []cache.Store
+	// EndpointSlices indexed by service, merged into Endpoints
+	endpointSlices cache.Indexer
+}
+
+func (k *K8s) setStore(syncType SyncType, store cache.Store) {
+	if k.stores == nil {
+		k.stores = map[SyncType]cache.Store{}
+	}
+	k.stores[syncType] = store
 }
 
 //GetKubernetesClient returns new client that communicates with k8s
@@ -53,7 +90,11 @@ func GetKubernetesClient() (*K8s, error) {
 	if err != nil {
 		panic(err.Error())
 	}
-	return &K8s{API: clientset}, nil
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &K8s{API: clientset, Dynamic: dynamicClient}, nil
 }
 
 //GetRemoteKubernetesClient returns new client that communicates with k8s
@@ -71,16 +112,22 @@ func GetRemoteKubernetesClient(kubeconfig string) (*K8s, error) {
 	if err != nil {
 		panic(err.Error())
 	}
-	return &K8s{API: clientset}, nil
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &K8s{API: clientset, Dynamic: dynamicClient}, nil
 }
 
 func (k *K8s) EventsNamespaces(channel chan *Namespace, stop chan struct{}) {
-	watchlist := cache.NewListWatchFromClient(
-		k.API.CoreV1().RESTClient(),
-		string("namespaces"),
-		corev1.NamespaceAll,
-		fields.Everything(),
-	)
+	watchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return k.API.CoreV1().Namespaces().List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return k.API.CoreV1().Namespaces().Watch(options)
+		},
+	}
 	_, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
 		watchlist,
 		&corev1.Namespace{},
@@ -101,9 +148,7 @@ func (k *K8s) EventsNamespaces(channel chan *Namespace, stop chan struct{}) {
 					Secret:    make(map[string]*Secret),
 					Status:    status,
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", NAMESPACE, item.Status, item.Name)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", NAMESPACE, item.Status, item.Name)
 				channel <- item
 			},
 			DeleteFunc: func(obj interface{}) {
@@ -117,12 +162,13 @@ func (k *K8s) EventsNamespaces(channel chan *Namespace, stop chan struct{}) {
 					Secret:    make(map[string]*Secret),
 					Status:    status,
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", NAMESPACE, item.Status, item.Name)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", NAMESPACE, item.Status, item.Name)
 				channel <- item
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
+				if unchangedResourceVersion(oldObj, newObj) {
+					return
+				}
 				data1 := oldObj.(*corev1.Namespace)
 				data2 := newObj.(*corev1.Namespace)
 				var status = MODIFIED
@@ -137,9 +183,7 @@ func (k *K8s) EventsNamespaces(channel chan *Namespace, stop chan struct{}) {
 				if item1.Name == item2.Name {
 					return
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", SERVICE, item2.Status, item2.Name)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", SERVICE, item2.Status, item2.Name)
 				channel <- item2
 			},
 		},
@@ -148,13 +192,19 @@ func (k *K8s) EventsNamespaces(channel chan *Namespace, stop chan struct{}) {
 }
 
 func (k *K8s) EventsEndpoints(channel chan *Endpoints, stop chan struct{}) {
-	watchlist := cache.NewListWatchFromClient(
-		k.API.CoreV1().RESTClient(),
-		string("endpoints"),
-		corev1.NamespaceAll,
-		fields.Everything(),
-	)
-	_, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
+	if k.EndpointSliceAPI {
+		k.eventsEndpointSlices(channel, stop)
+		return
+	}
+	watchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return k.API.CoreV1().Endpoints(corev1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return k.API.CoreV1().Endpoints(corev1.NamespaceAll).Watch(options)
+		},
+	}
+	store, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
 		watchlist,
 		&corev1.Endpoints{},
 		1*time.Second, //Duration is int64
@@ -164,9 +214,7 @@ func (k *K8s) EventsEndpoints(channel chan *Endpoints, stop chan struct{}) {
 				if err == ErrIgnored {
 					return
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", ENDPOINTS, item.Status, item.Service)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", ENDPOINTS, item.Status, item.Service)
 				channel <- item
 			},
 			DeleteFunc: func(obj interface{}) {
@@ -174,12 +222,13 @@ func (k *K8s) EventsEndpoints(channel chan *Endpoints, stop chan struct{}) {
 				if err == ErrIgnored {
 					return
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", ENDPOINTS, item.Status, item.Service)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", ENDPOINTS, item.Status, item.Service)
 				channel <- item
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
+				if unchangedResourceVersion(oldObj, newObj) {
+					return
+				}
 				item1, err := k.convertToEndpoints(oldObj, EMPTY)
 				if err == ErrIgnored {
 					return
@@ -189,25 +238,31 @@ func (k *K8s) EventsEndpoints(channel chan *Endpoints, stop chan struct{}) {
 					return
 				}
 				//fix modified state for ones that are deleted,new,same
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", ENDPOINTS, item2.Status, item2.Service)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", ENDPOINTS, item2.Status, item2.Service)
 				channel <- item2
 			},
 		},
 	)
+	k.setStore(ENDPOINTS, store)
 	go controller.Run(stop)
 }
 
+// Endpoints of kube-system services updated for leader election are ignored
+func ignoredEndpoints(namespace, name string) bool {
+	if namespace != "kube-system" {
+		return false
+	}
+	switch name {
+	case "kube-controller-manager", "kube-scheduler", "kubernetes-dashboard", "kube-dns":
+		return true
+	}
+	return false
+}
+
 func (k *K8s) convertToEndpoints(obj interface{}, status Status) (*Endpoints, error) {
 	data := obj.(*corev1.Endpoints)
-	if data.GetNamespace() == "kube-system" {
-		if data.ObjectMeta.Name == "kube-controller-manager" ||
-			data.ObjectMeta.Name == "kube-scheduler" ||
-			data.ObjectMeta.Name == "kubernetes-dashboard" ||
-			data.ObjectMeta.Name == "kube-dns" {
-			return nil, ErrIgnored
-		}
+	if ignoredEndpoints(data.GetNamespace(), data.GetName()) {
+		return nil, ErrIgnored
 	}
 	if data.ObjectMeta.GetDeletionTimestamp() != nil {
 		//detect endpoints that are in terminating state
@@ -218,14 +273,23 @@ func (k *K8s) convertToEndpoints(obj interface{}, status Status) (*Endpoints, er
 		Service:   StringW{Value: data.GetName()},
 		Ports:     &EndpointPorts{},
 		Addresses: &EndpointIPs{},
+		NotReady:  map[string]struct{}{},
 		Status:    status,
 	}
 	for _, subset := range data.Subsets {
+		for _, address := range subset.NotReadyAddresses {
+			item.NotReady[address.IP] = struct{}{}
+		}
+		ports := make(map[string]int64, len(subset.Ports))
+		for _, port := range subset.Ports {
+			ports[port.Name] = int64(port.Port)
+		}
 		for _, address := range subset.Addresses {
 			eip := &EndpointIP{
 				IP:          address.IP,
 				HAProxyName: "",
 				Disabled:    false,
+				Ports:       ports,
 				Status:      status,
 			}
 			var key string
@@ -250,132 +314,237 @@ func (k *K8s) convertToEndpoints(obj interface{}, status Status) (*Endpoints, er
 }
 
 func (k *K8s) EventsIngresses(channel chan *Ingress, stop chan struct{}) {
-	watchlist := cache.NewListWatchFromClient(
-		k.API.ExtensionsV1beta1().RESTClient(),
-		string("ingresses"),
-		corev1.NamespaceAll,
-		fields.Everything(),
-	)
-	_, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
+	var watchlist cache.ListerWatcher
+	var objType runtime.Object
+	switch k.IngressAPIVersion {
+	case networking.SchemeGroupVersion.String():
+		// Typed client drops spec.ingressClassName, unknown to the client library in use
+		watchlist = k.dynamicListWatch(networking.SchemeGroupVersion.WithResource("ingresses"))
+		objType = &unstructured.Unstructured{}
+	default:
+		watchlist = &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return k.API.ExtensionsV1beta1().Ingresses(corev1.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return k.API.ExtensionsV1beta1().Ingresses(corev1.NamespaceAll).Watch(options)
+			},
+		}
+		objType = &extensions.Ingress{}
+	}
+	store, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
 		watchlist,
-		&extensions.Ingress{},
+		objType,
 		1*time.Second, //Duration is int64
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				data := obj.(*extensions.Ingress)
-				var status = ADDED
-				if data.ObjectMeta.GetDeletionTimestamp() != nil {
-					//detect services that are in terminating state
-					status = DELETED
-				}
-				item := &Ingress{
-					Namespace:      data.GetNamespace(),
-					Name:           data.GetName(),
-					Annotations:    ConvertToMapStringW(data.ObjectMeta.Annotations),
-					Rules:          ConvertIngressRules(data.Spec.Rules),
-					DefaultBackend: ConvertIngressBackend(data.Spec.Backend),
-					TLS:            ConvertIngressTLS(data.Spec.TLS),
-					Status:         status,
-				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", INGRESS, item.Status, item.Name)
+				item, err := k.convertToIngress(obj, ADDED)
+				if err == ErrIgnored {
+					return
 				}
+				k8sLogger.Debugf("%s %s: %s \n", INGRESS, item.Status, item.Name)
 				channel <- item
 			},
 			DeleteFunc: func(obj interface{}) {
-				data := obj.(*extensions.Ingress)
-				var status = DELETED
-				item := &Ingress{
-					Namespace:      data.GetNamespace(),
-					Name:           data.GetName(),
-					Annotations:    ConvertToMapStringW(data.ObjectMeta.Annotations),
-					Rules:          ConvertIngressRules(data.Spec.Rules),
-					DefaultBackend: ConvertIngressBackend(data.Spec.Backend),
-					TLS:            ConvertIngressTLS(data.Spec.TLS),
-					Status:         status,
-				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", INGRESS, item.Status, item.Name)
+				item, err := k.convertToIngress(obj, DELETED)
+				if err == ErrIgnored {
+					return
 				}
+				k8sLogger.Debugf("%s %s: %s \n", INGRESS, item.Status, item.Name)
 				channel <- item
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
-				data1 := oldObj.(*extensions.Ingress)
-				data2 := newObj.(*extensions.Ingress)
-				var status = MODIFIED
-				item1 := &Ingress{
-					Namespace:      data1.GetNamespace(),
-					Name:           data1.GetName(),
-					Annotations:    ConvertToMapStringW(data1.ObjectMeta.Annotations),
-					Rules:          ConvertIngressRules(data1.Spec.Rules),
-					DefaultBackend: ConvertIngressBackend(data1.Spec.Backend),
-					TLS:            ConvertIngressTLS(data1.Spec.TLS),
-					Status:         status,
-				}
-				item2 := &Ingress{
-					Namespace:      data2.GetNamespace(),
-					Name:           data2.GetName(),
-					Annotations:    ConvertToMapStringW(data2.ObjectMeta.Annotations),
-					Rules:          ConvertIngressRules(data2.Spec.Rules),
-					DefaultBackend: ConvertIngressBackend(data2.Spec.Backend),
-					TLS:            ConvertIngressTLS(data2.Spec.TLS),
-					Status:         status,
+				if unchangedResourceVersion(oldObj, newObj) {
+					return
 				}
-				if item2.Equal(item1) {
+				item1, err := k.convertToIngress(oldObj, MODIFIED)
+				if err == ErrIgnored {
 					return
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", INGRESS, item2.Status, item2.Name)
+				item2, err := k.convertToIngress(newObj, MODIFIED)
+				if err == ErrIgnored {
+					return
 				}
+				if item2.Equal(item1) {
+					return
+				}
+				k8sLogger.Debugf("%s %s: %s \n", INGRESS, item2.Status, item2.Name)
 				channel <- item2
 			},
 		},
 	)
+	k.setStore(INGRESS, store)
 	go controller.Run(stop)
 }
 
-func (k *K8s) EventsServices(channel chan *Service, stop chan struct{}, publishSvc *Service) {
-	watchlist := cache.NewListWatchFromClient(
-		k.API.CoreV1().RESTClient(),
-		string(corev1.ResourceServices),
-		corev1.NamespaceAll,
-		fields.Everything(),
-	)
+func (k *K8s) EventsIngressClasses(channel chan *IngressClass, stop chan struct{}) {
+	if !k.IngressClassAPI {
+		return
+	}
 	_, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
-		watchlist,
-		&corev1.Service{},
+		k.dynamicListWatch(networking.SchemeGroupVersion.WithResource("ingressclasses")),
+		&unstructured.Unstructured{},
 		1*time.Second, //Duration is int64
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				data := obj.(*corev1.Service)
-				var status = ADDED
-				if data.ObjectMeta.GetDeletionTimestamp() != nil {
-					//detect services that are in terminating state
-					status = DELETED
+				item := convertToIngressClass(obj.(*unstructured.Unstructured), ADDED)
+				k8sLogger.Debugf("%s %s: %s \n", INGRESS_CLASS, item.Status, item.Name)
+				channel <- item
+			},
+			DeleteFunc: func(obj interface{}) {
+				data, ok := obj.(*unstructured.Unstructured)
+				if !ok {
+					return
 				}
-				item := &Service{
-					Namespace:   data.GetNamespace(),
-					Name:        data.GetName(),
-					Annotations: ConvertToMapStringW(data.ObjectMeta.Annotations),
-					Selector:    ConvertToMapStringW(data.Spec.Selector),
-					Ports:       []ServicePort{},
-					Status:      status,
+				item := convertToIngressClass(data, DELETED)
+				k8sLogger.Debugf("%s %s: %s \n", INGRESS_CLASS, item.Status, item.Name)
+				channel <- item
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if unchangedResourceVersion(oldObj, newObj) {
+					return
 				}
-				for _, sp := range data.Spec.Ports {
-					item.Ports = append(item.Ports, ServicePort{
-						Name:     sp.Name,
-						Protocol: string(sp.Protocol),
-						Port:     int64(sp.Port),
-					})
+				item1 := convertToIngressClass(oldObj.(*unstructured.Unstructured), MODIFIED)
+				item2 := convertToIngressClass(newObj.(*unstructured.Unstructured), MODIFIED)
+				if *item1 == *item2 {
+					return
 				}
+				k8sLogger.Debugf("%s %s: %s \n", INGRESS_CLASS, item2.Status, item2.Name)
+				channel <- item2
+			},
+		},
+	)
+	go controller.Run(stop)
+}
+
+func (k *K8s) dynamicListWatch(resource schema.GroupVersionResource) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return k.Dynamic.Resource(resource).Namespace(corev1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return k.Dynamic.Resource(resource).Namespace(corev1.NamespaceAll).Watch(options)
+		},
+	}
+}
+
+func convertToIngressClass(data *unstructured.Unstructured, status Status) *IngressClass {
+	controller, _, _ := unstructured.NestedString(data.Object, "spec", "controller")
+	return &IngressClass{
+		Name:       data.GetName(),
+		Controller: controller,
+		Default:    data.GetAnnotations()["ingressclass.kubernetes.io/is-default-class"] == "true",
+		Status:     status,
+	}
+}
+
+func (k *K8s) convertToIngress(obj interface{}, status Status) (*Ingress, error) {
+	var data *extensions.Ingress
+	var className string
+	switch ingress := obj.(type) {
+	case *extensions.Ingress:
+		data = ingress
+	case *unstructured.Unstructured:
+		networkingIngress := &networking.Ingress{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(ingress.Object, networkingIngress); err != nil {
+			k8sLogger.Warningf("ingress %s/%s: %s", ingress.GetNamespace(), ingress.GetName(), err)
+			return nil, ErrIgnored
+		}
+		data = convertToExtensionsIngress(networkingIngress)
+		className, _, _ = unstructured.NestedString(ingress.Object, "spec", "ingressClassName")
+	default:
+		return nil, ErrIgnored
+	}
+	if status == ADDED && data.ObjectMeta.GetDeletionTimestamp() != nil {
+		//detect ingresses that are in terminating state
+		status = DELETED
+	}
+	return &Ingress{
+		Namespace:      data.GetNamespace(),
+		Name:           data.GetName(),
+		UID:            string(data.GetUID()),
+		Class:          className,
+		Annotations:    ConvertToMapStringW(data.ObjectMeta.Annotations),
+		Rules:          ConvertIngressRules(data.Spec.Rules),
+		DefaultBackend: ConvertIngressBackend(data.Spec.Backend),
+		TLS:            ConvertIngressTLS(data.Spec.TLS),
+		Status:         status,
+	}, nil
+}
+
+// SetIngressAPIVersion selects the best Ingress API group version served by the cluster.
+// networking.k8s.io/v1 is not known by the client library in use, so
+// networking.k8s.io/v1beta1 is preferred with a fallback to extensions/v1beta1.
+// IngressClass resources are watched only if served (Kubernetes 1.18+).
+func (k *K8s) SetIngressAPIVersion() {
+	k.IngressAPIVersion = extensions.SchemeGroupVersion.String()
+	resources, err := k.API.Discovery().ServerResourcesForGroupVersion(networking.SchemeGroupVersion.String())
+	if err != nil {
+		return
+	}
+	for _, resource := range resources.APIResources {
+		switch resource.Name {
+		case "ingresses":
+			k.IngressAPIVersion = networking.SchemeGroupVersion.String()
+		case "ingressclasses":
+			k.IngressClassAPI = true
+		}
+	}
+}
+
+// convertToExtensionsIngress copies networking.k8s.io objects into extensions ones,
+// both Ingress API versions have the same fields so conversion code is shared.
+func convertToExtensionsIngress(data *networking.Ingress) *extensions.Ingress {
+	ingress := &extensions.Ingress{
+		ObjectMeta: data.ObjectMeta,
+	}
+	if data.Spec.Backend != nil {
+		backend := extensions.IngressBackend(*data.Spec.Backend)
+		ingress.Spec.Backend = &backend
+	}
+	for _, tls := range data.Spec.TLS {
+		ingress.Spec.TLS = append(ingress.Spec.TLS, extensions.IngressTLS(tls))
+	}
+	for _, rule := range data.Spec.Rules {
+		extRule := extensions.IngressRule{Host: rule.Host}
+		if rule.HTTP != nil {
+			extRule.HTTP = &extensions.HTTPIngressRuleValue{}
+			for _, path := range rule.HTTP.Paths {
+				extRule.HTTP.Paths = append(extRule.HTTP.Paths, extensions.HTTPIngressPath{
+					Path:    path.Path,
+					Backend: extensions.IngressBackend(path.Backend),
+				})
+			}
+		}
+		ingress.Spec.Rules = append(ingress.Spec.Rules, extRule)
+	}
+	return ingress
+}
+
+func (k *K8s) EventsServices(channel chan *Service, publishSvcChan chan *Service, stop chan struct{}, publishSvc *Service) {
+	watchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return k.API.CoreV1().Services(corev1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return k.API.CoreV1().Services(corev1.NamespaceAll).Watch(options)
+		},
+	}
+	store, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
+		watchlist,
+		&corev1.Service{},
+		1*time.Second, //Duration is int64
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				data := obj.(*corev1.Service)
+				item := convertToService(data, ADDED)
+				status := item.Status
 				if publishSvc != nil {
 					if publishSvc.Namespace == item.Namespace && publishSvc.Name == item.Name {
-						k.GetPublishServiceAddresses(data, publishSvc)
+						publishSvcChan <- k.GetPublishServiceAddresses(data, status)
 					}
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", SERVICE, item.Status, item.Name)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", SERVICE, item.Status, item.Name)
 				channel <- item
 			},
 			DeleteFunc: func(obj interface{}) {
@@ -390,74 +559,80 @@ func (k *K8s) EventsServices(channel chan *Service, stop chan struct{}, publishS
 				}
 				if publishSvc != nil {
 					if publishSvc.Namespace == item.Namespace && publishSvc.Name == item.Name {
-						publishSvc.Status = DELETED
+						publishSvcChan <- &Service{Namespace: item.Namespace, Name: item.Name, Status: DELETED}
 					}
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", SERVICE, item.Status, item.Name)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", SERVICE, item.Status, item.Name)
 				channel <- item
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
+				if unchangedResourceVersion(oldObj, newObj) {
+					return
+				}
 				data1 := oldObj.(*corev1.Service)
 				data2 := newObj.(*corev1.Service)
 				var status = MODIFIED
-				item1 := &Service{
-					Namespace:   data1.GetNamespace(),
-					Name:        data1.GetName(),
-					Annotations: ConvertToMapStringW(data1.ObjectMeta.Annotations),
-					Selector:    ConvertToMapStringW(data1.Spec.Selector),
-					Ports:       []ServicePort{},
-					Status:      status,
-				}
-				for _, sp := range data1.Spec.Ports {
-					item1.Ports = append(item1.Ports, ServicePort{
-						Name:     sp.Name,
-						Protocol: string(sp.Protocol),
-						Port:     int64(sp.Port),
-					})
-				}
-
-				item2 := &Service{
-					Namespace:   data2.GetNamespace(),
-					Name:        data2.GetName(),
-					Annotations: ConvertToMapStringW(data2.ObjectMeta.Annotations),
-					Selector:    ConvertToMapStringW(data2.Spec.Selector),
-					Ports:       []ServicePort{},
-					Status:      status,
-				}
-				for _, sp := range data2.Spec.Ports {
-					item2.Ports = append(item2.Ports, ServicePort{
-						Name:     sp.Name,
-						Protocol: string(sp.Protocol),
-						Port:     int64(sp.Port),
-					})
-				}
-				if item2.Equal(item1) {
-					return
-				}
+				item1 := convertToService(data1, status)
+				item2 := convertToService(data2, status)
+				// LoadBalancer status of publish service is not part of Service equality
 				if publishSvc != nil {
 					if publishSvc.Namespace == item2.Namespace && publishSvc.Name == item2.Name {
-						k.GetPublishServiceAddresses(data2, publishSvc)
+						publishSvcChan <- k.GetPublishServiceAddresses(data2, status)
 					}
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", SERVICE, item2.Status, item2.Name)
+				if item2.Equal(item1) {
+					return
 				}
+				k8sLogger.Debugf("%s %s: %s \n", SERVICE, item2.Status, item2.Name)
 				channel <- item2
 			},
 		},
 	)
+	k.setStore(SERVICE, store)
 	go controller.Run(stop)
 }
 
+func convertToService(data *corev1.Service, status Status) *Service {
+	if status == ADDED && data.ObjectMeta.GetDeletionTimestamp() != nil {
+		//detect services that are in terminating state
+		status = DELETED
+	}
+	item := &Service{
+		Namespace:   data.GetNamespace(),
+		Name:        data.GetName(),
+		Annotations: ConvertToMapStringW(data.ObjectMeta.Annotations),
+		Selector:    ConvertToMapStringW(data.Spec.Selector),
+		Ports:       []ServicePort{},
+		Status:      status,
+	}
+	if data.Spec.Type == corev1.ServiceTypeExternalName {
+		item.ExternalName = data.Spec.ExternalName
+	}
+	if data.Spec.SessionAffinity == corev1.ServiceAffinityClientIP {
+		item.ClientIPAffinity = int64(corev1.DefaultClientIPServiceAffinitySeconds)
+		if config := data.Spec.SessionAffinityConfig; config != nil && config.ClientIP != nil && config.ClientIP.TimeoutSeconds != nil {
+			item.ClientIPAffinity = int64(*config.ClientIP.TimeoutSeconds)
+		}
+	}
+	for _, sp := range data.Spec.Ports {
+		item.Ports = append(item.Ports, ServicePort{
+			Name:     sp.Name,
+			Protocol: string(sp.Protocol),
+			Port:     int64(sp.Port),
+		})
+	}
+	return item
+}
+
 func (k *K8s) EventsConfigfMaps(channel chan *ConfigMap, stop chan struct{}) {
-	watchlist := cache.NewListWatchFromClient(
-		k.API.CoreV1().RESTClient(),
-		string(corev1.ResourceConfigMaps),
-		corev1.NamespaceAll,
-		fields.Everything(),
-	)
+	watchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return k.API.CoreV1().ConfigMaps(corev1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return k.API.CoreV1().ConfigMaps(corev1.NamespaceAll).Watch(options)
+		},
+	}
 	_, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
 		watchlist,
 		&corev1.ConfigMap{},
@@ -476,9 +651,7 @@ func (k *K8s) EventsConfigfMaps(channel chan *ConfigMap, stop chan struct{}) {
 					Annotations: ConvertToMapStringW(data.Data),
 					Status:      status,
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", CONFIGMAP, item.Status, item.Name)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", CONFIGMAP, item.Status, item.Name)
 				channel <- item
 			},
 			DeleteFunc: func(obj interface{}) {
@@ -490,12 +663,13 @@ func (k *K8s) EventsConfigfMaps(channel chan *ConfigMap, stop chan struct{}) {
 					Annotations: ConvertToMapStringW(data.Data),
 					Status:      status,
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", CONFIGMAP, item.Status, item.Name)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", CONFIGMAP, item.Status, item.Name)
 				channel <- item
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
+				if unchangedResourceVersion(oldObj, newObj) {
+					return
+				}
 				data1 := oldObj.(*corev1.ConfigMap)
 				data2 := newObj.(*corev1.ConfigMap)
 				var status = MODIFIED
@@ -514,9 +688,7 @@ func (k *K8s) EventsConfigfMaps(channel chan *ConfigMap, stop chan struct{}) {
 				if item2.Equal(item1) {
 					return
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", CONFIGMAP, item2.Status, item2.Name)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", CONFIGMAP, item2.Status, item2.Name)
 				channel <- item2
 			},
 		},
@@ -525,33 +697,22 @@ func (k *K8s) EventsConfigfMaps(channel chan *ConfigMap, stop chan struct{}) {
 }
 
 func (k *K8s) EventsSecrets(channel chan *Secret, stop chan struct{}) {
-	watchlist := cache.NewListWatchFromClient(
-		k.API.CoreV1().RESTClient(),
-		string(corev1.ResourceSecrets),
-		corev1.NamespaceAll,
-		fields.Everything(),
-	)
-	_, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
+	watchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return k.API.CoreV1().Secrets(corev1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return k.API.CoreV1().Secrets(corev1.NamespaceAll).Watch(options)
+		},
+	}
+	store, controller := cache.NewInformer( // also take a look at NewSharedIndexInformer
 		watchlist,
 		&corev1.Secret{},
 		1*time.Second, //Duration is int64
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				data := obj.(*corev1.Secret)
-				var status = ADDED
-				if data.ObjectMeta.GetDeletionTimestamp() != nil {
-					//detect services that are in terminating state
-					status = DELETED
-				}
-				item := &Secret{
-					Namespace: data.GetNamespace(),
-					Name:      data.GetName(),
-					Data:      data.Data,
-					Status:    status,
-				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", SECRET, item.Status, item.Name)
-				}
+				item := convertToSecret(obj.(*corev1.Secret), ADDED)
+				k8sLogger.Debugf("%s %s: %s \n", SECRET, item.Status, item.Name)
 				channel <- item
 			},
 			DeleteFunc: func(obj interface{}) {
@@ -563,12 +724,13 @@ func (k *K8s) EventsSecrets(channel chan *Secret, stop chan struct{}) {
 					Data:      data.Data,
 					Status:    status,
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", SECRET, item.Status, item.Name)
-				}
+				k8sLogger.Debugf("%s %s: %s \n", SECRET, item.Status, item.Name)
 				channel <- item
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
+				if unchangedResourceVersion(oldObj, newObj) {
+					return
+				}
 				data1 := oldObj.(*corev1.Secret)
 				data2 := newObj.(*corev1.Secret)
 				var status = MODIFIED
@@ -587,94 +749,265 @@ func (k *K8s) EventsSecrets(channel chan *Secret, stop chan struct{}) {
 				if item2.Equal(item1) {
 					return
 				}
-				if DEBUG_API {
-					log.Printf("%s %s: %s \n", SECRET, item2.Status, item2.Name)
+				k8sLogger.Debugf("%s %s: %s \n", SECRET, item2.Status, item2.Name)
+				channel <- item2
+			},
+		},
+	)
+	k.setStore(SECRET, store)
+	go controller.Run(stop)
+}
+
+func convertToSecret(data *corev1.Secret, status Status) *Secret {
+	if status == ADDED && data.ObjectMeta.GetDeletionTimestamp() != nil {
+		//detect secrets that are in terminating state
+		status = DELETED
+	}
+	return &Secret{
+		Namespace: data.GetNamespace(),
+		Name:      data.GetName(),
+		Data:      data.Data,
+		Status:    status,
+	}
+}
+
+// Pods are only watched for their labels, their readiness is followed through endpoints.
+// Pods of the cluster can be numerous: with namespaces, they are watched in each one of them,
+// otherwise excluded namespaces are filtered out by the API server. Terminated pods are
+// never in endpoints.
+func (k *K8s) EventsPods(channel chan *Pod, stop chan struct{}, namespaces, excluded []string) {
+	selectors := []fields.Selector{
+		fields.OneTermNotEqualSelector("status.phase", string(corev1.PodSucceeded)),
+		fields.OneTermNotEqualSelector("status.phase", string(corev1.PodFailed)),
+	}
+	if len(namespaces) == 0 {
+		for _, namespace := range excluded {
+			selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", namespace))
+		}
+		k.eventsPodsNamespace(channel, stop, corev1.NamespaceAll, fields.AndSelectors(selectors...).String())
+		return
+	}
+	for _, namespace := range namespaces {
+		k.eventsPodsNamespace(channel, stop, namespace, fields.AndSelectors(selectors...).String())
+	}
+}
+
+func (k *K8s) eventsPodsNamespace(channel chan *Pod, stop chan struct{}, namespace, fieldSelector string) {
+	watchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return k.API.CoreV1().Pods(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return k.API.CoreV1().Pods(namespace).Watch(options)
+		},
+	}
+	store, controller := cache.NewInformer(
+		watchlist,
+		&corev1.Pod{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				item := convertToPod(obj.(*corev1.Pod), ADDED)
+				k8sLogger.Debugf("%s %s: %s \n", POD, item.Status, item.Name)
+				channel <- item
+			},
+			DeleteFunc: func(obj interface{}) {
+				data, ok := obj.(*corev1.Pod)
+				if !ok {
+					tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+					if !ok {
+						return
+					}
+					if data, ok = tombstone.Obj.(*corev1.Pod); !ok {
+						return
+					}
 				}
+				item := convertToPod(data, DELETED)
+				k8sLogger.Debugf("%s %s: %s \n", POD, item.Status, item.Name)
+				channel <- item
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if unchangedResourceVersion(oldObj, newObj) {
+					return
+				}
+				item1 := convertToPod(oldObj.(*corev1.Pod), MODIFIED)
+				item2 := convertToPod(newObj.(*corev1.Pod), MODIFIED)
+				if item2.Equal(item1) {
+					return
+				}
+				k8sLogger.Debugf("%s %s: %s \n", POD, item2.Status, item2.Name)
 				channel <- item2
 			},
 		},
 	)
+	k.podStores = append(k.podStores, store)
 	go controller.Run(stop)
 }
 
+func convertToPod(data *corev1.Pod, status Status) *Pod {
+	pod := &Pod{
+		Namespace: data.GetNamespace(),
+		Name:      data.GetName(),
+		Labels:    data.GetLabels(),
+		Ports:     map[string]int64{},
+		Status:    status,
+	}
+	for _, container := range data.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name != "" {
+				pod.Ports[port.Name] = int64(port.ContainerPort)
+			}
+		}
+	}
+	return pod
+}
+
+// ScaleFromZero scales deployment to one replica if it has none, scaled is false when
+// it already has replicas.
+func (k *K8s) ScaleFromZero(namespace, name string) (scaled bool, err error) {
+	scale, err := k.API.AppsV1().Deployments(namespace).GetScale(name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	if scale.Spec.Replicas > 0 {
+		return false, nil
+	}
+	scale.Spec.Replicas = 1
+	_, err = k.API.AppsV1().Deployments(namespace).UpdateScale(name, scale)
+	return err == nil, err
+}
+
+// Status is only written when it differs, the resulting ingress update has the same
+// spec and is not synced again.
 func (k *K8s) UpdateIngressStatus(ingress *Ingress, publishSvc *Service) (err error) {
-	var ingSource *extensions.Ingress
-	var ingCopy extensions.Ingress
 	status := publishSvc.Status
 	lbi := []corev1.LoadBalancerIngress{}
-	if status == EMPTY {
+	if status == EMPTY || ingress.Status == DELETED {
 		if ingress.Status == EMPTY {
 			return nil
 		}
 		status = ingress.Status
 	}
 
-	// Get Ingress
-	if ingSource, err = k.API.ExtensionsV1beta1().Ingresses(ingress.Namespace).Get(ingress.Name, metav1.GetOptions{}); err != nil {
-		return fmt.Errorf("update ingress status: failed to get ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
-	}
-	ingCopy = *ingSource
-	ingCopy.Status = extensions.IngressStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: lbi}}
-	// Update addresses
+	// Update addresses, otherwise they are removed
 	if status == ADDED || status == MODIFIED {
-		for _, addr := range publishSvc.Addresses {
-			if net.ParseIP(addr) == nil {
-				lbi = append(lbi, corev1.LoadBalancerIngress{Hostname: addr})
-			} else {
-				lbi = append(lbi, corev1.LoadBalancerIngress{IP: addr})
-			}
+		lbi = append(lbi, publishSvc.Addresses...)
+	}
+	lbStatus := corev1.LoadBalancerStatus{Ingress: lbi}
+
+	switch k.IngressAPIVersion {
+	case networking.SchemeGroupVersion.String():
+		var ingSource *networking.Ingress
+		if ingSource, err = k.API.NetworkingV1beta1().Ingresses(ingress.Namespace).Get(ingress.Name, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("update ingress status: failed to get ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
+		}
+		if apiequality.Semantic.DeepEqual(ingSource.Status.LoadBalancer, lbStatus) {
+			return nil
+		}
+		ingCopy := *ingSource
+		ingCopy.Status = networking.IngressStatus{LoadBalancer: lbStatus}
+		_, err = k.API.NetworkingV1beta1().Ingresses(ingress.Namespace).UpdateStatus(&ingCopy)
+	default:
+		var ingSource *extensions.Ingress
+		if ingSource, err = k.API.ExtensionsV1beta1().Ingresses(ingress.Namespace).Get(ingress.Name, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("update ingress status: failed to get ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
+		}
+		if apiequality.Semantic.DeepEqual(ingSource.Status.LoadBalancer, lbStatus) {
+			return nil
 		}
-		ingCopy.Status = extensions.IngressStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: lbi}}
+		ingCopy := *ingSource
+		ingCopy.Status = extensions.IngressStatus{LoadBalancer: lbStatus}
+		_, err = k.API.ExtensionsV1beta1().Ingresses(ingress.Namespace).UpdateStatus(&ingCopy)
 	}
-	// Remove addresses
-	if _, err = k.API.ExtensionsV1beta1().Ingresses(ingress.Namespace).UpdateStatus(&ingCopy); err != nil {
+	if err != nil {
 		return fmt.Errorf("failed to update LoadBalancer status of ingress%s/%s: %v", ingress.Namespace, ingress.Name, err)
 	}
-	log.Printf("successful update of LoadBalancer status of ingress %s/%s", ingress.Namespace, ingress.Name)
+	k8sLogger.Infof("successful update of LoadBalancer status of ingress %s/%s", ingress.Namespace, ingress.Name)
 	return nil
 
 }
 
-func (k *K8s) GetPublishServiceAddresses(service *corev1.Service, publishSvc *Service) {
-	addresses := []string{}
+// RemoveIngressStatus removes publish service addresses from ingress status,
+// entries written by other controllers are kept.
+func (k *K8s) RemoveIngressStatus(ingress *Ingress, publishSvc *Service) (err error) {
+	filter := func(lbi []corev1.LoadBalancerIngress) []corev1.LoadBalancerIngress {
+		result := []corev1.LoadBalancerIngress{}
+		for _, entry := range lbi {
+			owned := false
+			for _, address := range publishSvc.Addresses {
+				if entry == address {
+					owned = true
+					break
+				}
+			}
+			if !owned {
+				result = append(result, entry)
+			}
+		}
+		return result
+	}
+
+	switch k.IngressAPIVersion {
+	case networking.SchemeGroupVersion.String():
+		var ingSource *networking.Ingress
+		if ingSource, err = k.API.NetworkingV1beta1().Ingresses(ingress.Namespace).Get(ingress.Name, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("remove ingress status: failed to get ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
+		}
+		ingCopy := *ingSource
+		ingCopy.Status.LoadBalancer.Ingress = filter(ingSource.Status.LoadBalancer.Ingress)
+		_, err = k.API.NetworkingV1beta1().Ingresses(ingress.Namespace).UpdateStatus(&ingCopy)
+	default:
+		var ingSource *extensions.Ingress
+		if ingSource, err = k.API.ExtensionsV1beta1().Ingresses(ingress.Namespace).Get(ingress.Name, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("remove ingress status: failed to get ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
+		}
+		ingCopy := *ingSource
+		ingCopy.Status.LoadBalancer.Ingress = filter(ingSource.Status.LoadBalancer.Ingress)
+		_, err = k.API.ExtensionsV1beta1().Ingresses(ingress.Namespace).UpdateStatus(&ingCopy)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove LoadBalancer status of ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
+	}
+	k8sLogger.Infof("removed LoadBalancer status of ingress %s/%s", ingress.Namespace, ingress.Name)
+	return nil
+}
+
+// GetPublishServiceAddresses returns publish service with the addresses to be written in ingresses status.
+// Hostname and IP of LoadBalancer entries are kept together so both end up in ingress status.
+func (k *K8s) GetPublishServiceAddresses(service *corev1.Service, status Status) *Service {
+	addresses := []corev1.LoadBalancerIngress{}
 	switch service.Spec.Type {
 	case corev1.ServiceTypeExternalName:
-		addresses = []string{service.Spec.ExternalName}
+		addresses = append(addresses, corev1.LoadBalancerIngress{Hostname: service.Spec.ExternalName})
 	case corev1.ServiceTypeClusterIP:
-		addresses = []string{service.Spec.ClusterIP}
+		addresses = append(addresses, corev1.LoadBalancerIngress{IP: service.Spec.ClusterIP})
 	case corev1.ServiceTypeNodePort:
 		if service.Spec.ExternalIPs != nil {
-			addresses = append(addresses, service.Spec.ExternalIPs...)
+			for _, ip := range service.Spec.ExternalIPs {
+				addresses = append(addresses, corev1.LoadBalancerIngress{IP: ip})
+			}
 		} else {
-			addresses = append(addresses, service.Spec.ClusterIP)
+			addresses = append(addresses, corev1.LoadBalancerIngress{IP: service.Spec.ClusterIP})
 		}
 	case corev1.ServiceTypeLoadBalancer:
-		for _, ip := range service.Status.LoadBalancer.Ingress {
-			if ip.IP == "" {
-				addresses = append(addresses, ip.Hostname)
-			} else {
-				addresses = append(addresses, ip.IP)
+		for _, lbi := range service.Status.LoadBalancer.Ingress {
+			if lbi.IP == "" && lbi.Hostname == "" {
+				continue
 			}
+			addresses = append(addresses, corev1.LoadBalancerIngress{IP: lbi.IP, Hostname: lbi.Hostname})
 		}
-		addresses = append(addresses, service.Spec.ExternalIPs...)
-	default:
-		log.Printf("Unable to extract IP address/es from service %v", service)
-		return
-	}
-
-	equal := false
-	if len(publishSvc.Addresses) == len(addresses) {
-		equal = true
-		for i, address := range publishSvc.Addresses {
-			if address != publishSvc.Addresses[i] {
-				equal = false
-				break
-			}
+		for _, ip := range service.Spec.ExternalIPs {
+			addresses = append(addresses, corev1.LoadBalancerIngress{IP: ip})
 		}
+	default:
+		k8sLogger.Warningf("Unable to extract IP address/es from service %s/%s", service.Namespace, service.Name)
 	}
-	if equal {
-		return
+	return &Service{
+		Namespace: service.Namespace,
+		Name:      service.Name,
+		Addresses: addresses,
+		Status:    status,
 	}
-	publishSvc.Addresses = addresses
-	publishSvc.Status = MODIFIED
 }
@@ -0,0 +1,112 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testIngress() *extensions.Ingress {
+	return &extensions.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "app",
+			UID:         "uid-app",
+			Annotations: map[string]string{"haproxy.org/timeout-server": "10s"},
+		},
+		Spec: extensions.IngressSpec{
+			Rules: []extensions.IngressRule{{
+				Host: "app.example.com",
+				IngressRuleValue: extensions.IngressRuleValue{HTTP: &extensions.HTTPIngressRuleValue{
+					Paths: []extensions.HTTPIngressPath{{
+						Path:    "/",
+						Backend: extensions.IngressBackend{ServiceName: "app", ServicePort: intstr.FromInt(80)},
+					}},
+				}},
+			}},
+		},
+	}
+}
+
+func updateActions(client *fake.Clientset) (count int) {
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			count++
+		}
+	}
+	return count
+}
+
+// The same ingress received twice, with the status the controller writes in between,
+// does not require any sync and so no reload.
+func TestIngressFedTwice(t *testing.T) {
+	client := fake.NewSimpleClientset(testIngress())
+	k := &K8s{API: client, IngressAPIVersion: extensions.SchemeGroupVersion.String()}
+	c := testController()
+	ns := &Namespace{Name: "default", Relevant: true, Ingresses: map[string]*Ingress{}, IgnoredIngresses: map[string]*Ingress{}}
+	c.cfg.Namespace[ns.Name] = ns
+
+	channel := make(chan *Ingress, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	k.EventsIngresses(channel, stop)
+	var ingress *Ingress
+	select {
+	case ingress = <-channel:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ingress not received")
+	}
+	if !c.eventIngress(ns, ingress) {
+		t.Fatal("added ingress: expected sync")
+	}
+
+	publishSvc := &Service{Status: ADDED, Addresses: []corev1.LoadBalancerIngress{{IP: "10.0.0.100"}}}
+	if err := k.UpdateIngressStatus(ingress, publishSvc); err != nil {
+		t.Fatal(err)
+	}
+	if updates := updateActions(client); updates != 1 {
+		t.Fatalf("expected one status update, got %d", updates)
+	}
+	// Informer resyncs every second, neither the status update nor resyncs are events
+	select {
+	case item := <-channel:
+		t.Errorf("unexpected %s event of ingress %s", item.Status, item.Name)
+	case <-time.After(2500 * time.Millisecond):
+	}
+	if err := k.UpdateIngressStatus(ingress, publishSvc); err != nil {
+		t.Fatal(err)
+	}
+	if updates := updateActions(client); updates != 1 {
+		t.Errorf("same status: expected no new update, got %d updates", updates)
+	}
+
+	same, err := k.convertToIngress(testIngress(), MODIFIED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.eventIngress(ns, same) {
+		t.Error("same ingress fed twice: unexpected sync")
+	}
+	if ns.Ingresses["app"].Status != ADDED {
+		t.Errorf("same ingress fed twice: expected status kept, got %s", ns.Ingresses["app"].Status)
+	}
+}
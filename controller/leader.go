@@ -0,0 +1,92 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Leader election only guards ingresses status updates,
+// every replica keeps configuring its own HAProxy.
+func (c *HAProxyController) runLeaderElection(ctx context.Context) {
+	if !c.osArgs.EnableLeaderElection {
+		atomic.StoreInt32(&c.leader, 1)
+		return
+	}
+	namespace := c.osArgs.LeaderElectionNS
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	identity, err := os.Hostname()
+	utils.PanicErr(err)
+	// ConfigMap lock is used since Lease objects are not available before Kubernetes 1.14
+	lock, err := resourcelock.New(resourcelock.ConfigMapsResourceLock, namespace, c.osArgs.LeaderElectionID,
+		c.k8s.API.CoreV1(), c.k8s.API.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	utils.PanicErr(err)
+	config := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				k8sLogger.Infof("Leader election: %s is leading, updating ingresses status", identity)
+				atomic.StoreInt32(&c.leaderResync, 1)
+				atomic.StoreInt32(&c.leader, 1)
+				// Status is written by the resync instead of waiting for the next change
+				if atomic.CompareAndSwapInt32(&c.resyncPending, 0, 1) {
+					c.eventChan <- SyncDataEvent{SyncType: RESYNC}
+				}
+			},
+			OnStoppedLeading: func() {
+				k8sLogger.Infof("Leader election: %s stopped leading", identity)
+				atomic.StoreInt32(&c.leader, 0)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					k8sLogger.Infof("Leader election: %s is the leader", leader)
+				}
+			},
+		},
+	}
+	k8sLogger.Infof("Leader election: using configmap %s/%s", namespace, c.osArgs.LeaderElectionID)
+	go func() {
+		// RunOrDie returns when leadership is lost, replica goes back to candidate
+		for ctx.Err() == nil {
+			leaderelection.RunOrDie(ctx, config)
+		}
+	}()
+}
+
+// Return true if ingresses status can be updated by this replica
+func (c *HAProxyController) isLeader() bool {
+	return atomic.LoadInt32(&c.leader) == 1
+}
+
+// Return true once after leadership is acquired, status of all ingresses has to be written
+func (c *HAProxyController) leaderResyncRequired() bool {
+	return atomic.CompareAndSwapInt32(&c.leaderResync, 1, 0)
+}
@@ -0,0 +1,46 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// A new leader requests a resync so ingresses status is written without waiting for a change
+func TestLeaderResync(t *testing.T) {
+	c := testController()
+	c.k8s = &K8s{API: fake.NewSimpleClientset()}
+	c.osArgs.EnableLeaderElection = true
+	c.eventChan = make(chan SyncDataEvent, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.runLeaderElection(ctx)
+
+	select {
+	case event := <-c.eventChan:
+		if event.SyncType != RESYNC {
+			t.Fatalf("expected RESYNC event, got %s", event.SyncType)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("leader elected: no resync requested")
+	}
+	if !c.isLeader() || !c.leaderResyncRequired() {
+		t.Error("leader elected: expected status of all ingresses to be written")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"net"
+	"os"
+)
+
+// UDP syslog listener relaying logs of HAProxy to controller stdout,
+// used by log-stdout annotation when HAProxy can't log to stdout (before 1.9)
+type syslogRelay struct {
+	conn net.PacketConn
+}
+
+func newSyslogRelay() (*syslogRelay, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	relay := &syslogRelay{conn: conn}
+	go relay.run()
+	return relay, nil
+}
+
+// Address HAProxy sends logs to
+func (r *syslogRelay) Address() string {
+	return r.conn.LocalAddr().String()
+}
+
+func (r *syslogRelay) Close() error {
+	return r.conn.Close()
+}
+
+func (r *syslogRelay) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			// Listener closed
+			return
+		}
+		os.Stdout.Write(append(syslogMessage(buf[:n]), '\n')) //nolint errcheck
+	}
+}
+
+// Remove priority of syslog message, "<134>Apr 22 ..." is printed "Apr 22 ..."
+func syslogMessage(data []byte) []byte {
+	if len(data) > 0 && data[0] == '<' {
+		if i := bytes.IndexByte(data, '>'); i > 0 && i <= 4 {
+			data = data[i+1:]
+		}
+	}
+	return bytes.TrimRight(data, "\r\n")
+}
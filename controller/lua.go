@@ -0,0 +1,170 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+const (
+	authRequestLuaFile   = "auth-request.lua"
+	scaleFromZeroLuaFile = "scale-from-zero.lua"
+)
+
+// Lua action used by auth-url annotation:
+//   http-request lua.auth-request <backend> <path>
+// Request headers are sent to the first available server of <backend>,
+// txn.auth_response is set to "ok" if it answers with 2xx and to "denied"
+// otherwise. Response headers are stored in req.auth_response_header.<name>.
+const authRequestLua = `-- Generated by HAProxy Ingress Controller
+
+local timeout = 5
+
+local function server_addr(backend)
+	local be = core.backends[backend]
+	if be == nil then
+		return nil
+	end
+	for _, server in pairs(be.servers) do
+		local status = server:get_stats()["status"]
+		if status == "no check" or (status ~= nil and status:sub(1, 2) == "UP") then
+			return server:get_addr()
+		end
+	end
+	return nil
+end
+
+local function var_name(header)
+	local name = header:lower():gsub("[^%w]", "_")
+	return "req.auth_response_header." .. name
+end
+
+core.register_action("auth-request", { "http-req" }, function(txn, backend, path)
+	txn:set_var("txn.auth_response", "denied")
+	local addr = server_addr(backend)
+	if addr == nil then
+		txn:Warning("auth-request: no server available in backend " .. backend)
+		return
+	end
+	local ip, port = addr:match("^(.*):(%d+)$")
+	local socket = core.tcp()
+	socket:settimeout(timeout)
+	if socket:connect(ip, tonumber(port)) == nil then
+		txn:Warning("auth-request: cannot connect to " .. addr)
+		return
+	end
+	local request = { "GET " .. path .. " HTTP/1.0" }
+	for name, values in pairs(txn.http:req_get_headers()) do
+		if name ~= "content-length" and name ~= "transfer-encoding" and name ~= "connection" then
+			for _, value in pairs(values) do
+				table.insert(request, name .. ": " .. value)
+			end
+		end
+	end
+	table.insert(request, "X-Original-Method: " .. txn.f:method())
+	table.insert(request, "X-Original-URI: " .. txn.f:url())
+	table.insert(request, "Connection: close")
+	socket:send(table.concat(request, "\r\n") .. "\r\n\r\n")
+	local line = socket:receive("*l")
+	local code = line and tonumber(line:match("^HTTP/%d%.%d (%d%d%d)"))
+	if code == nil or code < 200 or code > 299 then
+		socket:close()
+		return
+	end
+	line = socket:receive("*l")
+	while line ~= nil and line ~= "" do
+		local name, value = line:match("^([^:]+):%s*(.*)$")
+		if name ~= nil then
+			txn:set_var(var_name(name), value)
+		end
+		line = socket:receive("*l")
+	end
+	socket:close()
+	txn:set_var("txn.auth_response", "ok")
+end, 2)
+`
+
+// Lua action used by scale-from-zero annotation:
+//   http-request lua.wait-for-server <timeout> if { nbsrv eq 0 }
+// Request waits up to <timeout> milliseconds for a server of the backend.
+const scaleFromZeroLua = `-- Generated by HAProxy Ingress Controller
+
+local function now_ms()
+	local now = core.now()
+	return now.sec * 1000 + math.floor(now.usec / 1000)
+end
+
+core.register_action("wait-for-server", { "http-req" }, function(txn, timeout)
+	local deadline = now_ms() + tonumber(timeout)
+	while txn.f:nbsrv() == 0 and now_ms() < deadline do
+		core.msleep(100)
+	end
+end, 1)
+`
+
+// Write Lua scripts to HAProxyLuaDir, they are loaded only when in use.
+func writeLuaScripts() error {
+	if err := ioutil.WriteFile(filepath.Join(HAProxyLuaDir, authRequestLuaFile), []byte(authRequestLua), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(HAProxyLuaDir, scaleFromZeroLuaFile), []byte(scaleFromZeroLua), 0644)
+}
+
+// Load Lua scripts of auth-url and scale-from-zero annotations while they are in use.
+// Only lua-load lines of the controller scripts are changed, other ones belong to
+// global-config-snippet annotation.
+func (c *HAProxyController) refreshLuaLoad() (reload bool) {
+	luaLoad := map[string]bool{
+		"lua-load " + filepath.Join(HAProxyLuaDir, authRequestLuaFile):   len(c.cfg.FrontendAuthRequests) > 0,
+		"lua-load " + filepath.Join(HAProxyLuaDir, scaleFromZeroLuaFile): len(c.cfg.ScaleFromZero) > 0,
+	}
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	lines := []types.UnProcessed{}
+	loaded := map[string]bool{}
+	if data, errGet := config.Get(parser.Global, parser.GlobalSectionName, ""); errGet == nil {
+		for _, line := range data.([]types.UnProcessed) {
+			if inUse, ok := luaLoad[line.Value]; ok {
+				if !inUse {
+					reload = true
+					continue
+				}
+				loaded[line.Value] = true
+			}
+			lines = append(lines, line)
+		}
+	}
+	for _, file := range []string{authRequestLuaFile, scaleFromZeroLuaFile} {
+		line := "lua-load " + filepath.Join(HAProxyLuaDir, file)
+		if luaLoad[line] && !loaded[line] {
+			lines = append(lines, types.UnProcessed{Value: line})
+			reload = true
+		}
+	}
+	if !reload {
+		return false
+	}
+	c.ActiveTransactionHasChanges = true
+	utils.LogErr(config.Set(parser.Global, parser.GlobalSectionName, "", lines))
+	return true
+}
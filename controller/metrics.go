@@ -0,0 +1,178 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Same buckets as Prometheus client default ones
+var syncDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// controllerMetrics are exposed in Prometheus text format on --metrics-port
+type controllerMetrics struct {
+	reloads              uint64
+	restarts             uint64
+	reloadsRateLimited   uint64
+	serverUpdatesRuntime uint64
+	serverUpdatesReload  uint64
+	serversDrained       uint64
+	serversRemoved       uint64
+	certUpdatesRuntime   uint64
+	certUpdatesReload    uint64
+	syncSuccess          uint64
+	syncError            uint64
+	managedIngresses     int64
+	managedBackends      int64
+	commitFailures       int64
+	rollbacks            uint64
+	mu                   sync.Mutex
+	syncBuckets          []uint64
+	syncCount            uint64
+	syncSum              float64
+	reloadReasons        map[string]uint64
+}
+
+func (m *controllerMetrics) syncDone(duration time.Duration, err error) {
+	if err != nil {
+		atomic.AddUint64(&m.syncError, 1)
+	} else {
+		atomic.AddUint64(&m.syncSuccess, 1)
+	}
+	seconds := duration.Seconds()
+	m.mu.Lock()
+	if m.syncBuckets == nil {
+		m.syncBuckets = make([]uint64, len(syncDurationBuckets))
+	}
+	for i, bucket := range syncDurationBuckets {
+		if seconds <= bucket {
+			m.syncBuckets[i]++
+		}
+	}
+	m.syncCount++
+	m.syncSum += seconds
+	m.mu.Unlock()
+}
+
+func (m *controllerMetrics) haproxyAction(action string) {
+	switch action {
+	case "reload":
+		atomic.AddUint64(&m.reloads, 1)
+	case "restart":
+		atomic.AddUint64(&m.restarts, 1)
+	}
+}
+
+// Count reasons of a HAProxy reload
+func (m *controllerMetrics) reloadDone(reasons []string) {
+	m.mu.Lock()
+	if m.reloadReasons == nil {
+		m.reloadReasons = make(map[string]uint64)
+	}
+	for _, reason := range reasons {
+		m.reloadReasons[reason]++
+	}
+	m.mu.Unlock()
+}
+
+// Serve /metrics on --metrics-port, disabled when port is 0.
+func (c *HAProxyController) runMetrics() {
+	if c.osArgs.MetricsPort == 0 {
+		return
+	}
+	c.statsFilter = statsMetricsFilter(c.osArgs.StatsMetrics)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", c.metricsHandler)
+	go func() {
+		addr := fmt.Sprintf(":%d", c.osArgs.MetricsPort)
+		logger.Infof("Metrics endpoint listening on %s/metrics", addr)
+		logger.Error(http.ListenAndServe(addr, mux))
+	}()
+}
+
+func (c *HAProxyController) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	m := &c.metrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "haproxy_ingress_reloads_total", "counter", "Number of HAProxy reloads.")
+	fmt.Fprintf(w, "haproxy_ingress_reloads_total %d\n", atomic.LoadUint64(&m.reloads))
+	writeMetric(w, "haproxy_ingress_reload_reasons_total", "counter", "Number of HAProxy reloads by reason, a reload can have several reasons.")
+	m.mu.Lock()
+	reasons := make([]string, 0, len(m.reloadReasons))
+	for reason := range m.reloadReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "haproxy_ingress_reload_reasons_total{reason=\"%s\"} %d\n", reason, m.reloadReasons[reason])
+	}
+	m.mu.Unlock()
+	writeMetric(w, "haproxy_ingress_reloads_rate_limited_total", "counter", "Number of syncs whose HAProxy reload was deferred by --reload-interval.")
+	fmt.Fprintf(w, "haproxy_ingress_reloads_rate_limited_total %d\n", atomic.LoadUint64(&m.reloadsRateLimited))
+	writeMetric(w, "haproxy_ingress_restarts_total", "counter", "Number of HAProxy restarts.")
+	fmt.Fprintf(w, "haproxy_ingress_restarts_total %d\n", atomic.LoadUint64(&m.restarts))
+	writeMetric(w, "haproxy_ingress_server_updates_total", "counter", "Number of backend server updates by the way they were applied.")
+	fmt.Fprintf(w, "haproxy_ingress_server_updates_total{applied=\"runtime\"} %d\n", atomic.LoadUint64(&m.serverUpdatesRuntime))
+	fmt.Fprintf(w, "haproxy_ingress_server_updates_total{applied=\"reload\"} %d\n", atomic.LoadUint64(&m.serverUpdatesReload))
+	writeMetric(w, "haproxy_ingress_server_removals_total", "counter", "Number of servers of removed pods by the way they were removed.")
+	fmt.Fprintf(w, "haproxy_ingress_server_removals_total{mode=\"drain\"} %d\n", atomic.LoadUint64(&m.serversDrained))
+	fmt.Fprintf(w, "haproxy_ingress_server_removals_total{mode=\"hard\"} %d\n", atomic.LoadUint64(&m.serversRemoved))
+	writeMetric(w, "haproxy_ingress_certificate_updates_total", "counter", "Number of certificate file updates by the way they were applied.")
+	fmt.Fprintf(w, "haproxy_ingress_certificate_updates_total{applied=\"runtime\"} %d\n", atomic.LoadUint64(&m.certUpdatesRuntime))
+	fmt.Fprintf(w, "haproxy_ingress_certificate_updates_total{applied=\"reload\"} %d\n", atomic.LoadUint64(&m.certUpdatesReload))
+	writeMetric(w, "haproxy_ingress_sync_total", "counter", "Number of HAProxy configuration syncs by result.")
+	fmt.Fprintf(w, "haproxy_ingress_sync_total{result=\"success\"} %d\n", atomic.LoadUint64(&m.syncSuccess))
+	fmt.Fprintf(w, "haproxy_ingress_sync_total{result=\"error\"} %d\n", atomic.LoadUint64(&m.syncError))
+
+	writeMetric(w, "haproxy_ingress_sync_duration_seconds", "histogram", "Duration of HAProxy configuration syncs.")
+	m.mu.Lock()
+	for i, bucket := range syncDurationBuckets {
+		var count uint64
+		if m.syncBuckets != nil {
+			count = m.syncBuckets[i]
+		}
+		fmt.Fprintf(w, "haproxy_ingress_sync_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bucket, 'g', -1, 64), count)
+	}
+	fmt.Fprintf(w, "haproxy_ingress_sync_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.syncCount)
+	fmt.Fprintf(w, "haproxy_ingress_sync_duration_seconds_sum %s\n", strconv.FormatFloat(m.syncSum, 'g', -1, 64))
+	fmt.Fprintf(w, "haproxy_ingress_sync_duration_seconds_count %d\n", m.syncCount)
+	m.mu.Unlock()
+
+	writeMetric(w, "haproxy_ingress_managed_ingresses", "gauge", "Number of ingresses handled at last sync.")
+	fmt.Fprintf(w, "haproxy_ingress_managed_ingresses %d\n", atomic.LoadInt64(&m.managedIngresses))
+	writeMetric(w, "haproxy_ingress_managed_backends", "gauge", "Number of backends in HAProxy configuration at last sync.")
+	fmt.Fprintf(w, "haproxy_ingress_managed_backends %d\n", atomic.LoadInt64(&m.managedBackends))
+	writeMetric(w, "haproxy_ingress_commit_failures", "gauge", "Number of consecutive failed HAProxy configuration commits.")
+	fmt.Fprintf(w, "haproxy_ingress_commit_failures %d\n", atomic.LoadInt64(&m.commitFailures))
+	writeMetric(w, "haproxy_ingress_config_rollbacks_total", "counter", "Number of times last valid HAProxy configuration was restored.")
+	fmt.Fprintf(w, "haproxy_ingress_config_rollbacks_total %d\n", atomic.LoadUint64(&m.rollbacks))
+	writeMetric(w, "haproxy_ingress_event_queue_length", "gauge", "Number of events waiting to be processed.")
+	fmt.Fprintf(w, "haproxy_ingress_event_queue_length %d\n", len(c.eventChan))
+
+	if c.statsFilter != nil {
+		c.writeStatsMetrics(w)
+	}
+}
+
+func writeMetric(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
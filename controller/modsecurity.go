@@ -0,0 +1,170 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	"github.com/haproxytech/models"
+)
+
+// Backend of ModSecurity SPOE agents, SPOE engine and group of frontends
+const (
+	modsecAgentBackend = "spoe-modsecurity"
+	modsecEngine       = "modsecurity"
+	modsecGroup        = "check-request"
+)
+
+// SPOE configuration of ModSecurity agent, it sets txn.modsec.code to the
+// status code of a request to block. Requests are processed normally on
+// agent errors and timeouts.
+var modsecSPOEConfig = fmt.Sprintf(`[%s]
+spoe-agent modsecurity-agent
+    groups %s
+    option var-prefix modsec
+    option continue-on-error
+    timeout hello 100ms
+    timeout idle 30s
+    timeout processing 1s
+    use-backend %s
+
+spoe-message check-request
+    args unique-id method path query req.ver req.hdrs_bin req.body_size req.body
+
+spoe-group %s
+    messages check-request
+`, modsecEngine, modsecGroup, modsecAgentBackend, modsecGroup)
+
+// Addresses of ModSecurity agents when modsecurity-enabled ConfigMap annotation
+// is set, nil when ModSecurity is not available. Errors are logged when annotations change.
+func (c *HAProxyController) modsecAgents() []string {
+	annEnabled, _ := GetValueFromAnnotations("modsecurity-enabled", c.cfg.ConfigMap.Annotations)
+	annEndpoints, _ := GetValueFromAnnotations("modsecurity-endpoints", c.cfg.ConfigMap.Annotations)
+	changed := annEnabled.Status != EMPTY || (annEndpoints != nil && annEndpoints.Status != EMPTY)
+	enabled, err := utils.GetBoolValue(annEnabled.Value, "modsecurity-enabled")
+	if err != nil || !enabled {
+		if changed {
+			utils.LogErr(err)
+		}
+		return nil
+	}
+	value := ""
+	if annEndpoints != nil && annEndpoints.Status != DELETED {
+		value = annEndpoints.Value
+	}
+	addresses, err := spoeAgentAddresses(value)
+	if err == nil && len(addresses) == 0 {
+		err = fmt.Errorf("no address")
+	}
+	if err != nil {
+		if changed {
+			utils.LogErr(fmt.Errorf("modsecurity-endpoints annotation: %s, ModSecurity is disabled", err))
+		}
+		return nil
+	}
+	return addresses
+}
+
+// waf annotation: requests of hosts and paths of ingress are checked by ModSecurity,
+// "on" denies the ones it blocks and "detect" only logs them on agent side.
+func (c *HAProxyController) handleWAF(ingress *Ingress) error {
+	for _, name := range []string{"modsecurity-enabled", "modsecurity-endpoints"} {
+		if ann, _ := GetValueFromAnnotations(name, c.cfg.ConfigMap.Annotations); ann != nil && ann.Status != EMPTY {
+			c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+		}
+	}
+	annWAF, _ := GetValueFromAnnotations("waf", ingress.Annotations)
+	if annWAF == nil {
+		return nil
+	}
+	if annWAF.Status != EMPTY || ingress.Status != EMPTY {
+		c.cfg.FrontendRulesStatus[HTTP] = MODIFIED
+	}
+	if annWAF.Status == DELETED || ingress.Status == DELETED {
+		return nil
+	}
+	switch annWAF.Value {
+	case "off":
+		return nil
+	case "on", "detect":
+	default:
+		return fmt.Errorf("waf annotation: unknown mode '%s'", annWAF.Value)
+	}
+	if c.cfg.ModSecurityAgents == nil {
+		if annWAF.Status != EMPTY {
+			return fmt.Errorf("waf annotation: ModSecurity is not enabled in ConfigMap")
+		}
+		return nil
+	}
+	for _, rule := range ingress.Rules {
+		for _, path := range rule.Paths {
+			acl := hostPathACL(rule.Host, path.Path)
+			if acl == "" {
+				continue
+			}
+			key := hashStrToUint(fmt.Sprintf("%s-%s-%s-%s-%s", WAF, ingress.Namespace, ingress.Name, rule.Host, path.Path))
+			c.cfg.FrontendHTTPReqRules[WAF][key] = models.HTTPRequestRule{
+				Index:      utils.PtrInt64(0),
+				Type:       "send-spoe-group",
+				SpoeEngine: modsecEngine,
+				SpoeGroup:  modsecGroup,
+				Cond:       "if",
+				CondTest:   acl,
+			}
+			if annWAF.Value == "on" {
+				c.cfg.FrontendHTTPReqRules[WAF][key+1] = models.HTTPRequestRule{
+					Index:      utils.PtrInt64(0),
+					Type:       "deny",
+					DenyStatus: 403,
+					Cond:       "if",
+					CondTest:   acl + " { var(txn.modsec.code) -m int gt 0 }",
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// SPOE filter of HTTP and HTTPS frontends, its configuration file and agents backend
+// are kept while some ingress has waf rules.
+func (c *HAProxyController) refreshModSecurity() (reload bool) {
+	agents := c.cfg.ModSecurityAgents
+	if len(c.cfg.FrontendHTTPReqRules[WAF]) == 0 {
+		agents = nil
+	}
+	file, content := spoeConfigFile(modsecEngine), ""
+	if agents != nil {
+		content = modsecSPOEConfig
+	}
+	changed, err := c.spoeConfigSet(file, content)
+	utils.LogErr(err)
+	reload = changed
+	if content == "" {
+		file = ""
+	}
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		if _, errFrontend := c.frontendGet(frontend); errFrontend != nil {
+			continue
+		}
+		changed, err = c.sectionSPOEFilter(parser.Frontends, frontend, modsecEngine, file)
+		utils.LogErr(err)
+		reload = reload || changed
+	}
+	changed, err = c.spoeAgentBackend(modsecAgentBackend, agents)
+	utils.LogErr(err)
+	return reload || changed
+}
@@ -15,10 +15,13 @@
 package controller
 
 import (
-	"log"
+	"sync/atomic"
 	"time"
 )
 
+// Maximum number of changes applied to configuration before syncing HAProxy
+const maxSyncBatch = 1000
+
 func (c *HAProxyController) monitorChanges() {
 
 	configMapReceivedAndProcessed := make(chan bool)
@@ -31,7 +34,13 @@ func (c *HAProxyController) monitorChanges() {
 	c.k8s.EventsEndpoints(podEndpoints, stop)
 
 	svcChan := make(chan *Service, 100)
-	c.k8s.EventsServices(svcChan, stop, c.cfg.PublishService)
+	publishSvcChan := make(chan *Service, 10)
+	publishSvc := c.cfg.PublishService
+	if len(c.osArgs.PublishAddress) > 0 {
+		// Static addresses of --publish-address
+		publishSvc = nil
+	}
+	c.k8s.EventsServices(svcChan, publishSvcChan, stop, publishSvc)
 
 	nsChan := make(chan *Namespace, 10)
 	c.k8s.EventsNamespaces(nsChan, stop)
@@ -39,12 +48,27 @@ func (c *HAProxyController) monitorChanges() {
 	ingChan := make(chan *Ingress, 10)
 	c.k8s.EventsIngresses(ingChan, stop)
 
+	ingClassChan := make(chan *IngressClass, 10)
+	c.k8s.EventsIngressClasses(ingClassChan, stop)
+
 	cfgChan := make(chan *ConfigMap, 10)
 	c.k8s.EventsConfigfMaps(cfgChan, stop)
 
 	secretChan := make(chan *Secret, 10)
 	c.k8s.EventsSecrets(secretChan, stop)
 
+	podChan := make(chan *Pod, 100)
+	podNamespaces, podExcluded := c.podNamespaces()
+	c.k8s.EventsPods(podChan, stop, podNamespaces, podExcluded)
+
+	// Periodic resync, skipped while previous one is not done
+	var resync <-chan time.Time
+	if c.osArgs.SyncPeriod > 0 {
+		ticker := time.NewTicker(c.osArgs.SyncPeriod)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
 	eventsIngress := []SyncDataEvent{}
 	eventsEndpoints := []SyncDataEvent{}
 	eventsServices := []SyncDataEvent{}
@@ -73,6 +97,9 @@ func (c *HAProxyController) monitorChanges() {
 			event := SyncDataEvent{SyncType: NAMESPACE, Namespace: item.Name, Data: item}
 			c.eventChan <- event
 		case item := <-podEndpoints:
+			if !c.isWatchedNamespace(item.Namespace) {
+				continue
+			}
 			event := SyncDataEvent{SyncType: ENDPOINTS, Namespace: item.Namespace, Data: item}
 			if configMapOk {
 				c.eventChan <- event
@@ -80,6 +107,9 @@ func (c *HAProxyController) monitorChanges() {
 				eventsEndpoints = append(eventsEndpoints, event)
 			}
 		case item := <-svcChan:
+			if !c.isWatchedNamespace(item.Namespace) {
+				continue
+			}
 			event := SyncDataEvent{SyncType: SERVICE, Namespace: item.Namespace, Data: item}
 			if configMapOk {
 				c.eventChan <- event
@@ -87,15 +117,31 @@ func (c *HAProxyController) monitorChanges() {
 				eventsServices = append(eventsServices, event)
 			}
 		case item := <-ingChan:
+			if !c.cfg.IsRelevantNamespace(item.Namespace) {
+				continue
+			}
 			event := SyncDataEvent{SyncType: INGRESS, Namespace: item.Namespace, Data: item}
 			if configMapOk {
 				c.eventChan <- event
 			} else {
 				eventsIngress = append(eventsIngress, event)
 			}
+		case item := <-publishSvcChan:
+			c.eventChan <- SyncDataEvent{SyncType: PUBLISH_SERVICE, Namespace: item.Namespace, Data: item}
+		case item := <-ingClassChan:
+			c.eventChan <- SyncDataEvent{SyncType: INGRESS_CLASS, Data: item}
 		case item := <-secretChan:
 			event := SyncDataEvent{SyncType: SECRET, Namespace: item.Namespace, Data: item}
 			c.eventChan <- event
+		case item := <-podChan:
+			if !c.isWatchedNamespace(item.Namespace) {
+				continue
+			}
+			c.eventChan <- SyncDataEvent{SyncType: POD, Namespace: item.Namespace, Data: item}
+		case <-resync:
+			if configMapOk && atomic.CompareAndSwapInt32(&c.resyncPending, 0, 1) {
+				c.eventChan <- SyncDataEvent{SyncType: RESYNC}
+			}
 		case <-time.After(time.Duration(syncEveryNSeconds) * time.Second):
 			//TODO syncEveryNSeconds sec is hardcoded, change that (annotation?)
 			//do sync of data every syncEveryNSeconds sec
@@ -106,34 +152,181 @@ func (c *HAProxyController) monitorChanges() {
 	}
 }
 
+// Services and endpoints from namespaces excluded by namespace-whitelist/blacklist
+// are dropped, except for default backend service and publish service. Annotations
+// and tcp-services referencing services of excluded namespaces are rejected.
+func (c *HAProxyController) isWatchedNamespace(namespace string) bool {
+	if c.cfg.IsRelevantNamespace(namespace) {
+		return true
+	}
+	if namespace == c.osArgs.DefaultBackendService.Namespace {
+		return true
+	}
+	return c.cfg.PublishService != nil && namespace == c.cfg.PublishService.Namespace
+}
+
+// Namespaces pods are watched in with namespace-whitelist, excluded ones otherwise, see EventsPods
+func (c *HAProxyController) podNamespaces() (namespaces, excluded []string) {
+	if len(c.cfg.NamespacesAccess.Whitelist) == 0 {
+		for namespace := range c.cfg.NamespacesAccess.Blacklist {
+			if c.isWatchedNamespace(namespace) {
+				continue
+			}
+			excluded = append(excluded, namespace)
+		}
+		return nil, excluded
+	}
+	watched := map[string]struct{}{}
+	for namespace := range c.cfg.NamespacesAccess.Whitelist {
+		watched[namespace] = struct{}{}
+	}
+	if namespace := c.osArgs.DefaultBackendService.Namespace; namespace != "" {
+		watched[namespace] = struct{}{}
+	}
+	for namespace := range watched {
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces, nil
+}
+
 //SyncData gets all kubernetes changes, aggregates them and apply to HAProxy.
-//All the changes must come through this function
+//All the changes must come through this function.
+//Changes are synced at most --sync-debounce after the first one of a batch, or once
+//maxSyncBatch changes are collected, so bursts of events give a single sync.
 func (c *HAProxyController) SyncData(jobChan <-chan SyncDataEvent, chConfigMapReceivedAndProcessed chan bool) {
 	hadChanges := false
-	for job := range jobChan {
-		ns := c.cfg.GetNamespace(job.Namespace)
-		change := false
-		switch job.SyncType {
-		case COMMAND:
-			if hadChanges {
-				if err := c.updateHAProxy(); err != nil {
-					log.Println(err)
+	batchSize := 0
+	var debounce <-chan time.Time
+	// Failed syncs are retried, see syncRetry
+	var retry <-chan time.Time
+	doSync := func() error {
+		err := c.syncHAProxy()
+		retry = c.syncRetry(err)
+		if err == nil {
+			hadChanges = false
+		}
+		return err
+	}
+	for {
+		select {
+		case job, ok := <-jobChan:
+			if !ok {
+				return
+			}
+			c.health.eventProcessed()
+			ns := c.cfg.GetNamespace(job.Namespace)
+			change := false
+			switch job.SyncType {
+			case COMMAND:
+				hadChanges = c.expireDrainingServers() || hadChanges
+				// In test mode output is validated once all objects are loaded
+				testPending := c.osArgs.Test && c.osArgs.TestOutputDir != "" && !c.testDone
+				// A failed sync is only retried by its timer so that retries back off
+				if (hadChanges || c.reloadPending) && (retry == nil || testPending) {
+					debounce = nil
+					batchSize = 0
+					err := doSync()
+					if testPending {
+						c.testDone = true
+						c.testResult <- c.validateTestOutput(err)
+					}
+					continue
 				}
+			case NAMESPACE:
+				change = c.eventNamespace(ns, job.Data.(*Namespace))
+			case INGRESS:
+				change = c.eventIngress(ns, job.Data.(*Ingress))
+			case INGRESS_CLASS:
+				change = c.eventIngressClass(job.Data.(*IngressClass))
+			case ENDPOINTS:
+				change = c.eventEndpoints(ns, job.Data.(*Endpoints))
+			case SERVICE:
+				change = c.eventService(ns, job.Data.(*Service))
+			case PUBLISH_SERVICE:
+				change = c.eventPublishService(job.Data.(*Service))
+			case CONFIGMAP:
+				change = c.eventConfigMap(ns, job.Data.(*ConfigMap), chConfigMapReceivedAndProcessed)
+			case SECRET:
+				change = c.eventSecret(ns, job.Data.(*Secret))
+			case POD:
+				change = c.eventPod(ns, job.Data.(*Pod))
+			case RELOAD:
+				// Done by next sync, only requested by OCSP updates
+				c.reloadPending = c.reloadRequired(ReloadOCSP, "OCSP response not updated through runtime API", true)
 				continue
+			case RESYNC:
+				// Leader election may request it before controller ConfigMap is processed,
+				// first sync then writes ingresses status
+				if c.cfg.ConfigMap == nil {
+					atomic.StoreInt32(&c.resyncPending, 0)
+					continue
+				}
+				logger.Debug("Resync")
+				hadChanges = c.resync() || hadChanges
+				c.forceFullSync = true
+				debounce = nil
+				batchSize = 0
+				doSync() //nolint errcheck
+				atomic.StoreInt32(&c.resyncPending, 0)
+				continue
+			case SHUTDOWN:
+				if c.osArgs.UpdateStatusOnShutdown == "true" && c.cfg.PublishService != nil && c.isLeader() {
+					c.removeIngressesStatus()
+				}
+				close(job.Data.(chan struct{}))
+				return
 			}
-		case NAMESPACE:
-			change = c.eventNamespace(ns, job.Data.(*Namespace))
-		case INGRESS:
-			change = c.eventIngress(ns, job.Data.(*Ingress))
-		case ENDPOINTS:
-			change = c.eventEndpoints(ns, job.Data.(*Endpoints))
-		case SERVICE:
-			change = c.eventService(ns, job.Data.(*Service))
-		case CONFIGMAP:
-			change = c.eventConfigMap(ns, job.Data.(*ConfigMap), chConfigMapReceivedAndProcessed)
-		case SECRET:
-			change = c.eventSecret(ns, job.Data.(*Secret))
+			hadChanges = hadChanges || change
+			if !change {
+				continue
+			}
+			batchSize++
+			if batchSize >= maxSyncBatch {
+				debounce = time.After(0)
+			} else if debounce == nil {
+				debounce = time.After(c.osArgs.SyncDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+			// Nothing is synced before controller ConfigMap is processed
+			if c.cfg.ConfigMap == nil {
+				continue
+			}
+			logger.Debugf("Syncing HAProxy configuration after %d changes", batchSize)
+			batchSize = 0
+			doSync() //nolint errcheck
+		case <-retry:
+			debounce = nil
+			batchSize = 0
+			logger.Infof("Retrying HAProxy configuration update after %d failed syncs", c.syncFailures)
+			doSync() //nolint errcheck
 		}
-		hadChanges = hadChanges || change
 	}
 }
+
+// Return timer of the retry of a failed sync, with a delay growing with consecutive failed
+// syncs. Next sync, whatever triggers it, is a full one so changes of failed one are not lost.
+func (c *HAProxyController) syncRetry(err error) <-chan time.Time {
+	if err == nil {
+		c.syncFailures = 0
+		return nil
+	}
+	c.syncFailures++
+	c.forceFullSync = true
+	delay := syncRetryDelay(c.syncFailures)
+	logger.Warningf("HAProxy configuration update failed, retrying in %s", delay)
+	return time.After(delay)
+}
+
+func (c *HAProxyController) syncHAProxy() error {
+	start := time.Now()
+	c.refreshSecretIndex()
+	err := c.updateHAProxy()
+	if err != nil {
+		logger.Error(err)
+	}
+	c.updateStatsPods()
+	c.metrics.syncDone(time.Since(start), err)
+	c.health.updateDone(err)
+	return err
+}
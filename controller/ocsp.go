@@ -0,0 +1,247 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspCheckPeriod = time.Minute
+	ocspMinBackoff  = time.Minute
+	ocspMaxBackoff  = time.Hour
+	ocspTimeout     = 10 * time.Second
+	// Refresh period of responses without next update
+	ocspDefaultRefresh = time.Hour
+)
+
+// Refresh state of OCSP response of a certificate file
+type ocspState struct {
+	modTime    time.Time
+	nextUpdate time.Time
+	failures   uint
+}
+
+// ocsp-stapling annotation, OCSP responses are stored next to certificates as <certificate>.ocsp
+// files loaded by HAProxy on reload, and updated through runtime API when refreshed.
+func (c *HAProxyController) handleOCSPStapling() (reload bool) {
+	annOCSP, _ := GetValueFromAnnotations("ocsp-stapling", c.cfg.ConfigMap.Annotations)
+	enabled, err := utils.GetBoolValue(annOCSP.Value, "ocsp-stapling")
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	var value int32
+	if enabled {
+		value = 1
+	}
+	if atomic.SwapInt32(&c.ocspEnabled, value) == value || enabled {
+		return false
+	}
+	// Stapled responses are dropped by next reload
+	files, err := ioutil.ReadDir(HAProxyCertDir)
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".ocsp") || strings.HasSuffix(f.Name(), ".issuer") {
+			utils.LogErr(os.Remove(path.Join(HAProxyCertDir, f.Name())))
+			reload = true
+		}
+	}
+	return reload
+}
+
+// Refresh OCSP responses of certificates in HAProxyCertDir while ocsp-stapling is enabled
+func (c *HAProxyController) runOCSPUpdater() {
+	if c.osArgs.Test {
+		return
+	}
+	go func() {
+		states := map[string]*ocspState{}
+		for range time.Tick(ocspCheckPeriod) {
+			if atomic.LoadInt32(&c.ocspEnabled) == 0 {
+				states = map[string]*ocspState{}
+				continue
+			}
+			c.ocspUpdate(states)
+		}
+	}()
+}
+
+func (c *HAProxyController) ocspUpdate(states map[string]*ocspState) {
+	files, err := ioutil.ReadDir(HAProxyCertDir)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	certificates := map[string]struct{}{}
+	for _, f := range files {
+		if f.IsDir() || !(strings.HasSuffix(f.Name(), ".rsa") || strings.HasSuffix(f.Name(), ".ecdsa")) {
+			continue
+		}
+		filename := path.Join(HAProxyCertDir, f.Name())
+		certificates[filename] = struct{}{}
+		// Rewritten certificates get a new response
+		state, ok := states[filename]
+		if !ok || !state.modTime.Equal(f.ModTime()) {
+			state = &ocspState{modTime: f.ModTime()}
+			states[filename] = state
+		}
+		if time.Now().Before(state.nextUpdate) {
+			continue
+		}
+		nextUpdate, errOCSP := c.ocspRefresh(filename)
+		if errOCSP != nil {
+			backoff := ocspMinBackoff << state.failures
+			if backoff > ocspMaxBackoff || backoff <= 0 {
+				backoff = ocspMaxBackoff
+			} else {
+				state.failures++
+			}
+			logger.Warningf("OCSP response of %s: %s, retrying in %s", filename, errOCSP, backoff)
+			state.nextUpdate = time.Now().Add(backoff)
+			continue
+		}
+		state.failures = 0
+		state.nextUpdate = nextUpdate
+	}
+	// Forget removed certificates
+	for filename := range states {
+		if _, ok := certificates[filename]; !ok {
+			delete(states, filename)
+		}
+	}
+}
+
+// Fetch OCSP response of certificate file, write it and update HAProxy.
+// Returns when it should be refreshed, certificates without OCSP responder are never refreshed.
+func (c *HAProxyController) ocspRefresh(filename string) (nextUpdate time.Time, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nextUpdate, err
+	}
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, errParse := x509.ParseCertificate(block.Bytes)
+		if errParse != nil {
+			return nextUpdate, errParse
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nextUpdate, errors.New("no certificate found")
+	}
+	cert := chain[0]
+	if len(cert.OCSPServer) == 0 {
+		return time.Now().Add(100 * 365 * 24 * time.Hour), nil
+	}
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	} else {
+		// HAProxy needs issuer to staple responses, it is read from <certificate>.issuer
+		if issuer, err = ocspFetchIssuer(cert); err != nil {
+			return nextUpdate, err
+		}
+		issuerPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.Raw})
+		if err = writeStateFile(filename+".issuer", string(issuerPEM)); err != nil {
+			return nextUpdate, err
+		}
+	}
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nextUpdate, err
+	}
+	client := http.Client{Timeout: ocspTimeout}
+	resp, err := client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nextUpdate, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nextUpdate, fmt.Errorf("responder %s returned %s", cert.OCSPServer[0], resp.Status)
+	}
+	der, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nextUpdate, err
+	}
+	response, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return nextUpdate, err
+	}
+	if response.Status != ocsp.Good {
+		logger.Warningf("OCSP response of %s: certificate status is not good (%d)", filename, response.Status)
+	}
+	_, errStat := os.Stat(filename + ".ocsp")
+	if err = writeStateFile(filename+".ocsp", string(der)); err != nil {
+		return nextUpdate, err
+	}
+	result, err := c.NativeAPI.Runtime.ExecuteRaw("set ssl ocsp-response " + base64.StdEncoding.EncodeToString(der))
+	if err != nil {
+		return nextUpdate, err
+	}
+	// HAProxy only updates responses of certificates loaded with one
+	if (len(result) == 0 || !strings.Contains(result[0], "updated")) && os.IsNotExist(errStat) {
+		logger.Debugf("OCSP response of %s not updated by HAProxy, reloading: %s", filename, strings.Join(result, " "))
+		c.eventChan <- SyncDataEvent{SyncType: RELOAD}
+	}
+	logger.Debugf("OCSP response of %s updated, next update %s", filename, response.NextUpdate)
+	// Refresh at half of response validity
+	if response.NextUpdate.IsZero() {
+		return time.Now().Add(ocspDefaultRefresh), nil
+	}
+	return response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2), nil
+}
+
+// Fetch issuer certificate from Authority Information Access URL
+func ocspFetchIssuer(cert *x509.Certificate) (*x509.Certificate, error) {
+	if len(cert.IssuingCertificateURL) == 0 {
+		return nil, errors.New("issuer certificate not in chain and without issuer URL")
+	}
+	client := http.Client{Timeout: ocspTimeout}
+	resp, err := client.Get(cert.IssuingCertificateURL[0])
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseCertificate(data)
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// Serve net/http/pprof handlers on --pprof-address when --pprof is set.
+// Address defaults to localhost, profiles must not be reachable from outside the pod.
+func (c *HAProxyController) runPprof() {
+	if !c.osArgs.Pprof {
+		return
+	}
+	if c.osArgs.PprofMutexFraction > 0 {
+		runtime.SetMutexProfileFraction(c.osArgs.PprofMutexFraction)
+	}
+	if c.osArgs.PprofBlockRate > 0 {
+		runtime.SetBlockProfileRate(c.osArgs.PprofBlockRate)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		logger.Infof("pprof endpoint listening on %s/debug/pprof/", c.osArgs.PprofAddress)
+		logger.Error(http.ListenAndServe(c.osArgs.PprofAddress, mux))
+	}()
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+)
+
+// Reasons of Kubernetes events recorded by the controller
+const (
+	ReasonInvalidAnnotation = "InvalidAnnotationValue"
+	ReasonInvalidTCPService = "InvalidTCPService"
+	ReasonMissingSecret     = "MissingSecret"
+	ReasonNoEndpoints       = "NoReadyEndpoints"
+	ReasonSyncFailed        = "SyncFailed"
+)
+
+// InitEventRecorder sets the recorder used to report configuration errors as Kubernetes events.
+// Similar events on the same object are aggregated and limited to a burst of 10 events,
+// then one event every 5 minutes, so a persistent error does not flood the API server.
+func (k *K8s) InitEventRecorder() {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: 10,
+		QPS:       1. / 300.,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k.API.CoreV1().Events("")})
+	host, _ := os.Hostname()
+	k.Recorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "haproxy-ingress-controller", Host: host})
+
+	podName := os.Getenv("POD_NAME")
+	podNamespace := os.Getenv("POD_NAMESPACE")
+	if podName == "" || podNamespace == "" {
+		return
+	}
+	pod, err := k.API.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		k8sLogger.Warningf("Unable to get controller pod %s/%s, events will only be recorded on ingresses: %s", podNamespace, podName, err)
+		return
+	}
+	if k.PodRef, err = reference.GetReference(scheme.Scheme, pod); err != nil {
+		k8sLogger.Error(err)
+	}
+}
+
+// IngressEvent records a Warning event on the ingress object.
+func (k *K8s) IngressEvent(ingress *Ingress, reason, message string) {
+	if k.Recorder == nil {
+		return
+	}
+	ref := &corev1.ObjectReference{
+		Kind:       "Ingress",
+		APIVersion: k.IngressAPIVersion,
+		Namespace:  ingress.Namespace,
+		Name:       ingress.Name,
+		UID:        types.UID(ingress.UID),
+	}
+	k.Recorder.Event(ref, corev1.EventTypeWarning, reason, message)
+}
+
+// PodEvent records a Warning event on the controller pod, if known.
+func (k *K8s) PodEvent(reason, message string) {
+	if k.Recorder == nil || k.PodRef == nil {
+		return
+	}
+	k.Recorder.Event(k.PodRef, corev1.EventTypeWarning, reason, message)
+}
+
+// Record err as a Warning event on ingress and return it so it can still be logged.
+func (c *HAProxyController) ingressEventErr(ingress *Ingress, reason string, err error) error {
+	if err != nil {
+		c.k8s.IngressEvent(ingress, reason, err.Error())
+	}
+	return err
+}
+
+// Record err as a Warning event on controller pod and return it so it can still be logged.
+func (c *HAProxyController) podEventErr(reason string, err error) error {
+	if err != nil {
+		c.k8s.PodEvent(reason, err.Error())
+	}
+	return err
+}
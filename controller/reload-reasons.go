@@ -0,0 +1,75 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+)
+
+// Reason of a HAProxy reload, logged when HAProxy is reloaded and exported
+// as reason label of haproxy_ingress_reload_reasons_total
+type reloadReason string
+
+const (
+	ReloadGlobalAnnotations reloadReason = "GlobalAnnotationsChanged"
+	ReloadServerState       reloadReason = "ServerStateChanged"
+	ReloadDefaultService    reloadReason = "DefaultServiceChanged"
+	ReloadBackend           reloadReason = "BackendChanged"
+	ReloadCerts             reloadReason = "CertsChanged"
+	ReloadAuth              reloadReason = "AuthChanged"
+	ReloadUniqueID          reloadReason = "UniqueIDChanged"
+	ReloadHTTPS             reloadReason = "HTTPSChanged"
+	ReloadOCSP              reloadReason = "OCSPChanged"
+	ReloadSNIBlacklist      reloadReason = "SNIBlacklistChanged"
+	ReloadFrontendRules     reloadReason = "FrontendRulesChanged"
+	ReloadBackendRules      reloadReason = "BackendRulesChanged"
+	ReloadMapRefresh        reloadReason = "MapRefresh"
+	ReloadTCPServices       reloadReason = "TCPServicesChanged"
+	ReloadBinds             reloadReason = "BindsChanged"
+	ReloadBackendSwitching  reloadReason = "BackendSwitchingChanged"
+	ReloadConfigSnippets    reloadReason = "ConfigSnippetsChanged"
+	ReloadRequestMirrors    reloadReason = "RequestMirrorsChanged"
+	ReloadModSecurity       reloadReason = "ModSecurityChanged"
+	ReloadLuaScripts        reloadReason = "LuaScriptsChanged"
+)
+
+// Record reason of a required reload, reasons are kept until HAProxy is reloaded so
+// deferred reloads report all of them. Object which changed is logged at debug level.
+func (c *HAProxyController) reloadRequired(reason reloadReason, object string, reload bool) bool {
+	if !reload {
+		return false
+	}
+	if object == "" {
+		logger.Debugf("reload required by %s", reason)
+	} else {
+		logger.Debugf("reload required by %s: %s", reason, object)
+	}
+	if c.reloadReasons == nil {
+		c.reloadReasons = make(map[reloadReason]struct{})
+	}
+	c.reloadReasons[reason] = struct{}{}
+	return true
+}
+
+// Sorted reasons of the pending reload, they are reset
+func (c *HAProxyController) takeReloadReasons() []string {
+	reasons := make([]string, 0, len(c.reloadReasons))
+	for reason := range c.reloadReasons {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+	c.reloadReasons = nil
+	return reasons
+}
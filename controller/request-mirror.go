@@ -0,0 +1,191 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+// Backend of the SPOE agent mirroring requests, and SPOE engine of mirrored backends
+const (
+	mirrorAgentBackend = "spoe-mirror"
+	mirrorEngine       = "mirror"
+)
+
+// Mirroring of requests of a backend, applied by refreshRequestMirrors
+type requestMirror struct {
+	// host:port of the shadow service, empty once annotation is removed
+	dest    string
+	percent int64
+}
+
+// SPOE configuration of a mirrored backend. Messages are sent asynchronously so
+// requests don't wait for the agent, its errors and timeouts only lose the mirrored copy.
+func (m *requestMirror) spoeConfig() string {
+	event := "event on-backend-http-request"
+	if m.percent < 100 {
+		event += fmt.Sprintf(" if { rand(100) lt %d }", m.percent)
+	}
+	return fmt.Sprintf(`[%s]
+spoe-agent mirror-agent
+    messages mirror
+    option async
+    option continue-on-error
+    timeout hello 500ms
+    timeout idle 30s
+    timeout processing 100ms
+    use-backend %s
+
+spoe-message mirror
+    args arg_method=method arg_path=url arg_ver=req.ver arg_hdrs=req.hdrs_bin arg_body=req.body arg_dest=str(%s)
+    %s
+`, mirrorEngine, mirrorAgentBackend, m.dest, event)
+}
+
+// request-mirror and mirror-percent annotations of service or ingress,
+// they are applied by refreshRequestMirrors
+func (c *HAProxyController) handleRequestMirror(namespace *Namespace, ingress *Ingress, service *Service, backendName string) {
+	annMirror, _ := c.backendAnnotation("request-mirror", ingress, service)
+	value := ""
+	if annMirror != nil && annMirror.Status != DELETED {
+		value = annMirror.Value
+	}
+	mirror, ok := c.cfg.BackendMirrors[backendName]
+	if value == "" {
+		if ok {
+			mirror.dest = ""
+		}
+		return
+	}
+	dest, err := c.mirrorDestination(namespace, value)
+	if err != nil {
+		utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation,
+			fmt.Errorf("request-mirror annotation of backend '%s': %s", backendName, err)))
+		return
+	}
+	annPercent, _ := c.backendAnnotation("mirror-percent", ingress, service)
+	percent, err := strconv.ParseInt(annPercent.Value, 10, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		utils.LogErr(c.ingressEventErr(ingress, ReasonInvalidAnnotation,
+			fmt.Errorf("mirror-percent annotation of backend '%s': invalid percentage '%s'", backendName, annPercent.Value)))
+		return
+	}
+	if !ok {
+		mirror = &requestMirror{}
+		c.cfg.BackendMirrors[backendName] = mirror
+	}
+	mirror.dest = dest
+	mirror.percent = percent
+}
+
+// Address of the shadow service of a request-mirror annotation,
+// namespace defaults to the one of the ingress
+func (c *HAProxyController) mirrorDestination(namespace *Namespace, value string) (string, error) {
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return "", fmt.Errorf("invalid '%s', expected [namespace/]service:port", value)
+	}
+	name, port := value[:i], value[i+1:]
+	nsName := namespace.Name
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		nsName, name = parts[0], parts[1]
+	}
+	if !c.isWatchedNamespace(nsName) {
+		return "", fmt.Errorf("namespace '%s' is excluded by namespace-whitelist/blacklist", nsName)
+	}
+	ns, ok := c.cfg.Namespace[nsName]
+	if !ok {
+		return "", fmt.Errorf("namespace '%s' does not exist", nsName)
+	}
+	service, ok := ns.Services[name]
+	if !ok || service.Status == DELETED {
+		return "", fmt.Errorf("service '%s/%s' does not exist", nsName, name)
+	}
+	for _, sp := range service.Ports {
+		if sp.Name == port || strconv.FormatInt(sp.Port, 10) == port {
+			return fmt.Sprintf("%s.%s.svc:%d", name, nsName, sp.Port), nil
+		}
+	}
+	return "", fmt.Errorf("service '%s/%s' has no port '%s'", nsName, name, port)
+}
+
+// Set SPOE configuration files and filters of mirrored backends, remove them
+// when mirroring stops, and keep the agent backend while some backend is mirrored.
+// Mirrors are forgotten once their removal is in the configuration.
+func (c *HAProxyController) refreshRequestMirrors() (reload bool) {
+	for backendName, mirror := range c.cfg.BackendMirrors {
+		file := spoeConfigFile("mirror-" + backendName)
+		_, errBackend := c.backendGet(backendName)
+		content := ""
+		if errBackend == nil && mirror.dest != "" && mirror.percent > 0 {
+			content = mirror.spoeConfig()
+		}
+		changed, err := c.spoeConfigSet(file, content)
+		if err != nil {
+			utils.LogErr(err)
+			continue
+		}
+		if errBackend == nil {
+			configFile := ""
+			if content != "" {
+				configFile = file
+			}
+			filterChanged, errFilter := c.sectionSPOEFilter(parser.Backends, backendName, mirrorEngine, configFile)
+			if errFilter != nil {
+				utils.LogErr(errFilter)
+				continue
+			}
+			// req.body is only sent when request body is buffered
+			if filterChanged {
+				if err = c.sectionBufferRequest(parser.Backends, backendName, configFile != ""); err != nil {
+					utils.LogErr(err)
+					continue
+				}
+			}
+			changed = changed || filterChanged
+		}
+		if !changed {
+			if content == "" {
+				delete(c.cfg.BackendMirrors, backendName)
+			}
+			continue
+		}
+		if content == "" {
+			logger.Debugf("request mirroring of backend '%s' removed", backendName)
+		} else {
+			logger.Debugf("mirroring %d%% of requests of backend '%s' to %s", mirror.percent, backendName, mirror.dest)
+		}
+		reload = true
+	}
+	// Agent backend points at the address of mirror-agent ConfigMap annotation,
+	// spoa-mirror listens on 127.0.0.1:12345 when it runs in controller pod.
+	addresses := []string{}
+	if len(c.cfg.BackendMirrors) > 0 {
+		annAgent, _ := GetValueFromAnnotations("mirror-agent", c.cfg.ConfigMap.Annotations)
+		var err error
+		if addresses, err = spoeAgentAddresses(annAgent.Value); err != nil || len(addresses) != 1 {
+			utils.LogErr(fmt.Errorf("mirror-agent annotation: invalid address '%s'", annAgent.Value))
+			return reload
+		}
+	}
+	r, err := c.spoeAgentBackend(mirrorAgentBackend, addresses)
+	utils.LogErr(err)
+	return reload || r
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"strings"
+	"testing"
+)
+
+// Services of blacklisted namespaces are not watched, referencing them is an error
+// instead of silently using a namespace without services.
+func TestMirrorDestinationExcludedNamespace(t *testing.T) {
+	c := testController()
+	c.cfg.NamespacesAccess.Blacklist = map[string]struct{}{"staging": {}}
+	for _, name := range []string{"default", "staging"} {
+		ns := c.cfg.NewNamespace(name)
+		ns.Services["api"] = &Service{Namespace: name, Name: "api", Ports: []ServicePort{{Name: "http", Port: 80}}, Status: ADDED}
+	}
+	ns := c.cfg.Namespace["default"]
+
+	if dest, err := c.mirrorDestination(ns, "api:http"); err != nil || dest != "api.default.svc:80" {
+		t.Errorf("watched namespace: expected api.default.svc:80, got %q, %v", dest, err)
+	}
+	_, err := c.mirrorDestination(ns, "staging/api:http")
+	if err == nil || !strings.Contains(err.Error(), "excluded") {
+		t.Errorf("excluded namespace: expected exclusion error, got %v", err)
+	}
+}
@@ -16,7 +16,12 @@ package controller
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/common"
+	"github.com/haproxytech/config-parser/v2/types"
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
 	"github.com/haproxytech/models"
 )
@@ -31,12 +36,28 @@ type BackendHTTPReqs struct {
 
 type Rule string
 
+// AuthRequest is a call to the auth-request Lua action
+type AuthRequest struct {
+	Backend string
+	Path    string
+	MapFile string
+}
+
 type rateLimitTable struct {
-	size   *int64
-	period *int64
+	size      *int64
+	period    *int64
+	tableType string
+	store     string
 }
 
+// Max length of string keys in rate limit tables
+const rateLimitKeyLen = 64
+
 const (
+	//nolint
+	ACCESS_LOG Rule = "access-log"
+	//nolint
+	APP_ROOT Rule = "app-root"
 	//nolint
 	BLACKLIST Rule = "blacklist"
 	//nolint
@@ -46,16 +67,38 @@ const (
 	//nolint
 	SSL_REDIRECT Rule = "ssl-redirect"
 	//nolint
+	AUTH Rule = "auth"
+	//nolint
+	CONN_LIMIT Rule = "conn-limit"
+	//nolint
+	CORS Rule = "cors"
+	//nolint
+	HSTS Rule = "hsts"
+	//nolint
+	METHODS Rule = "methods"
+	//nolint
 	PATH_REWRITE Rule = "path-rewrite"
 	//nolint
 	PROXY_PROTOCOL Rule = "proxy-protocol"
 	//nolint
+	REDIRECT Rule = "redirect"
+	//nolint
 	REQUEST_CAPTURE Rule = "request-capture"
 	//nolint
+	REQUEST_MAX_BODY_SIZE Rule = "request-max-body-size"
+	//nolint
+	REQUEST_DEL_HEADER Rule = "request-del-header"
+	//nolint
 	REQUEST_SET_HEADER Rule = "request-set-header"
 	//nolint
+	RESPONSE_CAPTURE Rule = "response-capture"
+	//nolint
+	RESPONSE_DEL_HEADER Rule = "response-del-header"
+	//nolint
 	RESPONSE_SET_HEADER Rule = "response-set-header"
 	//nolint
+	WAF Rule = "waf"
+	//nolint
 	WHITELIST Rule = "whitelist"
 )
 
@@ -68,12 +111,45 @@ func (c *HAProxyController) FrontendHTTPRspsRefresh() (reload bool) {
 	c.frontendHTTPResponseRuleDeleteAll(FrontendHTTP)
 	c.frontendHTTPResponseRuleDeleteAll(FrontendHTTPS)
 
+	// HSTS
+	for key, httpRule := range c.cfg.FrontendHTTPRspRules[HSTS] {
+		c.cfg.MapFiles.Modified(key)
+		utils.LogErr(c.frontendHTTPResponseRuleCreate(FrontendHTTPS, httpRule))
+	}
+	// RESPONSE_CAPTURE slots, unused ones are released
+	// but still declared so remaining IDs don't change
+	responseCaptures.allocate()
+	for key, httpRule := range c.cfg.FrontendHTTPRspRules[RESPONSE_CAPTURE] {
+		httpRule.CaptureID = utils.PtrInt64(responseCaptures.ids[httpRule.CaptureSample])
+		c.cfg.FrontendHTTPRspRules[RESPONSE_CAPTURE][key] = httpRule
+	}
+
 	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		// Log sampling
+		if httpRule := c.logSamplingRule(); httpRule != nil {
+			utils.LogErr(c.frontendHTTPResponseRuleCreate(frontend, *httpRule))
+		}
+		// RESPONSE_CAPTURE
+		utils.LogErr(c.frontendDeclareResponseCaptures(frontend, responseCaptures.lens))
+		for key, httpRule := range c.cfg.FrontendHTTPRspRules[RESPONSE_CAPTURE] {
+			c.cfg.MapFiles.Modified(key)
+			utils.LogErr(c.frontendHTTPResponseRuleCreate(frontend, httpRule))
+		}
 		// RESPONSE_SET_HEADER
 		for key, httpRule := range c.cfg.FrontendHTTPRspRules[RESPONSE_SET_HEADER] {
 			c.cfg.MapFiles.Modified(key)
 			utils.LogErr(c.frontendHTTPResponseRuleCreate(frontend, httpRule))
 		}
+		// RESPONSE_DEL_HEADER
+		// Rules are inserted at index 0, so deletion ends before set-header
+		for key, httpRule := range c.cfg.FrontendHTTPRspRules[RESPONSE_DEL_HEADER] {
+			c.cfg.MapFiles.Modified(key)
+			utils.LogErr(c.frontendHTTPResponseRuleCreate(frontend, httpRule))
+		}
+		// CORS
+		for _, httpRule := range c.cfg.FrontendHTTPRspRules[CORS] {
+			utils.LogErr(c.frontendHTTPResponseRuleCreate(frontend, httpRule))
+		}
 	}
 	return true
 }
@@ -86,32 +162,98 @@ func (c *HAProxyController) FrontendHTTPReqsRefresh() (reload bool) {
 	// DELETE RULES
 	c.frontendHTTPRequestRuleDeleteAll(FrontendHTTP)
 	c.frontendHTTPRequestRuleDeleteAll(FrontendHTTPS)
-	//STATIC: FORWARDED_PRTOTO
-	xforwardedprotoRule := models.HTTPRequestRule{
-		Index:     utils.PtrInt64(0),
-		Type:      "set-header",
-		HdrName:   "X-Forwarded-Proto",
-		HdrFormat: "https",
-		Cond:      "if",
-		CondTest:  "{ ssl_fc }",
-	}
-	utils.LogErr(c.frontendHTTPRequestRuleCreate(FrontendHTTPS, xforwardedprotoRule))
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		// UNIQUE_ID header
+		if httpRule := c.uniqueIDRule(); httpRule != nil {
+			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, *httpRule))
+		}
+		// FORWARDED headers
+		for _, httpRule := range c.forwardedHeadersRules(frontend) {
+			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+		}
+	}
+	// WAF
+	// Rules are inserted at index 0, so ModSecurity is called before deny rules
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		for _, ruleType := range []string{"deny", "send-spoe-group"} {
+			for _, httpRule := range c.cfg.FrontendHTTPReqRules[WAF] {
+				if httpRule.Type == ruleType {
+					utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+				}
+			}
+		}
+	}
+	// METHODS
+	// Rules are inserted at index 0, so methods are denied before ModSecurity is called
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		for _, httpRule := range c.cfg.FrontendHTTPReqRules[METHODS] {
+			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+		}
+	}
+	// ACCESS_LOG
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		for _, httpRule := range c.cfg.FrontendHTTPReqRules[ACCESS_LOG] {
+			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+		}
+	}
+	// APP_ROOT
+	// Rules are inserted at index 0, so SSL redirect ends before app-root
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		for _, httpRule := range c.cfg.FrontendHTTPReqRules[APP_ROOT] {
+			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+		}
+	}
 	// SSL_REDIRECT
 	for key, httpRule := range c.cfg.FrontendHTTPReqRules[SSL_REDIRECT] {
 		c.cfg.MapFiles.Modified(key)
 		utils.LogErr(c.frontendHTTPRequestRuleCreate(FrontendHTTP, httpRule))
 	}
+	// REDIRECT
+	// Rules are inserted at index 0, longest ACLs (so paths) must end first
+	redirectKeys := make([]uint64, 0, len(c.cfg.FrontendHTTPReqRules[REDIRECT]))
+	for key := range c.cfg.FrontendHTTPReqRules[REDIRECT] {
+		redirectKeys = append(redirectKeys, key)
+	}
+	sort.Slice(redirectKeys, func(i, j int) bool {
+		a, b := c.cfg.FrontendHTTPReqRules[REDIRECT][redirectKeys[i]], c.cfg.FrontendHTTPReqRules[REDIRECT][redirectKeys[j]]
+		if len(a.CondTest) != len(b.CondTest) {
+			return len(a.CondTest) < len(b.CondTest)
+		}
+		return a.CondTest < b.CondTest
+	})
+	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		for _, key := range redirectKeys {
+			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, c.cfg.FrontendHTTPReqRules[REDIRECT][key]))
+		}
+	}
+	// CAPTURE COOKIE
+	captureCookie := []string{}
+	if cookie := c.captureCookie(); cookie != "" {
+		captureCookie = append(captureCookie, "capture cookie "+cookie)
+	}
 	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
+		// Config parser does not handle "capture cookie" so it is managed as unprocessed data
+		utils.LogErr(c.unprocessedSet(parser.Frontends, frontend, "capture cookie", captureCookie))
 		// REQUEST_SET_HEADER
 		for key, httpRule := range c.cfg.FrontendHTTPReqRules[REQUEST_SET_HEADER] {
 			c.cfg.MapFiles.Modified(key)
 			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
 		}
+		// REQUEST_DEL_HEADER
+		// Rules are inserted at index 0, so deletion ends before set-header
+		for key, httpRule := range c.cfg.FrontendHTTPReqRules[REQUEST_DEL_HEADER] {
+			c.cfg.MapFiles.Modified(key)
+			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+		}
 		// REQUEST_CAPTURE
 		for key, httpRule := range c.cfg.FrontendHTTPReqRules[REQUEST_CAPTURE] {
 			c.cfg.MapFiles.Modified(key)
 			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
 		}
+		// CORS
+		for _, httpRule := range c.cfg.FrontendHTTPReqRules[CORS] {
+			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+		}
 		// STATIC: SET_VARIABLE txn.Base (for logging purpose)
 		setVarBaseRule := models.HTTPRequestRule{
 			Index:    utils.PtrInt64(0),
@@ -123,22 +265,36 @@ func (c *HAProxyController) FrontendHTTPReqsRefresh() (reload bool) {
 		utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, setVarBaseRule))
 		// RATE_LIMIT
 		for tableName, table := range rateLimitTables {
-			_, err := c.backendGet(tableName)
+			stickTable := &models.BackendStickTable{
+				Type:  table.tableType,
+				Size:  table.size,
+				Store: table.store,
+			}
+			if table.tableType == "string" {
+				stickTable.Keylen = utils.PtrInt64(rateLimitKeyLen)
+			}
+			backend, err := c.backendGet(tableName)
 			if err != nil {
-				err := c.backendCreate(models.Backend{
-					Name: tableName,
-					StickTable: &models.BackendStickTable{
-						Type:  "ip",
-						Size:  table.size,
-						Store: fmt.Sprintf("http_req_rate(%d)", *table.period),
-					},
+				err = c.backendCreate(models.Backend{
+					Name:       tableName,
+					StickTable: stickTable,
 				})
 				utils.LogErr(err)
+				continue
+			}
+			// Table type, size or period changed: table is recreated on reload
+			if backend.StickTable == nil || !reflect.DeepEqual(*backend.StickTable, *stickTable) {
+				backend.StickTable = stickTable
+				utils.LogErr(c.backendEdit(backend))
 			}
 		}
-		for key, httpRule := range c.cfg.FrontendHTTPReqRules[RATE_LIMIT] {
-			c.cfg.MapFiles.Modified(key)
-			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+		// Rules are inserted at index 0, tracking must end before deny rules
+		for _, track := range []bool{false, true} {
+			for _, httpRule := range c.cfg.FrontendHTTPReqRules[RATE_LIMIT] {
+				if (httpRule.Type == "track-sc0") == track {
+					utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+				}
+			}
 		}
 		// BLACKLIST
 		for _, httpRule := range c.cfg.FrontendHTTPReqRules[BLACKLIST] {
@@ -148,10 +304,76 @@ func (c *HAProxyController) FrontendHTTPReqsRefresh() (reload bool) {
 		for _, httpRule := range c.cfg.FrontendHTTPReqRules[WHITELIST] {
 			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
 		}
+		// CONN_LIMIT
+		// Rules are inserted at index 0, tracking must end before deny rules
+		for _, track := range []bool{false, true} {
+			for key, httpRule := range c.cfg.FrontendHTTPReqRules[CONN_LIMIT] {
+				if (httpRule.Type == "track-sc2") == track {
+					c.cfg.MapFiles.Modified(key)
+					utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+				}
+			}
+		}
+		// REQUEST_MAX_BODY_SIZE
+		for key, httpRule := range c.cfg.FrontendHTTPReqRules[REQUEST_MAX_BODY_SIZE] {
+			c.cfg.MapFiles.Modified(key)
+			utils.LogErr(c.frontendHTTPRequestRuleCreate(frontend, httpRule))
+		}
+		// req.body_size is only available when request body is buffered
+		bufferRequest := len(c.cfg.FrontendHTTPReqRules[REQUEST_MAX_BODY_SIZE]) > 0
+		utils.LogErr(c.sectionBufferRequest(parser.Frontends, frontend, bufferRequest))
+		// RATE_LIMIT responses with headers and CORS preflight responses, before auth requests
+		utils.LogErr(c.frontendHTTPReturns(frontend))
+		// AUTH
+		utils.LogErr(c.frontendAuthRequests(frontend))
 	}
 	return true
 }
 
+// Config parser does not handle Lua actions so lines are managed as unprocessed data.
+// They end up after all other http-request rules, which is the expected place since
+// denial and auth-headers are handled by backends.
+func (c *HAProxyController) frontendAuthRequests(frontend string) error {
+	lines := make([]string, 0, len(c.cfg.FrontendAuthRequests))
+	for key, authRequest := range c.cfg.FrontendAuthRequests {
+		c.cfg.MapFiles.Modified(key)
+		lines = append(lines, fmt.Sprintf("http-request lua.auth-request %s %s if %s", authRequest.Backend, authRequest.Path, hostACL(authRequest.MapFile)))
+	}
+	sort.Strings(lines)
+	return c.unprocessedSet(parser.Frontends, frontend, "http-request lua.auth-request", lines)
+}
+
+// Config parser does not handle http-request return so lines are managed as unprocessed data.
+// They end up after all other http-request rules, tracking of rate-limit and variables of
+// CORS origins are set before.
+func (c *HAProxyController) frontendHTTPReturns(frontend string) error {
+	lines := make([]string, 0, len(c.cfg.FrontendHTTPReturns))
+	for _, line := range c.cfg.FrontendHTTPReturns {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return c.unprocessedSet(parser.Frontends, frontend, "http-request return", lines)
+}
+
+// Config parser does not handle "declare capture" so lines are managed as unprocessed data
+func (c *HAProxyController) frontendDeclareResponseCaptures(frontend string, lens []int64) error {
+	lines := make([]string, 0, len(lens))
+	for _, length := range lens {
+		lines = append(lines, fmt.Sprintf("declare capture response len %d", length))
+	}
+	return c.unprocessedSet(parser.Frontends, frontend, "declare capture response", lines)
+}
+
+func (c *HAProxyController) sectionBufferRequest(section parser.Section, sectionName string, enabled bool) error {
+	config, _ := c.ActiveConfiguration()
+	var data common.ParserData
+	if enabled {
+		data = &types.SimpleOption{}
+	}
+	c.ActiveTransactionHasChanges = true
+	return config.Set(section, sectionName, "option http-buffer-request", data)
+}
+
 func (c *HAProxyController) FrontendTCPreqsRefresh() (reload bool) {
 	if c.cfg.FrontendRulesStatus[TCP] == EMPTY {
 		return false
@@ -161,9 +383,22 @@ func (c *HAProxyController) FrontendTCPreqsRefresh() (reload bool) {
 	for _, frontend := range []string{FrontendHTTP, FrontendHTTPS} {
 		// DELETE RULES
 		c.frontendTCPRequestRuleDeleteAll(frontend)
+		// CONN_LIMIT
+		// Rules are inserted at index 0, tracking must end before reject rules
+		for _, track := range []bool{false, true} {
+			for _, tcpRule := range c.cfg.FrontendTCPRules[CONN_LIMIT] {
+				if (tcpRule.Action == "track-sc1") == track {
+					utils.LogErr(c.frontendTCPRequestRuleCreate(frontend, tcpRule))
+				}
+			}
+		}
 		// PROXY_PROTCOL
-		if len(c.cfg.FrontendTCPRules[PROXY_PROTOCOL]) > 0 {
-			utils.LogErr(c.frontendTCPRequestRuleCreate(frontend, c.cfg.FrontendTCPRules[PROXY_PROTOCOL][0]))
+		// Behind SSL passthrough frontend, HTTPS frontend gets PROXY protocol from it
+		if frontend == FrontendHTTPS && c.cfg.SSLPassthrough {
+			continue
+		}
+		if tcpRule, ok := c.cfg.FrontendTCPRules[PROXY_PROTOCOL][hashStrToUint(fmt.Sprintf("%s-%s", PROXY_PROTOCOL, frontend))]; ok {
+			utils.LogErr(c.frontendTCPRequestRuleCreate(frontend, tcpRule))
 		}
 	}
 	if !c.cfg.SSLPassthrough {
@@ -213,9 +448,14 @@ func (c *HAProxyController) FrontendTCPreqsRefresh() (reload bool) {
 		c.cfg.MapFiles.Modified(key)
 		utils.LogErr(c.frontendTCPRequestRuleCreate(FrontendSSL, tcpRule))
 	}
+	// SNI_BLACKLIST
+	if tcpRule := c.sniBlacklistRule(); tcpRule != nil {
+		utils.LogErr(c.frontendTCPRequestRuleCreate(FrontendSSL, *tcpRule))
+	}
 	// PROXY_PROTCOL
-	if len(c.cfg.FrontendTCPRules[PROXY_PROTOCOL]) > 0 {
-		utils.LogErr(c.frontendTCPRequestRuleCreate(FrontendSSL, c.cfg.FrontendTCPRules[PROXY_PROTOCOL][0]))
+	// SSL passthrough frontend listens on HTTPS port
+	if tcpRule, ok := c.cfg.FrontendTCPRules[PROXY_PROTOCOL][hashStrToUint(fmt.Sprintf("%s-%s", PROXY_PROTOCOL, FrontendHTTPS))]; ok {
+		utils.LogErr(c.frontendTCPRequestRuleCreate(FrontendSSL, tcpRule))
 	}
 	return true
 }
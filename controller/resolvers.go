@@ -0,0 +1,317 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/params"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	"github.com/haproxytech/models"
+)
+
+// Resolvers section used by servers of ExternalName services
+const resolversSection = "kubernetes"
+
+// Server of ExternalName services backends
+const externalNameServer = "SRV_external"
+
+const resolvConf = "/etc/resolv.conf"
+
+// Return <ip>:<port> of nameservers separated by commas or spaces, port defaults to 53
+func parseNameservers(value string) ([]string, error) {
+	nameservers := []string{}
+	for _, address := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		host, port := address, "53"
+		if net.ParseIP(address) == nil {
+			var err error
+			if host, port, err = net.SplitHostPort(address); err != nil {
+				return nil, fmt.Errorf("incorrect nameserver '%s'", address)
+			}
+		}
+		if p, err := strconv.Atoi(port); net.ParseIP(host) == nil || err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("incorrect nameserver '%s'", address)
+		}
+		// HAProxy takes port after the last colon of IPv6 addresses
+		nameservers = append(nameservers, host+":"+port)
+	}
+	return nameservers, nil
+}
+
+// Return nameservers of resolv.conf, which point to cluster DNS in pods
+func resolvConfNameservers(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	addresses := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "nameserver" {
+			addresses = append(addresses, fields[1])
+		}
+	}
+	return parseNameservers(strings.Join(addresses, " "))
+}
+
+// Parse dns-resolvers annotation, a comma or space separated list of <name>:<ip>[:<port>]
+func parseDNSResolvers(value string) ([]types.Nameserver, error) {
+	lines := []types.Nameserver{}
+	names := map[string]bool{}
+	for _, resolver := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		parts := strings.SplitN(resolver, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || names[parts[0]] {
+			return nil, fmt.Errorf("incorrect resolver '%s'", resolver)
+		}
+		address, err := parseNameservers(parts[1])
+		if err != nil || len(address) != 1 {
+			return nil, fmt.Errorf("incorrect resolver '%s'", resolver)
+		}
+		names[parts[0]] = true
+		lines = append(lines, types.Nameserver{Name: parts[0], Address: address[0]})
+	}
+	return lines, nil
+}
+
+// Resolvers section is required while some ExternalName service exists
+// or some server of the configuration still uses it
+func (c *HAProxyController) resolversRequired(config *parser.Parser) bool {
+	for _, namespace := range c.cfg.Namespace {
+		if !namespace.Relevant {
+			continue
+		}
+		for _, service := range namespace.Services {
+			if service.ExternalName != "" && service.Status != DELETED {
+				return true
+			}
+		}
+	}
+	backends, _ := config.SectionsGet(parser.Backends)
+	for _, backend := range backends {
+		data, err := config.Get(parser.Backends, backend, "server")
+		if err != nil {
+			continue
+		}
+		for _, server := range data.([]types.Server) {
+			for _, param := range server.Params {
+				if option, ok := param.(*params.ServerOptionValue); ok && option.Name == "resolvers" && option.Value == resolversSection {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Nameservers of resolvers section, from dns-resolvers or nameservers annotation
+// and from /etc/resolv.conf when none is set
+func (c *HAProxyController) resolversNameservers() ([]types.Nameserver, error) {
+	annResolvers, _ := GetValueFromAnnotations("dns-resolvers", c.cfg.ConfigMap.Annotations)
+	if annResolvers != nil && annResolvers.Status != DELETED && annResolvers.Value != "" {
+		lines, err := parseDNSResolvers(annResolvers.Value)
+		if err != nil {
+			return nil, fmt.Errorf("dns-resolvers annotation: %s", err)
+		}
+		return lines, nil
+	}
+	var nameservers []string
+	var err error
+	annNameservers, _ := GetValueFromAnnotations("nameservers", c.cfg.ConfigMap.Annotations)
+	if annNameservers != nil && annNameservers.Status != DELETED && annNameservers.Value != "" {
+		if nameservers, err = parseNameservers(annNameservers.Value); err != nil {
+			return nil, fmt.Errorf("nameservers annotation: %s", err)
+		}
+	}
+	if len(nameservers) == 0 {
+		if nameservers, err = resolvConfNameservers(resolvConf); err != nil {
+			utils.LogErr(err)
+		}
+	}
+	return nameserverLines(nameservers), nil
+}
+
+// Nameservers named dns1, dns2...
+func nameserverLines(nameservers []string) []types.Nameserver {
+	lines := make([]types.Nameserver, 0, len(nameservers))
+	for i, address := range nameservers {
+		lines = append(lines, types.Nameserver{Name: fmt.Sprintf("dns%d", i+1), Address: address})
+	}
+	return lines
+}
+
+// Set hold valid, timeout retry and accepted_payload_size of resolvers section,
+// HAProxy defaults are used for the annotations which are not set
+func (c *HAProxyController) resolversOptions(config *parser.Parser) {
+	value := func(name string) string {
+		ann, _ := GetValueFromAnnotations(name, c.cfg.ConfigMap.Annotations)
+		if ann == nil || ann.Status == DELETED {
+			return ""
+		}
+		return ann.Value
+	}
+	var err error
+	if v := value("dns-hold-valid"); v == "" {
+		err = config.Set(parser.Resolvers, resolversSection, "hold valid", nil)
+	} else if _, err = utils.ParseTime(v); err == nil {
+		err = config.Set(parser.Resolvers, resolversSection, "hold valid", types.StringC{Value: v})
+	}
+	utils.LogErr(err)
+	if v := value("dns-timeout-retry"); v == "" {
+		err = config.Set(parser.Resolvers, resolversSection, "timeout retry", nil)
+	} else if _, err = utils.ParseTime(v); err == nil {
+		err = config.Set(parser.Resolvers, resolversSection, "timeout retry", types.SimpleTimeout{Value: v})
+	}
+	utils.LogErr(err)
+	if v := value("dns-accepted-payload-size"); v == "" {
+		err = config.Set(parser.Resolvers, resolversSection, "accepted_payload_size", nil)
+	} else if size, errSize := strconv.Atoi(v); errSize != nil || size < 512 || size > 8192 {
+		err = fmt.Errorf("dns-accepted-payload-size annotation: incorrect size '%s', expected 512 to 8192", v)
+	} else {
+		err = config.Set(parser.Resolvers, resolversSection, "accepted_payload_size", types.StringC{Value: v})
+	}
+	utils.LogErr(err)
+}
+
+// dns-* annotations set the resolvers section HAProxy re-resolves ExternalName services with.
+// Without them the section is only kept while it is required, nameservers default to the
+// nameservers annotation and then to /etc/resolv.conf.
+func (c *HAProxyController) handleResolvers() (reload bool) {
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	exists := false
+	sections, _ := config.SectionsGet(parser.Resolvers)
+	for _, section := range sections {
+		if section == resolversSection {
+			exists = true
+		}
+	}
+	configured, changed := false, false
+	for _, name := range []string{"dns-resolvers", "dns-hold-valid", "dns-timeout-retry", "dns-accepted-payload-size", "nameservers"} {
+		ann, _ := GetValueFromAnnotations(name, c.cfg.ConfigMap.Annotations)
+		if ann == nil {
+			continue
+		}
+		changed = changed || ann.Status != EMPTY
+		configured = configured || (ann.Status != DELETED && ann.Value != "")
+	}
+	if !configured && !c.resolversRequired(config) {
+		if !exists {
+			return false
+		}
+		if err = config.SectionsDelete(parser.Resolvers, resolversSection); err != nil {
+			utils.LogErr(err)
+			return false
+		}
+		logger.Infof("Resolvers section '%s' removed", resolversSection)
+		c.ActiveTransactionHasChanges = true
+		return true
+	}
+	if exists && !changed {
+		return false
+	}
+
+	lines, err := c.resolversNameservers()
+	if err != nil {
+		utils.LogErr(err)
+		if exists {
+			return false
+		}
+		nameservers, errResolvConf := resolvConfNameservers(resolvConf)
+		utils.LogErr(errResolvConf)
+		lines = nameserverLines(nameservers)
+	}
+	if len(lines) == 0 {
+		utils.LogErr(errors.New("no nameserver found, ExternalName services can't be resolved"))
+		return false
+	}
+
+	if !exists {
+		if err = config.SectionsCreate(parser.Resolvers, resolversSection); err != nil {
+			utils.LogErr(err)
+			return false
+		}
+	}
+	if err = config.Set(parser.Resolvers, resolversSection, "nameserver", lines); err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	c.resolversOptions(config)
+	addresses := make([]string, 0, len(lines))
+	for _, line := range lines {
+		addresses = append(addresses, line.Name+" "+line.Address)
+	}
+	logger.Infof("Resolvers nameservers: %s", strings.Join(addresses, ", "))
+	c.ActiveTransactionHasChanges = true
+	return true
+}
+
+// ExternalName services get a single server resolving the external name with HAProxy resolvers,
+// so DNS changes are followed by HAProxy. Servers of endpoints are removed when service type changed.
+func (c *HAProxyController) handleExternalName(ingress *Ingress, path *IngressPath, service *Service, backendName string) (reload bool, err error) {
+	port := path.ServicePortInt
+	if path.ServicePortString != "" {
+		port = 0
+		for _, sp := range service.Ports {
+			if sp.Name == path.ServicePortString {
+				port = sp.Port
+			}
+		}
+	}
+	if port == 0 {
+		return false, fmt.Errorf("servicePort(Str: %s, Int: %d) for ExternalName service '%s' not found", path.ServicePortString, path.ServicePortInt, service.Name)
+	}
+	_, servers, err := c.NativeAPI.Configuration.GetServers(backendName, c.ActiveTransaction)
+	if err != nil {
+		return false, err
+	}
+	server := models.Server{
+		Name:   externalNameServer,
+		Weight: utils.PtrInt64(128),
+	}
+	exists := false
+	for _, s := range servers {
+		if s.Name != externalNameServer {
+			utils.LogErr(c.backendServerDelete(backendName, s.Name))
+			reload = true
+			continue
+		}
+		exists = true
+		server = *s
+	}
+	modified := !exists || server.Address != service.ExternalName || server.Port == nil || *server.Port != port
+	server.Address = service.ExternalName
+	server.Port = &port
+	server.Resolvers = resolversSection
+	server.InitAddr = "none"
+	modified = c.handleServerAnnotations(ingress, service, &server) || modified
+	switch {
+	case !exists:
+		logger.Infof("Backend %s: server resolving %s:%d", backendName, service.ExternalName, port)
+		err = c.backendServerCreate(backendName, server)
+	case modified:
+		err = c.backendServerEdit(backendName, server)
+	}
+	return reload || modified, err
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Replay ingresses, services, endpoints, secrets and pods of informers stores into configuration
+// so changes of missed events are applied. Objects no longer in stores are deleted.
+// Called from SyncData, objects equal to known ones are left untouched.
+func (c *HAProxyController) resync() (change bool) {
+	if store, ok := c.k8s.stores[SECRET]; ok {
+		for _, obj := range store.List() {
+			item := convertToSecret(obj.(*corev1.Secret), ADDED)
+			change = c.eventSecret(c.cfg.GetNamespace(item.Namespace), item) || change
+		}
+		for _, namespace := range c.cfg.Namespace {
+			for name, secret := range namespace.Secret {
+				if secret.Status != DELETED && !inStore(store, namespace.Name, name) {
+					change = c.eventSecret(namespace, &Secret{Namespace: namespace.Name, Name: name, Status: DELETED}) || change
+				}
+			}
+		}
+	}
+	if len(c.k8s.podStores) > 0 {
+		for _, store := range c.k8s.podStores {
+			for _, obj := range store.List() {
+				item := convertToPod(obj.(*corev1.Pod), ADDED)
+				if c.isWatchedNamespace(item.Namespace) {
+					change = c.eventPod(c.cfg.GetNamespace(item.Namespace), item) || change
+				}
+			}
+		}
+		for _, namespace := range c.cfg.Namespace {
+			for name := range namespace.Pods {
+				if !inStores(c.k8s.podStores, namespace.Name, name) {
+					change = c.eventPod(namespace, &Pod{Namespace: namespace.Name, Name: name, Status: DELETED}) || change
+				}
+			}
+		}
+	}
+	if store, ok := c.k8s.stores[SERVICE]; ok {
+		for _, obj := range store.List() {
+			item := convertToService(obj.(*corev1.Service), ADDED)
+			if c.isWatchedNamespace(item.Namespace) {
+				change = c.eventService(c.cfg.GetNamespace(item.Namespace), item) || change
+			}
+		}
+		for _, namespace := range c.cfg.Namespace {
+			for name, service := range namespace.Services {
+				if service.Status != DELETED && !inStore(store, namespace.Name, name) {
+					change = c.eventService(namespace, &Service{Namespace: namespace.Name, Name: name, Status: DELETED}) || change
+				}
+			}
+		}
+	}
+	if items, ok := c.k8s.storedEndpoints(); ok {
+		stored := map[string]struct{}{}
+		for _, item := range items {
+			stored[item.Namespace+"/"+item.Service.Value] = struct{}{}
+			if !c.isWatchedNamespace(item.Namespace) {
+				continue
+			}
+			change = c.eventEndpoints(c.cfg.GetNamespace(item.Namespace), item) || change
+		}
+		for _, namespace := range c.cfg.Namespace {
+			for name, endpoints := range namespace.Endpoints {
+				if _, ok := stored[namespace.Name+"/"+name]; endpoints.Status != DELETED && !ok {
+					change = c.eventEndpoints(namespace, &Endpoints{Namespace: namespace.Name, Service: StringW{Value: name}, Status: DELETED}) || change
+				}
+			}
+		}
+	}
+	if store, ok := c.k8s.stores[INGRESS]; ok {
+		for _, obj := range store.List() {
+			item, err := c.k8s.convertToIngress(obj, ADDED)
+			if err == ErrIgnored || !c.cfg.IsRelevantNamespace(item.Namespace) {
+				continue
+			}
+			change = c.eventIngress(c.cfg.GetNamespace(item.Namespace), item) || change
+		}
+		for _, namespace := range c.cfg.Namespace {
+			for name, ingress := range namespace.Ingresses {
+				if ingress.Status != DELETED && !inStore(store, namespace.Name, name) {
+					change = c.eventIngress(namespace, &Ingress{Namespace: namespace.Name, Name: name, Status: DELETED}) || change
+				}
+			}
+		}
+	}
+	return change
+}
+
+func inStore(store cache.Store, namespace, name string) bool {
+	_, exists, err := store.GetByKey(namespace + "/" + name)
+	return err == nil && exists
+}
+
+func inStores(stores []cache.Store, namespace, name string) bool {
+	for _, store := range stores {
+		if inStore(store, namespace, name) {
+			return true
+		}
+	}
+	return false
+}
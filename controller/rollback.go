@@ -0,0 +1,166 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/haproxytech/client-native/configuration"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+// Number of consecutive failed commits before restoring last valid configuration
+const commitFailuresBeforeRollback = 3
+
+// Consecutive failed commits after which healthz fails, restoring last valid
+// configuration did not help
+const commitFailuresUnhealthy = 2 * commitFailuresBeforeRollback
+
+// Failed syncs are retried after 1s, delay doubles with each failure up to this one
+const syncRetryMaxDelay = time.Minute
+
+// Copy of last successfully committed HAProxy configuration
+func lastGoodCFG() string {
+	return HAProxyCFG + ".lastgood"
+}
+
+// Configuration client parameters, transactions are validated with haproxy -c before
+// being committed except in test mode where HAProxy may not be available.
+func (c *HAProxyController) configurationParams() configuration.ClientParams {
+	return configuration.ClientParams{
+		ConfigurationFile:         HAProxyCFG,
+		PersistentTransactions:    false,
+		Haproxy:                   "haproxy",
+		ValidateConfigurationFile: !c.osArgs.Test,
+	}
+}
+
+// Keep a copy of committed configuration so it can be restored on repeated failures.
+func (c *HAProxyController) configCommitted() {
+	c.commitFailures = 0
+	atomic.StoreInt64(&c.metrics.commitFailures, 0)
+	c.health.commitDone(0)
+	if c.ActiveTransactionHasChanges {
+		utils.LogErr(copyFile(HAProxyCFG, lastGoodCFG()))
+	}
+}
+
+// Count failed commit, every commitFailuresBeforeRollback consecutive failures
+// last valid configuration is restored and configuration client re-initialized.
+func (c *HAProxyController) configCommitFailed(err error) {
+	c.commitFailures++
+	atomic.StoreInt64(&c.metrics.commitFailures, int64(c.commitFailures))
+	c.health.commitDone(c.commitFailures)
+	if c.commitFailures == commitFailuresUnhealthy {
+		c.k8s.PodEvent(ReasonSyncFailed, fmt.Sprintf("%d consecutive HAProxy configuration commits failed: %s", c.commitFailures, err))
+	}
+	if c.commitFailures%commitFailuresBeforeRollback != 0 {
+		return
+	}
+	haproxyLogger.Errorf("%d consecutive configuration commits failed, restoring %s", c.commitFailures, lastGoodCFG())
+	errRollback := c.rollbackConfiguration()
+	c.health.rollbackDone(errRollback)
+	if errRollback != nil {
+		haproxyLogger.Errorf("unable to restore last valid configuration: %s", errRollback)
+		return
+	}
+	atomic.AddUint64(&c.metrics.rollbacks, 1)
+}
+
+// HAProxy is only reloaded after a successful commit, so running process still uses
+// the restored configuration. Pending changes are applied again on next sync.
+func (c *HAProxyController) rollbackConfiguration() error {
+	if err := copyFile(lastGoodCFG(), HAProxyCFG); err != nil {
+		return err
+	}
+	confClient := configuration.Client{}
+	if err := confClient.Init(c.configurationParams()); err != nil {
+		return err
+	}
+	c.NativeAPI.Configuration = &confClient
+	return nil
+}
+
+// Delay before retrying a failed configuration update, doubled by consecutive failed syncs
+// whatever made them fail: transaction, commit or reload
+func syncRetryDelay(failures int) time.Duration {
+	delay := time.Second
+	for i := 1; i < failures && delay < syncRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > syncRetryMaxDelay {
+		delay = syncRetryMaxDelay
+	}
+	return delay
+}
+
+// Lines reported by haproxy -c in validation errors of transactions
+var commitErrorLine = regexp.MustCompile(`line=(\d+) msg="([^"]*)"`)
+
+// Log configuration errors of a failed commit with the section and the line they are in,
+// read from the failed transaction file which is then removed.
+func (c *HAProxyController) logCommitError(err error) {
+	if c.ActiveTransaction == "" {
+		return
+	}
+	matches := commitErrorLine.FindAllStringSubmatch(err.Error(), -1)
+	if len(matches) == 0 {
+		return
+	}
+	file := filepath.Join(c.NativeAPI.Configuration.TransactionDir, "failed", fmt.Sprintf("%s.%s", filepath.Base(HAProxyCFG), c.ActiveTransaction))
+	content, errRead := ioutil.ReadFile(file)
+	if errRead != nil {
+		haproxyLogger.Error(errRead)
+		return
+	}
+	lines := strings.Split(string(content), "\n")
+	for _, match := range matches {
+		lineNo, _ := strconv.Atoi(match[1])
+		if lineNo < 1 || lineNo > len(lines) {
+			haproxyLogger.Errorf("configuration error at line %d: %s", lineNo, match[2])
+			continue
+		}
+		haproxyLogger.Errorf("configuration error in '%s' at line %d '%s': %s", configSection(lines, lineNo), lineNo, strings.TrimSpace(lines[lineNo-1]), match[2])
+	}
+	utils.LogErr(os.Remove(file))
+}
+
+// Sections of HAProxy configuration start with one of these keywords, unindented
+var configSectionKeywords = []string{"global", "defaults", "frontend", "backend", "listen", "resolvers", "userlist", "peers", "program", "cache", "mailers"}
+
+// Header of the section of line lineNo (starting at 1)
+func configSection(lines []string, lineNo int) string {
+	for i := lineNo - 1; i >= 0; i-- {
+		line := lines[i]
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		for _, keyword := range configSectionKeywords {
+			if fields[0] == keyword {
+				return strings.Join(fields, " ")
+			}
+		}
+	}
+	return "global"
+}
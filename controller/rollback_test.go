@@ -0,0 +1,168 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haproxytech/client-native/configuration"
+	parser "github.com/haproxytech/config-parser/v2"
+)
+
+// haproxy -c replacement rejecting configurations with an unknown directive
+const fakeHAProxy = `#!/bin/sh
+# haproxy -f <file> -c
+if grep -q invalid-directive "$2"; then
+  echo "unknown keyword 'invalid-directive' in 'global' section" >&2
+  exit 1
+fi
+`
+
+const validCFG = `global
+  maxconn 1000
+
+defaults
+  mode http
+`
+
+// HAProxy configuration validated by fakeHAProxy, found first in PATH
+func setupValidatedConfig(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "haproxy-rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "haproxy"), []byte(fakeHAProxy), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg, path := HAProxyCFG, os.Getenv("PATH")
+	HAProxyCFG = filepath.Join(dir, "haproxy.cfg")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	if err = ioutil.WriteFile(HAProxyCFG, []byte(validCFG), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = copyFile(HAProxyCFG, lastGoodCFG()); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		HAProxyCFG = cfg
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+// Sync steps of updateHAProxy around the commit of a transaction
+func commitDirective(t *testing.T, c *HAProxyController, directive string) error {
+	t.Helper()
+	if err := c.apiStartTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.apiDisposeTransaction()
+	if err := c.unprocessedSet(parser.Global, parser.GlobalSectionName, directive, []string{directive}); err != nil {
+		t.Fatal(err)
+	}
+	c.ActiveTransactionHasChanges = true
+	if err := c.apiCommitTransaction(); err != nil {
+		c.configCommitFailed(err)
+		return err
+	}
+	c.configCommitted()
+	return nil
+}
+
+func fileContains(t *testing.T, file, s string) bool {
+	t.Helper()
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Contains(string(content), s)
+}
+
+// A handler injects an invalid directive on every sync: HAProxy configuration is
+// never changed, the last valid one is restored and later valid changes are committed.
+func TestCommitInvalidDirective(t *testing.T) {
+	defer setupValidatedConfig(t)()
+	c := testController()
+	client := &configuration.Client{}
+	if err := client.Init(c.configurationParams()); err != nil {
+		t.Fatal(err)
+	}
+	c.NativeAPI.Configuration = client
+
+	for i := 1; i <= commitFailuresBeforeRollback; i++ {
+		if err := commitDirective(t, c, "invalid-directive"); err == nil {
+			t.Fatalf("commit %d of invalid directive: expected error", i)
+		}
+		if fileContains(t, HAProxyCFG, "invalid-directive") {
+			t.Fatalf("commit %d of invalid directive: written to %s", i, HAProxyCFG)
+		}
+		if c.commitFailures != i || c.health.commitFailures != i {
+			t.Errorf("commit %d: expected %d failures, got %d (healthz %d)", i, i, c.commitFailures, c.health.commitFailures)
+		}
+	}
+	if rollbacks := atomic.LoadUint64(&c.metrics.rollbacks); rollbacks != 1 {
+		t.Errorf("expected one rollback after %d failures, got %d", commitFailuresBeforeRollback, rollbacks)
+	}
+	if c.NativeAPI.Configuration == client {
+		t.Error("configuration client not re-initialized by rollback")
+	}
+	content, err := ioutil.ReadFile(HAProxyCFG)
+	if err != nil || string(content) != validCFG {
+		t.Errorf("expected last valid configuration restored, got %s, %v", content, err)
+	}
+
+	if err = commitDirective(t, c, "nbthread 2"); err != nil {
+		t.Fatalf("valid change after rollback: %s", err)
+	}
+	if c.commitFailures != 0 || c.health.commitFailures != 0 {
+		t.Errorf("valid change: expected failures reset, got %d", c.commitFailures)
+	}
+	if !fileContains(t, lastGoodCFG(), "nbthread 2") {
+		t.Error("valid change: last valid configuration not updated")
+	}
+}
+
+// Retry delay grows with failed syncs even when no commit failed, e.g. transaction not started
+func TestSyncRetryBackoff(t *testing.T) {
+	c := testController()
+	errSync := errors.New("transaction not started")
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		c.syncRetry(errSync)
+		if delay := syncRetryDelay(c.syncFailures); delay != expected {
+			t.Errorf("%d failed syncs: expected delay %s, got %s", c.syncFailures, expected, delay)
+		}
+	}
+	if c.commitFailures != 0 {
+		t.Errorf("expected no failed commit, got %d", c.commitFailures)
+	}
+	// Failure is not from the commit, next sync is still a full one
+	if !c.forceFullSync {
+		t.Error("failed sync: expected next sync to be a full one")
+	}
+	if delay := syncRetryDelay(20); delay != syncRetryMaxDelay {
+		t.Errorf("20 failed syncs: expected delay %s, got %s", syncRetryMaxDelay, delay)
+	}
+	if c.syncRetry(nil) != nil || c.syncFailures != 0 {
+		t.Errorf("successful sync: expected no retry and failures reset, got %d", c.syncFailures)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+// Period of backends statistics polling to detect requests waiting for a server
+const scaleFromZeroPeriod = time.Second
+
+// Minimum delay between two scale up attempts of a deployment
+const scaleFromZeroRetry = 10 * time.Second
+
+// Deployment woken up by requests of a backend, see scale-from-zero annotation
+type scaleFromZeroTarget struct {
+	Namespace  string
+	Deployment string
+}
+
+// handle scale-from-zero and scale-from-zero-target annotations: while the backend has
+// no server, requests wait for one up to timeout queue and the deployment is scaled to one
+// replica by scaleFromZeroMonitor. Server slots are provisioned even without pods by
+// handlePath, so the first pod is enabled through runtime API while requests are waiting.
+func (c *HAProxyController) handleScaleFromZero(ingress *Ingress, service *Service, backendName string) (reload bool) {
+	target, enabled := c.scaleFromZeroTarget(ingress, service)
+	line := ""
+	if enabled {
+		annTimeout, _ := c.backendAnnotation("timeout-queue", ingress, service)
+		timeout, err := utils.ParseTime(annTimeout.Value)
+		if err != nil {
+			utils.LogErr(fmt.Errorf("scale-from-zero annotation: timeout-queue: %s", err))
+			timeout = utils.PtrInt64(5000)
+		}
+		line = fmt.Sprintf("http-request lua.wait-for-server %d if { nbsrv eq 0 }", *timeout)
+	}
+	if _, ok := c.cfg.ScaleFromZero[backendName]; ok != enabled {
+		// Lua script is loaded while some backend uses it
+		reload = true
+	}
+	if enabled {
+		c.cfg.ScaleFromZero[backendName] = target
+	} else {
+		delete(c.cfg.ScaleFromZero, backendName)
+	}
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		utils.LogErr(err)
+		return reload
+	}
+	current := ""
+	if data, errGet := config.Get(parser.Backends, backendName, ""); errGet == nil {
+		for _, unprocessed := range data.([]types.UnProcessed) {
+			if strings.HasPrefix(unprocessed.Value, "http-request lua.wait-for-server") {
+				current = unprocessed.Value
+			}
+		}
+	}
+	if current == line {
+		return reload
+	}
+	lines := []string{}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	utils.LogErr(c.unprocessedSet(parser.Backends, backendName, "http-request lua.wait-for-server", lines))
+	return true
+}
+
+// Deployment of scale-from-zero annotation, it defaults to the name of the service
+func (c *HAProxyController) scaleFromZeroTarget(ingress *Ingress, service *Service) (target scaleFromZeroTarget, enabled bool) {
+	annEnabled, _ := c.backendAnnotation("scale-from-zero", ingress, service)
+	if annEnabled == nil || annEnabled.Status == DELETED {
+		return target, false
+	}
+	enabled, err := utils.GetBoolValue(annEnabled.Value, "scale-from-zero")
+	if err != nil || !enabled {
+		if annEnabled.Status != EMPTY {
+			utils.LogErr(err)
+		}
+		return target, false
+	}
+	target = scaleFromZeroTarget{Namespace: service.Namespace, Deployment: service.Name}
+	if annDeployment, _ := c.backendAnnotation("scale-from-zero-target", ingress, service); annDeployment != nil && annDeployment.Status != DELETED && annDeployment.Value != "" {
+		target.Deployment = annDeployment.Value
+	}
+	return target, true
+}
+
+// Endpoints of a scale-from-zero backend, they get server slots even without address
+func (c *HAProxyController) scaleFromZeroEndpoints(endpoints *Endpoints) bool {
+	for backendName := range endpoints.Backends {
+		if _, ok := c.cfg.ScaleFromZero[backendName]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove deleted backends from scale-from-zero ones, snapshot is taken for scaleFromZeroMonitor
+func (c *HAProxyController) refreshScaleFromZero() {
+	targets := make(map[string]scaleFromZeroTarget, len(c.cfg.ScaleFromZero))
+	for backendName, target := range c.cfg.ScaleFromZero {
+		if _, err := c.backendGet(backendName); err != nil {
+			delete(c.cfg.ScaleFromZero, backendName)
+			continue
+		}
+		targets[backendName] = target
+	}
+	c.scaleFromZeroTargets.Store(targets)
+}
+
+// Poll statistics of scale-from-zero backends: requests reaching a backend without active
+// server increase its sessions counter, its deployment is then scaled to one replica.
+func (c *HAProxyController) runScaleFromZeroMonitor() {
+	if c.osArgs.Test {
+		return
+	}
+	go func() {
+		sessions := map[string]int64{}
+		lastScale := map[string]time.Time{}
+		for range time.Tick(scaleFromZeroPeriod) {
+			targets, _ := c.scaleFromZeroTargets.Load().(map[string]scaleFromZeroTarget)
+			if len(targets) == 0 {
+				continue
+			}
+			stats, err := c.backendsStats()
+			if err != nil {
+				logger.Debugf("scale-from-zero: %s", err)
+				continue
+			}
+			for backendName, target := range targets {
+				stat, ok := stats[backendName]
+				if !ok {
+					continue
+				}
+				// Counters are reset on reload. All sessions count on the first poll of a
+				// backend, so its first request doesn't wait for another poll.
+				previous := sessions[backendName]
+				if stat.sessions < previous {
+					previous = 0
+				}
+				sessions[backendName] = stat.sessions
+				if stat.active > 0 || stat.sessions <= previous {
+					continue
+				}
+				if time.Since(lastScale[backendName]) < scaleFromZeroRetry {
+					continue
+				}
+				lastScale[backendName] = time.Now()
+				scaled, err := c.k8s.ScaleFromZero(target.Namespace, target.Deployment)
+				if err != nil {
+					logger.Errorf("scale-from-zero of backend '%s': %s", backendName, err)
+					continue
+				}
+				if scaled {
+					logger.Infof("scale-from-zero: deployment '%s/%s' scaled to 1 replica for backend '%s'", target.Namespace, target.Deployment, backendName)
+				}
+			}
+		}
+	}()
+}
+
+type backendStat struct {
+	sessions int64
+	active   int64
+}
+
+// Cumulated sessions and active servers of backends, from runtime API statistics
+func (c *HAProxyController) backendsStats() (map[string]backendStat, error) {
+	stat, err := c.runtimeStats("show stat -1 2 -1")
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(stat, "# ")))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, fmt.Errorf("incorrect show stat output: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	field := func(record []string, name string) int64 {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return 0
+		}
+		value, _ := strconv.ParseInt(record[i], 10, 64)
+		return value
+	}
+	stats := map[string]backendStat{}
+	for _, record := range records[1:] {
+		if len(record) < 2 || record[1] != "BACKEND" {
+			continue
+		}
+		stats[record[0]] = backendStat{
+			sessions: field(record, "stot"),
+			active:   field(record, "act"),
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Add secret reference "<namespace>/<name>" or "<name>" of namespace to index
+func addSecretRef(index map[string]struct{}, namespace, value string) {
+	if value == "" {
+		return
+	}
+	if !strings.Contains(value, "/") {
+		if namespace == "" {
+			return
+		}
+		value = namespace + "/" + value
+	}
+	index[value] = struct{}{}
+}
+
+// Add secrets of secret://<namespace>/<name>/<key> source references of annotations to index
+func addSourceRefs(index map[string]struct{}, annotations MapStringW) {
+	for _, ann := range annotations {
+		if ref, ok := parseSourceRef(ann.Value); ok && ref.kind == "secret" {
+			index[ref.namespace+"/"+ref.name] = struct{}{}
+		}
+	}
+}
+
+// Secrets referenced by TLS of ingresses, default certificate, stats-auth, TCP services
+// and source references of annotations. Deleted ingresses are kept until they are cleaned.
+func (c *HAProxyController) referencedSecrets() map[string]struct{} {
+	index := map[string]struct{}{}
+	for _, namespace := range c.cfg.Namespace {
+		for _, ingress := range namespace.Ingresses {
+			for _, tls := range ingress.TLS {
+				addSecretRef(index, ingress.Namespace, tls.SecretName.Value)
+			}
+			addSourceRefs(index, ingress.Annotations)
+		}
+	}
+	// --default-ssl-certificate is kept while ssl-certificate annotation replaces it
+	if ann, err := defaultAnnotationValues.Get("ssl-certificate"); err == nil {
+		addSecretRef(index, "", ann.Value)
+	}
+	if c.cfg.ConfigMap != nil {
+		for _, name := range []string{"ssl-certificate", "stats-auth"} {
+			if ann, _ := GetValueFromAnnotations(name, c.cfg.ConfigMap.Annotations); ann != nil {
+				addSecretRef(index, "", ann.Value)
+			}
+		}
+		addSourceRefs(index, c.cfg.ConfigMap.Annotations)
+	}
+	if c.cfg.ConfigMapTCPServices != nil {
+		for _, ann := range c.cfg.ConfigMapTCPServices.Annotations {
+			svc, err := parseTCPService(ann.Value)
+			if err != nil {
+				continue
+			}
+			addSecretRef(index, svc.namespace, svc.sslSecret)
+			if ref, ok := parseSourceRef(svc.whitelist); ok && ref.kind == "secret" {
+				index[ref.namespace+"/"+ref.name] = struct{}{}
+			}
+		}
+	}
+	return index
+}
+
+// Events of secrets neither referenced nor already known are dropped
+func (c *HAProxyController) secretReferenced(namespace, name string) bool {
+	_, ok := c.secretIndex[namespace+"/"+name]
+	return ok
+}
+
+// Update index of referenced secrets before a sync. Secrets which became referenced are
+// read from informer store since their events were dropped, the ones no longer referenced
+// are forgotten.
+func (c *HAProxyController) refreshSecretIndex() (change bool) {
+	index := c.referencedSecrets()
+	previous := c.secretIndex
+	c.secretIndex = index
+	for key := range index {
+		if _, ok := previous[key]; ok {
+			continue
+		}
+		parts := strings.SplitN(key, "/", 2)
+		if ns, ok := c.cfg.Namespace[parts[0]]; ok {
+			if _, ok = ns.Secret[parts[1]]; ok {
+				continue
+			}
+		}
+		store, ok := c.k8s.stores[SECRET]
+		if !ok {
+			continue
+		}
+		obj, exists, err := store.GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		logger.Debugf("secret '%s' is now referenced", key)
+		item := convertToSecret(obj.(*corev1.Secret), ADDED)
+		change = c.eventSecret(c.cfg.GetNamespace(item.Namespace), item) || change
+	}
+	for _, namespace := range c.cfg.Namespace {
+		for name, secret := range namespace.Secret {
+			if _, ok := index[namespace.Name+"/"+name]; !ok && secret.Status != DELETED {
+				logger.Debugf("secret '%s/%s' is no longer referenced", namespace.Name, name)
+				delete(namespace.Secret, name)
+			}
+		}
+	}
+	return change
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+// Make HAProxy load servers state of each backend from its own file in HAProxyStateDir,
+// written by saveServerState before each reload.
+func (c *HAProxyController) handleServerState() (reload bool) {
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	directives := []struct {
+		section     parser.Section
+		sectionName string
+		prefix      string
+		values      []string
+	}{
+		{parser.Global, parser.GlobalSectionName, "server-state-file", nil},
+		{parser.Global, parser.GlobalSectionName, "server-state-base", []string{"server-state-base " + HAProxyStateDir}},
+		{parser.Defaults, parser.DefaultSectionName, "load-server-state-from-file", []string{"load-server-state-from-file local"}},
+	}
+	for _, d := range directives {
+		current := []string{}
+		if data, errGet := config.Get(d.section, d.sectionName, ""); errGet == nil {
+			for _, line := range data.([]types.UnProcessed) {
+				if strings.HasPrefix(line.Value, d.prefix+" ") {
+					current = append(current, line.Value)
+				}
+			}
+		}
+		if strings.Join(current, "\n") == strings.Join(d.values, "\n") {
+			continue
+		}
+		if err = c.unprocessedSet(d.section, d.sectionName, d.prefix+" ", d.values); err != nil {
+			utils.LogErr(err)
+			continue
+		}
+		reload = true
+	}
+	return reload
+}
+
+// Saves HAProxy servers state of each backend so it is retrieved after reload.
+// State files of backends no longer running are removed.
+func (c *HAProxyController) saveServerState() error {
+	result, err := c.NativeAPI.Runtime.ExecuteRaw("show backend")
+	if err != nil {
+		return err
+	}
+	backends := map[string]struct{}{}
+	for _, line := range strings.Split(result[0], "\n") {
+		backend := strings.TrimSpace(line)
+		if backend == "" || strings.HasPrefix(backend, "#") {
+			continue
+		}
+		backends[backend] = struct{}{}
+		state, errState := c.NativeAPI.Runtime.ExecuteRaw("show servers state " + backend)
+		if errState != nil {
+			haproxyLogger.Error(errState)
+			continue
+		}
+		if errWrite := writeStateFile(filepath.Join(HAProxyStateDir, backend), state[0]); errWrite != nil {
+			haproxyLogger.Error(errWrite)
+		}
+	}
+	files, err := ioutil.ReadDir(HAProxyStateDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, ok := backends[file.Name()]; ok || file.IsDir() {
+			continue
+		}
+		if errRemove := os.Remove(filepath.Join(HAProxyStateDir, file.Name())); errRemove != nil {
+			haproxyLogger.Error(errRemove)
+		}
+	}
+	return nil
+}
+
+// Write state file atomically so HAProxy never loads a partial one.
+func writeStateFile(path, state string) error {
+	tmp := fmt.Sprintf("%s.tmp", path)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(state); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
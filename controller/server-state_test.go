@@ -0,0 +1,141 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haproxytech/client-native/runtime"
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/types"
+)
+
+// Runtime API socket answering commands with responses, unknown commands get an empty one
+func testRuntimeSocket(t *testing.T, dir string, responses map[string]string) *runtime.Client {
+	t.Helper()
+	socket := filepath.Join(dir, "runtime.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, errAccept := listener.Accept()
+			if errAccept != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			command := strings.TrimPrefix(strings.TrimSpace(line), "set severity-output number;")
+			conn.Write([]byte(responses[command] + "\n")) //nolint errcheck
+			conn.Close()
+		}
+	}()
+	client := &runtime.Client{}
+	if err = client.Init([]string{socket}, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func unprocessedLines(t *testing.T, c *HAProxyController, section parser.Section, sectionName string) []string {
+	t.Helper()
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{}
+	if data, errGet := config.Get(section, sectionName, ""); errGet == nil {
+		for _, line := range data.([]types.UnProcessed) {
+			lines = append(lines, line.Value)
+		}
+	}
+	return lines
+}
+
+// Servers state is saved before a reload in the files the new process loads
+func TestServerStateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateDir := HAProxyStateDir
+	HAProxyStateDir = filepath.Join(dir, "state") + "/"
+	defer func() { HAProxyStateDir = stateDir }()
+	if err = os.Mkdir(HAProxyStateDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c, cleanup := testControllerConfig(t, `global
+  server-state-file global
+
+defaults
+  mode http
+
+backend default-app-80
+  server app-1 10.0.0.1:8080
+`)
+	defer cleanup()
+	if !c.handleServerState() {
+		t.Fatal("server state directives changed: expected reload")
+	}
+	global := unprocessedLines(t, c, parser.Global, parser.GlobalSectionName)
+	if len(global) != 1 || global[0] != "server-state-base "+HAProxyStateDir {
+		t.Errorf("global: expected only server-state-base %s, got %v", HAProxyStateDir, global)
+	}
+	defaults := unprocessedLines(t, c, parser.Defaults, parser.DefaultSectionName)
+	if len(defaults) != 1 || defaults[0] != "load-server-state-from-file local" {
+		t.Errorf("defaults: expected load-server-state-from-file local, got %v", defaults)
+	}
+	if c.handleServerState() {
+		t.Error("server state directives unchanged: unexpected reload")
+	}
+
+	// Reload: state of running backends is saved, the one of a removed backend is pruned
+	stale := filepath.Join(HAProxyStateDir, "default-old-80")
+	if err = ioutil.WriteFile(stale, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := "1\n# be_id be_name srv_id srv_name srv_addr srv_op_state\n3 default-app-80 1 app-1 10.0.0.1 2"
+	c.NativeAPI.Runtime = testRuntimeSocket(t, dir, map[string]string{
+		"show backend":                      "# name\ndefault-app-80\nstats",
+		"show servers state default-app-80": state,
+		"show servers state stats":          "1\n# be_id be_name",
+	})
+	if err = c.saveServerState(); err != nil {
+		t.Fatal(err)
+	}
+	// load-server-state-from-file local reads <server-state-base>/<backend name>
+	content, err := ioutil.ReadFile(filepath.Join(strings.TrimPrefix(global[0], "server-state-base "), "default-app-80"))
+	if err != nil || string(content) != state {
+		t.Errorf("state of default-app-80: expected %q, got %q, %v", state, content, err)
+	}
+	if _, err = os.Stat(filepath.Join(HAProxyStateDir, "stats")); err != nil {
+		t.Errorf("state of stats: %s", err)
+	}
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("state of removed backend not pruned: %v", err)
+	}
+	files, _ := ioutil.ReadDir(HAProxyStateDir)
+	if len(files) != 2 {
+		t.Errorf("expected state files of 2 backends, got %d", len(files))
+	}
+}
@@ -16,59 +16,135 @@ package controller
 
 import (
 	"fmt"
-	"log"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/types"
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
 	"github.com/haproxytech/models"
 )
 
-// handle defaultBackned configured via cli param "default-backend-service"
+// Backend serving a static 404 page while default-backend-service is unavailable
+const defaultNotFoundBackend = "default_404"
+
+const notFoundPage = "HTTP/1.0 404 Not Found\r\nCache-Control: no-cache\r\nConnection: close\r\nContent-Type: text/html\r\n\r\n" +
+	"<html><body><h1>404 Not Found</h1>\nThe requested URL was not found.\n</body></html>\n"
+
+// handle default backend configured via cli params "default-backend-service" and "default-backend-port",
+// it serves requests matching no ingress rule. Its backend follows endpoints of the service like the
+// ones of ingresses, a static 404 page is served while the service does not exist or has no ready endpoint.
 func (c *HAProxyController) handleDefaultService() (reload bool, err error) {
-	reload = false
-	dsvcData, _ := GetValueFromAnnotations("default-backend-service")
-	dsvc := strings.Split(dsvcData.Value, "/")
+	dsvc := c.osArgs.DefaultBackendService
+	if dsvc.Namespace == "" || dsvc.Name == "" {
+		return false, nil
+	}
+	backendName := defaultNotFoundBackend
+	namespace, ok := c.cfg.Namespace[dsvc.Namespace]
+	if !ok {
+		err = fmt.Errorf("default service invalid namespace " + dsvc.Namespace)
+	} else if service, ok := namespace.Services[dsvc.Name]; !ok || service.Status == DELETED {
+		err = fmt.Errorf("default service '%s/%s' does not exist", dsvc.Namespace, dsvc.Name)
+	} else if path, errPort := defaultServicePath(service, int64(c.osArgs.DefaultBackendPort)); errPort != nil {
+		err = errPort
+	} else {
+		ingress := &Ingress{
+			Namespace:   namespace.Name,
+			Name:        "DefaultService",
+			Annotations: MapStringW{},
+			Rules:       map[string]*IngressRule{},
+		}
+		reload, err = c.handlePath(namespace, ingress, &IngressRule{}, path)
+		if endpoints, ok := namespace.Endpoints[service.Name]; service.ExternalName != "" || (ok && endpoints.ready()) {
+			backendName = getBackendName(namespace, service, path)
+		} else if err == nil {
+			err = fmt.Errorf("default service '%s/%s' has no ready endpoints", dsvc.Namespace, dsvc.Name)
+		}
+	}
+	if backendName == defaultNotFoundBackend {
+		r, errBackend := c.notFoundBackend()
+		reload = reload || r
+		if errBackend != nil {
+			return reload, errBackend
+		}
+	}
+	if frontend, errFrontend := c.frontendGet(FrontendHTTP); errFrontend != nil || frontend.DefaultBackend != backendName {
+		logger.Infof("Default backend is now '%s'", backendName)
+		utils.LogErr(c.setDefaultBackend(backendName))
+		reload = true
+	}
+	// Unavailable service is only reported when the default backend changes
+	if !reload {
+		err = nil
+	}
+	return reload, err
+}
 
-	if len(dsvc) != 2 {
-		return reload, fmt.Errorf("default service invalid data")
+// Default backend path on --default-backend-port, or on the first port of the service
+func defaultServicePath(service *Service, port int64) (*IngressPath, error) {
+	for _, sp := range service.Ports {
+		if port == 0 || sp.Port == port {
+			return &IngressPath{
+				ServiceName:      service.Name,
+				ServicePortInt:   sp.Port,
+				IsDefaultBackend: true,
+			}, nil
+		}
 	}
-	if dsvc[0] == "" || dsvc[1] == "" {
-		return reload, nil
+	return nil, fmt.Errorf("default service '%s' has no port %d", service.Name, port)
+}
+
+// Endpoints have an address to serve requests, server slots are disabled
+func (e *Endpoints) ready() bool {
+	if e.Status == DELETED {
+		return false
 	}
-	namespace, ok := c.cfg.Namespace[dsvc[0]]
-	if !ok {
-		return reload, fmt.Errorf("default service invalid namespace " + dsvc[0])
+	for _, ip := range *e.Addresses {
+		if !ip.Disabled && !ip.Draining && ip.Status != DELETED {
+			return true
+		}
 	}
-	service, ok := namespace.Services[dsvc[1]]
-	if !ok {
-		return reload, fmt.Errorf("service '" + dsvc[1] + "' does not exist")
+	return false
+}
+
+// Backend without servers answering with a static 404 page, through errorfile of the 503 it returns
+func (c *HAProxyController) notFoundBackend() (reload bool, err error) {
+	if _, err = c.backendGet(defaultNotFoundBackend); err == nil {
+		return false, nil
 	}
-	ingress := &Ingress{
-		Namespace:   namespace.Name,
-		Name:        "DefaultService",
-		Annotations: MapStringW{},
-		Rules:       map[string]*IngressRule{},
+	file := filepath.Join(HAProxyErrDir, "default-404.http")
+	if err = ioutil.WriteFile(file, []byte(notFoundPage), 0644); err != nil {
+		return false, err
 	}
-	path := &IngressPath{
-		ServiceName:      service.Name,
-		ServicePortInt:   service.Ports[0].Port,
-		IsDefaultBackend: true,
+	if err = c.backendCreate(models.Backend{Name: defaultNotFoundBackend, Mode: "http"}); err != nil {
+		return false, err
 	}
-	return c.handlePath(namespace, ingress, &IngressRule{}, path)
+	return true, c.unprocessedSet(parser.Backends, defaultNotFoundBackend, "errorfile", []string{"errorfile 503 " + file})
 }
 
 // handle the IngressPath related endpoints and make corresponding backend servers configuration in HAProxy
-func (c *HAProxyController) handleEndpointIP(namespace *Namespace, ingress *Ingress, rule *IngressRule, path *IngressPath, service *Service, backendName string, newBackend bool, endpoints *Endpoints, ip *EndpointIP) (reload bool) {
+func (c *HAProxyController) handleEndpointIP(namespace *Namespace, ingress *Ingress, rule *IngressRule, path *IngressPath, service *Service, backendName string, newBackend bool, portName string, ip *EndpointIP, weight *int64) (reload bool) {
 	reload = false
+	port := ip.Port(portName, path.TargetPort)
 	server := models.Server{
 		Name:    ip.HAProxyName,
 		Address: ip.IP,
-		Port:    &path.TargetPort,
+		Port:    &port,
 		Weight:  utils.PtrInt64(128),
 	}
 	if ip.Disabled {
 		server.Maintenance = "enabled"
 	}
+	if weight != nil {
+		server.Weight = weight
+	}
+	// Drain state is applied through runtime API, weight 0 keeps it after a reload
+	if ip.Draining {
+		server.Weight = utils.PtrInt64(0)
+	}
 	annotationsActive := c.handleServerAnnotations(ingress, service, &server)
 	status := ip.Status
 	if status == EMPTY {
@@ -76,6 +152,10 @@ func (c *HAProxyController) handleEndpointIP(namespace *Namespace, ingress *Ingr
 			status = ADDED
 		} else if annotationsActive {
 			status = MODIFIED
+		} else if weight != nil {
+			if current, err := c.backendServerGet(backendName, server.Name); err == nil && (current.Weight == nil || *current.Weight != *weight) {
+				status = MODIFIED
+			}
 		}
 	}
 	switch status {
@@ -100,17 +180,33 @@ func (c *HAProxyController) handleEndpointIP(namespace *Namespace, ingress *Ingr
 				utils.LogErr(err)
 			}
 		}
-		status := "ready"
-		if ip.Disabled {
-			status = "maint"
+		// Address and state were already applied through runtime API, see processEndpointIPs,
+		// server annotations can only be applied by a reload.
+		if annotationsActive {
+			reload = true
+		} else if weight != nil {
+			if err := c.NativeAPI.Runtime.SetServerWeight(backendName, server.Name, strconv.FormatInt(*weight, 10)); err != nil {
+				logger.Error(err)
+				reload = true
+			} else {
+				atomic.AddUint64(&c.metrics.serverUpdatesRuntime, 1)
+			}
 		}
-		log.Printf("Modified: %s - %s - %v\n", backendName, ip.HAProxyName, status)
+		logger.Debugf("Modified: %s - %s - %v\n", backendName, ip.HAProxyName, ip.serverState())
 	case DELETED:
 		err := c.backendServerDelete(backendName, server.Name)
 		if err != nil && !strings.Contains(err.Error(), "does not exist") {
 			utils.LogErr(err)
 		}
-		return true
+		reload = true
+	}
+	// Server lines are rewritten by creation and edition
+	if status == ADDED || status == MODIFIED {
+		utils.LogErr(c.backendServerParam(backendName, server.Name, "slowstart", c.serverSlowstart(ingress, service)))
+		utils.LogErr(c.backendServerParam(backendName, server.Name, "maxqueue", c.serverMaxqueue(ingress, service)))
+	}
+	if reload {
+		atomic.AddUint64(&c.metrics.serverUpdatesReload, 1)
 	}
 	return reload
 }
@@ -132,10 +228,11 @@ func (c *HAProxyController) handleService(namespace *Namespace, ingress *Ingress
 	if status == DELETED {
 		key := fmt.Sprintf("%s-%s-%s-%s", rule.Host, path.Path, namespace.Name, ingress.Name)
 		switch {
+		case path.IsCanary, path.IsAuthService:
 		case path.IsSSLPassthrough:
 			c.deleteUseBackendRule(key, FrontendSSL)
 		case path.IsDefaultBackend:
-			log.Printf("Removing default_backend %s from ingress \n", service.Name)
+			logger.Infof("Removing default_backend %s from ingress \n", service.Name)
 			err = c.setDefaultBackend("")
 			reload = true
 		default:
@@ -145,11 +242,7 @@ func (c *HAProxyController) handleService(namespace *Namespace, ingress *Ingress
 	}
 
 	// Set backendName
-	if path.ServicePortInt == 0 {
-		backendName = fmt.Sprintf("%s-%s-%s", namespace.Name, service.Name, path.ServicePortString)
-	} else {
-		backendName = fmt.Sprintf("%s-%s-%d", namespace.Name, service.Name, path.ServicePortInt)
-	}
+	backendName = getBackendName(namespace, service, path)
 
 	// Get/Create Backend
 	newBackend = false
@@ -174,15 +267,30 @@ func (c *HAProxyController) handleService(namespace *Namespace, ingress *Ingress
 	// handle Annotations
 	activeSSLPassthrough := c.handleSSLPassthrough(ingress, service, path, &backend, newBackend)
 	activeBackendAnn := c.handleBackendAnnotations(ingress, service, &backend, newBackend)
-	if activeBackendAnn || activeSSLPassthrough {
+	activeAffinity, r := c.handleSessionAffinity(ingress, service, &backend)
+	reload = reload || r
+	if activeBackendAnn || activeSSLPassthrough || activeAffinity {
 		if err = c.backendEdit(backend); err != nil {
 			return backendName, newBackend, reload, err
 		}
 		reload = true
 	}
+	c.handleBackendConfigSnippet(ingress, service, backendName)
+	c.handleRequestMirror(namespace, ingress, service, backendName)
+	reload = c.handleScaleFromZero(ingress, service, backendName) || reload
+
+	// Canary and header routing backends are only reachable via the use_backend rules
+	// of the primary one and auth backend via the auth-request Lua action.
+	if path.IsCanary || path.IsAuthService || path.IsTCPService {
+		return backendName, newBackend, reload, nil
+	}
+	canaryBackend, canaryWeight, canaryModified, r := c.handleCanary(namespace, ingress, rule, path)
+	reload = reload || r
+	headerBackend, headerCond, headerModified, r := c.handleHeaderRouting(namespace, ingress, rule, path)
+	reload = reload || r
 
 	// No need to update BackendSwitching
-	if (status == EMPTY && !activeSSLPassthrough) || path.IsTCPService {
+	if status == EMPTY && !activeSSLPassthrough && !canaryModified && !headerModified {
 		return backendName, newBackend, reload, nil
 	}
 
@@ -199,14 +307,18 @@ func (c *HAProxyController) handleService(namespace *Namespace, ingress *Ingress
 		// Update backendSwitching
 		key := fmt.Sprintf("%s-%s-%s-%s", host, path.Path, namespace.Name, ingress.Name)
 		useBackendRule := UseBackendRule{
-			Host:      host,
-			Path:      path.Path,
-			Backend:   backendName,
-			Namespace: namespace.Name,
+			Host:          host,
+			Path:          path.Path,
+			Backend:       backendName,
+			Namespace:     namespace.Name,
+			CanaryBackend: canaryBackend,
+			CanaryWeight:  canaryWeight,
+			HeaderBackend: headerBackend,
+			HeaderCond:    headerCond,
 		}
 		switch {
 		case path.IsDefaultBackend:
-			log.Printf("Confiugring default_backend %s from ingress %s\n", service.Name, ingress.Name)
+			logger.Infof("Confiugring default_backend %s from ingress %s\n", service.Name, ingress.Name)
 			err = c.setDefaultBackend(backendName)
 			reload = true
 		case path.IsSSLPassthrough:
@@ -229,9 +341,164 @@ func (c *HAProxyController) handleService(namespace *Namespace, ingress *Ingress
 	return backendName, newBackend, reload, nil
 }
 
+// handle canary-service annotation by creating a backend for the canary service.
+// Traffic is split between primary and canary backends in refreshBackendSwitching.
+// Canary backend is removed with clearBackends once no use_backend rule references it.
+func (c *HAProxyController) handleCanary(namespace *Namespace, ingress *Ingress, rule *IngressRule, path *IngressPath) (backendName string, weight int64, modified bool, reload bool) {
+	annCanarySvc, _ := GetValueFromAnnotations("canary-service", ingress.Annotations)
+	annCanaryWeight, _ := GetValueFromAnnotations("canary-weight", ingress.Annotations)
+	if annCanarySvc != nil && annCanarySvc.Status != EMPTY {
+		modified = true
+	}
+	if annCanaryWeight != nil && annCanaryWeight.Status != EMPTY {
+		modified = true
+	}
+	if annCanarySvc == nil || annCanarySvc.Status == DELETED {
+		return "", 0, modified, false
+	}
+	weight = 100
+	if annCanaryWeight != nil && annCanaryWeight.Status != DELETED {
+		w, err := strconv.ParseInt(annCanaryWeight.Value, 10, 64)
+		if err != nil || w < 0 || w > 100 {
+			utils.LogErr(fmt.Errorf("canary-weight annotation: incorrect value '%s' in ingress '%s', must be between 0 and 100", annCanaryWeight.Value, ingress.Name))
+			return "", 0, modified, false
+		}
+		weight = w
+	}
+	backendName, reload = c.handleAlternatePath(namespace, ingress, rule, path, "canary-service", annCanarySvc.Value, modified)
+	if backendName == "" {
+		return "", 0, modified, reload
+	}
+	return backendName, weight, modified, reload
+}
+
+// handle route-by-header and route-service annotations by creating a backend for the
+// alternate service, requests with the matching header or cookie are sent to it by a
+// use_backend rule evaluated before the one of the primary backend.
+// Alternate backend is removed with clearBackends once no use_backend rule references it.
+func (c *HAProxyController) handleHeaderRouting(namespace *Namespace, ingress *Ingress, rule *IngressRule, path *IngressPath) (backendName string, cond string, modified bool, reload bool) {
+	annHeader, _ := GetValueFromAnnotations("route-by-header", ingress.Annotations)
+	annService, _ := GetValueFromAnnotations("route-service", ingress.Annotations)
+	for _, ann := range []*StringW{annHeader, annService} {
+		if ann != nil && ann.Status != EMPTY {
+			modified = true
+		}
+	}
+	if annHeader == nil || annHeader.Status == DELETED || annService == nil || annService.Status == DELETED {
+		if modified && (annHeader == nil || annHeader.Status == DELETED) != (annService == nil || annService.Status == DELETED) {
+			utils.LogErr(fmt.Errorf("route-by-header and route-service annotations must be set together in ingress '%s'", ingress.Name))
+		}
+		return "", "", modified, false
+	}
+	cond, err := headerRoutingCond(annHeader.Value)
+	if err != nil {
+		utils.LogErr(fmt.Errorf("route-by-header annotation of ingress '%s': %s", ingress.Name, err))
+		return "", "", modified, false
+	}
+	backendName, reload = c.handleAlternatePath(namespace, ingress, rule, path, "route-service", annService.Value, modified)
+	if backendName == "" {
+		return "", "", modified, reload
+	}
+	return backendName, cond, modified, reload
+}
+
+// ACL of route-by-header annotation, "<header>: <value>" matches the value of a request
+// header and "Cookie: <name>=<value>" the value of a cookie.
+func headerRoutingCond(value string) (string, error) {
+	parts := strings.SplitN(value, ":", 2)
+	name := strings.TrimSpace(parts[0])
+	if len(parts) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+		return "", fmt.Errorf("incorrect value '%s', expected '<header>: <value>'", value)
+	}
+	match := strings.TrimSpace(parts[1])
+	if match == "" || strings.ContainsAny(match, " \t") {
+		return "", fmt.Errorf("incorrect value '%s', header value must be a single word", value)
+	}
+	if strings.EqualFold(name, "cookie") {
+		cookie := strings.SplitN(match, "=", 2)
+		if len(cookie) != 2 || cookie[0] == "" || cookie[1] == "" {
+			return "", fmt.Errorf("incorrect value '%s', expected 'Cookie: <name>=<value>'", value)
+		}
+		return fmt.Sprintf("{ req.cook(%s) -m str %s }", cookie[0], cookie[1]), nil
+	}
+	return fmt.Sprintf("{ req.hdr(%s) -m str %s }", name, match), nil
+}
+
+// Create backend of a service selected by an annotation for an ingress path. Value format
+// is <service>[:<port>], port defaults to the one of the primary service.
+// Empty backend name is returned on errors.
+func (c *HAProxyController) handleAlternatePath(namespace *Namespace, ingress *Ingress, rule *IngressRule, path *IngressPath, annName, value string, modified bool) (backendName string, reload bool) {
+	altPath := &IngressPath{
+		Path:              path.Path,
+		ServicePortInt:    path.ServicePortInt,
+		ServicePortString: path.ServicePortString,
+		IsSSLPassthrough:  path.IsSSLPassthrough,
+		IsCanary:          true,
+		Status:            path.Status,
+	}
+	if modified && altPath.Status == EMPTY {
+		altPath.Status = MODIFIED
+	}
+	parts := strings.Split(value, ":")
+	altPath.ServiceName = parts[0]
+	if len(parts) > 1 {
+		if port, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			altPath.ServicePortInt = port
+			altPath.ServicePortString = ""
+		} else {
+			altPath.ServicePortInt = 0
+			altPath.ServicePortString = parts[1]
+		}
+	}
+	service, ok := namespace.Services[altPath.ServiceName]
+	if !ok {
+		utils.LogErr(fmt.Errorf("%s annotation: service '%s' does not exist", annName, altPath.ServiceName))
+		return "", false
+	}
+	reload, err := c.handlePath(namespace, ingress, rule, altPath)
+	if err != nil {
+		utils.LogErr(err)
+		return "", reload
+	}
+	return getBackendName(namespace, service, altPath), reload
+}
+
+// Delete use_backend rules of path in HTTP, HTTPS and SSL passthrough frontends,
+// including the ones of ip-routing addresses
+func (c *HAProxyController) deletePathUseBackendRules(namespace *Namespace, ingress *Ingress, rule *IngressRule, path *IngressPath) {
+	hosts := []string{rule.Host}
+	if ipRouting, _ := GetValueFromAnnotations("ip-routing", ingress.Annotations); ipRouting != nil {
+		hosts = append(hosts, strings.Split(ipRouting.Value, ",")...)
+	}
+	for _, host := range hosts {
+		c.deleteUseBackendRule(fmt.Sprintf("%s-%s-%s-%s", host, path.Path, namespace.Name, ingress.Name), FrontendHTTP, FrontendHTTPS, FrontendSSL)
+	}
+}
+
+func getBackendName(namespace *Namespace, service *Service, path *IngressPath) string {
+	if path.ServicePortInt == 0 {
+		return fmt.Sprintf("%s-%s-%s", namespace.Name, service.Name, path.ServicePortString)
+	}
+	return fmt.Sprintf("%s-%s-%d", namespace.Name, service.Name, path.ServicePortInt)
+}
+
 // handle IngressPath and make corresponding HAProxy configuration
 func (c *HAProxyController) handlePath(namespace *Namespace, ingress *Ingress, rule *IngressRule, path *IngressPath) (reload bool, err error) {
 	reload = false
+	// Requests of redirected ingresses don't reach a backend, see handleRedirect.
+	// use_backend rules are only removed when handleRedirect creates the redirect
+	// rules, so with a valid URL, and removing redirect annotations restores them.
+	if !path.IsCanary && !path.IsAuthService && !path.IsTCPService && hostPathACL(rule.Host, path.Path) != "" {
+		if location, _, _, errRedirect := ingressRedirectURL(ingress); location != "" && errRedirect == nil {
+			c.deletePathUseBackendRules(namespace, ingress, rule, path)
+			return false, nil
+		}
+		_, _, redirectChanged := ingressRedirect(ingress)
+		annKeepQuery, _ := GetValueFromAnnotations("redirect-keep-query", ingress.Annotations)
+		if (redirectChanged || (annKeepQuery != nil && annKeepQuery.Status != EMPTY)) && path.Status == EMPTY {
+			path.Status = MODIFIED
+		}
+	}
 	service, ok := namespace.Services[path.ServiceName]
 	if !ok {
 		return reload, fmt.Errorf("service '%s' does not exist", path.ServiceName)
@@ -242,50 +509,165 @@ func (c *HAProxyController) handlePath(namespace *Namespace, ingress *Ingress, r
 	if err != nil {
 		return reload, err
 	}
+	if service.ExternalName != "" {
+		if backendName == "" {
+			return reload, nil
+		}
+		r, err = c.handleExternalName(ingress, path, service, backendName)
+		return reload || r, err
+	}
+	if service.Status == MODIFIED && backendName != "" && !newBackend {
+		// Service may have been an ExternalName one
+		if errDel := c.backendServerDelete(backendName, externalNameServer); errDel == nil {
+			reload = true
+		}
+	}
 
 	endpoints, ok := namespace.Endpoints[service.Name]
 	if !ok {
-		log.Printf("No Endpoints found for service '%s'", service.Name)
-		return reload, nil // not an end of world scenario, just log this
+		logger.Warningf("No Endpoints found for service '%s'", service.Name)
+		r = c.handleNoEndpoints(ingress, service, path, backendName, nil)
+		return reload || r, nil // not an end of world scenario, just log this
 	}
-	endpoints.BackendName = backendName
-	if err := c.setTargetPort(path, service, endpoints); err != nil {
+	portName, portChanged, err := c.setTargetPort(path, service, endpoints, backendName)
+	if err != nil {
 		return reload, err
 	}
+	endpoints.setBackend(backendName, portName)
+	// Slots of scale-from-zero backends are created with the backend, requests
+	// then wait for a pod without reload, see handleScaleFromZero
+	if len(*endpoints.Addresses) == 0 && c.scaleFromZeroEndpoints(endpoints) {
+		c.processEndpointIPs(endpoints)
+	}
 
+	weights := c.blueGreenWeights(namespace, service, endpoints)
 	for _, ip := range *endpoints.Addresses {
-		r := c.handleEndpointIP(namespace, ingress, rule, path, service, backendName, newBackend, endpoints, ip)
+		// Port was already updated through runtime API, servers are rewritten for next reload
+		if portChanged && ip.Status == EMPTY {
+			ip.Status = MODIFIED
+		}
+		var weight *int64
+		if w, ok := weights[ip.HAProxyName]; ok {
+			weight = utils.PtrInt64(w)
+		}
+		r := c.handleEndpointIP(namespace, ingress, rule, path, service, backendName, newBackend, portName, ip, weight)
 		reload = reload || r
 	}
-	return reload, nil
+	// Servers and no-endpoints response are updated in the same sync
+	r = c.handleNoEndpoints(ingress, service, path, backendName, endpoints)
+	return reload || r, nil
+}
+
+// Response of backends without ready endpoints, body is set by no-endpoints-response ConfigMap annotation
+const noEndpointsHeader = "HTTP/1.0 503 Service Unavailable\r\nCache-Control: no-cache\r\nConnection: close\r\nContent-Type: text/html\r\n\r\n"
+
+const noEndpointsBody = "<html><body><h1>503 Service Unavailable</h1>\nNo server is available to handle this request.\n</body></html>\n"
+
+// Write errorfile served by backends without ready endpoints, changed is true when its content changed
+func (c *HAProxyController) noEndpointsFile() (file string, changed bool, err error) {
+	body := noEndpointsBody
+	if ann, _ := GetValueFromAnnotations("no-endpoints-response", c.cfg.ConfigMap.Annotations); ann != nil && ann.Status != DELETED && ann.Value != "" {
+		body = ann.Value
+	}
+	content := noEndpointsHeader + body
+	file = filepath.Join(HAProxyErrDir, "no-endpoints.http")
+	if current, errRead := ioutil.ReadFile(file); errRead == nil && string(current) == content {
+		return file, false, nil
+	}
+	return file, true, ioutil.WriteFile(file, []byte(content), 0644)
+}
+
+// Backends of services without ready endpoints answer with the no-endpoints response
+// instead of the generic 503, an event is recorded on the ingress when it starts.
+// no-endpoints-page annotation set to "false" keeps the generic 503,
+// for example when clients retry on it.
+func (c *HAProxyController) handleNoEndpoints(ingress *Ingress, service *Service, path *IngressPath, backendName string, endpoints *Endpoints) (reload bool) {
+	if backendName == "" || path.IsTCPService || path.IsSSLPassthrough {
+		return false
+	}
+	file, fileChanged, err := c.noEndpointsFile()
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	enabled := true
+	if ann, _ := c.backendAnnotation("no-endpoints-page", ingress, service); ann != nil {
+		if enabled, err = utils.GetBoolValue(ann.Value, "no-endpoints-page"); err != nil {
+			if ann.Status != EMPTY {
+				utils.LogErr(err)
+			}
+			enabled = true
+		}
+	}
+	line := "errorfile 503 " + file
+	// Requests of scale-from-zero backends wait for a server instead
+	_, scaleFromZero := c.cfg.ScaleFromZero[backendName]
+	active := enabled && !scaleFromZero && (endpoints == nil || !endpoints.ready())
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	current := false
+	if data, errGet := config.Get(parser.Backends, backendName, ""); errGet == nil {
+		for _, unprocessed := range data.([]types.UnProcessed) {
+			if unprocessed.Value == line {
+				current = true
+			}
+		}
+	}
+	if active == current {
+		return active && fileChanged
+	}
+	lines := []string{}
+	if active {
+		lines = append(lines, line)
+		c.k8s.IngressEvent(ingress, ReasonNoEndpoints, fmt.Sprintf("service '%s' has no ready endpoints, backend '%s' serves the no-endpoints response", service.Name, backendName))
+	}
+	utils.LogErr(c.unprocessedSet(parser.Backends, backendName, line, lines))
+	return true
 }
 
-// Look for the targetPort (Endpoint port) corresponding to the servicePort of the IngressPath
-func (c *HAProxyController) setTargetPort(path *IngressPath, service *Service, endpoints *Endpoints) error {
+// Look for the targetPort (Endpoint port) corresponding to the servicePort of the IngressPath,
+// a servicePort referred to by name is matched by name. Endpoint ports have the name of service
+// ports, pods can expose them on different numbers so each server uses the port of its address.
+// Port is resolved for each path, paths of the service can use different ports with their backends.
+func (c *HAProxyController) setTargetPort(path *IngressPath, service *Service, endpoints *Endpoints, backendName string) (portName string, portChanged bool, err error) {
 	for _, sp := range service.Ports {
 		// Find corresponding servicePort
-		if sp.Name == path.ServicePortString || sp.Port == path.ServicePortInt {
-			// Find the corresponding targetPort in Endpoints ports
-			if endpoints != nil {
-				for _, epPort := range *endpoints.Ports {
-					if epPort.Name == sp.Name {
-						// Dinamically update backend port
-						if path.TargetPort != epPort.Port && path.TargetPort != 0 {
-							for _, EndpointIP := range *endpoints.Addresses {
-								if err := c.NativeAPI.Runtime.SetServerAddr(endpoints.BackendName, EndpointIP.HAProxyName, EndpointIP.IP, int(epPort.Port)); err != nil {
-									log.Println(err)
-								}
-								log.Printf("TargetPort for backend %s changed to %d", endpoints.BackendName, epPort.Port)
-							}
-						}
-						path.TargetPort = epPort.Port
-						return nil
+		if path.ServicePortString != "" && sp.Name != path.ServicePortString {
+			continue
+		}
+		if path.ServicePortString == "" && sp.Port != path.ServicePortInt {
+			continue
+		}
+		if endpoints == nil {
+			// Return nil even if corresponding target port was not found.
+			return "", false, nil
+		}
+		// Find the corresponding targetPort in Endpoints ports
+		for _, epPort := range *endpoints.Ports {
+			if epPort.Name != sp.Name {
+				continue
+			}
+			// Dinamically update backend port
+			if previous, ok := endpoints.Backends[backendName]; path.TargetPort != 0 && (path.TargetPort != epPort.Port || !ok || previous != sp.Name) {
+				portChanged = true
+				for _, ip := range *endpoints.Addresses {
+					if ip.Disabled {
+						continue
+					}
+					if err := c.NativeAPI.Runtime.SetServerAddr(backendName, ip.HAProxyName, ip.IP, int(ip.Port(sp.Name, epPort.Port))); err != nil {
+						logger.Error(err)
 					}
 				}
-				log.Printf("Could not find Targetport of '%s' for service %s", sp.Name, service.Name)
-			} // Return nil even if corresponding target port was not found.
-			return nil
+				logger.Infof("TargetPort for backend %s changed to %d", backendName, epPort.Port)
+			}
+			path.TargetPort = epPort.Port
+			return sp.Name, portChanged, nil
 		}
+		logger.Warningf("Could not find Targetport of '%s' for service %s", sp.Name, service.Name)
+		return "", false, nil
 	}
-	return fmt.Errorf("servicePort(Str: %s, Int: %d) for serviceName '%s' not found", path.ServicePortString, path.ServicePortInt, service.Name)
+	return "", false, fmt.Errorf("servicePort(Str: %s, Int: %d) for serviceName '%s' not found", path.ServicePortString, path.ServicePortInt, service.Name)
 }
@@ -0,0 +1,123 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/params"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+// use_backend rules of a path are only removed when its redirect is valid,
+// in every frontend and for every ip-routing address
+func TestRedirectUseBackendRules(t *testing.T) {
+	c := testController()
+	c.cfg.Init(utils.OSArgs{}, "")
+	ns := c.cfg.NewNamespace("default")
+	path := &IngressPath{ServiceName: "app", ServicePortInt: 80, Path: "/"}
+	rule := &IngressRule{Host: "app.example.com", Paths: map[string]*IngressPath{"/": path}}
+	rules := []struct{ key, frontend string }{
+		{"app.example.com-/-default-app", FrontendHTTP},
+		{"app.example.com-/-default-app", FrontendHTTPS},
+		{"app.example.com-/-default-app", FrontendSSL},
+		{"10.0.0.1-/-default-app", FrontendHTTP},
+	}
+
+	for _, test := range []struct {
+		location string
+		deleted  bool
+	}{
+		{"not an url", false},
+		{"https://example.com/", true},
+	} {
+		ingress := &Ingress{
+			Namespace: "default",
+			Name:      "app",
+			Annotations: MapStringW{
+				"permanent-redirect": &StringW{Value: test.location},
+				"ip-routing":         &StringW{Value: "10.0.0.1"},
+			},
+			Rules: map[string]*IngressRule{rule.Host: rule},
+		}
+		for _, r := range rules {
+			c.addUseBackendRule(r.key, UseBackendRule{Host: rule.Host, Path: "/", Backend: "default-app-80"}, r.frontend)
+		}
+		// Service does not exist, path is still handled when redirect is invalid
+		c.handlePath(ns, ingress, rule, path) //nolint errcheck
+		for _, r := range rules {
+			if _, ok := c.cfg.BackendSwitchingRules[r.frontend][r.key]; ok == test.deleted {
+				t.Errorf("redirect %q: rule %s of %s: expected deleted %t", test.location, r.key, r.frontend, test.deleted)
+			}
+		}
+	}
+}
+
+// backend-maxqueue annotation sets maxqueue parameter of servers, 0 removes it
+func TestServerMaxqueue(t *testing.T) {
+	c, cleanup := testControllerConfig(t, `global
+defaults
+backend default-app-80
+  mode http
+  server SRV_1 10.0.0.1:80 maxconn 50
+`)
+	defer cleanup()
+	ingress := &Ingress{Namespace: "default", Name: "app", Annotations: MapStringW{}}
+	service := &Service{Namespace: "default", Name: "app", Annotations: MapStringW{}}
+
+	for _, test := range []struct {
+		value    string
+		status   Status
+		expected string
+	}{
+		{"10", ADDED, "10"},
+		{"-1", MODIFIED, ""},
+		{"20", MODIFIED, "20"},
+		{"0", MODIFIED, ""},
+		{"20", DELETED, ""},
+	} {
+		service.Annotations["backend-maxqueue"] = &StringW{Value: test.value, Status: test.status}
+		maxqueue := c.serverMaxqueue(ingress, service)
+		if maxqueue != test.expected {
+			t.Errorf("backend-maxqueue %s %s: expected %q, got %q", test.value, test.status, test.expected, maxqueue)
+		}
+		if err := c.backendServerParam("default-app-80", "SRV_1", "maxqueue", maxqueue); err != nil {
+			t.Fatal(err)
+		}
+		server, err := c.backendServerGet("default-app-80", "SRV_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.Maxconn == nil || *server.Maxconn != 50 {
+			t.Errorf("backend-maxqueue %s: maxconn of server not kept", test.value)
+		}
+		config, _ := c.ActiveConfiguration()
+		data, err := config.Get(parser.Backends, "default-app-80", "server")
+		if err != nil {
+			t.Fatal(err)
+		}
+		param := ""
+		for _, p := range data.([]types.Server)[0].Params {
+			if option, ok := p.(*params.ServerOptionValue); ok && option.Name == "maxqueue" {
+				param = option.Value
+			}
+		}
+		if param != test.expected {
+			t.Errorf("backend-maxqueue %s %s: expected server parameter %q, got %q", test.value, test.status, test.expected, param)
+		}
+	}
+}
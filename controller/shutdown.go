@@ -0,0 +1,74 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Gracefully stop HAProxy: master process is sent SIGUSR1 so workers finish active
+// sessions, it is killed if still running after --shutdown-grace-period.
+func (c *HAProxyController) haproxyShutdown() {
+	if c.osArgs.Test {
+		return
+	}
+	process, err := c.HAProxyProcess()
+	if err != nil {
+		haproxyLogger.Warningf("HAProxy is not running: %s", err)
+		c.haproxyCleanup()
+		return
+	}
+	haproxyLogger.Infof("Stopping HAProxy, waiting up to %s for active sessions", c.osArgs.ShutdownGracePeriod)
+	if err = c.haproxyService("stop"); err != nil {
+		haproxyLogger.Error(err)
+	}
+	if !waitProcessExit(process, c.osArgs.ShutdownGracePeriod) {
+		haproxyLogger.Warningf("HAProxy still running after %s, killing it", c.osArgs.ShutdownGracePeriod)
+		haproxyLogger.Err(process.Signal(syscall.SIGTERM))
+		waitProcessExit(process, time.Second)
+	}
+	haproxyLogger.Info("HAProxy stopped")
+	c.haproxyCleanup()
+}
+
+// Remove pid file and runtime socket so a restarting container does not
+// mistake a reused pid for a running HAProxy.
+func (c *HAProxyController) haproxyCleanup() {
+	for _, file := range []string{HAProxyPIDFile, HAProxySocket} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			haproxyLogger.Error(err)
+		}
+	}
+}
+
+// Return true if process exited before timeout.
+// HAProxy master is a child of the controller and has to be reaped to disappear.
+func waitProcessExit(process *os.Process, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if pid, _ := syscall.Wait4(process.Pid, nil, syscall.WNOHANG, nil); pid == process.Pid {
+			return true
+		}
+		if process.Signal(syscall.Signal(0)) != nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
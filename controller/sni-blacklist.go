@@ -0,0 +1,125 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	"github.com/haproxytech/models"
+)
+
+// Pattern file of SNI values rejected by sni-blacklist annotations
+func sniBlacklistFile() string {
+	return path.Join(HAProxyMapDir, "sni-blacklist.lst")
+}
+
+// Add SNI values of sni-blacklist annotation, they are lower-cased
+// since SNI is lower-cased before matching.
+func (c *HAProxyController) addSNIBlacklist(annotations MapStringW) {
+	ann, _ := GetValueFromAnnotations("sni-blacklist", annotations)
+	if ann == nil || ann.Status == DELETED {
+		return
+	}
+	for _, sni := range strings.Fields(strings.Replace(ann.Value, ",", " ", -1)) {
+		sni = strings.ToLower(sni)
+		if strings.ContainsAny(sni, "/:*") {
+			logger.Warningf("sni-blacklist annotation: skipping '%s', not a hostname", sni)
+			continue
+		}
+		c.cfg.SNIBlacklist[sni] = struct{}{}
+	}
+}
+
+// handle sni-blacklist annotations of ConfigMap and ingresses. Connections to deny-listed
+// SNI values are rejected by TCP rules, which only change when the list becomes empty or not.
+// Other changes of the list rewrite the pattern file and update it through runtime API.
+func (c *HAProxyController) handleSNIBlacklist() (reload bool) {
+	c.addSNIBlacklist(c.cfg.ConfigMap.Annotations)
+	for _, namespace := range c.cfg.Namespace {
+		if !namespace.Relevant {
+			continue
+		}
+		for _, ingress := range namespace.Ingresses {
+			if ingress.Status != DELETED {
+				c.addSNIBlacklist(ingress.Annotations)
+			}
+		}
+	}
+	patterns := make([]string, 0, len(c.cfg.SNIBlacklist))
+	for sni := range c.cfg.SNIBlacklist {
+		patterns = append(patterns, sni)
+	}
+	sort.Strings(patterns)
+	file := sniBlacklistFile()
+	current, errRead := ioutil.ReadFile(file)
+	if len(patterns) == 0 {
+		if errRead != nil {
+			return false
+		}
+		c.cfg.FrontendRulesStatus[TCP] = MODIFIED
+		utils.LogErr(os.Remove(file))
+		return true
+	}
+	content := strings.Join(patterns, "\n") + "\n"
+	if errRead == nil && string(current) == content {
+		return false
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	if errRead != nil {
+		// New pattern file, TCP rules are created
+		c.cfg.FrontendRulesStatus[TCP] = MODIFIED
+		return true
+	}
+	if err := c.sniBlacklistRuntimeUpdate(file, patterns); err != nil {
+		logger.Warningf("sni-blacklist: runtime update failed, reload required: %s", err)
+		return true
+	}
+	logger.Debugf("sni-blacklist: %d SNI values updated through runtime API", len(patterns))
+	return false
+}
+
+func (c *HAProxyController) sniBlacklistRuntimeUpdate(file string, patterns []string) error {
+	commands := make([]string, 0, len(patterns)+1)
+	commands = append(commands, "clear acl "+file)
+	for _, sni := range patterns {
+		commands = append(commands, fmt.Sprintf("add acl %s %s", file, sni))
+	}
+	return c.runtimeCommands(commands)
+}
+
+// TCP rule of SSL passthrough frontend rejecting deny-listed SNI values, nil when the
+// list is empty. SNI is read from the TLS client hello, before TLS termination by HTTPS
+// frontend, SSL passthrough frontend is enabled while the list is not empty.
+func (c *HAProxyController) sniBlacklistRule() *models.TCPRequestRule {
+	if len(c.cfg.SNIBlacklist) == 0 {
+		return nil
+	}
+	return &models.TCPRequestRule{
+		Index:    utils.PtrInt64(0),
+		Type:     "content",
+		Action:   "reject",
+		Cond:     "if",
+		CondTest: fmt.Sprintf("{ req_ssl_sni,lower -f %s }", sniBlacklistFile()),
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/parsers/filters"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	"github.com/haproxytech/models"
+)
+
+// SPOE configuration files are written next to map files
+func spoeConfigFile(name string) string {
+	return path.Join(HAProxyMapDir, fmt.Sprintf("spoe-%s.conf", name))
+}
+
+// Set content of SPOE configuration file, empty content removes it. Files used by
+// the running HAProxy are only changed by writeSPOEFiles once the transaction is
+// committed. A new file is written now since haproxy -c reads it when the
+// transaction is validated.
+func (c *HAProxyController) spoeConfigSet(file, content string) (changed bool, err error) {
+	current, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	exists := err == nil
+	if (exists && string(current) == content) || (!exists && content == "") {
+		delete(c.cfg.SPOEFiles, file)
+		return false, nil
+	}
+	c.cfg.SPOEFiles[file] = content
+	if !exists {
+		return true, ioutil.WriteFile(file, []byte(content), 0644)
+	}
+	return true, nil
+}
+
+// Write SPOE configuration files changed by the committed transaction
+func (c *HAProxyController) writeSPOEFiles() {
+	for file, content := range c.cfg.SPOEFiles {
+		var err error
+		if content == "" {
+			err = os.Remove(file)
+		} else {
+			err = ioutil.WriteFile(file, []byte(content), 0644)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			utils.LogErr(err)
+		}
+		delete(c.cfg.SPOEFiles, file)
+	}
+}
+
+// Set SPOE filter of an engine in a section, other filters are kept.
+// Empty configFile removes the filter.
+func (c *HAProxyController) sectionSPOEFilter(section parser.Section, sectionName, engine, configFile string) (changed bool, err error) {
+	config, err := c.ActiveConfiguration()
+	if err != nil {
+		return false, err
+	}
+	current := []types.Filter{}
+	if data, errGet := config.Get(section, sectionName, "filter"); errGet == nil {
+		current = data.([]types.Filter)
+	}
+	result := []types.Filter{}
+	found := false
+	for _, filter := range current {
+		if spoe, ok := filter.(*filters.Spoe); ok && spoe.Engine == engine {
+			if spoe.Config == configFile && !found {
+				found = true
+				result = append(result, filter)
+			}
+			continue
+		}
+		result = append(result, filter)
+	}
+	if configFile != "" && !found {
+		result = append(result, &filters.Spoe{Engine: engine, Config: configFile})
+	}
+	if len(result) == len(current) && (found || configFile == "") {
+		return false, nil
+	}
+	c.ActiveTransactionHasChanges = true
+	if len(result) == 0 {
+		return true, config.Set(section, sectionName, "filter", nil)
+	}
+	return true, config.Set(section, sectionName, "filter", result)
+}
+
+// Parse comma separated list of SPOE agent addresses
+func spoeAgentAddresses(value string) ([]string, error) {
+	addresses := []string{}
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+			return nil, fmt.Errorf("invalid address '%s'", address)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// Backend of SPOE agents with one server per address, no address removes it
+func (c *HAProxyController) spoeAgentBackend(backendName string, addresses []string) (reload bool, err error) {
+	_, errBackend := c.backendGet(backendName)
+	if len(addresses) == 0 {
+		if errBackend == nil {
+			return true, c.backendDelete(backendName)
+		}
+		return false, nil
+	}
+	if errBackend != nil {
+		if err = c.backendCreate(models.Backend{Name: backendName, Mode: string(TCP)}); err != nil {
+			return false, err
+		}
+		reload = true
+	}
+	servers := make(map[string]models.Server, len(addresses))
+	for i, address := range addresses {
+		host, portStr, _ := net.SplitHostPort(address)
+		port, errPort := strconv.ParseInt(portStr, 10, 64)
+		if errPort != nil {
+			return reload, fmt.Errorf("invalid port in '%s'", address)
+		}
+		name := fmt.Sprintf("agent%d", i+1)
+		servers[name] = models.Server{
+			Name:    name,
+			Address: host,
+			Port:    &port,
+			Check:   "enabled",
+		}
+	}
+	_, current, err := c.NativeAPI.Configuration.GetServers(backendName, c.ActiveTransaction)
+	if err != nil {
+		return reload, err
+	}
+	for _, server := range current {
+		if _, ok := servers[server.Name]; !ok {
+			err = c.backendServerDelete(backendName, server.Name)
+			reload = true
+		}
+	}
+	for name, server := range servers {
+		currentServer, errGet := c.backendServerGet(backendName, name)
+		switch {
+		case errGet != nil:
+			err = c.backendServerCreate(backendName, server)
+		case currentServer.Address != server.Address || currentServer.Port == nil || *currentServer.Port != *server.Port:
+			err = c.backendServerEdit(backendName, server)
+		default:
+			continue
+		}
+		reload = true
+	}
+	return reload, err
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fileContent(file string) string {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(content)
+}
+
+func TestSPOEConfigSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy-spoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := testController()
+	c.cfg.SPOEFiles = map[string]string{}
+	file := filepath.Join(dir, "spoe-mirror-app.conf")
+
+	// haproxy -c needs new files to validate the transaction
+	if changed, err := c.spoeConfigSet(file, "v1"); err != nil || !changed {
+		t.Fatalf("new file: expected change, got %v, %v", changed, err)
+	}
+	if content := fileContent(file); content != "v1" {
+		t.Errorf("new file: expected written before commit, got %s", content)
+	}
+	c.writeSPOEFiles()
+
+	if changed, _ := c.spoeConfigSet(file, "v1"); changed {
+		t.Error("same content: unexpected change")
+	}
+
+	// running HAProxy keeps its file until the transaction is committed
+	if changed, _ := c.spoeConfigSet(file, "v2"); !changed {
+		t.Error("new content: expected change")
+	}
+	if content := fileContent(file); content != "v1" {
+		t.Errorf("new content: expected file unchanged before commit, got %s", content)
+	}
+	c.writeSPOEFiles()
+	if content := fileContent(file); content != "v2" {
+		t.Errorf("new content: expected v2 after commit, got %s", content)
+	}
+
+	if changed, _ := c.spoeConfigSet(file, ""); !changed {
+		t.Error("removal: expected change")
+	}
+	if _, err = os.Stat(file); err != nil {
+		t.Errorf("removal: expected file kept before commit, got %s", err)
+	}
+	c.writeSPOEFiles()
+	if _, err = os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("removal: expected file removed after commit, got %v", err)
+	}
+	if changed, _ := c.spoeConfigSet(file, ""); changed {
+		t.Error("missing file removal: unexpected change")
+	}
+}
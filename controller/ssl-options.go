@@ -0,0 +1,190 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	parser "github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/params"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+)
+
+// Options accepted by ssl-default-bind-options
+var sslGlobalOptionWords = map[string]struct{}{
+	"no-sslv3": {}, "no-tlsv10": {}, "no-tlsv11": {}, "no-tlsv12": {}, "no-tlsv13": {},
+	"force-sslv3": {}, "force-tlsv10": {}, "force-tlsv11": {}, "force-tlsv12": {}, "force-tlsv13": {},
+	"no-tls-tickets": {}, "prefer-client-ciphers": {},
+}
+
+// Options of ingress ssl-options annotation, set on HTTPS binds
+var sslBindOptionWords = map[string]struct{}{
+	"no-sslv3": {}, "no-tlsv10": {}, "no-tlsv11": {}, "no-tlsv12": {}, "no-tlsv13": {},
+	"force-sslv3": {}, "force-tlsv10": {}, "force-tlsv11": {}, "force-tlsv12": {}, "force-tlsv13": {},
+	"prefer-client-ciphers": {}, "strict-sni": {}, "no-ca-names": {}, "allow-0rtt": {},
+}
+
+var sslBindOptionValues = map[string]struct{}{
+	"ssl-min-ver": {}, "ssl-max-ver": {}, "ciphers": {}, "curves": {}, "ecdhe": {},
+}
+
+var sslVersions = map[string]struct{}{
+	"SSLv3": {}, "TLSv1.0": {}, "TLSv1.1": {}, "TLSv1.2": {}, "TLSv1.3": {},
+}
+
+var sslCiphersRegexp = regexp.MustCompile(`^[A-Za-z0-9_+!@=:.-]+$`)
+
+func validateSSLCiphers(value string) error {
+	if !sslCiphersRegexp.MatchString(value) {
+		return fmt.Errorf("incorrect cipher list '%s'", value)
+	}
+	return nil
+}
+
+// Parse space separated ssl options, words are single options and values are options followed by an argument
+func parseSSLOptions(value string, words, values map[string]struct{}) ([]params.BindOption, error) {
+	options := []params.BindOption{}
+	fields := strings.Fields(value)
+	for i := 0; i < len(fields); i++ {
+		name := fields[i]
+		if _, ok := words[name]; ok {
+			options = append(options, &params.BindOptionWord{Name: name})
+			continue
+		}
+		if _, ok := values[name]; !ok {
+			return nil, fmt.Errorf("unknown ssl option '%s'", name)
+		}
+		if i+1 == len(fields) {
+			return nil, fmt.Errorf("ssl option '%s' requires a value", name)
+		}
+		i++
+		switch name {
+		case "ssl-min-ver", "ssl-max-ver":
+			if _, ok := sslVersions[fields[i]]; !ok {
+				return nil, fmt.Errorf("incorrect value '%s' of ssl option '%s'", fields[i], name)
+			}
+		default:
+			if err := validateSSLCiphers(fields[i]); err != nil {
+				return nil, fmt.Errorf("incorrect value '%s' of ssl option '%s'", fields[i], name)
+			}
+		}
+		options = append(options, &params.BindOptionValue{Name: name, Value: fields[i]})
+	}
+	return options, nil
+}
+
+// ssl-options, ssl-ciphers and ssl-ciphersuites ConfigMap annotations set TLS defaults of binds in global section
+func (c *HAProxyController) handleSSLOptions() (reload bool) {
+	config, _ := c.ActiveConfiguration()
+
+	annOptions, _ := GetValueFromAnnotations("ssl-options", c.cfg.ConfigMap.Annotations)
+	if annOptions != nil && annOptions.Status != EMPTY {
+		var err error
+		if annOptions.Status == DELETED {
+			err = config.Set(parser.Global, parser.GlobalSectionName, "ssl-default-bind-options", nil)
+		} else if _, err = parseSSLOptions(annOptions.Value, sslGlobalOptionWords, map[string]struct{}{"ssl-min-ver": {}, "ssl-max-ver": {}}); err == nil {
+			err = config.Set(parser.Global, parser.GlobalSectionName, "ssl-default-bind-options", types.StringC{
+				Value: strings.Join(strings.Fields(annOptions.Value), " "),
+			})
+		}
+		if err != nil {
+			utils.LogErr(fmt.Errorf("ssl-options annotation: %s", err))
+		} else {
+			c.ActiveTransactionHasChanges = true
+			reload = true
+		}
+	}
+
+	annCiphers, _ := GetValueFromAnnotations("ssl-ciphers", c.cfg.ConfigMap.Annotations)
+	if annCiphers != nil && annCiphers.Status != EMPTY {
+		var err error
+		if annCiphers.Status == DELETED {
+			err = config.Set(parser.Global, parser.GlobalSectionName, "ssl-default-bind-ciphers", nil)
+		} else if err = validateSSLCiphers(annCiphers.Value); err == nil {
+			err = config.Set(parser.Global, parser.GlobalSectionName, "ssl-default-bind-ciphers", types.StringC{
+				Value: annCiphers.Value,
+			})
+		}
+		if err != nil {
+			utils.LogErr(fmt.Errorf("ssl-ciphers annotation: %s", err))
+		} else {
+			c.ActiveTransactionHasChanges = true
+			reload = true
+		}
+	}
+
+	// ssl-default-bind-ciphersuites is not handled by config parser
+	annCipherSuites, _ := GetValueFromAnnotations("ssl-ciphersuites", c.cfg.ConfigMap.Annotations)
+	if annCipherSuites != nil && annCipherSuites.Status != EMPTY {
+		values := []string{}
+		err := validateSSLCiphers(annCipherSuites.Value)
+		if annCipherSuites.Status != DELETED && err == nil {
+			values = append(values, "ssl-default-bind-ciphersuites "+annCipherSuites.Value)
+		}
+		if err != nil && annCipherSuites.Status != DELETED {
+			utils.LogErr(fmt.Errorf("ssl-ciphersuites annotation: %s", err))
+		} else {
+			utils.LogErr(c.unprocessedSet(parser.Global, parser.GlobalSectionName, "ssl-default-bind-ciphersuites", values))
+			reload = true
+		}
+	}
+	return reload
+}
+
+// Record ssl-options annotation of ingress in sslOptions, by value
+func (c *HAProxyController) handleIngressSSLOptions(ingress *Ingress, sslOptions map[string][]string) error {
+	if ingress.Status == DELETED {
+		return nil
+	}
+	annOptions, err := ingress.Annotations.Get("ssl-options")
+	if err != nil || annOptions.Status == DELETED {
+		return nil
+	}
+	if _, err = parseSSLOptions(annOptions.Value, sslBindOptionWords, sslBindOptionValues); err != nil {
+		return fmt.Errorf("ssl-options annotation: %s", err)
+	}
+	value := strings.Join(strings.Fields(annOptions.Value), " ")
+	sslOptions[value] = append(sslOptions[value], ingress.Namespace+"/"+ingress.Name)
+	return nil
+}
+
+// Return ssl options of HTTPS binds from ingresses ssl-options annotations,
+// they are shared by all hosts so ingresses must agree on them
+func httpsBindSSLOptions(sslOptions map[string][]string) string {
+	if len(sslOptions) > 1 {
+		conflicts := []string{}
+		for value, ingresses := range sslOptions {
+			conflicts = append(conflicts, fmt.Sprintf("'%s' (%s)", value, strings.Join(ingresses, ", ")))
+		}
+		sort.Strings(conflicts)
+		utils.LogErr(fmt.Errorf("ssl-options annotation: ingresses set different values, ignoring them: %s", strings.Join(conflicts, ", ")))
+		return ""
+	}
+	for value := range sslOptions {
+		return value
+	}
+	return ""
+}
+
+// Return ssl parameters of HTTPS binds
+func (c *HAProxyController) httpsBindParams() []params.BindOption {
+	ssl := c.sslBindParams(c.http2())
+	options, _ := parseSSLOptions(c.cfg.HTTPSOptions, sslBindOptionWords, sslBindOptionValues)
+	return append(ssl, options...)
+}
@@ -0,0 +1,299 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAProxy statistic of "show stat" exported as haproxy_<proxy type>_<name>
+type statsMetric struct {
+	field      string
+	name       string
+	metricType string
+	help       string
+	// Statistics in milliseconds are exported in seconds
+	milliseconds bool
+}
+
+var statsMetrics = map[string][]statsMetric{
+	"frontend": {
+		{field: "scur", name: "current_sessions", metricType: "gauge", help: "Current number of active sessions."},
+		{field: "smax", name: "max_sessions", metricType: "gauge", help: "Maximum observed number of active sessions."},
+		{field: "slim", name: "limit_sessions", metricType: "gauge", help: "Configured session limit."},
+		{field: "stot", name: "sessions_total", metricType: "counter", help: "Total number of sessions."},
+		{field: "bin", name: "bytes_in_total", metricType: "counter", help: "Current total of incoming bytes."},
+		{field: "bout", name: "bytes_out_total", metricType: "counter", help: "Current total of outgoing bytes."},
+		{field: "dreq", name: "requests_denied_total", metricType: "counter", help: "Total of requests denied for security."},
+		{field: "ereq", name: "request_errors_total", metricType: "counter", help: "Total of request errors."},
+		{field: "req_tot", name: "http_requests_total", metricType: "counter", help: "Total HTTP requests."},
+		{field: "conn_tot", name: "connections_total", metricType: "counter", help: "Total number of connections."},
+	},
+	"backend": {
+		{field: "qcur", name: "current_queue", metricType: "gauge", help: "Current number of queued requests not assigned to any server."},
+		{field: "qmax", name: "max_queue", metricType: "gauge", help: "Maximum observed number of queued requests not assigned to any server."},
+		{field: "scur", name: "current_sessions", metricType: "gauge", help: "Current number of active sessions."},
+		{field: "smax", name: "max_sessions", metricType: "gauge", help: "Maximum observed number of active sessions."},
+		{field: "slim", name: "limit_sessions", metricType: "gauge", help: "Configured session limit."},
+		{field: "stot", name: "sessions_total", metricType: "counter", help: "Total number of sessions."},
+		{field: "bin", name: "bytes_in_total", metricType: "counter", help: "Current total of incoming bytes."},
+		{field: "bout", name: "bytes_out_total", metricType: "counter", help: "Current total of outgoing bytes."},
+		{field: "econ", name: "connection_errors_total", metricType: "counter", help: "Total of connection errors."},
+		{field: "eresp", name: "response_errors_total", metricType: "counter", help: "Total of response errors."},
+		{field: "wretr", name: "retry_warnings_total", metricType: "counter", help: "Total of retry warnings."},
+		{field: "wredis", name: "redispatch_warnings_total", metricType: "counter", help: "Total of redispatch warnings."},
+		{field: "act", name: "active_servers", metricType: "gauge", help: "Current number of active servers."},
+		{field: "weight", name: "weight", metricType: "gauge", help: "Total weight of the servers in the backend."},
+		{field: "qtime", name: "http_queue_time_average_seconds", metricType: "gauge", help: "Avg. HTTP queue time for last 1024 successful connections.", milliseconds: true},
+		{field: "ctime", name: "http_connect_time_average_seconds", metricType: "gauge", help: "Avg. HTTP connect time for last 1024 successful connections.", milliseconds: true},
+		{field: "rtime", name: "http_response_time_average_seconds", metricType: "gauge", help: "Avg. HTTP response time for last 1024 successful connections.", milliseconds: true},
+		{field: "ttime", name: "http_total_time_average_seconds", metricType: "gauge", help: "Avg. HTTP total time for last 1024 successful connections.", milliseconds: true},
+	},
+	"server": {
+		{field: "qcur", name: "current_queue", metricType: "gauge", help: "Current number of queued requests assigned to this server."},
+		{field: "qmax", name: "max_queue", metricType: "gauge", help: "Maximum observed number of queued requests assigned to this server."},
+		{field: "scur", name: "current_sessions", metricType: "gauge", help: "Current number of active sessions."},
+		{field: "smax", name: "max_sessions", metricType: "gauge", help: "Maximum observed number of active sessions."},
+		{field: "slim", name: "limit_sessions", metricType: "gauge", help: "Configured session limit."},
+		{field: "stot", name: "sessions_total", metricType: "counter", help: "Total number of sessions."},
+		{field: "bin", name: "bytes_in_total", metricType: "counter", help: "Current total of incoming bytes."},
+		{field: "bout", name: "bytes_out_total", metricType: "counter", help: "Current total of outgoing bytes."},
+		{field: "econ", name: "connection_errors_total", metricType: "counter", help: "Total of connection errors."},
+		{field: "eresp", name: "response_errors_total", metricType: "counter", help: "Total of response errors."},
+		{field: "wretr", name: "retry_warnings_total", metricType: "counter", help: "Total of retry warnings."},
+		{field: "wredis", name: "redispatch_warnings_total", metricType: "counter", help: "Total of redispatch warnings."},
+		{field: "weight", name: "weight", metricType: "gauge", help: "Current weight of the server."},
+		{field: "chkfail", name: "check_failures_total", metricType: "counter", help: "Total number of failed health checks."},
+		{field: "downtime", name: "downtime_seconds_total", metricType: "counter", help: "Total downtime in seconds."},
+	},
+}
+
+// Statistics of "show info" exported as haproxy_process_<name>
+var infoMetrics = []statsMetric{
+	{field: "Uptime_sec", name: "uptime_seconds", metricType: "gauge", help: "Time since HAProxy process start."},
+	{field: "CurrConns", name: "current_connections", metricType: "gauge", help: "Current number of connections."},
+	{field: "Maxconn", name: "max_connections", metricType: "gauge", help: "Maximum number of concurrent connections."},
+	{field: "CumConns", name: "connections_total", metricType: "counter", help: "Total number of connections."},
+	{field: "CumReq", name: "requests_total", metricType: "counter", help: "Total number of requests."},
+}
+
+// Proxy types of "type" field of "show stat"
+var statsProxyTypes = map[string]string{"0": "frontend", "1": "backend", "2": "server"}
+
+// Set of exported metric names of --stats-metrics, nil when HAProxy statistics are not exported
+func statsMetricsFilter(value string) map[string]struct{} {
+	filter := map[string]struct{}{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			filter[name] = struct{}{}
+		}
+	}
+	if len(filter) == 0 {
+		return nil
+	}
+	return filter
+}
+
+// Pods of servers by backend, used as pod label of server metrics.
+// Built after each sync since configuration can't be read while scraping.
+func (c *HAProxyController) updateStatsPods() {
+	if c.statsFilter == nil {
+		return
+	}
+	pods := map[string]map[string]string{}
+	for _, namespace := range c.cfg.Namespace {
+		for _, endpoints := range namespace.Endpoints {
+			if len(endpoints.Backends) == 0 || endpoints.Status == DELETED {
+				continue
+			}
+			servers := map[string]string{}
+			for _, ip := range *endpoints.Addresses {
+				if !ip.Disabled && ip.Status != DELETED && ip.Name != "" {
+					servers[ip.HAProxyName] = ip.Name
+				}
+			}
+			for backendName := range endpoints.Backends {
+				pods[backendName] = servers
+			}
+		}
+	}
+	c.statsPods.Store(pods)
+}
+
+// Run a runtime command, retried once since the socket may be unavailable while HAProxy reloads
+func (c *HAProxyController) runtimeStats(command string) (string, error) {
+	var result []string
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if result, err = c.NativeAPI.Runtime.ExecuteRaw(command); err == nil && len(result) > 0 {
+			// Controller runs a single HAProxy process
+			return result[0], nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no runtime socket")
+	}
+	return "", err
+}
+
+// Run runtime commands in order, stopping at the first one HAProxy answers with an error
+func (c *HAProxyController) runtimeCommands(commands []string) error {
+	for _, command := range commands {
+		result, err := c.NativeAPI.Runtime.ExecuteRaw(command)
+		if err != nil {
+			return err
+		}
+		for _, line := range result {
+			if line = strings.TrimSpace(line); line != "" && line != "Done." {
+				return fmt.Errorf("%s: %s", command, line)
+			}
+		}
+	}
+	return nil
+}
+
+// HAProxy statistics of runtime API, haproxy_up is 0 when they can't be read
+func (c *HAProxyController) writeStatsMetrics(w io.Writer) {
+	filter := c.statsFilter
+	_, all := filter["all"]
+	exported := func(name string) bool {
+		_, ok := filter[name]
+		return all || ok
+	}
+	info, errInfo := c.runtimeStats("show info")
+	stat, errStat := c.runtimeStats("show stat")
+	writeMetric(w, "haproxy_up", "gauge", "Was the last scrape of HAProxy statistics successful.")
+	if errInfo != nil || errStat != nil {
+		logger.Warningf("HAProxy statistics unavailable: %v %v", errInfo, errStat)
+		fmt.Fprintln(w, "haproxy_up 0")
+		return
+	}
+	fmt.Fprintln(w, "haproxy_up 1")
+
+	infoValues := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		if parts := strings.SplitN(line, ":", 2); len(parts) == 2 {
+			infoValues[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	for _, m := range infoMetrics {
+		name := "haproxy_process_" + m.name
+		if value, ok := infoValues[m.field]; ok && exported(name) {
+			writeMetric(w, name, m.metricType, m.help)
+			fmt.Fprintf(w, "%s %s\n", name, value)
+		}
+	}
+
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(stat, "# ")))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil || len(records) == 0 {
+		logger.Warningf("HAProxy statistics: incorrect show stat output: %v", err)
+		return
+	}
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	pods, _ := c.statsPods.Load().(map[string]map[string]string)
+	// Samples by metric name, so each family is written at once
+	samples := map[string][]string{}
+	for _, record := range records[1:] {
+		proxyType, ok := statsProxyTypes[field(record, "type")]
+		if !ok {
+			continue
+		}
+		proxy, server := field(record, "pxname"), field(record, "svname")
+		var labels string
+		switch proxyType {
+		case "frontend":
+			labels = fmt.Sprintf("frontend=\"%s\"", escapeLabel(proxy))
+		case "backend":
+			labels = fmt.Sprintf("backend=\"%s\"", escapeLabel(proxy))
+		case "server":
+			pod, ok := pods[proxy][server]
+			// Unused server slots of scale-server-slots are not exported
+			if !ok && strings.HasPrefix(field(record, "status"), "MAINT") {
+				continue
+			}
+			labels = fmt.Sprintf("backend=\"%s\",server=\"%s\",pod=\"%s\"", escapeLabel(proxy), escapeLabel(server), escapeLabel(pod))
+		}
+		prefix := "haproxy_" + proxyType + "_"
+		for _, m := range statsMetrics[proxyType] {
+			value := field(record, m.field)
+			if value == "" || !exported(prefix+m.name) {
+				continue
+			}
+			if m.milliseconds {
+				ms, errParse := strconv.ParseFloat(value, 64)
+				if errParse != nil {
+					continue
+				}
+				value = strconv.FormatFloat(ms/1000, 'g', -1, 64)
+			}
+			samples[prefix+m.name] = append(samples[prefix+m.name], fmt.Sprintf("%s{%s} %s", prefix+m.name, labels, value))
+		}
+		if proxyType != "frontend" && exported(prefix+"up") {
+			up := "0"
+			switch status := field(record, "status"); {
+			case strings.HasPrefix(status, "UP"), status == "OPEN", status == "no check", status == "DRAIN":
+				up = "1"
+			}
+			samples[prefix+"up"] = append(samples[prefix+"up"], fmt.Sprintf("%sup{%s} %s", prefix, labels, up))
+		}
+		if exported(prefix + "http_responses_total") {
+			for _, code := range []string{"1xx", "2xx", "3xx", "4xx", "5xx", "other"} {
+				if value := field(record, "hrsp_"+code); value != "" {
+					samples[prefix+"http_responses_total"] = append(samples[prefix+"http_responses_total"],
+						fmt.Sprintf("%shttp_responses_total{%s,code=\"%s\"} %s", prefix, labels, code, value))
+				}
+			}
+		}
+	}
+	for _, proxyType := range []string{"frontend", "backend", "server"} {
+		prefix := "haproxy_" + proxyType + "_"
+		families := statsMetrics[proxyType]
+		if proxyType != "frontend" {
+			families = append(families, statsMetric{name: "up", metricType: "gauge", help: "Current health status (1 = UP, 0 = DOWN)."})
+		}
+		families = append(families, statsMetric{name: "http_responses_total", metricType: "counter", help: "Total of HTTP responses by status code class."})
+		for _, m := range families {
+			lines, ok := samples[prefix+m.name]
+			if !ok {
+				continue
+			}
+			writeMetric(w, prefix+m.name, m.metricType, m.help)
+			fmt.Fprintln(w, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
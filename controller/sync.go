@@ -24,8 +24,16 @@ const (
 	ENDPOINTS SyncType = "ENDPOINTS"
 	INGRESS   SyncType = "INGRESS"
 	NAMESPACE SyncType = "NAMESPACE"
+	POD       SyncType = "POD"
 	SERVICE   SyncType = "SERVICE"
+	RELOAD    SyncType = "RELOAD"
+	RESYNC    SyncType = "RESYNC"
 	SECRET    SyncType = "SECRET"
+	SHUTDOWN  SyncType = "SHUTDOWN"
+	//nolint
+	INGRESS_CLASS SyncType = "INGRESS_CLASS"
+	//nolint
+	PUBLISH_SERVICE SyncType = "PUBLISH_SERVICE"
 )
 
 //SyncDataEvent represents converted k8s received message
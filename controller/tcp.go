@@ -5,116 +5,359 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/haproxytech/config-parser/v2/params"
 	"github.com/haproxytech/kubernetes-ingress/controller/utils"
 	"github.com/haproxytech/models"
 )
 
-func (c *HAProxyController) handleTCPServices() (reload bool, err error) {
+// tcpService is a value of TCP services ConfigMap: <namespace>/<service>:<port>[:option]...
+type tcpService struct {
+	namespace      string
+	name           string
+	port           int64
+	ssl            bool
+	sslSecret      string
+	sslPassthrough bool
+	acceptProxy    bool
+	sendProxy      string
+	check          string
+	whitelist      string
+}
+
+func parseTCPService(value string) (svc tcpService, err error) {
+	// Whitelist may hold IPv6 addresses or a source reference, it is the last option
+	options := value
+	if i := strings.Index(value, ":whitelist="); i >= 0 {
+		options = value[:i]
+		svc.whitelist = value[i+len(":whitelist="):]
+		if _, isRef := parseSourceRef(svc.whitelist); !isRef {
+			for _, address := range strings.Fields(strings.Replace(svc.whitelist, ",", " ", -1)) {
+				if !validSource(address) {
+					return svc, fmt.Errorf("incorrect whitelist of TCP service '%s': '%s' is not an IP or CIDR", value, address)
+				}
+			}
+		}
+	}
+	parts := strings.Split(options, ":")
+	if len(parts) < 2 {
+		return svc, fmt.Errorf("incorrect TCP service '%s', expected namespace/service:port[:option]...", value)
+	}
+	svcName := strings.Split(parts[0], "/")
+	if len(svcName) != 2 || svcName[0] == "" || svcName[1] == "" {
+		return svc, fmt.Errorf("incorrect Service Name '%s'", parts[0])
+	}
+	svc.namespace = svcName[0]
+	svc.name = svcName[1]
+	if svc.port, err = strconv.ParseInt(parts[1], 10, 64); err != nil || svc.port < 1 || svc.port > 65535 {
+		return svc, fmt.Errorf("incorrect port '%s' of Service '%s'", parts[1], parts[0])
+	}
+	for _, option := range parts[2:] {
+		switch {
+		case option == "ssl":
+			svc.ssl = true
+		case strings.HasPrefix(option, "ssl="):
+			svc.ssl = true
+			svc.sslSecret = strings.TrimPrefix(option, "ssl=")
+			if secret := strings.Split(svc.sslSecret, "/"); len(secret) > 2 || secret[0] == "" || secret[len(secret)-1] == "" {
+				return svc, fmt.Errorf("incorrect secret '%s' of TCP service '%s'", svc.sslSecret, value)
+			}
+		case option == "ssl-passthrough":
+			svc.sslPassthrough = true
+		case option == "accept-proxy":
+			svc.acceptProxy = true
+		case option == "send-proxy":
+			svc.sendProxy = "proxy"
+		case option == "send-proxy-v2":
+			svc.sendProxy = "proxy-v2"
+		case option == "check":
+			svc.check = "true"
+		case option == "no-check":
+			svc.check = "false"
+		default:
+			return svc, fmt.Errorf("unknown option '%s' of TCP service '%s'", option, value)
+		}
+	}
+	if svc.ssl && svc.sslPassthrough {
+		return svc, fmt.Errorf("ssl and ssl-passthrough options of TCP service '%s' can't be used together", value)
+	}
+	return svc, nil
+}
+
+func (svc tcpService) backendName() string {
+	return fmt.Sprintf("%s-%s-%d", svc.namespace, svc.name, svc.port)
+}
+
+// Parameters of binds of TCP service frontend, a TLS offloading service uses certificate
+// bundle of its secret if any, or certificates of HTTPS frontend. accept-proxy is set by
+// accept-proxy option of the service or by proxy-protocol annotation.
+func (c *HAProxyController) tcpServiceBindParams(frontendName string, svc tcpService, bundle string) []params.BindOption {
+	shared := []params.BindOption{}
+	if svc.acceptProxy || c.proxyProtocol(frontendName).acceptProxy {
+		shared = append(shared, &params.BindOptionWord{Name: "accept-proxy"})
+	}
+	switch {
+	case bundle != "":
+		shared = append(shared, &params.BindOptionWord{Name: "ssl"}, &params.BindOptionValue{Name: "crt", Value: bundle})
+	case svc.ssl:
+		shared = append(shared, c.sslBindParams(false)...)
+	}
+	return shared
+}
+
+// Write certificates of TCP service secret to HAProxyCertDir and return their bundle.
+// Secret is looked up in service namespace unless given as <namespace>/<name>.
+func (c *HAProxyController) tcpServiceCertificate(frontendName string, svc tcpService, changed bool, usedCerts map[string]struct{}) (bundle string, reload bool, err error) {
+	namespace := svc.namespace
+	name := svc.sslSecret
+	if parts := strings.Split(svc.sslSecret, "/"); len(parts) == 2 {
+		namespace = parts[0]
+		name = parts[1]
+	}
+	var secret *Secret
+	if ns, ok := c.cfg.Namespace[namespace]; ok {
+		secret = ns.Secret[name]
+	}
+	if secret == nil || secret.Status == DELETED {
+		return "", false, fmt.Errorf("TLS secret '%s/%s' of TCP service does not exist, using default certificates", namespace, name)
+	}
+	reload = c.handleSecret(Ingress{Name: frontendName}, *secret, changed || secret.Status != EMPTY, usedCerts)
+	bundle = certificateBundle(frontendName, *secret)
+	_, rsa := usedCerts[bundle+".rsa"]
+	_, ecdsa := usedCerts[bundle+".ecdsa"]
+	if !rsa && !ecdsa {
+		return "", reload, fmt.Errorf("TLS secret '%s/%s' of TCP service has no certificate, using default certificates", namespace, name)
+	}
+	return bundle, reload, nil
+}
+
+// option tcp-check, or ssl-hello-chk for ssl-passthrough, on backend of TCP services with check option.
+// A backend shared by several TCP services is checked if one of them has it.
+func (c *HAProxyController) tcpServiceBackendCheck(backendName, advCheck string) (reload bool) {
+	backend, err := c.backendGet(backendName)
+	if err != nil || backend.AdvCheck == advCheck {
+		return false
+	}
+	backend.AdvCheck = advCheck
+	if err = c.backendEdit(backend); err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	return true
+}
+
+// tcp-request connection rules of TCP service frontend: expect-proxy rule of proxy-protocol annotation
+// and rule rejecting clients not in whitelist, an empty whitelist removes it. Source references are
+// written to pattern files, see srcACL, and HAProxy is only reloaded when rules or the content of the
+// pattern file change. Clients are rejected while the whitelist can't be read.
+func (c *HAProxyController) tcpServiceTCPRules(frontendName string, svc tcpService) (reload bool, err error) {
+	rules := models.TCPRequestRules{}
+	if sources := c.proxyProtocol(frontendName).sources; len(sources) > 0 {
+		rule := proxyProtocolRule(sources)
+		rules = append(rules, &rule)
+	}
+	if strings.TrimSpace(strings.Replace(svc.whitelist, ",", " ", -1)) != "" {
+		rule := &models.TCPRequestRule{
+			Index:  utils.PtrInt64(int64(len(rules))),
+			Type:   "connection",
+			Action: "reject",
+		}
+		var acl string
+		if acl, reload, err = c.srcACL(svc.whitelist); err == nil {
+			rule.Cond = "unless"
+			rule.CondTest = acl
+		} else {
+			err = fmt.Errorf("whitelist of TCP service '%s': %s, rejecting all clients", frontendName, err)
+		}
+		rules = append(rules, rule)
+	}
+	_, current, errGet := c.NativeAPI.Configuration.GetTCPRequestRules("frontend", frontendName, c.ActiveTransaction)
+	if errGet != nil {
+		return reload, errGet
+	}
+	if len(current) == len(rules) {
+		equal := true
+		for i, rule := range rules {
+			if current[i].Type != rule.Type || current[i].Action != rule.Action || current[i].Cond != rule.Cond || current[i].CondTest != rule.CondTest {
+				equal = false
+				break
+			}
+		}
+		if equal {
+			return reload, err
+		}
+	}
+	c.frontendTCPRequestRuleDeleteAll(frontendName)
+	for _, rule := range rules {
+		utils.LogErr(c.frontendTCPRequestRuleCreate(frontendName, *rule))
+	}
+	return true, err
+}
+
+// Return frontend, other than the TCP service one, listening on port
+func (c *HAProxyController) tcpServicePortConflict(frontendName string, port int64) string {
+	switch port {
+	case c.httpPort():
+		return FrontendHTTP
+	case c.httpsPort():
+		return FrontendHTTPS
+	}
+	if frontend := c.frontendUsingPort(port); frontend != frontendName {
+		return frontend
+	}
+	return ""
+}
+
+// Each entry of TCP services ConfigMap gets a tcp-<port> frontend using backend of the service.
+// Frontends, binds and certificates are checked on every sync, invalid entries are reported when they change.
+func (c *HAProxyController) handleTCPServices(usedCerts map[string]struct{}) (reload bool, err error) {
 	if c.cfg.ConfigMapTCPServices == nil {
 		return false, nil
 	}
-	for port, svc := range c.cfg.ConfigMapTCPServices.Annotations {
-		// Get TCP service from ConfigMap
-		// parts[0]: Service Name
-		// parts[1]: Service Port
-		// parts[2]: SSL option
-		parts := strings.Split(svc.Value, ":")
-		svcPort := parts[1]
-		var sslOption string
-		if len(parts) > 2 {
-			sslOption = parts[2]
-		}
-		svcName := strings.Split(parts[0], "/")
-		if len(svcName) != 2 {
-			utils.LogErr(fmt.Errorf("incorrect Service Name '%s'", parts[0]))
+	backendChecks := map[string]string{}
+	validFrontends := map[string]struct{}{}
+	for port, entry := range c.cfg.ConfigMapTCPServices.Annotations {
+		frontendName := fmt.Sprintf("tcp-%s", port)
+		if entry.Status == DELETED {
 			continue
 		}
-		namespace := svcName[0]
-		service := svcName[1]
 
-		// Handle Frontend
-		var frontendName, backendName string
-		if svc.Status != EMPTY {
-			backendName = fmt.Sprintf("%s-%s-%s", svcName[0], svcName[1], svcPort)
-			frontendName = fmt.Sprintf("tcp-%s", port)
-		}
-		switch svc.Status {
-		case DELETED:
-			err = c.frontendDelete(frontendName)
-			utils.PanicErr(err)
-			c.cfg.BackendSwitchingStatus["tcp-services"] = struct{}{}
-			reload = true
-			continue
-		case MODIFIED:
-			frontend, errFt := c.frontendGet(frontendName)
-			if err != nil {
-				utils.PanicErr(errFt)
-				continue
-			}
-			frontend.DefaultBackend = backendName
-			if sslOption == "ssl" {
-				utils.LogErr(c.enableSSLOffload(frontend.Name, false))
-			} else {
-				utils.LogErr(c.disableSSLOffload(frontend.Name))
+		frontendPort, errPort := strconv.ParseInt(port, 10, 64)
+		svc, errSvc := parseTCPService(entry.Value)
+		switch {
+		case errPort != nil || frontendPort < 1 || frontendPort > 65535:
+			errSvc = fmt.Errorf("incorrect port '%s' of TCP service", port)
+		case errSvc == nil && !c.isWatchedNamespace(svc.namespace):
+			errSvc = fmt.Errorf("namespace '%s' of TCP service '%s' is excluded by namespace-whitelist/blacklist, ignoring it", svc.namespace, entry.Value)
+		case errSvc == nil:
+			if frontend := c.tcpServicePortConflict(frontendName, frontendPort); frontend != "" {
+				errSvc = fmt.Errorf("port %d of TCP service '%s' is already used by frontend '%s', ignoring it", frontendPort, entry.Value, frontend)
 			}
-			if err = c.frontendEdit(frontend); err != nil {
-				utils.PanicErr(err)
-				continue
+		}
+		if errSvc != nil {
+			if entry.Status != EMPTY {
+				utils.LogErr(c.podEventErr(ReasonInvalidTCPService, errSvc))
 			}
-			reload = true
-		case ADDED:
-			frontend := models.Frontend{
+			continue
+		}
+		validFrontends[frontendName] = struct{}{}
+
+		// Handle Frontend
+		backendName := svc.backendName()
+		frontend, errFt := c.frontendGet(frontendName)
+		if errFt != nil {
+			frontend = models.Frontend{
 				Name:           frontendName,
 				Mode:           "tcp",
 				Tcplog:         true,
 				DefaultBackend: backendName,
 			}
-			err = c.frontendCreate(frontend)
-			if err != nil {
-				utils.PanicErr(err)
+			if err = c.frontendCreate(frontend); err != nil {
+				utils.LogErr(err)
 				continue
 			}
-			err = c.frontendBindCreate(frontendName, models.Bind{
-				Address: "0.0.0.0:" + port,
-				Name:    "bind_1",
-			})
-			utils.PanicErr(err)
-			err = c.frontendBindCreate(frontendName, models.Bind{
-				Address: ":::" + port,
-				Name:    "bind_2",
-				V4v6:    true,
-			})
-			if err != nil {
-				utils.PanicErr(err)
+			reload = true
+		} else if frontend.DefaultBackend != backendName {
+			frontend.DefaultBackend = backendName
+			if err = c.frontendEdit(frontend); err != nil {
+				utils.LogErr(err)
 				continue
 			}
-			if sslOption == "ssl" {
-				utils.LogErr(c.enableSSLOffload(frontend.Name, false))
-			}
+			c.cfg.BackendSwitchingStatus["tcp-services"] = struct{}{}
 			reload = true
 		}
+		var r bool
+		var errBinds error
+		var bundle string
+		if svc.sslSecret != "" {
+			var errCert error
+			bundle, r, errCert = c.tcpServiceCertificate(frontendName, svc, entry.Status != EMPTY, usedCerts)
+			if errCert != nil && entry.Status != EMPTY {
+				utils.LogErr(c.podEventErr(ReasonMissingSecret, errCert))
+			}
+			reload = reload || r
+		}
+		r, errBinds = c.frontendBindsSet(frontendName, frontendPort, c.tcpServiceBindParams(frontendName, svc, bundle))
+		utils.LogErr(errBinds)
+		reload = reload || r
+		r, errRules := c.tcpServiceTCPRules(frontendName, svc)
+		if errRules != nil && entry.Status != EMPTY {
+			utils.LogErr(c.podEventErr(ReasonInvalidTCPService, errRules))
+		}
+		reload = reload || r
 
 		// Handle Backend
-		var servicePort int64
-		if servicePort, err = strconv.ParseInt(svcPort, 10, 64); err != nil {
-			utils.LogErr(err)
-			continue
-		}
+		// Server options of entry are handled as annotations of the service ingress
 		ingress := &Ingress{
-			Namespace:   namespace,
+			Namespace:   svc.namespace,
 			Annotations: MapStringW{},
 			Rules:       map[string]*IngressRule{},
 		}
+		annStatus := entry.Status
+		if annStatus != EMPTY {
+			annStatus = ADDED
+		}
+		sendProxy := svc.sendProxy
+		if sendProxy == "" {
+			sendProxy = "disabled"
+		}
+		ingress.Annotations["send-proxy-protocol"] = &StringW{Value: sendProxy, Status: annStatus}
+		check := svc.check
+		if check == "" && annStatus != EMPTY {
+			annCheck, _ := GetValueFromAnnotations("check", c.cfg.ConfigMap.Annotations)
+			check = annCheck.Value
+		}
+		if check != "" {
+			ingress.Annotations["check"] = &StringW{Value: check, Status: annStatus}
+		}
 		path := &IngressPath{
-			ServiceName:    service,
-			ServicePortInt: servicePort,
+			ServiceName:    svc.name,
+			ServicePortInt: svc.port,
 			IsTCPService:   true,
-			Status:         svc.Status,
+			Status:         entry.Status,
 		}
-		nsmmp := c.cfg.GetNamespace(namespace)
+		nsmmp := c.cfg.GetNamespace(svc.namespace)
 		r, errBck := c.handlePath(nsmmp, ingress, nil, path)
 		utils.LogErr(errBck)
 		reload = reload || r
+
+		if _, ok := backendChecks[backendName]; !ok {
+			backendChecks[backendName] = ""
+		}
+		if svc.check == "true" {
+			backendChecks[backendName] = models.BackendAdvCheckTCPCheck
+			if svc.sslPassthrough {
+				backendChecks[backendName] = models.BackendAdvCheckSslHelloChk
+			}
+		}
+	}
+	for backendName, advCheck := range backendChecks {
+		reload = c.tcpServiceBackendCheck(backendName, advCheck) || reload
 	}
+	reload = c.tcpServiceFrontendsClean(validFrontends) || reload
 	return reload, err
 }
+
+// Delete tcp-<port> frontends of deleted entries and of the ones that became
+// invalid or conflicting, their backends are removed once no frontend uses them.
+func (c *HAProxyController) tcpServiceFrontendsClean(validFrontends map[string]struct{}) (reload bool) {
+	frontends, err := c.frontendsGet()
+	if err != nil {
+		utils.LogErr(err)
+		return false
+	}
+	for _, frontend := range frontends {
+		if !strings.HasPrefix(frontend.Name, "tcp-") {
+			continue
+		}
+		if _, ok := validFrontends[frontend.Name]; ok {
+			continue
+		}
+		if err = c.frontendDelete(frontend.Name); err != nil {
+			utils.LogErr(err)
+			continue
+		}
+		c.cfg.BackendSwitchingStatus["tcp-services"] = struct{}{}
+		reload = true
+	}
+	return reload
+}
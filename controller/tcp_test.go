@@ -0,0 +1,63 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import "testing"
+
+// Frontend of an entry becoming invalid, or of one removed, is deleted
+func TestTCPServicesFrontendsClean(t *testing.T) {
+	c, cleanup := testControllerConfig(t, `global
+  maxconn 1000
+
+defaults
+  mode tcp
+
+frontend tcp-1234
+  bind :1234
+  default_backend default-db-5432
+
+frontend tcp-5000
+  bind :5000
+  default_backend default-cache-6379
+
+frontend stats
+  bind :1024
+`)
+	defer cleanup()
+	c.k8s = &K8s{}
+	c.cfg.BackendSwitchingStatus = map[string]struct{}{}
+	c.cfg.ConfigMapTCPServices = &ConfigMap{Annotations: MapStringW{
+		"1234": &StringW{Value: "default/db", Status: MODIFIED},
+	}}
+
+	reload, err := c.handleTCPServices(map[string]struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reload {
+		t.Error("frontends deleted: expected reload")
+	}
+	for _, name := range []string{"tcp-1234", "tcp-5000"} {
+		if _, errFt := c.frontendGet(name); errFt == nil {
+			t.Errorf("frontend %s without valid entry not deleted", name)
+		}
+	}
+	if _, errFt := c.frontendGet("stats"); errFt != nil {
+		t.Errorf("frontend stats: %s", errFt)
+	}
+	if _, ok := c.cfg.BackendSwitchingStatus["tcp-services"]; !ok {
+		t.Error("backends of deleted frontends not scheduled for removal")
+	}
+}
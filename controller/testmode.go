@@ -0,0 +1,139 @@
+// Copyright 2019 HAProxy Technologies LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/haproxytech/kubernetes-ingress/controller/utils"
+	corev1 "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+var manifestSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// GetTestKubernetesClient returns a fake client serving Kubernetes objects of the manifests
+// (.yaml, .yml or .json files) found in inputDir. networking.k8s.io Ingresses are converted to
+// extensions/v1beta1 and the controller ConfigMap is created empty if not provided.
+func GetTestKubernetesClient(inputDir string, configMap utils.NamespaceValue) (*K8s, error) {
+	files, err := ioutil.ReadDir(inputDir)
+	if err != nil {
+		return nil, err
+	}
+	objects := []runtime.Object{}
+	configMapFound := false
+	decoder := scheme.Codecs.UniversalDeserializer()
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+		content, errRead := ioutil.ReadFile(filepath.Join(inputDir, file.Name()))
+		if errRead != nil {
+			return nil, errRead
+		}
+		for _, manifest := range manifestSeparator.Split(string(content), -1) {
+			if strings.TrimSpace(manifest) == "" {
+				continue
+			}
+			obj, _, errDecode := decoder.Decode([]byte(manifest), nil, nil)
+			if errDecode != nil {
+				return nil, fmt.Errorf("%s: %s", file.Name(), errDecode)
+			}
+			switch data := obj.(type) {
+			case *networking.Ingress:
+				obj = convertToExtensionsIngress(data)
+			case *corev1.ConfigMap:
+				if data.Namespace == configMap.Namespace && data.Name == configMap.Name {
+					configMapFound = true
+				}
+			}
+			objects = append(objects, obj)
+		}
+	}
+	if !configMapFound {
+		objects = append(objects, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: configMap.Namespace, Name: configMap.Name},
+		})
+	}
+	logger.Infof("Test mode: %d Kubernetes objects loaded from %s", len(objects), inputDir)
+	return &K8s{API: fake.NewSimpleClientset(objects...)}, nil
+}
+
+// Copy rendered configuration to --test-output-dir and validate it with haproxy -c.
+// Called once after the first sync in test mode.
+func (c *HAProxyController) validateTestOutput(syncErr error) error {
+	if syncErr != nil {
+		return fmt.Errorf("test mode: sync failed: %s", syncErr)
+	}
+	outputDir := c.osArgs.TestOutputDir
+	outputCfg := filepath.Join(outputDir, filepath.Base(HAProxyCFG))
+	if err := copyFile(HAProxyCFG, outputCfg); err != nil {
+		return err
+	}
+	for _, dir := range []string{HAProxyMapDir, HAProxyCertDir, HAProxyErrDir, HAProxyLuaDir} {
+		if err := copyDir(dir, filepath.Join(outputDir, filepath.Base(dir))); err != nil {
+			return err
+		}
+	}
+	// Paths in configuration still refer to controller directories, copied files are for inspection
+	result, err := exec.Command("haproxy", "-c", "-f", outputCfg).CombinedOutput()
+	haproxyLogger.Infof("Test mode: haproxy -c -f %s\n%s", outputCfg, result)
+	if err != nil {
+		return fmt.Errorf("test mode: invalid HAProxy configuration: %s", err)
+	}
+	logger.Infof("Test mode: valid HAProxy configuration written to %s", outputDir)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, content, 0644)
+}
+
+func copyDir(src, dst string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if err = copyFile(filepath.Join(src, file.Name()), filepath.Join(dst, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -50,7 +50,38 @@ func (a *EndpointPorts) Equal(b *EndpointPorts) bool {
 }
 
 func (a *EndpointIP) Equal(b *EndpointIP) bool {
-	return a.IP == b.IP
+	return a.IP == b.IP && a.portsEqual(b)
+}
+
+func (a *EndpointIP) portsEqual(b *EndpointIP) bool {
+	if len(a.Ports) != len(b.Ports) {
+		return false
+	}
+	for name, port := range a.Ports {
+		if p, ok := b.Ports[name]; !ok || p != port {
+			return false
+		}
+	}
+	return true
+}
+
+// Runtime API state of the server of an endpoint address
+func (a *EndpointIP) serverState() string {
+	switch {
+	case a.Disabled:
+		return "maint"
+	case a.Draining:
+		return "drain"
+	}
+	return "ready"
+}
+
+// Return port of endpoint address for endpoint port name, or defaultPort
+func (a *EndpointIP) Port(name string, defaultPort int64) int64 {
+	if port, ok := a.Ports[name]; ok {
+		return port
+	}
+	return defaultPort
 }
 
 func (a *EndpointIPs) Equal(b *EndpointIPs) bool {
@@ -121,7 +152,8 @@ func (a *IngressTLS) Equal(b *IngressTLS) bool {
 	if a.Host != b.Host {
 		return false
 	}
-	if a.SecretName != b.SecretName {
+	// OldValue of secret name is kept after a change, only the value matters
+	if !a.SecretName.Equal(&b.SecretName) {
 		return false
 	}
 	return true
@@ -132,7 +164,7 @@ func (a *Ingress) Equal(b *Ingress) bool {
 	if a == nil || b == nil {
 		return false
 	}
-	if a.Name != b.Name {
+	if a.Name != b.Name || a.Class != b.Class {
 		return false
 	}
 	if len(a.Rules) != len(b.Rules) {
@@ -173,6 +205,9 @@ func (a *Service) Equal(b *Service) bool {
 	if !a.Selector.Equal(b.Selector) {
 		return false
 	}
+	if a.ExternalName != b.ExternalName || a.ClientIPAffinity != b.ClientIPAffinity {
+		return false
+	}
 	if len(a.Ports) != len(b.Ports) {
 		return false
 	}
@@ -222,6 +257,26 @@ func (a *Secret) Equal(b *Secret) bool {
 	return true
 }
 
+//Equal compares two pods, only their labels matter
+func (a *Pod) Equal(b *Pod) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.Name != b.Name {
+		return false
+	}
+	if len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for key, value := range a.Labels {
+		value2, ok := b.Labels[key]
+		if !ok || value != value2 {
+			return false
+		}
+	}
+	return true
+}
+
 //Equal checks if pods are equal
 func (a *Endpoints) Equal(b *Endpoints) bool {
 	if a == nil || b == nil {
@@ -239,6 +294,14 @@ func (a *Endpoints) Equal(b *Endpoints) bool {
 	if !a.Addresses.Equal(b.Addresses) {
 		return false
 	}
+	if len(a.NotReady) != len(b.NotReady) {
+		return false
+	}
+	for ip := range a.NotReady {
+		if _, ok := b.NotReady[ip]; !ok {
+			return false
+		}
+	}
 
 	return true
 }
@@ -15,6 +15,9 @@
 package controller
 
 import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
 	extensions "k8s.io/api/extensions/v1beta1"
 )
 
@@ -24,12 +27,22 @@ const (
 	FrontendSSL   = "ssl"
 )
 
+// IngressClassController is the spec.controller value of IngressClasses handled by the controller
+const IngressClassController = "haproxy.org/ingress-controller"
+
 var (
 	HAProxyCFG      string
 	HAProxyCertDir  string
 	HAProxyStateDir string
 	HAProxyMapDir   string
+	HAProxyErrDir   string
+	HAProxyLuaDir   string
 	HAProxyPIDFile  string
+	HAProxySocket   string
+	// HAProxyVersion is [major, minor] of the HAProxy binary in use
+	HAProxyVersion [2]int
+	// HAProxyALPN is true if HAProxy binary supports ALPN negotiation on binds
+	HAProxyALPN bool
 )
 
 //ServicePort describes port of a service
@@ -45,7 +58,13 @@ type EndpointIP struct {
 	Name        string
 	HAProxyName string
 	Disabled    bool
-	Status      Status
+	// Ports of the endpoints subset of the address by name,
+	// pods of a service can expose a named port on different numbers
+	Ports map[string]int64
+	// Server of a terminating pod, drained until DrainDeadline, see --drain-timeout
+	Draining      bool
+	DrainDeadline time.Time
+	Status        Status
 }
 
 type EndpointPort struct {
@@ -60,23 +79,29 @@ type EndpointPorts []*EndpointPort
 
 //Endpoints is usefull data from k8s structures about Endpoints
 type Endpoints struct {
-	Namespace   string
-	Service     StringW
-	BackendName string
-	Ports       *EndpointPorts
-	Addresses   *EndpointIPs
-	Status      Status
+	Namespace string
+	Service   StringW
+	// Name of endpoint port used by servers of each backend of the service, by backend name.
+	// Paths can refer to different ports of the service, each one has its own backend.
+	Backends  map[string]string
+	Ports     *EndpointPorts
+	Addresses *EndpointIPs
+	// IPs of not ready addresses, pods keep one while they terminate
+	NotReady map[string]struct{}
+	Status   Status
 }
 
 //Service is usefull data from k8s structures about service
 type Service struct {
-	Namespace   string
-	Name        string
-	Ports       []ServicePort
-	Addresses   []string //Used only for publish-service
-	Annotations MapStringW
-	Selector    MapStringW
-	Status      Status
+	Namespace        string
+	Name             string
+	Ports            []ServicePort
+	ExternalName     string                       //DNS name of ExternalName services
+	ClientIPAffinity int64                        //Timeout in seconds of ClientIP session affinity, 0 without affinity
+	Addresses        []corev1.LoadBalancerIngress //Used only for publish-service
+	Annotations      MapStringW
+	Selector         MapStringW
+	Status           Status
 }
 
 //Namespace is usefull data from k8s structures about namespace
@@ -85,10 +110,23 @@ type Namespace struct {
 	Name      string
 	Relevant  bool
 	Ingresses map[string]*Ingress
-	Endpoints map[string]*Endpoints
-	Services  map[string]*Service
-	Secret    map[string]*Secret
-	Status    Status
+	// Ingresses with an ingress class not handled by the controller
+	IgnoredIngresses map[string]*Ingress
+	Endpoints        map[string]*Endpoints
+	Services         map[string]*Service
+	Secret           map[string]*Secret
+	ConfigMaps       map[string]*ConfigMap
+	// Labels of pods backing endpoints, see blue-green-balance annotation
+	Pods   map[string]*Pod
+	Status Status
+}
+
+//IngressClass is usefull data from k8s structures about ingress class
+type IngressClass struct {
+	Name       string
+	Controller string
+	Default    bool
+	Status     Status
 }
 
 //IngressPath is usefull data from k8s structures about ingress path
@@ -101,6 +139,8 @@ type IngressPath struct {
 	IsTCPService      bool
 	IsSSLPassthrough  bool
 	IsDefaultBackend  bool
+	IsCanary          bool
+	IsAuthService     bool
 	Status            Status
 }
 
@@ -115,11 +155,15 @@ type IngressRule struct {
 type Ingress struct {
 	Namespace      string
 	Name           string
+	UID            string
+	Class          string
 	Annotations    MapStringW
 	Rules          map[string]*IngressRule
 	DefaultBackend *IngressPath
 	TLS            map[string]*IngressTLS
-	Status         Status
+	// Set when ingress.class no longer matches, ingress is then DELETED
+	ClassChanged bool
+	Status       Status
 }
 
 // IngressTLS describes the transport layer security associated with an Ingress.
@@ -137,6 +181,16 @@ type ConfigMap struct {
 	Status      Status
 }
 
+//Pod is usefull data from k8s structures about pod
+type Pod struct {
+	Namespace string
+	Name      string
+	Labels    map[string]string
+	// Named container ports, they can't change
+	Ports  map[string]int64
+	Status Status
+}
+
 //Secret is usefull data from k8s structures about secret
 type Secret struct {
 	Namespace string
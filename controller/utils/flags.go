@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
 //NamespaceValue used to automatically distinct namespace/name string
@@ -30,17 +31,47 @@ func (n NamespaceValue) MarshalFlag() (string, error) {
 
 //OSArgs contains arguments that can be sent to controller
 type OSArgs struct {
-	Version               []bool         `short:"v" long:"version" description:"version"`
-	DefaultBackendService NamespaceValue `long:"default-backend-service" default:"" description:"default service to serve 404 page. If not specified HAProxy serves http 400"`
-	DefaultCertificate    NamespaceValue `long:"default-ssl-certificate" default:"" description:"secret name of the certificate"`
-	ConfigMap             NamespaceValue `long:"configmap" description:"configmap designated for HAProxy" default:"default/haproxy-configmap"`
-	ConfigMapTCPServices  NamespaceValue `long:"configmap-tcp-services" description:"configmap used to define tcp services" default:""`
-	KubeConfig            string         `long:"kubeconfig" default:"" description:"combined with -e. location of kube config file"`
-	NamespaceWhitelist    []string       `long:"namespace-whitelist" description:"whitelisted namespaces"`
-	NamespaceBlacklist    []string       `long:"namespace-blacklist" description:"blacklisted namespaces"`
-	OutOfCluster          bool           `short:"e" description:"use as out of cluster controller NOTE: experimantal"`
-	Test                  bool           `short:"t" description:"simulate running HAProxy"`
-	Help                  []bool         `short:"h" long:"help" description:"show this help message"`
-	IngressClass          string         `long:"ingress.class" default:"" description:"ingress.class to monitor in multiple controllers environment"`
-	PublishService        string         `long:"publish-service" default:"" description:"Takes the form namespace/name. The controller mirrors the address of this service's endpoints to the load-balancer status of all Ingress objects it satisfies"`
+	Version                []bool         `short:"v" long:"version" description:"version"`
+	DefaultBackendService  NamespaceValue `long:"default-backend-service" default:"" description:"default service to serve 404 page. If not specified HAProxy serves http 503"`
+	DefaultBackendPort     int            `long:"default-backend-port" default:"0" description:"port of default-backend-service, its first port if not specified"`
+	DefaultCertificate     NamespaceValue `long:"default-ssl-certificate" default:"" description:"secret name of the certificate"`
+	ConfigMap              NamespaceValue `long:"configmap" description:"configmap designated for HAProxy" default:"default/haproxy-configmap"`
+	ConfigMapTCPServices   NamespaceValue `long:"configmap-tcp-services" description:"configmap used to define tcp services" default:""`
+	KubeConfig             string         `long:"kubeconfig" default:"" description:"combined with -e. location of kube config file"`
+	NamespaceWhitelist     []string       `long:"namespace-whitelist" description:"whitelisted namespaces"`
+	NamespaceBlacklist     []string       `long:"namespace-blacklist" description:"blacklisted namespaces"`
+	OutOfCluster           bool           `short:"e" description:"use as out of cluster controller NOTE: experimantal"`
+	Test                   bool           `short:"t" description:"simulate running HAProxy"`
+	TestInput              string         `long:"test-input" default:"" description:"with -t, directory of Kubernetes manifests used instead of a cluster"`
+	TestOutputDir          string         `long:"test-output-dir" default:"" description:"with -t, write rendered configuration in this directory, validate it with haproxy -c and exit"`
+	Help                   []bool         `short:"h" long:"help" description:"show this help message"`
+	IngressClass           string         `long:"ingress.class" default:"" description:"ingress.class to monitor in multiple controllers environment"`
+	EmptyIngressClass      bool           `long:"empty-class" description:"also monitor ingresses without ingress.class annotation when ingress.class is set"`
+	AnnotationPrefix       []string       `long:"annotation-prefix" default:"haproxy.org" description:"annotation prefix, repeat it for several prefixes in priority order. Prefixes other than the first one are deprecated"`
+	EnableLeaderElection   bool           `long:"enable-leader-election" description:"only the elected replica updates ingresses status"`
+	LeaderElectionID       string         `long:"leader-election-id" default:"haproxy-ingress-leader" description:"name of the configmap used as leader election lock"`
+	LeaderElectionNS       string         `long:"leader-election-namespace" default:"" description:"namespace of the leader election lock, defaults to POD_NAMESPACE environment variable"`
+	UpdateStatusOnShutdown string         `long:"update-status-on-shutdown" default:"true" choice:"true" choice:"false" description:"remove publish service addresses from ingresses status when controller stops"`
+	SyncDebounce           time.Duration  `long:"sync-debounce" default:"500ms" description:"changes are synced to HAProxy at most this duration after the first one, changes received meanwhile are synced together"`
+	SyncPeriod             time.Duration  `long:"sync-period" default:"5m" description:"period of full resync of Kubernetes objects and HAProxy configuration, 0 disables it"`
+	DrainTimeout           time.Duration  `long:"drain-timeout" default:"30s" description:"servers of terminating pods are drained at most this duration before being removed, 0 removes them immediately"`
+	ReloadInterval         time.Duration  `long:"reload-interval" default:"0s" description:"minimum interval between HAProxy reloads, reloads required meanwhile are coalesced"`
+	ShutdownGracePeriod    time.Duration  `long:"shutdown-grace-period" default:"25s" description:"on SIGTERM, maximum duration HAProxy is given to finish active sessions before being killed"`
+	BindIPv4               string         `long:"bind-ipv4" default:"true" choice:"true" choice:"false" description:"HTTP, HTTPS and TCP services frontends listen on IPv4 addresses"`
+	BindIPv6               string         `long:"bind-ipv6" default:"true" choice:"true" choice:"false" description:"HTTP, HTTPS and TCP services frontends listen on IPv6 addresses"`
+	HTTPBindPort           int            `long:"http-bind-port" default:"80" description:"port of HTTP frontend, 0 disables it. Can be changed with http-bind-port ConfigMap annotation"`
+	HTTPSBindPort          int            `long:"https-bind-port" default:"443" description:"port of HTTPS frontend, 0 disables it. Can be changed with https-bind-port ConfigMap annotation"`
+	BindAddress            []string       `long:"bind-address" description:"address HTTP, HTTPS and TCP services frontends listen on, can be repeated. Defaults to wildcard addresses of enabled families"`
+	HealthzPort            int            `long:"healthz-port" default:"1042" description:"port of /healthz endpoint used by liveness and readiness probes, 0 disables it"`
+	HealthzStaleness       time.Duration  `long:"healthz-staleness" default:"60s" description:"/healthz fails if no event was processed by the controller during this period"`
+	MetricsPort            int            `long:"metrics-port" default:"0" description:"port of Prometheus /metrics endpoint of the controller, 0 disables it"`
+	StatsMetrics           string         `long:"stats-metrics" default:"" description:"HAProxy statistics exported on /metrics: 'all' or comma separated metric names, none by default"`
+	Pprof                  bool           `long:"pprof" description:"serve net/http/pprof profiles on --pprof-address"`
+	PprofAddress           string         `long:"pprof-address" default:"127.0.0.1:6060" description:"listen address of pprof endpoint"`
+	PprofMutexFraction     int            `long:"pprof-mutex-fraction" default:"0" description:"with --pprof, enable mutex profile with runtime.SetMutexProfileFraction"`
+	PprofBlockRate         int            `long:"pprof-block-rate" default:"0" description:"with --pprof, enable block profile with runtime.SetBlockProfileRate"`
+	LogLevel               string         `long:"log-level" default:"info" choice:"error" choice:"warning" choice:"info" choice:"debug" choice:"trace" description:"level of logged messages"`
+	DisableConfigSnippets  bool           `long:"disable-config-snippets" description:"ignore backend-config-snippet annotations, for clusters where tenants should not inject raw HAProxy configuration"`
+	PublishService         string         `long:"publish-service" default:"" description:"Takes the form namespace/name. The controller mirrors the address of this service's endpoints to the load-balancer status of all Ingress objects it satisfies"`
+	PublishAddress         []string       `long:"publish-address" description:"IP or hostname written to the load-balancer status of ingresses instead of the addresses of a publish service, can be repeated"`
 }
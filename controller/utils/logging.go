@@ -15,9 +15,11 @@
 package utils
 
 import (
+	"fmt"
 	"log"
 	"runtime"
 	"strings"
+	"sync/atomic"
 )
 
 const (
@@ -25,17 +27,124 @@ const (
 	LogType      = log.LstdFlags | log.Lshortfile
 )
 
-func LogErr(err error) {
+//LogLevel of messages, a message is logged if its level is lower or equal to current one
+type LogLevel int32
+
+//LogLevel values
+const (
+	LogLevelError LogLevel = iota
+	LogLevelWarning
+	LogLevelInfo
+	LogLevelDebug
+	LogLevelTrace
+)
+
+var logLevelNames = []string{"error", "warning", "info", "debug", "trace"}
+
+var logLevel = int32(LogLevelInfo)
+
+//SetLogLevel sets level from its name: error, warning, info, debug or trace
+func SetLogLevel(name string) error {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			atomic.StoreInt32(&logLevel, int32(level))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level '%s', expected one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+//LogLevelEnabled returns true if messages of level are logged
+func LogLevelEnabled(level LogLevel) bool {
+	return LogLevel(atomic.LoadInt32(&logLevel)) >= level
+}
+
+//Logger logs messages of a component (controller, k8s, haproxy ...)
+type Logger struct {
+	Component string
+}
+
+//GetLogger returns Logger of component
+func GetLogger(component string) Logger {
+	return Logger{Component: component}
+}
+
+func (l Logger) output(level LogLevel, msg string) {
+	if !LogLevelEnabled(level) {
+		return
+	}
+	log.SetFlags(LogTypeShort)
+	log.Printf("%-7s [%s] %s", strings.ToUpper(logLevelNames[level]), l.Component, strings.TrimRight(msg, "\n"))
+	log.SetFlags(LogType)
+}
+
+func (l Logger) Error(args ...interface{}) {
+	l.output(LogLevelError, fmt.Sprintln(args...))
+}
+
+func (l Logger) Errorf(format string, args ...interface{}) {
+	l.output(LogLevelError, fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Warning(args ...interface{}) {
+	l.output(LogLevelWarning, fmt.Sprintln(args...))
+}
+
+func (l Logger) Warningf(format string, args ...interface{}) {
+	l.output(LogLevelWarning, fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Info(args ...interface{}) {
+	l.output(LogLevelInfo, fmt.Sprintln(args...))
+}
+
+func (l Logger) Infof(format string, args ...interface{}) {
+	l.output(LogLevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Debug(args ...interface{}) {
+	l.output(LogLevelDebug, fmt.Sprintln(args...))
+}
+
+func (l Logger) Debugf(format string, args ...interface{}) {
+	l.output(LogLevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Trace(args ...interface{}) {
+	l.output(LogLevelTrace, fmt.Sprintln(args...))
+}
+
+func (l Logger) Tracef(format string, args ...interface{}) {
+	l.output(LogLevelTrace, fmt.Sprintf(format, args...))
+}
+
+//Err logs err with its source location at error level
+func (l Logger) Err(err error) {
 	if err == nil {
 		return
 	}
-	_, file, no, ok := runtime.Caller(1)
-	if ok {
-		file1 := strings.Replace(file, "/src/", "", 1)
-		log.SetFlags(LogTypeShort)
-		log.Printf("%s:%d %s\n", file1, no, err.Error())
-		log.SetFlags(LogType)
+	l.output(LogLevelError, callerPrefix(2)+err.Error())
+}
+
+//Fatalf logs at error level and exits
+func (l Logger) Fatalf(format string, args ...interface{}) {
+	log.Fatalf("%-7s [%s] %s", "ERROR", l.Component, fmt.Sprintf(format, args...))
+}
+
+func callerPrefix(skip int) string {
+	_, file, no, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d ", strings.Replace(file, "/src/", "", 1), no)
+}
+
+//LogErr logs err with its source location at error level
+func LogErr(err error) {
+	if err == nil {
+		return
 	}
+	GetLogger("controller").output(LogLevelError, callerPrefix(1)+err.Error())
 }
 
 func PanicErr(err error) {
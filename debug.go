@@ -16,7 +16,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"path"
@@ -32,7 +31,7 @@ const (
 )
 
 func setupTestEnv() {
-	log.Printf("Running in test env")
+	logger.Infof("Running in test env")
 	cfgDir = path.Join(TestFolderPath, cfgDir)
 	err := os.MkdirAll(cfgDir, 0755)
 	utils.LogErr(err)
@@ -40,20 +39,20 @@ func setupTestEnv() {
 	cmd := exec.Command("pwd")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Fatalf("cmd.Run() failed with %s\n", err)
+		logger.Fatalf("cmd.Run() failed with %s\n", err)
 	}
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalf("%s", err)
 	}
-	log.Println(dir)
+	logger.Info(dir)
 	copyFile(path.Join(dir, "fs/etc/haproxy/haproxy.cfg"), c.HAProxyCFG)
-	log.Println(string(out))
+	logger.Info(string(out))
 }
 
 func copyFile(src, dst string) {
 	cmd := fmt.Sprintf("cp %s %s", src, dst)
-	log.Println(cmd)
+	logger.Info(cmd)
 	result := exec.Command("bash", "-c", cmd)
 	_, err := result.CombinedOutput()
 	utils.LogErr(err)
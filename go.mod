@@ -7,6 +7,7 @@ require (
 	github.com/haproxytech/config-parser/v2 v2.0.1-0.20200417115602-4292d48d861c
 	github.com/haproxytech/models v1.2.5-0.20200414103449-1ad77053aff9
 	github.com/jessevdk/go-flags v1.4.0
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 	k8s.io/api v0.0.0-20190620084959-7cf5895f2711
 	k8s.io/apimachinery v0.0.0-20190612205821-1799e75a0719
 	k8s.io/client-go v0.0.0-20190620085101-78d2af792bab
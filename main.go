@@ -17,9 +17,10 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	c "github.com/haproxytech/kubernetes-ingress/controller"
@@ -29,6 +30,8 @@ import (
 
 var cfgDir string
 
+var logger = utils.GetLogger("controller")
+
 func main() {
 
 	var osArgs utils.OSArgs
@@ -39,12 +42,37 @@ func main() {
 		os.Exit(exitCode)
 	}()
 	if err != nil {
-		log.Println(err)
+		logger.Error(err)
 		exitCode = 1
 		return
 	}
+	if err = utils.SetLogLevel(osArgs.LogLevel); err != nil {
+		logger.Error(err)
+		exitCode = 1
+		return
+	}
+	if len(osArgs.NamespaceWhitelist) > 0 && len(osArgs.NamespaceBlacklist) > 0 {
+		logger.Error("namespace-whitelist and namespace-blacklist can't be used together")
+		exitCode = 1
+		return
+	}
+	if osArgs.PublishService != "" && len(osArgs.PublishAddress) > 0 {
+		logger.Error("publish-service and publish-address can't be used together")
+		exitCode = 1
+		return
+	}
+	for _, address := range osArgs.PublishAddress {
+		if address == "" || (strings.ContainsAny(address, "/: ") && net.ParseIP(address) == nil) {
+			logger.Errorf("publish-address: incorrect address '%s', expected an IP or a hostname", address)
+			exitCode = 1
+			return
+		}
+	}
 	defaultBackendSvc := fmt.Sprintf("%s/%s", osArgs.DefaultBackendService.Namespace, osArgs.DefaultBackendService.Name)
-	defaultCertificate := fmt.Sprintf("%s/%s", osArgs.DefaultBackendService.Namespace, osArgs.DefaultCertificate.Name)
+	defaultCertificate := ""
+	if osArgs.DefaultCertificate.Name != "" {
+		defaultCertificate = fmt.Sprintf("%s/%s", osArgs.DefaultCertificate.Namespace, osArgs.DefaultCertificate.Name)
+	}
 	c.SetDefaultAnnotation("default-backend-service", defaultBackendSvc)
 	c.SetDefaultAnnotation("ssl-certificate", defaultCertificate)
 
@@ -64,17 +92,24 @@ func main() {
 		return
 	}
 
-	log.Println(IngressControllerInfo)
-	log.Printf("HAProxy Ingress Controller %s %s%s\n\n", GitTag, GitCommit, GitDirty)
-	log.Printf("Build from: %s\n", GitRepo)
-	log.Printf("Build date: %s\n\n", BuildTime)
-	log.Printf("ConfigMap: %s/%s\n", osArgs.ConfigMap.Namespace, osArgs.ConfigMap.Name)
-	log.Printf("Ingress class: %s\n", osArgs.IngressClass)
-	log.Printf("Publish service: %s\n", osArgs.PublishService)
-	log.Printf("Default backend service: %s\n", defaultBackendSvc)
-	log.Printf("Default ssl certificate: %s\n", defaultCertificate)
+	logger.Info(IngressControllerInfo)
+	logger.Infof("HAProxy Ingress Controller %s %s%s\n\n", GitTag, GitCommit, GitDirty)
+	logger.Infof("Build from: %s\n", GitRepo)
+	logger.Infof("Build date: %s\n\n", BuildTime)
+	logger.Infof("ConfigMap: %s/%s\n", osArgs.ConfigMap.Namespace, osArgs.ConfigMap.Name)
+	logger.Infof("Ingress class: %s\n", osArgs.IngressClass)
+	if osArgs.EmptyIngressClass {
+		logger.Infof("Ingresses without ingress.class are monitored\n")
+	}
+	if len(osArgs.PublishAddress) > 0 {
+		logger.Infof("Publish addresses: %s\n", strings.Join(osArgs.PublishAddress, ", "))
+	} else {
+		logger.Infof("Publish service: %s\n", osArgs.PublishService)
+	}
+	logger.Infof("Default backend service: %s\n", defaultBackendSvc)
+	logger.Infof("Default ssl certificate: %s\n", defaultCertificate)
 	if osArgs.ConfigMapTCPServices.Name != "" {
-		log.Printf("TCP Services defined in %s/%s\n", osArgs.ConfigMapTCPServices.Namespace, osArgs.ConfigMapTCPServices.Name)
+		logger.Infof("TCP Services defined in %s/%s\n", osArgs.ConfigMapTCPServices.Namespace, osArgs.ConfigMapTCPServices.Name)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -93,5 +128,8 @@ func main() {
 	controller := c.HAProxyController{
 		HAProxyCfgDir: cfgDir,
 	}
-	controller.Start(ctx, osArgs)
+	if err = controller.Start(ctx, osArgs); err != nil {
+		logger.Error(err)
+		exitCode = 1
+	}
 }